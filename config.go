@@ -2,13 +2,64 @@ package main
 
 // nolint: lll
 import (
+	"io"
 	"net"
+	"net/url"
+	stdOS "os"
+	"regexp"
+	"strings"
+	"time"
 
-	"github.com/brigadecore/brigade-foundations/http"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/brigade"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/connect"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/ipfilter"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/polling"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/readiness"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/relay"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/server"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/subscriptions"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
 	"github.com/brigadecore/brigade-foundations/os"
 	"github.com/brigadecore/brigade/sdk/v3/restmachinery"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
 )
 
+// eventSourceRegex matches valid values for the Source field of events emitted
+// into Brigade, e.g. brigade.sh/bitbucket.
+var eventSourceRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// apiClientTLSConfig populates TLS configuration for communicating with the
+// Brigade API server, beyond what the Brigade SDK supports, from environment
+// variables.
+func apiClientTLSConfig() brigade.TLSConfig {
+	return brigade.TLSConfig{
+		CACertPath:     os.GetEnvVar("API_CA_CERT_PATH", ""),
+		ClientCertPath: os.GetEnvVar("API_CLIENT_CERT_PATH", ""),
+		ClientKeyPath:  os.GetEnvVar("API_CLIENT_KEY_PATH", ""),
+	}
+}
+
+// apiTokenFileConfig populates configuration for reading the Brigade API token
+// from a file from environment variables. The bool return value indicates
+// whether a file has been specified.
+func apiTokenFileConfig() (bool, brigade.TokenFileConfig, error) {
+	config := brigade.TokenFileConfig{
+		Path: os.GetEnvVar("API_TOKEN_FILE", ""),
+	}
+	if config.Path == "" {
+		return false, config, nil
+	}
+	var err error
+	config.PollInterval, err =
+		os.GetDurationFromEnvVar("API_TOKEN_FILE_POLL_INTERVAL", 30*time.Second)
+	if err == nil && config.PollInterval <= 0 {
+		err = errors.New("API_TOKEN_FILE_POLL_INTERVAL must be positive")
+	}
+	return true, config, err
+}
+
 // apiClientConfig populates the Brigade SDK's APIClientOptions from
 // environment variables.
 func apiClientConfig() (string, string, restmachinery.APIClientOptions, error) {
@@ -17,28 +68,639 @@ func apiClientConfig() (string, string, restmachinery.APIClientOptions, error) {
 	if err != nil {
 		return address, "", opts, err
 	}
-	token, err := os.GetRequiredEnvVar("API_TOKEN")
-	if err != nil {
-		return address, token, opts, err
+	// The token is not required if it is to be read from a file instead.
+	var token string
+	if os.GetEnvVar("API_TOKEN_FILE", "") == "" {
+		if token, err = os.GetRequiredEnvVar("API_TOKEN"); err != nil {
+			return address, token, opts, err
+		}
 	}
 	opts.AllowInsecureConnections, err =
 		os.GetBoolFromEnvVar("API_IGNORE_CERT_WARNINGS", false)
 	return address, token, opts, err
 }
 
+// tenantConfig encapsulates settings for the Brigade API server that events
+// for repositories in a single Bitbucket workspace should be emitted into.
+type tenantConfig struct {
+	Workspace             string `yaml:"workspace"`
+	APIAddress            string `yaml:"apiAddress"`
+	APIToken              string `yaml:"apiToken"`
+	APIIgnoreCertWarnings bool   `yaml:"apiIgnoreCertWarnings"`
+	APICACertPath         string `yaml:"apiCACertPath"`
+	APIClientCertPath     string `yaml:"apiClientCertPath"`
+	APIClientKeyPath      string `yaml:"apiClientKeyPath"`
+}
+
+// tenantsConfig populates a table of tenants from a file referenced by an
+// environment variable. If no such file is referenced, an empty table is
+// returned.
+func tenantsConfig() ([]tenantConfig, error) {
+	tenants := []tenantConfig{}
+	tenantsPath := os.GetEnvVar("TENANTS_PATH", "")
+	if tenantsPath == "" {
+		return tenants, nil
+	}
+	if err := loadYAMLFile(tenantsPath, &tenants); err != nil {
+		return nil, err
+	}
+	workspaces := map[string]struct{}{}
+	for i, tenant := range tenants {
+		var err error
+		if tenant.Workspace == "" {
+			err = errors.Errorf("tenant %d does not specify a workspace", i)
+		} else if _, ok := workspaces[tenant.Workspace]; ok {
+			err = errors.Errorf(
+				"workspace %q is specified by more than one tenant",
+				tenant.Workspace,
+			)
+		} else if tenant.APIAddress == "" {
+			err = errors.Errorf(
+				"tenant for workspace %q does not specify an apiAddress",
+				tenant.Workspace,
+			)
+		} else if tenant.APIToken == "" {
+			err = errors.Errorf(
+				"tenant for workspace %q does not specify an apiToken",
+				tenant.Workspace,
+			)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error in %s", tenantsPath)
+		}
+		workspaces[tenant.Workspace] = struct{}{}
+	}
+	return tenants, nil
+}
+
+// dryRunConfig determines from an environment variable whether the gateway
+// should merely log the events it would otherwise have emitted into Brigade.
+func dryRunConfig() (bool, error) {
+	return os.GetBoolFromEnvVar("DRY_RUN", false)
+}
+
+// serviceConfig populates configuration for the webhooks service from
+// environment variables and any files they reference.
+func serviceConfig() (webhooks.ServiceConfig, error) {
+	config := webhooks.ServiceConfig{
+		Source: os.GetEnvVar("EVENT_SOURCE", webhooks.DefaultSource),
+	}
+	if !eventSourceRegex.MatchString(config.Source) {
+		return config, errors.Errorf(
+			"EVENT_SOURCE value %q is invalid; it must begin with a letter or "+
+				"digit and contain only letters, digits, and the characters . _ - /",
+			config.Source,
+		)
+	}
+	refFiltersPath := os.GetEnvVar("REF_FILTERS_PATH", "")
+	if refFiltersPath != "" {
+		if err := loadYAMLFile(refFiltersPath, &config.RefFilters); err != nil {
+			return config, err
+		}
+		for _, refFilter := range config.RefFilters {
+			if err := refFilter.Validate(); err != nil {
+				return config, errors.Wrapf(err, "error in %s", refFiltersPath)
+			}
+		}
+	}
+	var err error
+	if config.ProjectMappings, err = projectMappingsConfig(); err != nil {
+		return config, err
+	}
+	pathFiltersPath := os.GetEnvVar("PATH_FILTERS_PATH", "")
+	if pathFiltersPath != "" {
+		if err := loadYAMLFile(pathFiltersPath, &config.PathFilters); err != nil {
+			return config, err
+		}
+		for _, pathFilter := range config.PathFilters {
+			if err := pathFilter.Validate(); err != nil {
+				return config, errors.Wrapf(err, "error in %s", pathFiltersPath)
+			}
+		}
+		// Path filters are evaluated against changed paths, which are only
+		// listed when enabled.
+		if changedPathsEnabled, err :=
+			os.GetBoolFromEnvVar("CHANGED_PATHS_ENABLED", false); err != nil ||
+			!changedPathsEnabled {
+			return config, errors.New(
+				"PATH_FILTERS_PATH requires CHANGED_PATHS_ENABLED to be true",
+			)
+		}
+	}
+	return config, nil
+}
+
+// changedPathsConfig determines from environment variables whether the paths
+// of the files changed by pull requests and pushes should be added to the
+// payloads of the corresponding events. The int return value is the number of
+// commit ranges whose changed paths are cached.
+func changedPathsConfig() (bool, int, error) {
+	enabled, err := os.GetBoolFromEnvVar("CHANGED_PATHS_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, 0, err
+	}
+	cacheSize, err := os.GetIntFromEnvVar("CHANGED_PATHS_CACHE_SIZE", 1000)
+	if err == nil && cacheSize <= 0 {
+		err = errors.New("CHANGED_PATHS_CACHE_SIZE must be positive")
+	}
+	return enabled, cacheSize, err
+}
+
+// loadYAMLFile unmarshals the contents of the specified YAML file into the
+// provided object. Unrecognized fields are treated as errors.
+func loadYAMLFile(path string, obj interface{}) error {
+	file, err := stdOS.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %s", path)
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(obj); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "error parsing %s", path)
+	}
+	return nil
+}
+
+// deliveryArchiveConfig populates configuration for the optional archive of
+// received webhook deliveries from environment variables. The bool return value
+// indicates whether the archive is enabled.
+func deliveryArchiveConfig() (bool, webhooks.DirectoryArchiveConfig, error) {
+	config := webhooks.DirectoryArchiveConfig{}
+	enabled, err := os.GetBoolFromEnvVar("ARCHIVE_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, config, err
+	}
+	config.Dir, err = os.GetRequiredEnvVar("ARCHIVE_DIR")
+	if err != nil {
+		return enabled, config, err
+	}
+	config.MaxAge, err =
+		os.GetDurationFromEnvVar("ARCHIVE_MAX_AGE", 7*24*time.Hour)
+	if err != nil {
+		return enabled, config, err
+	}
+	if config.MaxAge <= 0 {
+		return enabled, config, errors.New("ARCHIVE_MAX_AGE must be positive")
+	}
+	config.MaxFiles, err = os.GetIntFromEnvVar("ARCHIVE_MAX_FILES", 10000)
+	if err == nil && config.MaxFiles <= 0 {
+		err = errors.New("ARCHIVE_MAX_FILES must be positive")
+	}
+	return enabled, config, err
+}
+
+// adminConfig populates configuration for the optional administrative API from
+// environment variables. The return values indicate whether the API is enabled,
+// the bearer token that must be presented to access it, and the number of
+// recently received webhooks that are retained for inspection or redelivery.
+func adminConfig() (bool, string, int, error) {
+	enabled, err := os.GetBoolFromEnvVar("ADMIN_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, "", 0, err
+	}
+	token, err := os.GetRequiredEnvVar("ADMIN_TOKEN")
+	if err != nil {
+		return enabled, token, 0, err
+	}
+	maxDeliveries, err := os.GetIntFromEnvVar("ADMIN_MAX_DELIVERIES", 100)
+	if err == nil && maxDeliveries <= 0 {
+		err = errors.New("ADMIN_MAX_DELIVERIES must be positive")
+	}
+	return enabled, token, maxDeliveries, err
+}
+
+// rateLimiterConfig populates configuration for the optional rate limiting of
+// webhooks from environment variables. The bool return value indicates whether
+// any rate limit is enabled.
+func rateLimiterConfig() (bool, webhooks.RateLimiterConfig, error) {
+	config := webhooks.RateLimiterConfig{}
+	var err error
+	if config.Global, err = rateLimit("RATE_LIMIT_GLOBAL"); err != nil {
+		return false, config, err
+	}
+	if config.PerRepo, err = rateLimit("RATE_LIMIT_PER_REPO"); err != nil {
+		return false, config, err
+	}
+	return config.Global.PerMinute > 0 || config.PerRepo.PerMinute > 0,
+		config,
+		nil
+}
+
+// rateLimit populates a single rate limit from the environment variables
+// <prefix>_PER_MINUTE and <prefix>_BURST. A per minute limit of zero, the
+// default, means no limit.
+func rateLimit(prefix string) (webhooks.RateLimit, error) {
+	limit := webhooks.RateLimit{}
+	var err error
+	limit.PerMinute, err = os.GetIntFromEnvVar(prefix+"_PER_MINUTE", 0)
+	if err != nil {
+		return limit, err
+	}
+	if limit.PerMinute < 0 {
+		return limit, errors.Errorf("%s_PER_MINUTE must not be negative", prefix)
+	}
+	limit.Burst, err = os.GetIntFromEnvVar(prefix+"_BURST", limit.PerMinute)
+	if err == nil && limit.Burst < 0 {
+		err = errors.Errorf("%s_BURST must not be negative", prefix)
+	}
+	return limit, err
+}
+
+// webhookSecretConfig returns, from an environment variable, the secret
+// Bitbucket signs webhooks with. An empty string indicates that no secret is
+// configured and that webhooks are not signed.
+func webhookSecretConfig() string {
+	return os.GetEnvVar("WEBHOOK_SECRET", "")
+}
+
+// bitbucketClientConfig populates configuration for communicating with the
+// Bitbucket REST API from environment variables. Either an access token or a
+// username and app password are required.
+func bitbucketClientConfig() (bitbucket.ClientConfig, error) {
+	config := bitbucket.ClientConfig{
+		APIAddress: os.GetEnvVar(
+			"BITBUCKET_API_ADDRESS",
+			bitbucket.DefaultAPIAddress,
+		),
+		AccessToken: os.GetEnvVar("BITBUCKET_ACCESS_TOKEN", ""),
+	}
+	if config.AccessToken != "" {
+		return config, nil
+	}
+	var err error
+	if config.Username, err =
+		os.GetRequiredEnvVar("BITBUCKET_USERNAME"); err != nil {
+		return config, errors.Wrap(
+			err,
+			"either BITBUCKET_ACCESS_TOKEN or BITBUCKET_USERNAME and "+
+				"BITBUCKET_APP_PASSWORD must be specified",
+		)
+	}
+	config.AppPassword, err = os.GetRequiredEnvVar("BITBUCKET_APP_PASSWORD")
+	return config, err
+}
+
+// webhookRegistrationConfig populates configuration for automatically
+// registering webhooks in Bitbucket repositories from environment variables.
+// The bool return value indicates whether registration is enabled.
+func webhookRegistrationConfig() (bool, bitbucket.ReconcilerConfig, error) {
+	enabled, err := os.GetBoolFromEnvVar("WEBHOOK_REGISTRATION_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, bitbucket.ReconcilerConfig{}, err
+	}
+	config, err := managedWebhookConfig()
+	if err != nil {
+		return enabled, config, err
+	}
+	if len(config.Repos) == 0 && len(config.Workspaces) == 0 {
+		return enabled, config, errors.New(
+			"WEBHOOK_REGISTRATION_REPOS or WEBHOOK_REGISTRATION_WORKSPACES must " +
+				"be specified",
+		)
+	}
+	config.Interval, err =
+		os.GetDurationFromEnvVar("WEBHOOK_REGISTRATION_INTERVAL", time.Hour)
+	if err == nil && config.Interval <= 0 {
+		err = errors.New("WEBHOOK_REGISTRATION_INTERVAL must be positive")
+	}
+	return enabled, config, err
+}
+
+// managedWebhookConfig populates configuration describing the webhooks the
+// gateway manages in Bitbucket repositories from environment variables. The
+// URL webhooks are sent to is required. Repositories and workspaces are
+// optional, but are validated if specified.
+func managedWebhookConfig() (bitbucket.ReconcilerConfig, error) {
+	config := bitbucket.ReconcilerConfig{
+		Events: webhooks.SupportedEventKeys(),
+		Secret: webhookSecretConfig(),
+	}
+	var err error
+	if config.URL, err =
+		os.GetRequiredEnvVar("WEBHOOK_REGISTRATION_URL"); err != nil {
+		return config, err
+	}
+	config.Repos = os.GetStringSliceFromEnvVar("WEBHOOK_REGISTRATION_REPOS", nil)
+	if err =
+		validateRepos("WEBHOOK_REGISTRATION_REPOS", config.Repos); err != nil {
+		return config, err
+	}
+	config.Workspaces =
+		os.GetStringSliceFromEnvVar("WEBHOOK_REGISTRATION_WORKSPACES", nil)
+	config.Description = os.GetEnvVar(
+		"WEBHOOK_REGISTRATION_DESCRIPTION",
+		bitbucket.DefaultWebhookDescription,
+	)
+	return config, nil
+}
+
+// validateRepos returns an error if any of the provided repositories, which
+// were read from the specified environment variable, is not a repository's
+// full name.
+func validateRepos(envVar string, repos []string) error {
+	for _, repo := range repos {
+		if parts := strings.Split(repo, "/"); len(parts) != 2 ||
+			parts[0] == "" || parts[1] == "" {
+			return errors.Errorf(
+				"%s value %q is not a repository's full name, e.g. "+
+					"example-org/example",
+				envVar,
+				repo,
+			)
+		}
+	}
+	return nil
+}
+
+// projectMappingsConfig loads and validates project mappings from the file
+// specified by an environment variable, if any.
+func projectMappingsConfig() ([]webhooks.ProjectMapping, error) {
+	projectMappingsPath := os.GetEnvVar("PROJECT_MAPPINGS_PATH", "")
+	if projectMappingsPath == "" {
+		return nil, nil
+	}
+	projectMappings := []webhooks.ProjectMapping{}
+	if err := loadYAMLFile(projectMappingsPath, &projectMappings); err != nil {
+		return nil, err
+	}
+	for _, projectMapping := range projectMappings {
+		if err := projectMapping.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "error in %s", projectMappingsPath)
+		}
+	}
+	return projectMappings, nil
+}
+
+// subscriptionAuditConfig populates configuration for periodically auditing
+// Brigade projects' event subscriptions against the webhooks configured in
+// Bitbucket repositories from environment variables. The bool return value
+// indicates whether auditing is enabled. The returned ReconcilerConfig
+// describes the webhooks the gateway manages.
+func subscriptionAuditConfig() (
+	bool,
+	subscriptions.AuditorConfig,
+	bitbucket.ReconcilerConfig,
+	error,
+) {
+	auditorConfig := subscriptions.AuditorConfig{
+		Source:          os.GetEnvVar("EVENT_SOURCE", webhooks.DefaultSource),
+		SupportedEvents: webhooks.SupportedEventKeys(),
+	}
+	reconcilerConfig := bitbucket.ReconcilerConfig{}
+	enabled, err := os.GetBoolFromEnvVar("SUBSCRIPTION_AUDIT_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, auditorConfig, reconcilerConfig, err
+	}
+	dryRun, err := dryRunConfig()
+	if err != nil {
+		return enabled, auditorConfig, reconcilerConfig, err
+	}
+	if dryRun {
+		return enabled, auditorConfig, reconcilerConfig, errors.New(
+			"SUBSCRIPTION_AUDIT_ENABLED is not supported in dry run mode",
+		)
+	}
+	if reconcilerConfig, err = managedWebhookConfig(); err != nil {
+		return enabled, auditorConfig, reconcilerConfig, err
+	}
+	auditorConfig.Repos = reconcilerConfig.Repos
+	auditorConfig.Workspaces = reconcilerConfig.Workspaces
+	if auditorConfig.ProjectMappings, err = projectMappingsConfig(); err != nil {
+		return enabled, auditorConfig, reconcilerConfig, err
+	}
+	if auditorConfig.Interval, err = os.GetDurationFromEnvVar(
+		"SUBSCRIPTION_AUDIT_INTERVAL",
+		10*time.Minute,
+	); err != nil {
+		return enabled, auditorConfig, reconcilerConfig, err
+	}
+	if auditorConfig.Interval <= 0 {
+		return enabled, auditorConfig, reconcilerConfig,
+			errors.New("SUBSCRIPTION_AUDIT_INTERVAL must be positive")
+	}
+	if auditorConfig.Reconcile, err =
+		os.GetBoolFromEnvVar("SUBSCRIPTION_AUDIT_RECONCILE", false); err != nil {
+		return enabled, auditorConfig, reconcilerConfig, err
+	}
+	if auditorConfig.Reconcile {
+		var registrationEnabled bool
+		if registrationEnabled, err = os.GetBoolFromEnvVar(
+			"WEBHOOK_REGISTRATION_ENABLED",
+			false,
+		); err == nil && registrationEnabled {
+			err = errors.New(
+				"SUBSCRIPTION_AUDIT_RECONCILE and WEBHOOK_REGISTRATION_ENABLED are " +
+					"mutually exclusive",
+			)
+		}
+	}
+	return enabled, auditorConfig, reconcilerConfig, err
+}
+
+// pollingConfig populates configuration for polling the Bitbucket REST API for
+// changes to repositories from environment variables. The bool return value
+// indicates whether polling is enabled.
+func pollingConfig() (bool, polling.PollerConfig, error) {
+	config := polling.PollerConfig{}
+	enabled, err := os.GetBoolFromEnvVar("POLLING_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, config, err
+	}
+	config.Repos = os.GetStringSliceFromEnvVar("POLLING_REPOS", nil)
+	if len(config.Repos) == 0 {
+		return enabled, config, errors.New("POLLING_REPOS must be specified")
+	}
+	if err = validateRepos("POLLING_REPOS", config.Repos); err != nil {
+		return enabled, config, err
+	}
+	if config.StatePath, err =
+		os.GetRequiredEnvVar("POLLING_STATE_PATH"); err != nil {
+		return enabled, config, err
+	}
+	config.Interval, err =
+		os.GetDurationFromEnvVar("POLLING_INTERVAL", time.Minute)
+	if err == nil && config.Interval <= 0 {
+		err = errors.New("POLLING_INTERVAL must be positive")
+	}
+	return enabled, config, err
+}
+
+// relayConfig populates configuration for receiving webhooks relayed by a
+// relay server from environment variables. The bool return value indicates
+// whether relaying is enabled.
+func relayConfig() (bool, relay.ClientConfig, error) {
+	config := relay.ClientConfig{}
+	enabled, err := os.GetBoolFromEnvVar("RELAY_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, config, err
+	}
+	if config.Address, err = os.GetRequiredEnvVar("RELAY_ADDRESS"); err != nil {
+		return enabled, config, err
+	}
+	if config.Token, err = os.GetRequiredEnvVar("RELAY_TOKEN"); err != nil {
+		return enabled, config, err
+	}
+	config.RetryInterval, err =
+		os.GetDurationFromEnvVar("RELAY_RETRY_INTERVAL", 5*time.Second)
+	if err != nil {
+		return enabled, config, err
+	}
+	if config.RetryInterval <= 0 {
+		return enabled, config,
+			errors.New("RELAY_RETRY_INTERVAL must be positive")
+	}
+	config.MaxConcurrency, err = os.GetIntFromEnvVar(
+		"RELAY_MAX_CONCURRENCY",
+		relay.DefaultMaxConcurrency,
+	)
+	if err == nil && config.MaxConcurrency <= 0 {
+		err = errors.New("RELAY_MAX_CONCURRENCY must be positive")
+	}
+	return enabled, config, err
+}
+
+// relayServerConfig populates configuration for the relay subcommand's relay
+// server from environment variables.
+func relayServerConfig() (relay.ServerConfig, error) {
+	config := relay.ServerConfig{}
+	var err error
+	if config.Token, err =
+		os.GetRequiredEnvVar("RELAY_SERVER_TOKEN"); err != nil {
+		return config, err
+	}
+	if config.ResponseTimeout, err = os.GetDurationFromEnvVar(
+		"RELAY_SERVER_RESPONSE_TIMEOUT",
+		10*time.Second,
+	); err != nil {
+		return config, err
+	}
+	if config.ResponseTimeout <= 0 {
+		return config,
+			errors.New("RELAY_SERVER_RESPONSE_TIMEOUT must be positive")
+	}
+	config.MaxPending, err =
+		os.GetIntFromEnvVar("RELAY_SERVER_MAX_PENDING", 100)
+	if err == nil && config.MaxPending <= 0 {
+		err = errors.New("RELAY_SERVER_MAX_PENDING must be positive")
+	}
+	return config, err
+}
+
+// connectConfig populates configuration for serving a Bitbucket Connect app
+// from environment variables. The bool return value indicates whether the app
+// is enabled.
+func connectConfig() (bool, connect.AppConfig, error) {
+	config := connect.AppConfig{
+		Key:    os.GetEnvVar("CONNECT_APP_KEY", connect.DefaultKey),
+		Name:   os.GetEnvVar("CONNECT_APP_NAME", connect.DefaultName),
+		Events: webhooks.SupportedEventKeys(),
+		AllowedWorkspaces: os.GetStringSliceFromEnvVar(
+			"CONNECT_ALLOWED_WORKSPACES",
+			nil,
+		),
+	}
+	enabled, err := os.GetBoolFromEnvVar("CONNECT_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, config, err
+	}
+	if config.BaseURL, err =
+		os.GetRequiredEnvVar("CONNECT_BASE_URL"); err != nil {
+		return enabled, config, err
+	}
+	// Paths in the app descriptor are relative to the base URL, so the base URL
+	// must not itself have a path.
+	baseURL, err := url.Parse(config.BaseURL)
+	if err != nil || (baseURL.Scheme != "https" && baseURL.Scheme != "http") ||
+		baseURL.Host == "" || strings.TrimSuffix(baseURL.Path, "/") != "" {
+		return enabled, config, errors.Errorf(
+			"CONNECT_BASE_URL value %q is not an absolute URL without a path, "+
+				"e.g. https://gateway.example.com",
+			config.BaseURL,
+		)
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if config.InstallationsPath, err =
+		os.GetRequiredEnvVar("CONNECT_INSTALLATIONS_PATH"); err != nil {
+		return enabled, config, err
+	}
+	// Anyone who can reach the app can attempt to install it, so installation
+	// is restricted to specific workspaces and to Bitbucket's IP ranges.
+	if len(config.AllowedWorkspaces) == 0 {
+		return enabled, config, errors.New(
+			"CONNECT_ALLOWED_WORKSPACES must be specified when CONNECT_ENABLED " +
+				"is true",
+		)
+	}
+	if len(os.GetStringSliceFromEnvVar("ALLOWED_CLIENT_IPS", nil)) == 0 {
+		return enabled, config, errors.New(
+			"ALLOWED_CLIENT_IPS must be specified when CONNECT_ENABLED is true",
+		)
+	}
+	config.APIAddress =
+		os.GetEnvVar("BITBUCKET_API_ADDRESS", bitbucket.DefaultAPIAddress)
+	return enabled, config, nil
+}
+
 // ipFilterConfig populates configuration for the IP web request filter.
-func ipFilterConfig() (http.IPFilterConfig, error) {
-	config := http.IPFilterConfig{}
+func ipFilterConfig() (ipfilter.Config, error) {
+	config := ipfilter.Config{}
 	var err error
 	config.AllowedRanges, err =
 		os.GetIPNetSliceFromEnvVar("ALLOWED_CLIENT_IPS", []net.IPNet{})
+	if err != nil {
+		return config, err
+	}
+	config.TrustedProxies, err =
+		os.GetIPNetSliceFromEnvVar("TRUSTED_PROXIES", []net.IPNet{})
+	return config, err
+}
+
+// ipRangesRefresherConfig populates configuration for periodically refreshing
+// the IP ranges permitted by the IP filter from environment variables. The bool
+// return value indicates whether refreshing is enabled.
+func ipRangesRefresherConfig() (bool, ipfilter.RefresherConfig, error) {
+	config := ipfilter.RefresherConfig{}
+	enabled, err := os.GetBoolFromEnvVar("IP_RANGES_REFRESH_ENABLED", false)
+	if err != nil || !enabled {
+		return enabled, config, err
+	}
+	config.Source =
+		os.GetEnvVar("IP_RANGES_SOURCE", ipfilter.AtlassianIPRangesURL)
+	config.Interval, err =
+		os.GetDurationFromEnvVar("IP_RANGES_REFRESH_INTERVAL", time.Hour)
+	if err == nil && config.Interval <= 0 {
+		err = errors.New("IP_RANGES_REFRESH_INTERVAL must be positive")
+	}
+	return true, config, err
+}
+
+// readinessCheckerConfig populates configuration for the periodic checks that
+// determine whether the gateway is ready to receive webhooks from environment
+// variables.
+func readinessCheckerConfig() (readiness.CheckerConfig, error) {
+	config := readiness.CheckerConfig{}
+	var err error
+	config.Interval, err =
+		os.GetDurationFromEnvVar("READINESS_CHECK_INTERVAL", 30*time.Second)
+	if err != nil {
+		return config, err
+	}
+	if config.Interval <= 0 {
+		return config, errors.New("READINESS_CHECK_INTERVAL must be positive")
+	}
+	config.Timeout, err =
+		os.GetDurationFromEnvVar("READINESS_CHECK_TIMEOUT", 10*time.Second)
+	if err == nil && config.Timeout <= 0 {
+		err = errors.New("READINESS_CHECK_TIMEOUT must be positive")
+	}
 	return config, err
 }
 
 // serverConfig populates configuration for the HTTP/S server from environment
 // variables.
-func serverConfig() (http.ServerConfig, error) {
-	config := http.ServerConfig{}
+func serverConfig() (server.Config, error) {
+	config := server.Config{}
 	var err error
 	config.Port, err = os.GetIntFromEnvVar("PORT", 8080)
 	if err != nil {
@@ -57,6 +719,41 @@ func serverConfig() (http.ServerConfig, error) {
 		if err != nil {
 			return config, err
 		}
+		config.TLSCertPollInterval, err =
+			os.GetDurationFromEnvVar("TLS_CERT_POLL_INTERVAL", 30*time.Second)
+		if err != nil {
+			return config, err
+		}
+		if config.TLSCertPollInterval <= 0 {
+			return config, errors.New("TLS_CERT_POLL_INTERVAL must be positive")
+		}
+		config.TLSMinVersion, err =
+			server.ParseTLSVersion(os.GetEnvVar("TLS_MIN_VERSION", "1.2"))
+		if err != nil {
+			return config, errors.Wrap(err, "error parsing TLS_MIN_VERSION")
+		}
+		cipherSuites := os.GetStringSliceFromEnvVar("TLS_CIPHER_SUITES", nil)
+		if len(cipherSuites) > 0 {
+			if config.TLSCipherSuites, err =
+				server.ParseCipherSuites(cipherSuites); err != nil {
+				return config, errors.Wrap(err, "error parsing TLS_CIPHER_SUITES")
+			}
+		}
 	}
-	return config, nil
+	config.ProxyProtocolEnabled, err =
+		os.GetBoolFromEnvVar("PROXY_PROTOCOL_ENABLED", false)
+	if err != nil || !config.ProxyProtocolEnabled {
+		return config, err
+	}
+	config.ProxyProtocolTrustedSources, err = os.GetIPNetSliceFromEnvVar(
+		"PROXY_PROTOCOL_TRUSTED_SOURCES",
+		nil,
+	)
+	if err == nil && len(config.ProxyProtocolTrustedSources) == 0 {
+		err = errors.New(
+			"PROXY_PROTOCOL_TRUSTED_SOURCES must be specified when " +
+				"PROXY_PROTOCOL_ENABLED is true",
+		)
+	}
+	return config, err
 }
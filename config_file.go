@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	stdOS "os"
+	"strconv"
+	"strings"
+
+	"github.com/brigadecore/brigade-foundations/os"
+	"github.com/pkg/errors"
+)
+
+// configFile models the optional YAML configuration file referenced by the
+// CONFIG_FILE environment variable. Every setting corresponds to one of the
+// environment variables the gateway is otherwise configured with, and the
+// environment variable, if set to a non-empty value, takes precedence. See
+// docs/CONFIGURATION.md for the complete schema.
+type configFile struct {
+	API                 configFileAPI             `yaml:"api"`
+	TenantsPath         string                    `yaml:"tenantsPath"`
+	EventSource         string                    `yaml:"eventSource"`
+	RefFiltersPath      string                    `yaml:"refFiltersPath"`
+	ProjectMappingsPath string                    `yaml:"projectMappingsPath"`
+	ChangedPaths        configFileChangedPaths    `yaml:"changedPaths"`
+	PathFiltersPath     string                    `yaml:"pathFiltersPath"`
+	DryRun              *bool                     `yaml:"dryRun"`
+	Archive             configFileArchive         `yaml:"archive"`
+	Admin               configFileAdmin           `yaml:"admin"`
+	RateLimits          configFileRateLimits      `yaml:"rateLimits"`
+	WebhookSecret       string                    `yaml:"webhookSecret"`
+	Bitbucket           configFileBitbucket       `yaml:"bitbucket"`
+	WebhookRegistration configFileRegistration    `yaml:"webhookRegistration"`
+	SubscriptionAudit   configFileAudit           `yaml:"subscriptionAudit"`
+	Polling             configFilePolling         `yaml:"polling"`
+	Relay               configFileRelay           `yaml:"relay"`
+	Connect             configFileConnect         `yaml:"connect"`
+	AllowedClientIPs    []string                  `yaml:"allowedClientIPs"`
+	TrustedProxies      []string                  `yaml:"trustedProxies"`
+	IPRangesRefresh     configFileIPRangesRefresh `yaml:"ipRangesRefresh"`
+	ReadinessChecks     configFileReadinessChecks `yaml:"readinessChecks"`
+	Server              configFileServer          `yaml:"server"`
+}
+
+// configFileAPI models the api section of the configuration file.
+type configFileAPI struct {
+	Address               string `yaml:"address"`
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	TokenFilePollInterval string `yaml:"tokenFilePollInterval"`
+	IgnoreCertWarnings    *bool  `yaml:"ignoreCertWarnings"`
+	CACertPath            string `yaml:"caCertPath"`
+	ClientCertPath        string `yaml:"clientCertPath"`
+	ClientKeyPath         string `yaml:"clientKeyPath"`
+}
+
+// configFileChangedPaths models the changedPaths section of the configuration
+// file.
+type configFileChangedPaths struct {
+	Enabled   *bool `yaml:"enabled"`
+	CacheSize *int  `yaml:"cacheSize"`
+}
+
+// configFileArchive models the archive section of the configuration file.
+type configFileArchive struct {
+	Enabled  *bool  `yaml:"enabled"`
+	Dir      string `yaml:"dir"`
+	MaxAge   string `yaml:"maxAge"`
+	MaxFiles *int   `yaml:"maxFiles"`
+}
+
+// configFileAdmin models the admin section of the configuration file.
+type configFileAdmin struct {
+	Enabled       *bool  `yaml:"enabled"`
+	Token         string `yaml:"token"`
+	MaxDeliveries *int   `yaml:"maxDeliveries"`
+}
+
+// configFileRateLimits models the rateLimits section of the configuration
+// file.
+type configFileRateLimits struct {
+	Global  configFileRateLimit `yaml:"global"`
+	PerRepo configFileRateLimit `yaml:"perRepo"`
+}
+
+// configFileRateLimit models a single rate limit in the configuration file.
+type configFileRateLimit struct {
+	PerMinute *int `yaml:"perMinute"`
+	Burst     *int `yaml:"burst"`
+}
+
+// configFileBitbucket models the bitbucket section of the configuration file.
+type configFileBitbucket struct {
+	APIAddress  string `yaml:"apiAddress"`
+	Username    string `yaml:"username"`
+	AppPassword string `yaml:"appPassword"`
+	AccessToken string `yaml:"accessToken"`
+}
+
+// configFileRegistration models the webhookRegistration section of the
+// configuration file.
+type configFileRegistration struct {
+	Enabled     *bool    `yaml:"enabled"`
+	URL         string   `yaml:"url"`
+	Repos       []string `yaml:"repos"`
+	Workspaces  []string `yaml:"workspaces"`
+	Description string   `yaml:"description"`
+	Interval    string   `yaml:"interval"`
+}
+
+// configFileAudit models the subscriptionAudit section of the configuration
+// file.
+type configFileAudit struct {
+	Enabled   *bool  `yaml:"enabled"`
+	Interval  string `yaml:"interval"`
+	Reconcile *bool  `yaml:"reconcile"`
+}
+
+// configFilePolling models the polling section of the configuration file.
+type configFilePolling struct {
+	Enabled   *bool    `yaml:"enabled"`
+	Repos     []string `yaml:"repos"`
+	Interval  string   `yaml:"interval"`
+	StatePath string   `yaml:"statePath"`
+}
+
+// configFileRelay models the relay section of the configuration file.
+type configFileRelay struct {
+	Enabled        *bool                 `yaml:"enabled"`
+	Address        string                `yaml:"address"`
+	Token          string                `yaml:"token"`
+	RetryInterval  string                `yaml:"retryInterval"`
+	MaxConcurrency *int                  `yaml:"maxConcurrency"`
+	Server         configFileRelayServer `yaml:"server"`
+}
+
+// configFileRelayServer models the relay.server section of the configuration
+// file, which configures the relay subcommand.
+type configFileRelayServer struct {
+	Token           string `yaml:"token"`
+	ResponseTimeout string `yaml:"responseTimeout"`
+	MaxPending      *int   `yaml:"maxPending"`
+}
+
+// configFileConnect models the connect section of the configuration file.
+type configFileConnect struct {
+	Enabled           *bool    `yaml:"enabled"`
+	BaseURL           string   `yaml:"baseURL"`
+	AppKey            string   `yaml:"appKey"`
+	AppName           string   `yaml:"appName"`
+	InstallationsPath string   `yaml:"installationsPath"`
+	AllowedWorkspaces []string `yaml:"allowedWorkspaces"`
+}
+
+// configFileIPRangesRefresh models the ipRangesRefresh section of the
+// configuration file.
+type configFileIPRangesRefresh struct {
+	Enabled  *bool  `yaml:"enabled"`
+	Source   string `yaml:"source"`
+	Interval string `yaml:"interval"`
+}
+
+// configFileReadinessChecks models the readinessChecks section of the
+// configuration file.
+type configFileReadinessChecks struct {
+	Interval string `yaml:"interval"`
+	Timeout  string `yaml:"timeout"`
+}
+
+// configFileServer models the server section of the configuration file.
+type configFileServer struct {
+	Port          *int                    `yaml:"port"`
+	TLS           configFileTLS           `yaml:"tls"`
+	ProxyProtocol configFileProxyProtocol `yaml:"proxyProtocol"`
+}
+
+// configFileTLS models the server.tls section of the configuration file.
+type configFileTLS struct {
+	Enabled          *bool    `yaml:"enabled"`
+	CertPath         string   `yaml:"certPath"`
+	KeyPath          string   `yaml:"keyPath"`
+	CertPollInterval string   `yaml:"certPollInterval"`
+	MinVersion       string   `yaml:"minVersion"`
+	CipherSuites     []string `yaml:"cipherSuites"`
+}
+
+// configFileProxyProtocol models the server.proxyProtocol section of the
+// configuration file.
+type configFileProxyProtocol struct {
+	Enabled        *bool    `yaml:"enabled"`
+	TrustedSources []string `yaml:"trustedSources"`
+}
+
+// envVars returns a map of environment variable names to the values specified
+// for them by the configuration file. Settings that are not specified by the
+// file are omitted.
+func (c configFile) envVars() map[string]string {
+	envVars := map[string]string{
+		"API_ADDRESS":                    c.API.Address,
+		"API_TOKEN":                      c.API.Token,
+		"API_TOKEN_FILE":                 c.API.TokenFile,
+		"API_TOKEN_FILE_POLL_INTERVAL":   c.API.TokenFilePollInterval,
+		"API_IGNORE_CERT_WARNINGS":       boolEnvVar(c.API.IgnoreCertWarnings),
+		"API_CA_CERT_PATH":               c.API.CACertPath,
+		"API_CLIENT_CERT_PATH":           c.API.ClientCertPath,
+		"API_CLIENT_KEY_PATH":            c.API.ClientKeyPath,
+		"TENANTS_PATH":                   c.TenantsPath,
+		"EVENT_SOURCE":                   c.EventSource,
+		"REF_FILTERS_PATH":               c.RefFiltersPath,
+		"PROJECT_MAPPINGS_PATH":          c.ProjectMappingsPath,
+		"CHANGED_PATHS_ENABLED":          boolEnvVar(c.ChangedPaths.Enabled),
+		"CHANGED_PATHS_CACHE_SIZE":       intEnvVar(c.ChangedPaths.CacheSize),
+		"PATH_FILTERS_PATH":              c.PathFiltersPath,
+		"DRY_RUN":                        boolEnvVar(c.DryRun),
+		"ARCHIVE_ENABLED":                boolEnvVar(c.Archive.Enabled),
+		"ARCHIVE_DIR":                    c.Archive.Dir,
+		"ARCHIVE_MAX_AGE":                c.Archive.MaxAge,
+		"ARCHIVE_MAX_FILES":              intEnvVar(c.Archive.MaxFiles),
+		"ADMIN_ENABLED":                  boolEnvVar(c.Admin.Enabled),
+		"ADMIN_TOKEN":                    c.Admin.Token,
+		"ADMIN_MAX_DELIVERIES":           intEnvVar(c.Admin.MaxDeliveries),
+		"RATE_LIMIT_GLOBAL_PER_MINUTE":   intEnvVar(c.RateLimits.Global.PerMinute),
+		"RATE_LIMIT_GLOBAL_BURST":        intEnvVar(c.RateLimits.Global.Burst),
+		"RATE_LIMIT_PER_REPO_PER_MINUTE": intEnvVar(c.RateLimits.PerRepo.PerMinute),
+		"RATE_LIMIT_PER_REPO_BURST":      intEnvVar(c.RateLimits.PerRepo.Burst),
+		"WEBHOOK_SECRET":                 c.WebhookSecret,
+		"BITBUCKET_API_ADDRESS":          c.Bitbucket.APIAddress,
+		"BITBUCKET_USERNAME":             c.Bitbucket.Username,
+		"BITBUCKET_APP_PASSWORD":         c.Bitbucket.AppPassword,
+		"BITBUCKET_ACCESS_TOKEN":         c.Bitbucket.AccessToken,
+		"WEBHOOK_REGISTRATION_ENABLED":   boolEnvVar(c.WebhookRegistration.Enabled),
+		"WEBHOOK_REGISTRATION_URL":       c.WebhookRegistration.URL,
+		"WEBHOOK_REGISTRATION_REPOS": strings.Join(
+			c.WebhookRegistration.Repos,
+			",",
+		),
+		"WEBHOOK_REGISTRATION_WORKSPACES": strings.Join(
+			c.WebhookRegistration.Workspaces,
+			",",
+		),
+		"WEBHOOK_REGISTRATION_DESCRIPTION": c.WebhookRegistration.Description,
+		"WEBHOOK_REGISTRATION_INTERVAL":    c.WebhookRegistration.Interval,
+		"SUBSCRIPTION_AUDIT_ENABLED":       boolEnvVar(c.SubscriptionAudit.Enabled),
+		"SUBSCRIPTION_AUDIT_INTERVAL":      c.SubscriptionAudit.Interval,
+		"SUBSCRIPTION_AUDIT_RECONCILE": boolEnvVar(
+			c.SubscriptionAudit.Reconcile,
+		),
+		"POLLING_ENABLED":               boolEnvVar(c.Polling.Enabled),
+		"POLLING_REPOS":                 strings.Join(c.Polling.Repos, ","),
+		"POLLING_INTERVAL":              c.Polling.Interval,
+		"POLLING_STATE_PATH":            c.Polling.StatePath,
+		"RELAY_ENABLED":                 boolEnvVar(c.Relay.Enabled),
+		"RELAY_ADDRESS":                 c.Relay.Address,
+		"RELAY_TOKEN":                   c.Relay.Token,
+		"RELAY_RETRY_INTERVAL":          c.Relay.RetryInterval,
+		"RELAY_MAX_CONCURRENCY":         intEnvVar(c.Relay.MaxConcurrency),
+		"RELAY_SERVER_TOKEN":            c.Relay.Server.Token,
+		"RELAY_SERVER_RESPONSE_TIMEOUT": c.Relay.Server.ResponseTimeout,
+		"RELAY_SERVER_MAX_PENDING":      intEnvVar(c.Relay.Server.MaxPending),
+		"CONNECT_ENABLED":               boolEnvVar(c.Connect.Enabled),
+		"CONNECT_BASE_URL":              c.Connect.BaseURL,
+		"CONNECT_APP_KEY":               c.Connect.AppKey,
+		"CONNECT_APP_NAME":              c.Connect.AppName,
+		"CONNECT_INSTALLATIONS_PATH":    c.Connect.InstallationsPath,
+		"CONNECT_ALLOWED_WORKSPACES": strings.Join(
+			c.Connect.AllowedWorkspaces,
+			",",
+		),
+		"ALLOWED_CLIENT_IPS":         strings.Join(c.AllowedClientIPs, ","),
+		"TRUSTED_PROXIES":            strings.Join(c.TrustedProxies, ","),
+		"IP_RANGES_REFRESH_ENABLED":  boolEnvVar(c.IPRangesRefresh.Enabled),
+		"IP_RANGES_SOURCE":           c.IPRangesRefresh.Source,
+		"IP_RANGES_REFRESH_INTERVAL": c.IPRangesRefresh.Interval,
+		"READINESS_CHECK_INTERVAL":   c.ReadinessChecks.Interval,
+		"READINESS_CHECK_TIMEOUT":    c.ReadinessChecks.Timeout,
+		"PORT":                       intEnvVar(c.Server.Port),
+		"TLS_ENABLED":                boolEnvVar(c.Server.TLS.Enabled),
+		"TLS_CERT_PATH":              c.Server.TLS.CertPath,
+		"TLS_KEY_PATH":               c.Server.TLS.KeyPath,
+		"TLS_CERT_POLL_INTERVAL":     c.Server.TLS.CertPollInterval,
+		"TLS_MIN_VERSION":            c.Server.TLS.MinVersion,
+		"TLS_CIPHER_SUITES": strings.Join(
+			c.Server.TLS.CipherSuites,
+			",",
+		),
+		"PROXY_PROTOCOL_ENABLED": boolEnvVar(c.Server.ProxyProtocol.Enabled),
+		"PROXY_PROTOCOL_TRUSTED_SOURCES": strings.Join(
+			c.Server.ProxyProtocol.TrustedSources,
+			",",
+		),
+	}
+	for name, value := range envVars {
+		if value == "" {
+			delete(envVars, name)
+		}
+	}
+	return envVars
+}
+
+// boolEnvVar returns the environment variable value corresponding to the
+// provided bool setting from the configuration file. If the setting was not
+// specified, an empty string is returned.
+func boolEnvVar(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+// intEnvVar returns the environment variable value corresponding to the
+// provided int setting from the configuration file. If the setting was not
+// specified, an empty string is returned.
+func intEnvVar(i *int) string {
+	if i == nil {
+		return ""
+	}
+	return strconv.Itoa(*i)
+}
+
+// applyConfigFile loads the configuration file referenced by the CONFIG_FILE
+// environment variable, if any, and sets every environment variable that
+// corresponds to a setting in the file, unless that environment variable is
+// already set to a non-empty value. In this manner, the file provides values
+// that environment variables can override. Like the gateway's other settings,
+// environment variables that are set to an empty value are treated as unset.
+// Unrecognized settings and settings of the wrong type are treated as errors,
+// all of which are reported at once.
+func applyConfigFile() error {
+	path := os.GetEnvVar("CONFIG_FILE", "")
+	if path == "" {
+		return nil
+	}
+	config := configFile{}
+	if err := loadYAMLFile(path, &config); err != nil {
+		return err
+	}
+	for name, value := range config.envVars() {
+		if stdOS.Getenv(name) != "" {
+			continue
+		}
+		if err := stdOS.Setenv(name, value); err != nil {
+			return errors.Wrapf(err, "error setting %s from %s", name, path)
+		}
+	}
+	return nil
+}
+
+// configErrors is an error that aggregates every problem found with the
+// gateway's configuration.
+type configErrors []error
+
+func (c configErrors) Error() string {
+	msgs := make([]string, len(c))
+	for i, err := range c {
+		msgs[i] = fmt.Sprintf("  - %s", err)
+	}
+	return fmt.Sprintf(
+		"found %d problem(s) with the gateway's configuration:\n%s",
+		len(c),
+		strings.Join(msgs, "\n"),
+	)
+}
+
+// validateConfig validates all of the gateway's configuration, without acting
+// on it, and returns a configErrors describing every problem found. If no
+// problems are found, nil is returned.
+func validateConfig() error {
+	errs := configErrors{}
+	collect := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	_, err := serviceConfig()
+	collect(err)
+	changedPathsEnabled, _, err := changedPathsConfig()
+	collect(err)
+	tenants, err := tenantsConfig()
+	collect(err)
+	dryRun, err := dryRunConfig()
+	collect(err)
+	// The default Brigade API server is only communicated with if no tenants
+	// are configured and the gateway is not running in dry run mode.
+	if len(tenants) == 0 && !dryRun {
+		_, _, _, err = apiClientConfig()
+		collect(err)
+		_, _, err = apiTokenFileConfig()
+		collect(err)
+	}
+	_, _, err = deliveryArchiveConfig()
+	collect(err)
+	_, _, _, err = adminConfig()
+	collect(err)
+	_, _, err = rateLimiterConfig()
+	collect(err)
+	registrationEnabled, _, err := webhookRegistrationConfig()
+	collect(err)
+	auditEnabled, _, _, err := subscriptionAuditConfig()
+	collect(err)
+	pollingEnabled, _, err := pollingConfig()
+	collect(err)
+	if changedPathsEnabled || registrationEnabled || auditEnabled ||
+		pollingEnabled {
+		_, err = bitbucketClientConfig()
+		collect(err)
+	}
+	_, _, err = relayConfig()
+	collect(err)
+	_, _, err = connectConfig()
+	collect(err)
+	_, err = ipFilterConfig()
+	collect(err)
+	_, _, err = ipRangesRefresherConfig()
+	collect(err)
+	_, err = readinessCheckerConfig()
+	collect(err)
+	_, err = serverConfig()
+	collect(err)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFileEnvVars(t *testing.T) {
+	config := configFile{}
+	require.Empty(t, config.envVars())
+	config.API.Address = "https://brigade.example.com"
+	config.AllowedClientIPs = []string{"192.0.2.0/24", "2001:db8::/32"}
+	tlsEnabled := true
+	config.Server.TLS.Enabled = &tlsEnabled
+	dryRun := false
+	config.DryRun = &dryRun
+	port := 8080
+	config.Server.Port = &port
+	require.Equal(
+		t,
+		map[string]string{
+			"API_ADDRESS":        "https://brigade.example.com",
+			"ALLOWED_CLIENT_IPS": "192.0.2.0/24,2001:db8::/32",
+			"TLS_ENABLED":        "true",
+			"DRY_RUN":            "false",
+			"PORT":               "8080",
+		},
+		config.envVars(),
+	)
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(error)
+	}{
+		{
+			name: "CONFIG_FILE not defined",
+			assertions: func(err error) {
+				require.NoError(t, err)
+			},
+		},
+		{
+			name: "file does not exist",
+			setup: func() {
+				t.Setenv("CONFIG_FILE", filepath.Join(dir, "does-not-exist.yaml"))
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error opening")
+			},
+		},
+		{
+			name: "file contains unrecognized settings",
+			setup: func() {
+				configPath := filepath.Join(dir, "unrecognized.yaml")
+				require.NoError(
+					t,
+					os.WriteFile(
+						configPath,
+						[]byte("api:\n  adress: foo\nport: 8080\n"),
+						0600,
+					),
+				)
+				t.Setenv("CONFIG_FILE", configPath)
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing")
+				// Every unrecognized setting is reported
+				require.Contains(t, err.Error(), "field adress not found")
+				require.Contains(t, err.Error(), "field port not found")
+			},
+		},
+		{
+			name: "file contains settings of the wrong type",
+			setup: func() {
+				configPath := filepath.Join(dir, "wrong-types.yaml")
+				require.NoError(
+					t,
+					os.WriteFile(
+						configPath,
+						[]byte("dryRun: maybe\nserver:\n  port: eighty\n"),
+						0600,
+					),
+				)
+				t.Setenv("CONFIG_FILE", configPath)
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing")
+				// Every setting of the wrong type is reported, along with its line
+				require.Contains(t, err.Error(), "line 1: cannot unmarshal")
+				require.Contains(t, err.Error(), "line 3: cannot unmarshal")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				configPath := filepath.Join(dir, "config.yaml")
+				require.NoError(
+					t,
+					os.WriteFile(
+						configPath,
+						[]byte(
+							"api:\n"+
+								"  address: https://brigade.example.com\n"+
+								"allowedClientIPs:\n"+
+								"- 192.0.2.0/24\n"+
+								"- 198.51.100.0/24\n"+
+								"server:\n"+
+								"  port: 8080\n",
+						),
+						0600,
+					),
+				)
+				t.Setenv("CONFIG_FILE", configPath)
+				// Environment variables take precedence over the file
+				t.Setenv("PORT", "9090")
+				// Unless they are empty, in which case they are treated as unset
+				t.Setenv("ALLOWED_CLIENT_IPS", "")
+				t.Cleanup(func() {
+					os.Unsetenv("API_ADDRESS")        // nolint: errcheck
+					os.Unsetenv("ALLOWED_CLIENT_IPS") // nolint: errcheck
+				})
+			},
+			assertions: func(err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					"https://brigade.example.com",
+					os.Getenv("API_ADDRESS"),
+				)
+				require.Equal(
+					t,
+					"192.0.2.0/24,198.51.100.0/24",
+					os.Getenv("ALLOWED_CLIENT_IPS"),
+				)
+				require.Equal(t, "9090", os.Getenv("PORT"))
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(applyConfigFile())
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	err := configErrors{errors.New("foo"), errors.New("bar")}
+	require.Equal(
+		t,
+		"found 2 problem(s) with the gateway's configuration:\n"+
+			"  - foo\n"+
+			"  - bar",
+		err.Error(),
+	)
+}
+
+func TestValidateConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(error)
+	}{
+		{
+			name: "multiple problems",
+			setup: func() {
+				t.Setenv("ARCHIVE_ENABLED", "true")
+				t.Setenv("PORT", "eighty")
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				errs, ok := err.(configErrors)
+				require.True(t, ok)
+				require.Len(t, errs, 3)
+				require.Contains(t, err.Error(), "API_ADDRESS")
+				require.Contains(t, err.Error(), "ARCHIVE_DIR")
+				require.Contains(t, err.Error(), "PORT")
+			},
+		},
+		{
+			name: "API settings not required in dry run mode",
+			setup: func() {
+				t.Setenv("DRY_RUN", "true")
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				errs, ok := err.(configErrors)
+				require.True(t, ok)
+				require.Len(t, errs, 2)
+				require.NotContains(t, err.Error(), "API_ADDRESS")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("ARCHIVE_DIR", t.TempDir())
+				t.Setenv("PORT", "8080")
+			},
+			assertions: func(err error) {
+				require.NoError(t, err)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(validateConfig())
+		})
+	}
+}
@@ -2,10 +2,23 @@ package main
 
 // nolint: lll
 import (
+	"crypto/tls"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
-	"github.com/brigadecore/brigade-foundations/http"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/brigade"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/connect"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/ipfilter"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/polling"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/readiness"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/relay"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/server"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/subscriptions"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
 	"github.com/brigadecore/brigade/sdk/v3/restmachinery"
 	"github.com/stretchr/testify/require"
 )
@@ -56,30 +69,1706 @@ func TestAPIClientConfig(t *testing.T) {
 				require.Contains(t, err.Error(), "API_TOKEN")
 			},
 		},
+		{
+			name: "API_TOKEN not set, but API_TOKEN_FILE set",
+			setup: func() {
+				t.Setenv("API_TOKEN_FILE", "/var/run/secrets/token")
+			},
+			assertions: func(
+				address string,
+				token string,
+				_ restmachinery.APIClientOptions,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Equal(t, "foo", address)
+				require.Empty(t, token)
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("API_TOKEN_FILE", "")
+				t.Setenv("API_TOKEN", "bar")
+				t.Setenv("API_IGNORE_CERT_WARNINGS", "true")
+			},
+			assertions: func(
+				address string,
+				token string,
+				opts restmachinery.APIClientOptions,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.Equal(t, "foo", address)
+				require.Equal(t, "bar", token)
+				require.True(t, opts.AllowInsecureConnections)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.setup()
+			address, token, opts, err := apiClientConfig()
+			testCase.assertions(address, token, opts, err)
+		})
+	}
+}
+
+func TestAPIClientTLSConfig(t *testing.T) {
+	require.Equal(t, brigade.TLSConfig{}, apiClientTLSConfig())
+	t.Setenv("API_CA_CERT_PATH", "/var/ssl/ca.crt")
+	t.Setenv("API_CLIENT_CERT_PATH", "/var/ssl/client.crt")
+	t.Setenv("API_CLIENT_KEY_PATH", "/var/ssl/client.key")
+	require.Equal(
+		t,
+		brigade.TLSConfig{
+			CACertPath:     "/var/ssl/ca.crt",
+			ClientCertPath: "/var/ssl/client.crt",
+			ClientKeyPath:  "/var/ssl/client.key",
+		},
+		apiClientTLSConfig(),
+	)
+}
+
+func TestAPITokenFileConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, brigade.TokenFileConfig, error)
+	}{
+		{
+			name: "API_TOKEN_FILE not set",
+			assertions: func(enabled bool, _ brigade.TokenFileConfig, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "API_TOKEN_FILE_POLL_INTERVAL not parsable as duration",
+			setup: func() {
+				t.Setenv("API_TOKEN_FILE", "/var/run/secrets/token")
+				t.Setenv("API_TOKEN_FILE_POLL_INTERVAL", "foo")
+			},
+			assertions: func(_ bool, _ brigade.TokenFileConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a duration")
+				require.Contains(t, err.Error(), "API_TOKEN_FILE_POLL_INTERVAL")
+			},
+		},
+		{
+			name: "API_TOKEN_FILE_POLL_INTERVAL not positive",
+			setup: func() {
+				t.Setenv("API_TOKEN_FILE_POLL_INTERVAL", "0s")
+			},
+			assertions: func(_ bool, _ brigade.TokenFileConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("API_TOKEN_FILE_POLL_INTERVAL", "1m")
+			},
+			assertions: func(
+				enabled bool,
+				config brigade.TokenFileConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					brigade.TokenFileConfig{
+						Path:         "/var/run/secrets/token",
+						PollInterval: time.Minute,
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(apiTokenFileConfig())
+		})
+	}
+}
+
+func TestDryRunConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, error)
+	}{
+		{
+			name: "DRY_RUN not defined",
+			assertions: func(dryRun bool, err error) {
+				require.NoError(t, err)
+				require.False(t, dryRun)
+			},
+		},
+		{
+			name: "DRY_RUN not a bool",
+			setup: func() {
+				t.Setenv("DRY_RUN", "nope")
+			},
+			assertions: func(_ bool, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "DRY_RUN")
+			},
+		},
+		{
+			name: "DRY_RUN defined",
+			setup: func() {
+				t.Setenv("DRY_RUN", "true")
+			},
+			assertions: func(dryRun bool, err error) {
+				require.NoError(t, err)
+				require.True(t, dryRun)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(dryRunConfig())
+		})
+	}
+}
+
+func TestServiceConfig(t *testing.T) {
+	dir := t.TempDir()
+	refFiltersPath := filepath.Join(dir, "ref-filters.yaml")
+	projectMappingsPath := filepath.Join(dir, "project-mappings.yaml")
+	pathFiltersPath := filepath.Join(dir, "path-filters.yaml")
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(webhooks.ServiceConfig, error)
+	}{
+		{
+			name: "EVENT_SOURCE not defined",
+			assertions: func(config webhooks.ServiceConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(t, webhooks.DefaultSource, config.Source)
+			},
+		},
+		{
+			name: "EVENT_SOURCE is invalid",
+			setup: func() {
+				t.Setenv("EVENT_SOURCE", "example.com/bit bucket")
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "EVENT_SOURCE value")
+				require.Contains(t, err.Error(), "is invalid")
+			},
+		},
+		{
+			name: "REF_FILTERS_PATH not defined",
+			setup: func() {
+				t.Setenv("EVENT_SOURCE", "example.com/bitbucket-partner")
+			},
+			assertions: func(config webhooks.ServiceConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "example.com/bitbucket-partner", config.Source)
+				require.Empty(t, config.RefFilters)
+				require.Empty(t, config.ProjectMappings)
+			},
+		},
+		{
+			name: "REF_FILTERS_PATH refers to non-existent file",
+			setup: func() {
+				t.Setenv("REF_FILTERS_PATH", refFiltersPath)
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error opening")
+			},
+		},
+		{
+			name: "ref filters contain unknown field",
+			setup: func() {
+				writeFile(t, refFiltersPath, "- repo: example-org/*\n  foo: bar\n")
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing")
+				require.Contains(t, err.Error(), "field foo not found")
+			},
+		},
+		{
+			name: "ref filters contain invalid pattern",
+			setup: func() {
+				writeFile(
+					t,
+					refFiltersPath,
+					"- repo: example-org/*\n  branches:\n    include: ['[main']\n",
+				)
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "invalid pattern")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				writeFile(
+					t,
+					refFiltersPath,
+					"- repo: example-org/*\n"+
+						"  branches:\n"+
+						"    include: [main]\n"+
+						"  tags:\n"+
+						"    exclude: ['*-rc*']\n",
+				)
+			},
+			assertions: func(config webhooks.ServiceConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					[]webhooks.RefFilter{
+						{
+							Repo: "example-org/*",
+							Branches: webhooks.RefPatterns{
+								Include: []string{"main"},
+							},
+							Tags: webhooks.RefPatterns{
+								Exclude: []string{"*-rc*"},
+							},
+						},
+					},
+					config.RefFilters,
+				)
+			},
+		},
+		{
+			name: "PROJECT_MAPPINGS_PATH refers to non-existent file",
+			setup: func() {
+				t.Setenv("PROJECT_MAPPINGS_PATH", projectMappingsPath)
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error opening")
+			},
+		},
+		{
+			name: "project mapping does not specify a project",
+			setup: func() {
+				writeFile(t, projectMappingsPath, "- repo: example-org/*\n")
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify a project")
+			},
+		},
+		{
+			name: "success with project mappings",
+			setup: func() {
+				writeFile(
+					t,
+					projectMappingsPath,
+					"- repo: example-org/*\n  project: example\n",
+				)
+			},
+			assertions: func(config webhooks.ServiceConfig, err error) {
+				require.NoError(t, err)
+				require.Len(t, config.RefFilters, 1)
+				require.Equal(
+					t,
+					[]webhooks.ProjectMapping{
+						{
+							Repo:    "example-org/*",
+							Project: "example",
+						},
+					},
+					config.ProjectMappings,
+				)
+			},
+		},
+		{
+			name: "PATH_FILTERS_PATH refers to non-existent file",
+			setup: func() {
+				t.Setenv("PATH_FILTERS_PATH", pathFiltersPath)
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error opening")
+			},
+		},
+		{
+			name: "path filter contains component without paths",
+			setup: func() {
+				writeFile(
+					t,
+					pathFiltersPath,
+					"- repo: example-org/*\n  components:\n  - name: billing\n",
+				)
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify paths")
+			},
+		},
+		{
+			name: "path filters without changed paths",
+			setup: func() {
+				writeFile(
+					t,
+					pathFiltersPath,
+					"- repo: example-org/*\n"+
+						"  exclude: ['**/*.md']\n"+
+						"  components:\n"+
+						"  - name: billing\n"+
+						"    paths: [services/billing/**]\n",
+				)
+			},
+			assertions: func(_ webhooks.ServiceConfig, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"PATH_FILTERS_PATH requires CHANGED_PATHS_ENABLED",
+				)
+			},
+		},
+		{
+			name: "success with path filters",
+			setup: func() {
+				t.Setenv("CHANGED_PATHS_ENABLED", "true")
+			},
+			assertions: func(config webhooks.ServiceConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					[]webhooks.PathFilter{
+						{
+							Repo:    "example-org/*",
+							Exclude: []string{"**/*.md"},
+							Components: []webhooks.Component{
+								{
+									Name:  "billing",
+									Paths: []string{"services/billing/**"},
+								},
+							},
+						},
+					},
+					config.PathFilters,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(serviceConfig())
+		})
+	}
+}
+
+func TestChangedPathsConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(enabled bool, cacheSize int, err error)
+	}{
+		{
+			name: "CHANGED_PATHS_ENABLED not defined",
+			assertions: func(enabled bool, _ int, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "CHANGED_PATHS_CACHE_SIZE not an int",
+			setup: func() {
+				t.Setenv("CHANGED_PATHS_ENABLED", "true")
+				t.Setenv("CHANGED_PATHS_CACHE_SIZE", "lots")
+			},
+			assertions: func(_ bool, _ int, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as an int")
+				require.Contains(t, err.Error(), "CHANGED_PATHS_CACHE_SIZE")
+			},
+		},
+		{
+			name: "CHANGED_PATHS_CACHE_SIZE not positive",
+			setup: func() {
+				t.Setenv("CHANGED_PATHS_CACHE_SIZE", "0")
+			},
+			assertions: func(_ bool, _ int, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"CHANGED_PATHS_CACHE_SIZE must be positive",
+				)
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("CHANGED_PATHS_CACHE_SIZE", "50")
+			},
+			assertions: func(enabled bool, cacheSize int, err error) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(t, 50, cacheSize)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(changedPathsConfig())
+		})
+	}
+}
+
+func TestTenantsConfig(t *testing.T) {
+	tenantsPath := filepath.Join(t.TempDir(), "tenants.yaml")
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func([]tenantConfig, error)
+	}{
+		{
+			name: "TENANTS_PATH not defined",
+			assertions: func(tenants []tenantConfig, err error) {
+				require.NoError(t, err)
+				require.Empty(t, tenants)
+			},
+		},
+		{
+			name: "TENANTS_PATH refers to non-existent file",
+			setup: func() {
+				t.Setenv("TENANTS_PATH", tenantsPath)
+			},
+			assertions: func(_ []tenantConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error opening")
+			},
+		},
+		{
+			name: "tenant does not specify a workspace",
+			setup: func() {
+				writeFile(t, tenantsPath, "- apiAddress: https://brigade.example.com\n")
+			},
+			assertions: func(_ []tenantConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify a workspace")
+			},
+		},
+		{
+			name: "workspace specified by more than one tenant",
+			setup: func() {
+				writeFile(
+					t,
+					tenantsPath,
+					"- workspace: example-org\n"+
+						"  apiAddress: https://brigade.example.com\n"+
+						"  apiToken: foo\n"+
+						"- workspace: example-org\n"+
+						"  apiAddress: https://brigade.example.com\n"+
+						"  apiToken: foo\n",
+				)
+			},
+			assertions: func(_ []tenantConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "more than one tenant")
+			},
+		},
+		{
+			name: "tenant does not specify an apiAddress",
+			setup: func() {
+				writeFile(t, tenantsPath, "- workspace: example-org\n")
+			},
+			assertions: func(_ []tenantConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify an apiAddress")
+			},
+		},
+		{
+			name: "tenant does not specify an apiToken",
+			setup: func() {
+				writeFile(
+					t,
+					tenantsPath,
+					"- workspace: example-org\n"+
+						"  apiAddress: https://brigade.example.com\n",
+				)
+			},
+			assertions: func(_ []tenantConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify an apiToken")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				writeFile(
+					t,
+					tenantsPath,
+					"- workspace: example-org\n"+
+						"  apiAddress: https://brigade.example.com\n"+
+						"  apiToken: foo\n"+
+						"- workspace: another-org\n"+
+						"  apiAddress: https://brigade.example.org\n"+
+						"  apiToken: bar\n"+
+						"  apiIgnoreCertWarnings: true\n",
+				)
+			},
+			assertions: func(tenants []tenantConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					[]tenantConfig{
+						{
+							Workspace:  "example-org",
+							APIAddress: "https://brigade.example.com",
+							APIToken:   "foo",
+						},
+						{
+							Workspace:             "another-org",
+							APIAddress:            "https://brigade.example.org",
+							APIToken:              "bar",
+							APIIgnoreCertWarnings: true,
+						},
+					},
+					tenants,
+				)
+			},
+		},
+		{
+			name: "success with TLS files",
+			setup: func() {
+				writeFile(
+					t,
+					tenantsPath,
+					"- workspace: example-org\n"+
+						"  apiAddress: https://brigade.example.com\n"+
+						"  apiToken: foo\n"+
+						"  apiCACertPath: /var/ssl/ca.crt\n"+
+						"  apiClientCertPath: /var/ssl/client.crt\n"+
+						"  apiClientKeyPath: /var/ssl/client.key\n",
+				)
+			},
+			assertions: func(tenants []tenantConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					[]tenantConfig{
+						{
+							Workspace:         "example-org",
+							APIAddress:        "https://brigade.example.com",
+							APIToken:          "foo",
+							APICACertPath:     "/var/ssl/ca.crt",
+							APIClientCertPath: "/var/ssl/client.crt",
+							APIClientKeyPath:  "/var/ssl/client.key",
+						},
+					},
+					tenants,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(tenantsConfig())
+		})
+	}
+}
+
+func TestDeliveryArchiveConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, webhooks.DirectoryArchiveConfig, error)
+	}{
+		{
+			name: "ARCHIVE_ENABLED not defined",
+			assertions: func(
+				enabled bool,
+				_ webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "ARCHIVE_DIR required but not set",
+			setup: func() {
+				t.Setenv("ARCHIVE_ENABLED", "true")
+			},
+			assertions: func(
+				_ bool,
+				_ webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "value not found for")
+				require.Contains(t, err.Error(), "ARCHIVE_DIR")
+			},
+		},
+		{
+			name: "ARCHIVE_MAX_AGE not a duration",
+			setup: func() {
+				t.Setenv("ARCHIVE_DIR", "/var/archive")
+				t.Setenv("ARCHIVE_MAX_AGE", "forever")
+			},
+			assertions: func(
+				_ bool,
+				_ webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a duration")
+				require.Contains(t, err.Error(), "ARCHIVE_MAX_AGE")
+			},
+		},
+		{
+			name: "ARCHIVE_MAX_AGE not positive",
+			setup: func() {
+				t.Setenv("ARCHIVE_MAX_AGE", "0s")
+			},
+			assertions: func(
+				_ bool,
+				_ webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "ARCHIVE_MAX_AGE must be positive")
+			},
+		},
+		{
+			name: "ARCHIVE_MAX_FILES not an int",
+			setup: func() {
+				t.Setenv("ARCHIVE_MAX_AGE", "24h")
+				t.Setenv("ARCHIVE_MAX_FILES", "lots")
+			},
+			assertions: func(
+				_ bool,
+				_ webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as an int")
+				require.Contains(t, err.Error(), "ARCHIVE_MAX_FILES")
+			},
+		},
+		{
+			name: "ARCHIVE_MAX_FILES not positive",
+			setup: func() {
+				t.Setenv("ARCHIVE_MAX_FILES", "-1")
+			},
+			assertions: func(
+				_ bool,
+				_ webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "ARCHIVE_MAX_FILES must be positive")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("ARCHIVE_MAX_FILES", "100")
+			},
+			assertions: func(
+				enabled bool,
+				config webhooks.DirectoryArchiveConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					webhooks.DirectoryArchiveConfig{
+						Dir:      "/var/archive",
+						MaxAge:   24 * time.Hour,
+						MaxFiles: 100,
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(deliveryArchiveConfig())
+		})
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(
+			enabled bool,
+			token string,
+			maxDeliveries int,
+			err error,
+		)
+	}{
+		{
+			name: "ADMIN_ENABLED not defined",
+			assertions: func(enabled bool, _ string, _ int, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "ADMIN_TOKEN required but not set",
+			setup: func() {
+				t.Setenv("ADMIN_ENABLED", "true")
+			},
+			assertions: func(_ bool, _ string, _ int, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "value not found for")
+				require.Contains(t, err.Error(), "ADMIN_TOKEN")
+			},
+		},
+		{
+			name: "ADMIN_MAX_DELIVERIES not an int",
+			setup: func() {
+				t.Setenv("ADMIN_TOKEN", "foo")
+				t.Setenv("ADMIN_MAX_DELIVERIES", "lots")
+			},
+			assertions: func(_ bool, _ string, _ int, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as an int")
+				require.Contains(t, err.Error(), "ADMIN_MAX_DELIVERIES")
+			},
+		},
+		{
+			name: "ADMIN_MAX_DELIVERIES not positive",
+			setup: func() {
+				t.Setenv("ADMIN_MAX_DELIVERIES", "0")
+			},
+			assertions: func(_ bool, _ string, _ int, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"ADMIN_MAX_DELIVERIES must be positive",
+				)
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("ADMIN_MAX_DELIVERIES", "50")
+			},
+			assertions: func(
+				enabled bool,
+				token string,
+				maxDeliveries int,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(t, "foo", token)
+				require.Equal(t, 50, maxDeliveries)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(adminConfig())
+		})
+	}
+}
+
+func TestRateLimiterConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, webhooks.RateLimiterConfig, error)
+	}{
+		{
+			name: "no limits defined",
+			assertions: func(
+				enabled bool,
+				_ webhooks.RateLimiterConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "RATE_LIMIT_GLOBAL_PER_MINUTE not an int",
+			setup: func() {
+				t.Setenv("RATE_LIMIT_GLOBAL_PER_MINUTE", "lots")
+			},
+			assertions: func(_ bool, _ webhooks.RateLimiterConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as an int")
+				require.Contains(t, err.Error(), "RATE_LIMIT_GLOBAL_PER_MINUTE")
+			},
+		},
+		{
+			name: "RATE_LIMIT_GLOBAL_PER_MINUTE negative",
+			setup: func() {
+				t.Setenv("RATE_LIMIT_GLOBAL_PER_MINUTE", "-1")
+			},
+			assertions: func(_ bool, _ webhooks.RateLimiterConfig, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"RATE_LIMIT_GLOBAL_PER_MINUTE must not be negative",
+				)
+			},
+		},
+		{
+			name: "RATE_LIMIT_PER_REPO_BURST negative",
+			setup: func() {
+				t.Setenv("RATE_LIMIT_GLOBAL_PER_MINUTE", "600")
+				t.Setenv("RATE_LIMIT_PER_REPO_PER_MINUTE", "60")
+				t.Setenv("RATE_LIMIT_PER_REPO_BURST", "-1")
+			},
+			assertions: func(_ bool, _ webhooks.RateLimiterConfig, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"RATE_LIMIT_PER_REPO_BURST must not be negative",
+				)
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("RATE_LIMIT_PER_REPO_BURST", "10")
+			},
+			assertions: func(
+				enabled bool,
+				config webhooks.RateLimiterConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					webhooks.RateLimiterConfig{
+						Global:  webhooks.RateLimit{PerMinute: 600, Burst: 600},
+						PerRepo: webhooks.RateLimit{PerMinute: 60, Burst: 10},
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(rateLimiterConfig())
+		})
+	}
+}
+
+func TestWebhookSecretConfig(t *testing.T) {
+	require.Empty(t, webhookSecretConfig())
+	t.Setenv("WEBHOOK_SECRET", "foo")
+	require.Equal(t, "foo", webhookSecretConfig())
+}
+
+func TestBitbucketClientConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bitbucket.ClientConfig, error)
+	}{
+		{
+			name: "no credentials defined",
+			assertions: func(_ bitbucket.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "BITBUCKET_ACCESS_TOKEN or")
+			},
+		},
+		{
+			name: "BITBUCKET_APP_PASSWORD not defined",
+			setup: func() {
+				t.Setenv("BITBUCKET_USERNAME", "foo")
+			},
+			assertions: func(_ bitbucket.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "BITBUCKET_APP_PASSWORD")
+			},
+		},
+		{
+			name: "username and app password defined",
+			setup: func() {
+				t.Setenv("BITBUCKET_APP_PASSWORD", "bar")
+			},
+			assertions: func(config bitbucket.ClientConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					bitbucket.ClientConfig{
+						APIAddress:  bitbucket.DefaultAPIAddress,
+						Username:    "foo",
+						AppPassword: "bar",
+					},
+					config,
+				)
+			},
+		},
+		{
+			name: "access token defined",
+			setup: func() {
+				t.Setenv("BITBUCKET_API_ADDRESS", "https://bitbucket.example.com")
+				t.Setenv("BITBUCKET_ACCESS_TOKEN", "bat")
+			},
+			assertions: func(config bitbucket.ClientConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					bitbucket.ClientConfig{
+						APIAddress:  "https://bitbucket.example.com",
+						AccessToken: "bat",
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(bitbucketClientConfig())
+		})
+	}
+}
+
+func TestWebhookRegistrationConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, bitbucket.ReconcilerConfig, error)
+	}{
+		{
+			name: "WEBHOOK_REGISTRATION_ENABLED not defined",
+			assertions: func(enabled bool, _ bitbucket.ReconcilerConfig, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "WEBHOOK_REGISTRATION_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("WEBHOOK_REGISTRATION_ENABLED", "nope")
+			},
+			assertions: func(_ bool, _ bitbucket.ReconcilerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "WEBHOOK_REGISTRATION_ENABLED")
+			},
+		},
+		{
+			name: "WEBHOOK_REGISTRATION_URL not defined",
+			setup: func() {
+				t.Setenv("WEBHOOK_REGISTRATION_ENABLED", "true")
+			},
+			assertions: func(_ bool, _ bitbucket.ReconcilerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "WEBHOOK_REGISTRATION_URL")
+			},
+		},
+		{
+			name: "no repositories or workspaces defined",
+			setup: func() {
+				t.Setenv(
+					"WEBHOOK_REGISTRATION_URL",
+					"https://gateway.example.com/events",
+				)
+			},
+			assertions: func(_ bool, _ bitbucket.ReconcilerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"WEBHOOK_REGISTRATION_REPOS or WEBHOOK_REGISTRATION_WORKSPACES",
+				)
+			},
+		},
+		{
+			name: "WEBHOOK_REGISTRATION_REPOS invalid",
+			setup: func() {
+				t.Setenv("WEBHOOK_REGISTRATION_REPOS", "example-org/a,example")
+			},
+			assertions: func(_ bool, _ bitbucket.ReconcilerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), `"example" is not`)
+			},
+		},
+		{
+			name: "WEBHOOK_REGISTRATION_INTERVAL not positive",
+			setup: func() {
+				t.Setenv("WEBHOOK_REGISTRATION_REPOS", "example-org/a")
+				t.Setenv("WEBHOOK_REGISTRATION_INTERVAL", "0s")
+			},
+			assertions: func(_ bool, _ bitbucket.ReconcilerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("WEBHOOK_REGISTRATION_WORKSPACES", "another-org")
+				t.Setenv("WEBHOOK_REGISTRATION_INTERVAL", "30m")
+				t.Setenv("WEBHOOK_SECRET", "foo")
+			},
+			assertions: func(
+				enabled bool,
+				config bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					bitbucket.ReconcilerConfig{
+						Repos:       []string{"example-org/a"},
+						Workspaces:  []string{"another-org"},
+						URL:         "https://gateway.example.com/events",
+						Description: bitbucket.DefaultWebhookDescription,
+						Events:      webhooks.SupportedEventKeys(),
+						Secret:      "foo",
+						Interval:    30 * time.Minute,
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(webhookRegistrationConfig())
+		})
+	}
+}
+
+func TestSubscriptionAuditConfig(t *testing.T) {
+	projectMappingsPath := filepath.Join(t.TempDir(), "project-mappings.yaml")
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(
+			bool,
+			subscriptions.AuditorConfig,
+			bitbucket.ReconcilerConfig,
+			error,
+		)
+	}{
+		{
+			name: "SUBSCRIPTION_AUDIT_ENABLED not defined",
+			assertions: func(
+				enabled bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "SUBSCRIPTION_AUDIT_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("SUBSCRIPTION_AUDIT_ENABLED", "nope")
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "SUBSCRIPTION_AUDIT_ENABLED")
+			},
+		},
+		{
+			name: "dry run mode enabled",
+			setup: func() {
+				t.Setenv("SUBSCRIPTION_AUDIT_ENABLED", "true")
+				t.Setenv("DRY_RUN", "true")
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "not supported in dry run mode")
+			},
+		},
+		{
+			name: "WEBHOOK_REGISTRATION_URL not defined",
+			setup: func() {
+				t.Setenv("DRY_RUN", "false")
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "WEBHOOK_REGISTRATION_URL")
+			},
+		},
+		{
+			name: "SUBSCRIPTION_AUDIT_INTERVAL not positive",
+			setup: func() {
+				t.Setenv(
+					"WEBHOOK_REGISTRATION_URL",
+					"https://gateway.example.com/events",
+				)
+				t.Setenv("SUBSCRIPTION_AUDIT_INTERVAL", "-1m")
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "SUBSCRIPTION_AUDIT_RECONCILE not a bool",
+			setup: func() {
+				t.Setenv("SUBSCRIPTION_AUDIT_INTERVAL", "5m")
+				t.Setenv("SUBSCRIPTION_AUDIT_RECONCILE", "nope")
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "SUBSCRIPTION_AUDIT_RECONCILE")
+			},
+		},
+		{
+			name: "reconciling while webhook registration is enabled",
+			setup: func() {
+				t.Setenv("SUBSCRIPTION_AUDIT_RECONCILE", "true")
+				t.Setenv("WEBHOOK_REGISTRATION_ENABLED", "true")
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "mutually exclusive")
+			},
+		},
+		{
+			name: "PROJECT_MAPPINGS_PATH refers to non-existent file",
+			setup: func() {
+				t.Setenv("WEBHOOK_REGISTRATION_ENABLED", "false")
+				t.Setenv("PROJECT_MAPPINGS_PATH", projectMappingsPath)
+			},
+			assertions: func(
+				_ bool,
+				_ subscriptions.AuditorConfig,
+				_ bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error opening")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				writeFile(
+					t,
+					projectMappingsPath,
+					"- repo: example-org/*\n  project: example\n",
+				)
+				t.Setenv("WEBHOOK_REGISTRATION_REPOS", "example-org/a")
+				t.Setenv("WEBHOOK_SECRET", "foo")
+			},
+			assertions: func(
+				enabled bool,
+				auditorConfig subscriptions.AuditorConfig,
+				reconcilerConfig bitbucket.ReconcilerConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					subscriptions.AuditorConfig{
+						Source:          webhooks.DefaultSource,
+						SupportedEvents: webhooks.SupportedEventKeys(),
+						Repos:           []string{"example-org/a"},
+						ProjectMappings: []webhooks.ProjectMapping{
+							{
+								Repo:    "example-org/*",
+								Project: "example",
+							},
+						},
+						Interval:  5 * time.Minute,
+						Reconcile: true,
+					},
+					auditorConfig,
+				)
+				require.Equal(
+					t,
+					bitbucket.ReconcilerConfig{
+						Repos:       []string{"example-org/a"},
+						URL:         "https://gateway.example.com/events",
+						Description: bitbucket.DefaultWebhookDescription,
+						Events:      webhooks.SupportedEventKeys(),
+						Secret:      "foo",
+					},
+					reconcilerConfig,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(subscriptionAuditConfig())
+		})
+	}
+}
+
+func TestPollingConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, polling.PollerConfig, error)
+	}{
+		{
+			name: "POLLING_ENABLED not defined",
+			assertions: func(enabled bool, _ polling.PollerConfig, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "POLLING_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("POLLING_ENABLED", "nope")
+			},
+			assertions: func(_ bool, _ polling.PollerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "POLLING_ENABLED")
+			},
+		},
+		{
+			name: "POLLING_REPOS not defined",
+			setup: func() {
+				t.Setenv("POLLING_ENABLED", "true")
+			},
+			assertions: func(_ bool, _ polling.PollerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "POLLING_REPOS must be specified")
+			},
+		},
+		{
+			name: "POLLING_REPOS invalid",
+			setup: func() {
+				t.Setenv("POLLING_REPOS", "example-org/a,example")
+			},
+			assertions: func(_ bool, _ polling.PollerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), `POLLING_REPOS value "example"`)
+			},
+		},
+		{
+			name: "POLLING_STATE_PATH not defined",
+			setup: func() {
+				t.Setenv("POLLING_REPOS", "example-org/a,example-org/b")
+			},
+			assertions: func(_ bool, _ polling.PollerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "POLLING_STATE_PATH")
+			},
+		},
+		{
+			name: "POLLING_INTERVAL not positive",
+			setup: func() {
+				t.Setenv("POLLING_STATE_PATH", "/var/lib/gateway/state.json")
+				t.Setenv("POLLING_INTERVAL", "0s")
+			},
+			assertions: func(_ bool, _ polling.PollerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("POLLING_INTERVAL", "30s")
+			},
+			assertions: func(enabled bool, config polling.PollerConfig, err error) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					polling.PollerConfig{
+						Repos:     []string{"example-org/a", "example-org/b"},
+						Interval:  30 * time.Second,
+						StatePath: "/var/lib/gateway/state.json",
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(pollingConfig())
+		})
+	}
+}
+
+func TestRelayConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, relay.ClientConfig, error)
+	}{
+		{
+			name: "RELAY_ENABLED not defined",
+			assertions: func(enabled bool, _ relay.ClientConfig, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "RELAY_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("RELAY_ENABLED", "nope")
+			},
+			assertions: func(_ bool, _ relay.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "RELAY_ENABLED")
+			},
+		},
+		{
+			name: "RELAY_ADDRESS not defined",
+			setup: func() {
+				t.Setenv("RELAY_ENABLED", "true")
+			},
+			assertions: func(_ bool, _ relay.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "RELAY_ADDRESS")
+			},
+		},
+		{
+			name: "RELAY_TOKEN not defined",
+			setup: func() {
+				t.Setenv("RELAY_ADDRESS", "https://relay.example.com")
+			},
+			assertions: func(_ bool, _ relay.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "RELAY_TOKEN")
+			},
+		},
+		{
+			name: "RELAY_RETRY_INTERVAL not positive",
+			setup: func() {
+				t.Setenv("RELAY_TOKEN", "foo")
+				t.Setenv("RELAY_RETRY_INTERVAL", "0s")
+			},
+			assertions: func(_ bool, _ relay.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "RELAY_MAX_CONCURRENCY not positive",
+			setup: func() {
+				t.Setenv("RELAY_RETRY_INTERVAL", "10s")
+				t.Setenv("RELAY_MAX_CONCURRENCY", "0")
+			},
+			assertions: func(_ bool, _ relay.ClientConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("RELAY_MAX_CONCURRENCY", "5")
+			},
+			assertions: func(enabled bool, config relay.ClientConfig, err error) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					relay.ClientConfig{
+						Address:        "https://relay.example.com",
+						Token:          "foo",
+						RetryInterval:  10 * time.Second,
+						MaxConcurrency: 5,
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(relayConfig())
+		})
+	}
+}
+
+func TestRelayServerConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(relay.ServerConfig, error)
+	}{
+		{
+			name: "RELAY_SERVER_TOKEN not defined",
+			assertions: func(_ relay.ServerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "RELAY_SERVER_TOKEN")
+			},
+		},
+		{
+			name: "RELAY_SERVER_RESPONSE_TIMEOUT not positive",
+			setup: func() {
+				t.Setenv("RELAY_SERVER_TOKEN", "foo")
+				t.Setenv("RELAY_SERVER_RESPONSE_TIMEOUT", "0s")
+			},
+			assertions: func(_ relay.ServerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+				require.Contains(t, err.Error(), "RELAY_SERVER_RESPONSE_TIMEOUT")
+			},
+		},
+		{
+			name: "RELAY_SERVER_MAX_PENDING not positive",
+			setup: func() {
+				t.Setenv("RELAY_SERVER_RESPONSE_TIMEOUT", "5s")
+				t.Setenv("RELAY_SERVER_MAX_PENDING", "0")
+			},
+			assertions: func(_ relay.ServerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+				require.Contains(t, err.Error(), "RELAY_SERVER_MAX_PENDING")
+			},
+		},
 		{
 			name: "success",
 			setup: func() {
-				t.Setenv("API_TOKEN", "bar")
-				t.Setenv("API_IGNORE_CERT_WARNINGS", "true")
+				t.Setenv("RELAY_SERVER_MAX_PENDING", "20")
+			},
+			assertions: func(config relay.ServerConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					relay.ServerConfig{
+						Token:           "foo",
+						ResponseTimeout: 5 * time.Second,
+						MaxPending:      20,
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(relayServerConfig())
+		})
+	}
+}
+
+func TestConnectConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, connect.AppConfig, error)
+	}{
+		{
+			name: "CONNECT_ENABLED not defined",
+			assertions: func(enabled bool, _ connect.AppConfig, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "CONNECT_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("CONNECT_ENABLED", "nope")
 			},
-			assertions: func(
-				address string,
-				token string,
-				opts restmachinery.APIClientOptions,
-				err error,
-			) {
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "CONNECT_ENABLED")
+			},
+		},
+		{
+			name: "CONNECT_BASE_URL not defined",
+			setup: func() {
+				t.Setenv("CONNECT_ENABLED", "true")
+			},
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "CONNECT_BASE_URL")
+			},
+		},
+		{
+			name: "CONNECT_BASE_URL has a path",
+			setup: func() {
+				t.Setenv("CONNECT_BASE_URL", "https://gateway.example.com/foo")
+			},
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "without a path")
+			},
+		},
+		{
+			name: "CONNECT_BASE_URL not absolute",
+			setup: func() {
+				t.Setenv("CONNECT_BASE_URL", "gateway.example.com")
+			},
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "not an absolute URL")
+			},
+		},
+		{
+			name: "CONNECT_INSTALLATIONS_PATH not defined",
+			setup: func() {
+				t.Setenv("CONNECT_BASE_URL", "https://gateway.example.com/")
+			},
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "CONNECT_INSTALLATIONS_PATH")
+			},
+		},
+		{
+			name: "CONNECT_ALLOWED_WORKSPACES not defined",
+			setup: func() {
+				t.Setenv(
+					"CONNECT_INSTALLATIONS_PATH",
+					"/var/lib/gateway/installations.json",
+				)
+			},
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "CONNECT_ALLOWED_WORKSPACES")
+			},
+		},
+		{
+			name: "ALLOWED_CLIENT_IPS not defined",
+			setup: func() {
+				t.Setenv("CONNECT_ALLOWED_WORKSPACES", "example-org,another-org")
+			},
+			assertions: func(_ bool, _ connect.AppConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "ALLOWED_CLIENT_IPS")
+			},
+		},
+		{
+			name: "success with defaults",
+			setup: func() {
+				t.Setenv("ALLOWED_CLIENT_IPS", "192.0.2.0/24")
+			},
+			assertions: func(enabled bool, config connect.AppConfig, err error) {
 				require.NoError(t, err)
-				require.Equal(t, "foo", address)
-				require.Equal(t, "bar", token)
-				require.True(t, opts.AllowInsecureConnections)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					connect.AppConfig{
+						Key:               connect.DefaultKey,
+						Name:              connect.DefaultName,
+						BaseURL:           "https://gateway.example.com",
+						Events:            webhooks.SupportedEventKeys(),
+						InstallationsPath: "/var/lib/gateway/installations.json",
+						AllowedWorkspaces: []string{"example-org", "another-org"},
+						APIAddress:        bitbucket.DefaultAPIAddress,
+					},
+					config,
+				)
+			},
+		},
+		{
+			name: "success with overrides",
+			setup: func() {
+				t.Setenv("CONNECT_APP_KEY", "example-gateway")
+				t.Setenv("CONNECT_APP_NAME", "Example Gateway")
+				t.Setenv("BITBUCKET_API_ADDRESS", "https://bitbucket.example.com")
+			},
+			assertions: func(_ bool, config connect.AppConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "example-gateway", config.Key)
+				require.Equal(t, "Example Gateway", config.Name)
+				require.Equal(t, "https://bitbucket.example.com", config.APIAddress)
 			},
 		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
-			testCase.setup()
-			address, token, opts, err := apiClientConfig()
-			testCase.assertions(address, token, opts, err)
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(connectConfig())
 		})
 	}
 }
@@ -88,16 +1777,17 @@ func TestIPFilterConfig(t *testing.T) {
 	testCases := []struct {
 		name       string
 		setup      func()
-		assertions func(http.IPFilterConfig, error)
+		assertions func(ipfilter.Config, error)
 	}{
 		{
 			name: "ALLOWED_CLIENT_IPS not defined",
-			assertions: func(config http.IPFilterConfig, err error) {
+			assertions: func(config ipfilter.Config, err error) {
 				require.NoError(t, err)
 				require.Equal(
 					t,
-					http.IPFilterConfig{
-						AllowedRanges: []net.IPNet{},
+					ipfilter.Config{
+						AllowedRanges:  []net.IPNet{},
+						TrustedProxies: []net.IPNet{},
 					},
 					config,
 				)
@@ -108,13 +1798,34 @@ func TestIPFilterConfig(t *testing.T) {
 			setup: func() {
 				t.Setenv("ALLOWED_CLIENT_IPS", "192.168.1.0/24,0.0.0.0/0")
 			},
-			assertions: func(config http.IPFilterConfig, err error) {
+			assertions: func(config ipfilter.Config, err error) {
 				require.NoError(t, err)
 				require.Len(t, config.AllowedRanges, 2)
 				require.Equal(t, "192.168.1.0/24", config.AllowedRanges[0].String())
 				require.Equal(t, "0.0.0.0/0", config.AllowedRanges[1].String())
 			},
 		},
+		{
+			name: "TRUSTED_PROXIES not parsable",
+			setup: func() {
+				t.Setenv("TRUSTED_PROXIES", "foo")
+			},
+			assertions: func(_ ipfilter.Config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "TRUSTED_PROXIES")
+			},
+		},
+		{
+			name: "TRUSTED_PROXIES defined",
+			setup: func() {
+				t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+			},
+			assertions: func(config ipfilter.Config, err error) {
+				require.NoError(t, err)
+				require.Len(t, config.TrustedProxies, 1)
+				require.Equal(t, "10.0.0.0/8", config.TrustedProxies[0].String())
+			},
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -126,18 +1837,184 @@ func TestIPFilterConfig(t *testing.T) {
 	}
 }
 
+func TestIPRangesRefresherConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(bool, ipfilter.RefresherConfig, error)
+	}{
+		{
+			name: "IP_RANGES_REFRESH_ENABLED not defined",
+			assertions: func(enabled bool, _ ipfilter.RefresherConfig, err error) {
+				require.NoError(t, err)
+				require.False(t, enabled)
+			},
+		},
+		{
+			name: "IP_RANGES_REFRESH_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("IP_RANGES_REFRESH_ENABLED", "nope")
+			},
+			assertions: func(_ bool, _ ipfilter.RefresherConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "IP_RANGES_REFRESH_ENABLED")
+			},
+		},
+		{
+			name: "IP_RANGES_REFRESH_INTERVAL not positive",
+			setup: func() {
+				t.Setenv("IP_RANGES_REFRESH_ENABLED", "true")
+				t.Setenv("IP_RANGES_REFRESH_INTERVAL", "0s")
+			},
+			assertions: func(_ bool, _ ipfilter.RefresherConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "IP_RANGES_SOURCE not defined",
+			setup: func() {
+				t.Setenv("IP_RANGES_REFRESH_INTERVAL", "6h")
+			},
+			assertions: func(
+				enabled bool,
+				config ipfilter.RefresherConfig,
+				err error,
+			) {
+				require.NoError(t, err)
+				require.True(t, enabled)
+				require.Equal(
+					t,
+					ipfilter.RefresherConfig{
+						Source:   ipfilter.AtlassianIPRangesURL,
+						Interval: 6 * time.Hour,
+					},
+					config,
+				)
+			},
+		},
+		{
+			name: "IP_RANGES_SOURCE defined",
+			setup: func() {
+				t.Setenv("IP_RANGES_SOURCE", "/app/config/ip-ranges.json")
+			},
+			assertions: func(_ bool, config ipfilter.RefresherConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "/app/config/ip-ranges.json", config.Source)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(ipRangesRefresherConfig())
+		})
+	}
+}
+
+func TestReadinessCheckerConfig(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(readiness.CheckerConfig, error)
+	}{
+		{
+			name: "defaults",
+			assertions: func(config readiness.CheckerConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					readiness.CheckerConfig{
+						Interval: 30 * time.Second,
+						Timeout:  10 * time.Second,
+					},
+					config,
+				)
+			},
+		},
+		{
+			name: "READINESS_CHECK_INTERVAL not parsable as duration",
+			setup: func() {
+				t.Setenv("READINESS_CHECK_INTERVAL", "often")
+			},
+			assertions: func(_ readiness.CheckerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a duration")
+				require.Contains(t, err.Error(), "READINESS_CHECK_INTERVAL")
+			},
+		},
+		{
+			name: "READINESS_CHECK_INTERVAL not positive",
+			setup: func() {
+				t.Setenv("READINESS_CHECK_INTERVAL", "0s")
+			},
+			assertions: func(_ readiness.CheckerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"READINESS_CHECK_INTERVAL must be positive",
+				)
+			},
+		},
+		{
+			name: "READINESS_CHECK_TIMEOUT not positive",
+			setup: func() {
+				t.Setenv("READINESS_CHECK_INTERVAL", "1m")
+				t.Setenv("READINESS_CHECK_TIMEOUT", "-1s")
+			},
+			assertions: func(_ readiness.CheckerConfig, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"READINESS_CHECK_TIMEOUT must be positive",
+				)
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("READINESS_CHECK_TIMEOUT", "5s")
+			},
+			assertions: func(config readiness.CheckerConfig, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					readiness.CheckerConfig{
+						Interval: time.Minute,
+						Timeout:  5 * time.Second,
+					},
+					config,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(readinessCheckerConfig())
+		})
+	}
+}
+
 func TestServerConfig(t *testing.T) {
 	testCases := []struct {
 		name       string
 		setup      func()
-		assertions func(http.ServerConfig, error)
+		assertions func(server.Config, error)
 	}{
 		{
 			name: "PORT not an int",
 			setup: func() {
 				t.Setenv("PORT", "foo")
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ server.Config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "was not parsable as an int")
 				require.Contains(t, err.Error(), "PORT")
@@ -149,7 +2026,7 @@ func TestServerConfig(t *testing.T) {
 				t.Setenv("PORT", "8080")
 				t.Setenv("TLS_ENABLED", "nope")
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ server.Config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "was not parsable as a bool")
 				require.Contains(t, err.Error(), "TLS_ENABLED")
@@ -160,7 +2037,7 @@ func TestServerConfig(t *testing.T) {
 			setup: func() {
 				t.Setenv("TLS_ENABLED", "true")
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ server.Config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "value not found for")
 				require.Contains(t, err.Error(), "TLS_CERT_PATH")
@@ -171,31 +2048,127 @@ func TestServerConfig(t *testing.T) {
 			setup: func() {
 				t.Setenv("TLS_CERT_PATH", "/var/ssl/cert")
 			},
-			assertions: func(_ http.ServerConfig, err error) {
+			assertions: func(_ server.Config, err error) {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), "value not found for")
 				require.Contains(t, err.Error(), "TLS_KEY_PATH")
 			},
 		},
 		{
-			name: "success",
+			name: "TLS_CERT_POLL_INTERVAL not positive",
 			setup: func() {
 				t.Setenv("TLS_KEY_PATH", "/var/ssl/key")
+				t.Setenv("TLS_CERT_POLL_INTERVAL", "-1s")
+			},
+			assertions: func(_ server.Config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must be positive")
+			},
+		},
+		{
+			name: "TLS_MIN_VERSION unsupported",
+			setup: func() {
+				t.Setenv("TLS_CERT_POLL_INTERVAL", "1m")
+				t.Setenv("TLS_MIN_VERSION", "1.1")
+			},
+			assertions: func(_ server.Config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "TLS_MIN_VERSION")
+				require.Contains(t, err.Error(), "unsupported TLS version")
+			},
+		},
+		{
+			name: "TLS_CIPHER_SUITES contains unsupported cipher suite",
+			setup: func() {
+				t.Setenv("TLS_MIN_VERSION", "1.3")
+				t.Setenv("TLS_CIPHER_SUITES", "TLS_RSA_WITH_RC4_128_SHA")
+			},
+			assertions: func(_ server.Config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "TLS_CIPHER_SUITES")
+				require.Contains(t, err.Error(), "unsupported cipher suite")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv(
+					"TLS_CIPHER_SUITES",
+					"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,"+
+						"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+				)
 			},
-			assertions: func(config http.ServerConfig, err error) {
+			assertions: func(config server.Config, err error) {
 				require.NoError(t, err)
 				require.Equal(
 					t,
-					http.ServerConfig{
-						Port:        8080,
-						TLSEnabled:  true,
-						TLSCertPath: "/var/ssl/cert",
-						TLSKeyPath:  "/var/ssl/key",
+					server.Config{
+						Port:                8080,
+						TLSEnabled:          true,
+						TLSCertPath:         "/var/ssl/cert",
+						TLSKeyPath:          "/var/ssl/key",
+						TLSCertPollInterval: time.Minute,
+						TLSMinVersion:       tls.VersionTLS13,
+						TLSCipherSuites: []uint16{
+							tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+							tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+						},
 					},
 					config,
 				)
 			},
 		},
+		{
+			name: "PROXY_PROTOCOL_ENABLED not a bool",
+			setup: func() {
+				t.Setenv("PROXY_PROTOCOL_ENABLED", "nope")
+			},
+			assertions: func(_ server.Config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "was not parsable as a bool")
+				require.Contains(t, err.Error(), "PROXY_PROTOCOL_ENABLED")
+			},
+		},
+		{
+			name: "PROXY_PROTOCOL_TRUSTED_SOURCES not defined",
+			setup: func() {
+				t.Setenv("PROXY_PROTOCOL_ENABLED", "true")
+			},
+			assertions: func(_ server.Config, err error) {
+				require.Error(t, err)
+				require.Contains(
+					t,
+					err.Error(),
+					"PROXY_PROTOCOL_TRUSTED_SOURCES must be specified",
+				)
+			},
+		},
+		{
+			name: "PROXY_PROTOCOL_TRUSTED_SOURCES not parsable",
+			setup: func() {
+				t.Setenv("PROXY_PROTOCOL_TRUSTED_SOURCES", "foo")
+			},
+			assertions: func(_ server.Config, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "PROXY_PROTOCOL_TRUSTED_SOURCES")
+			},
+		},
+		{
+			name: "success with PROXY protocol",
+			setup: func() {
+				t.Setenv("PROXY_PROTOCOL_TRUSTED_SOURCES", "10.0.0.0/8")
+			},
+			assertions: func(config server.Config, err error) {
+				require.NoError(t, err)
+				require.True(t, config.ProxyProtocolEnabled)
+				require.Len(t, config.ProxyProtocolTrustedSources, 1)
+				require.Equal(
+					t,
+					"10.0.0.0/8",
+					config.ProxyProtocolTrustedSources[0].String(),
+				)
+			},
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -205,3 +2178,8 @@ func TestServerConfig(t *testing.T) {
 		})
 	}
 }
+
+// writeFile writes the provided contents to the specified file.
+func writeFile(t *testing.T, path string, contents string) {
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0600))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/brigade"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/brigadecore/brigade-foundations/os"
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	"github.com/pkg/errors"
+)
+
+// diagnosis is the outcome of a single check performed by the doctor
+// subcommand.
+type diagnosis struct {
+	// check describes what was checked.
+	check string
+	// err is the problem that was found, if any.
+	err error
+	// note, if non-empty, is additional information about a check that passed.
+	note string
+	// hint suggests how the problem that was found, if any, can be remedied.
+	hint string
+}
+
+// doctor implements the doctor subcommand, which diagnoses common problems
+// with a gateway's configuration and its access to Brigade using the same
+// configuration as the gateway itself. A report is written to the provided
+// io.Writer. An error is returned if any problem was found.
+func doctor(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(
+			flags.Output(),
+			"Usage: bitbucket-gateway doctor [options]\n\n"+
+				"Diagnoses problems with the gateway's configuration and its "+
+				"access to Brigade.\n\nOptions:\n",
+		)
+		flags.PrintDefaults()
+	}
+	timeout := flags.Duration(
+		"timeout",
+		10*time.Second,
+		"how long to wait for each request to a Brigade API server",
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	diagnoses := []diagnosis{diagnoseConfig()}
+	diagnoses = append(diagnoses, diagnoseBrigadeAPIs(ctx, *timeout)...)
+	diagnoses = append(diagnoses, diagnoseServerTLS(time.Now()))
+	diagnoses = append(diagnoses, diagnoseIPRanges()...)
+
+	var failed int
+	for _, d := range diagnoses {
+		if d.err == nil {
+			fmt.Fprintf(out, "[PASS] %s\n", d.check)
+			if d.note != "" {
+				fmt.Fprintf(out, "       %s\n", d.note)
+			}
+			continue
+		}
+		failed++
+		fmt.Fprintf(
+			out,
+			"[FAIL] %s\n       %s\n",
+			d.check,
+			// Indent every line of multi-line errors
+			strings.ReplaceAll(d.err.Error(), "\n", "\n       "),
+		)
+		if d.hint != "" {
+			fmt.Fprintf(out, "       Hint: %s\n", d.hint)
+		}
+	}
+	fmt.Fprintf(
+		out,
+		"\n%d checks passed; %d failed\n",
+		len(diagnoses)-failed,
+		failed,
+	)
+	if failed > 0 {
+		return errors.Errorf("%d problem(s) found", failed)
+	}
+	return nil
+}
+
+// diagnoseConfig validates all of the gateway's configuration.
+func diagnoseConfig() diagnosis {
+	return diagnosis{
+		check: "configuration is valid",
+		err:   validateConfig(),
+		hint: "correct the problems listed; see docs/CONFIGURATION.md for " +
+			"details of every setting",
+	}
+}
+
+// diagnoseBrigadeAPIs checks that every Brigade API server the gateway emits
+// events into is reachable, accepts the gateway's token, and permits the
+// gateway to create events from the configured source.
+func diagnoseBrigadeAPIs(
+	ctx context.Context,
+	timeout time.Duration,
+) []diagnosis {
+	const check = "Brigade API access"
+	dryRun, err := dryRunConfig()
+	if err != nil {
+		return []diagnosis{{check: check, err: err}}
+	}
+	if dryRun {
+		return []diagnosis{{
+			check: check,
+			note:  "skipped; events are never emitted into Brigade in dry run mode",
+		}}
+	}
+	tenants, err := tenantsConfig()
+	if err != nil {
+		return []diagnosis{{check: check, err: err}}
+	}
+	source := os.GetEnvVar("EVENT_SOURCE", webhooks.DefaultSource)
+	if len(tenants) == 0 {
+		description := fmt.Sprintf(
+			"Brigade API at %s",
+			os.GetEnvVar("API_ADDRESS", ""),
+		)
+		var client sdk.EventsClient
+		if client, err = newEventsClient(ctx); err != nil {
+			return []diagnosis{{
+				check: fmt.Sprintf("%s: client configuration", description),
+				err:   err,
+				hint:  apiTLSHint,
+			}}
+		}
+		return diagnoseBrigadeAPI(ctx, description, client, source, timeout)
+	}
+	tenantClients, err := newTenantEventsClients()
+	if err != nil {
+		return []diagnosis{{check: check, err: err, hint: apiTLSHint}}
+	}
+	diagnoses := []diagnosis{}
+	for _, tenant := range tenants {
+		diagnoses = append(
+			diagnoses,
+			diagnoseBrigadeAPI(
+				ctx,
+				fmt.Sprintf(
+					"Brigade API at %s for workspace %s",
+					tenant.APIAddress,
+					tenant.Workspace,
+				),
+				tenantClients[tenant.Workspace],
+				source,
+				timeout,
+			)...,
+		)
+	}
+	return diagnoses
+}
+
+// apiTLSHint is the hint offered when a client for a Brigade API server cannot
+// be configured.
+const apiTLSHint = "check that the API token file and any CA certificate, " +
+	"client certificate, and client key files exist and contain PEM-encoded " +
+	"data"
+
+// diagnoseBrigadeAPI checks that the Brigade API server the provided client
+// communicates with is reachable, accepts the client's token, and permits the
+// client to create events from the specified source.
+func diagnoseBrigadeAPI(
+	ctx context.Context,
+	description string,
+	client sdk.EventsClient,
+	source string,
+	timeout time.Duration,
+) []diagnosis {
+	access := diagnosis{
+		check: fmt.Sprintf("%s: reachable and token accepted", description),
+	}
+	if checker, ok := client.(brigade.APIChecker); ok {
+		checkCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		access.err = checker.CheckAPI(checkCtx)
+	}
+	if access.err != nil {
+		if _, ok := errors.Cause(access.err).(*meta.ErrAuthentication); ok {
+			access.hint = "the API token is invalid, has expired, or has been " +
+				"revoked; create a new token for the gateway's service account " +
+				"using `brig service-account create`"
+		} else {
+			access.hint = "check that the API address is correct and reachable " +
+				"from the gateway and, if the API server's certificate is not " +
+				"trusted, specify a CA certificate or ignore certificate warnings"
+		}
+		// There is no point checking anything else
+		return []diagnosis{access}
+	}
+	create := diagnosis{
+		check: fmt.Sprintf(
+			"%s: token may create events with source %s",
+			description,
+			source,
+		),
+	}
+	createCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	create.note, create.err = probeEventCreation(createCtx, client, source)
+	if _, ok := errors.Cause(create.err).(*meta.ErrAuthorization); ok {
+		create.hint = fmt.Sprintf(
+			"grant the gateway's service account permission to create events "+
+				"using `brig role grant EVENT_CREATOR --service-account "+
+				"<service account id> --source %s`",
+			source,
+		)
+	}
+	return []diagnosis{access, create}
+}
+
+// probeEventCreation attempts to create an event from the specified source for
+// a project that does not exist. If the API server reports that the project
+// does not exist, the client must have been permitted to create the event. In
+// the unlikely event that the project does exist, a note to that effect is
+// returned.
+func probeEventCreation(
+	ctx context.Context,
+	client sdk.EventsClient,
+	source string,
+) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating project ID")
+	}
+	projectID := fmt.Sprintf("gateway-doctor-%s", hex.EncodeToString(b))
+	events, err := client.Create(
+		ctx,
+		sdk.Event{
+			ProjectID: projectID,
+			Source:    source,
+			Type:      "doctor",
+		},
+		nil,
+	)
+	if _, ok := errors.Cause(err).(*meta.ErrNotFound); ok {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"a project %s unexpectedly exists; %d event(s) were created for it",
+		projectID,
+		len(events.Items),
+	), nil
+}
+
+// diagnoseServerTLS checks that, if TLS is enabled, the certificate and key
+// the gateway is configured to serve can be loaded and that the certificate
+// has not expired as of the provided time.
+func diagnoseServerTLS(now time.Time) diagnosis {
+	d := diagnosis{check: "TLS certificate and key"}
+	config, err := serverConfig()
+	if err != nil {
+		d.err = err
+		return d
+	}
+	if !config.TLSEnabled {
+		d.note = "skipped; TLS is disabled, so it should be terminated by an " +
+			"ingress controller or load balancer"
+		return d
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath)
+	if err != nil {
+		d.err = errors.Wrap(err, "error loading certificate and key")
+		d.hint = "check that TLS_CERT_PATH and TLS_KEY_PATH refer to a matching " +
+			"PEM-encoded certificate and private key"
+		return d
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		d.err = errors.Wrap(err, "error parsing certificate")
+		return d
+	}
+	if now.After(leaf.NotAfter) {
+		d.err = errors.Errorf(
+			"certificate expired at %s",
+			leaf.NotAfter.Format(time.RFC3339),
+		)
+		d.hint = "renew the certificate; it is reloaded automatically once " +
+			"replaced"
+		return d
+	}
+	d.note = fmt.Sprintf(
+		"certificate expires at %s",
+		leaf.NotAfter.Format(time.RFC3339),
+	)
+	return d
+}
+
+// diagnoseIPRanges checks that all configured IP ranges are valid CIDRs and
+// that webhooks will be accepted from at least some clients.
+func diagnoseIPRanges() []diagnosis {
+	const hint = "specify IP ranges in CIDR notation, e.g. 192.0.2.0/24 or " +
+		"2001:db8::/32, separated by commas"
+	diagnoses := []diagnosis{}
+	for _, envVar := range []string{
+		"ALLOWED_CLIENT_IPS",
+		"TRUSTED_PROXIES",
+		"PROXY_PROTOCOL_TRUSTED_SOURCES",
+	} {
+		ranges, err := os.GetIPNetSliceFromEnvVar(envVar, []net.IPNet{})
+		d := diagnosis{
+			check: fmt.Sprintf("%s are valid CIDRs", envVar),
+			err:   err,
+		}
+		if err != nil {
+			d.hint = hint
+		} else {
+			d.note = fmt.Sprintf("%d range(s) specified", len(ranges))
+		}
+		diagnoses = append(diagnoses, d)
+	}
+	allowedRanges, err :=
+		os.GetIPNetSliceFromEnvVar("ALLOWED_CLIENT_IPS", []net.IPNet{})
+	if err != nil {
+		return diagnoses
+	}
+	refreshEnabled, _, err := ipRangesRefresherConfig()
+	d := diagnosis{check: "webhooks are accepted from some client IPs", err: err}
+	if err == nil && len(allowedRanges) == 0 && !refreshEnabled {
+		d.err = errors.New(
+			"no client IPs are allowed, so every webhook will be rejected",
+		)
+		d.hint = "specify Bitbucket's IP ranges using ALLOWED_CLIENT_IPS or " +
+			"enable IP_RANGES_REFRESH_ENABLED to obtain them from Atlassian"
+	}
+	return append(diagnoses, d)
+}
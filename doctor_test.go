@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v3/testing"
+	"github.com/stretchr/testify/require"
+)
+
+// mockAPICheckingEventsClient is a mock sdk.EventsClient that also implements
+// the brigade.APIChecker interface.
+type mockAPICheckingEventsClient struct {
+	sdkTesting.MockEventsClient
+	checkAPIErr error
+}
+
+func (m *mockAPICheckingEventsClient) CheckAPI(context.Context) error {
+	return m.checkAPIErr
+}
+
+func TestDoctor(t *testing.T) {
+	// A stand-in for the Brigade API server that accepts the gateway's token
+	// and reports that the project events are created for does not exist
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Path {
+			case "/v2/whoami":
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte(`{"type":"SERVICE_ACCOUNT","id":"gateway"}`)) // nolint: errcheck
+			case "/v2/events":
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"type":"Project","id":"foo"}`)) // nolint: errcheck
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+	t.Setenv("API_ADDRESS", server.URL)
+	t.Setenv("API_TOKEN", "foo")
+	t.Setenv("ALLOWED_CLIENT_IPS", "192.0.2.0/24")
+	out := &bytes.Buffer{}
+	err := doctor(context.Background(), nil, out)
+	require.NoError(t, err, out.String())
+	require.NotContains(t, out.String(), "[FAIL]")
+	require.Contains(
+		t,
+		out.String(),
+		"[PASS] Brigade API at "+server.URL+": token may create events with "+
+			"source brigade.sh/bitbucket",
+	)
+	require.Contains(t, out.String(), "0 failed")
+
+	// Now with a problem
+	t.Setenv("ALLOWED_CLIENT_IPS", "")
+	out.Reset()
+	err = doctor(context.Background(), nil, out)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 problem(s) found")
+	require.Contains(
+		t,
+		out.String(),
+		"[FAIL] webhooks are accepted from some client IPs",
+	)
+	require.Contains(t, out.String(), "Hint: specify Bitbucket's IP ranges")
+}
+
+func TestDiagnoseBrigadeAPI(t *testing.T) {
+	testCases := []struct {
+		name       string
+		client     sdk.EventsClient
+		assertions func([]diagnosis)
+	}{
+		{
+			name: "token rejected",
+			client: &mockAPICheckingEventsClient{
+				checkAPIErr: &meta.ErrAuthentication{},
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 1)
+				require.Error(t, diagnoses[0].err)
+				require.Contains(t, diagnoses[0].hint, "token is invalid")
+			},
+		},
+		{
+			name: "API server unreachable",
+			client: &mockAPICheckingEventsClient{
+				checkAPIErr: context.DeadlineExceeded,
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 1)
+				require.Error(t, diagnoses[0].err)
+				require.Contains(t, diagnoses[0].hint, "reachable")
+			},
+		},
+		{
+			name: "token may not create events",
+			client: &mockAPICheckingEventsClient{
+				MockEventsClient: sdkTesting.MockEventsClient{
+					CreateFn: func(
+						context.Context,
+						sdk.Event,
+						*sdk.EventCreateOptions,
+					) (sdk.EventList, error) {
+						return sdk.EventList{}, &meta.ErrAuthorization{}
+					},
+				},
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 2)
+				require.NoError(t, diagnoses[0].err)
+				require.Error(t, diagnoses[1].err)
+				require.Contains(t, diagnoses[1].hint, "EVENT_CREATOR")
+				require.Contains(t, diagnoses[1].hint, "--source example.com/foo")
+			},
+		},
+		{
+			name: "token may create events",
+			client: &mockAPICheckingEventsClient{
+				MockEventsClient: sdkTesting.MockEventsClient{
+					CreateFn: func(
+						_ context.Context,
+						event sdk.Event,
+						_ *sdk.EventCreateOptions,
+					) (sdk.EventList, error) {
+						require.Equal(t, "example.com/foo", event.Source)
+						require.NotEmpty(t, event.ProjectID)
+						return sdk.EventList{}, &meta.ErrNotFound{}
+					},
+				},
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 2)
+				require.NoError(t, diagnoses[0].err)
+				require.NoError(t, diagnoses[1].err)
+				require.Empty(t, diagnoses[1].note)
+			},
+		},
+		{
+			name: "project unexpectedly exists",
+			client: &mockAPICheckingEventsClient{
+				MockEventsClient: sdkTesting.MockEventsClient{
+					CreateFn: func(
+						context.Context,
+						sdk.Event,
+						*sdk.EventCreateOptions,
+					) (sdk.EventList, error) {
+						return sdk.EventList{Items: []sdk.Event{{}}}, nil
+					},
+				},
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 2)
+				require.NoError(t, diagnoses[1].err)
+				require.Contains(t, diagnoses[1].note, "unexpectedly exists")
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(
+				diagnoseBrigadeAPI(
+					context.Background(),
+					"Brigade API",
+					testCase.client,
+					"example.com/foo",
+					time.Second,
+				),
+			)
+		})
+	}
+}
+
+func TestDiagnoseServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	notAfter := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	testCases := []struct {
+		name       string
+		setup      func()
+		now        time.Time
+		assertions func(diagnosis)
+	}{
+		{
+			name: "TLS disabled",
+			assertions: func(d diagnosis) {
+				require.NoError(t, d.err)
+				require.Contains(t, d.note, "TLS is disabled")
+			},
+		},
+		{
+			name: "certificate does not exist",
+			setup: func() {
+				t.Setenv("TLS_ENABLED", "true")
+				t.Setenv("TLS_CERT_PATH", certPath)
+				t.Setenv("TLS_KEY_PATH", keyPath)
+			},
+			assertions: func(d diagnosis) {
+				require.Error(t, d.err)
+				require.Contains(t, d.err.Error(), "error loading certificate")
+				require.NotEmpty(t, d.hint)
+			},
+		},
+		{
+			name: "certificate expired",
+			setup: func() {
+				writeSelfSignedCert(t, certPath, keyPath, notAfter)
+			},
+			now: notAfter.Add(time.Minute),
+			assertions: func(d diagnosis) {
+				require.Error(t, d.err)
+				require.Contains(t, d.err.Error(), "certificate expired")
+			},
+		},
+		{
+			name: "success",
+			now:  time.Now(),
+			assertions: func(d diagnosis) {
+				require.NoError(t, d.err)
+				require.Equal(
+					t,
+					"certificate expires at "+notAfter.Format(time.RFC3339),
+					d.note,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(diagnoseServerTLS(testCase.now))
+		})
+	}
+}
+
+func TestDiagnoseIPRanges(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func([]diagnosis)
+	}{
+		{
+			name: "no client IPs allowed",
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 4)
+				for _, d := range diagnoses[:3] {
+					require.NoError(t, d.err)
+				}
+				require.Error(t, diagnoses[3].err)
+				require.Contains(t, diagnoses[3].err.Error(), "every webhook")
+			},
+		},
+		{
+			name: "invalid CIDR",
+			setup: func() {
+				t.Setenv("TRUSTED_PROXIES", "10.0.0.0/33")
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 4)
+				require.Error(t, diagnoses[1].err)
+				require.Contains(t, diagnoses[1].hint, "CIDR notation")
+			},
+		},
+		{
+			name: "IP ranges refreshed",
+			setup: func() {
+				t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+				t.Setenv("IP_RANGES_REFRESH_ENABLED", "true")
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 4)
+				for _, d := range diagnoses {
+					require.NoError(t, d.err)
+				}
+			},
+		},
+		{
+			name: "client IPs allowed",
+			setup: func() {
+				t.Setenv("IP_RANGES_REFRESH_ENABLED", "false")
+				t.Setenv("ALLOWED_CLIENT_IPS", "192.0.2.0/24,2001:db8::/32")
+			},
+			assertions: func(diagnoses []diagnosis) {
+				require.Len(t, diagnoses, 4)
+				for _, d := range diagnoses {
+					require.NoError(t, d.err)
+				}
+				require.Equal(t, "2 range(s) specified", diagnoses[0].note)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(diagnoseIPRanges())
+		})
+	}
+}
+
+// writeSelfSignedCert writes a PEM-encoded, self-signed certificate expiring
+// at the specified time, and its private key, to the specified paths.
+func writeSelfSignedCert(
+	t *testing.T,
+	certPath string,
+	keyPath string,
+	notAfter time.Time,
+) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	certDER, err :=
+		x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(
+		t,
+		os.WriteFile(
+			certPath,
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			0600,
+		),
+	)
+	require.NoError(
+		t,
+		os.WriteFile(
+			keyPath,
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+			0600,
+		),
+	)
+}
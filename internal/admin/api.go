@@ -0,0 +1,156 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// API is an interface for components that expose administrative operations
+// over HTTP.
+type API interface {
+	// ListDeliveries responds with a summary of recently received webhooks and
+	// the outcome of handling each. The optional limit query parameter bounds
+	// the number of deliveries included in the response.
+	ListDeliveries(w http.ResponseWriter, r *http.Request)
+	// Redeliver processes the recently received webhook identified by the uuid
+	// path parameter a second time.
+	Redeliver(w http.ResponseWriter, r *http.Request)
+}
+
+// deliverySummary is a summary of a single webhooks.Delivery.
+type deliverySummary struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	EventKey   string    `json:"eventKey"`
+	Repo       string    `json:"repo,omitempty"`
+	StatusCode int       `json:"statusCode"`
+	Error      string    `json:"error,omitempty"`
+	Latency    string    `json:"latency"`
+	EventIDs   []string  `json:"eventIDs"`
+}
+
+type api struct {
+	deliveries webhooks.RecentDeliveries
+	replayer   webhooks.Replayer
+}
+
+// NewAPI returns an implementation of the API interface that reports on the
+// provided webhooks.RecentDeliveries and uses the provided webhooks.Replayer
+// to redeliver them.
+func NewAPI(
+	deliveries webhooks.RecentDeliveries,
+	replayer webhooks.Replayer,
+) API {
+	return &api{
+		deliveries: deliveries,
+		replayer:   replayer,
+	}
+}
+
+func (a *api) ListDeliveries(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var limit int
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit < 1 {
+			writeJSON(
+				w,
+				http.StatusBadRequest,
+				errorResponse{Error: "limit must be a positive integer"},
+			)
+			return
+		}
+	}
+	deliveries := a.deliveries.List(limit)
+	summaries := make([]deliverySummary, len(deliveries))
+	for i, delivery := range deliveries {
+		summaries[i] = deliverySummary{
+			ID:         delivery.ID,
+			ReceivedAt: delivery.ReceivedAt,
+			EventKey:   delivery.EventKey(),
+			Repo:       delivery.Repo(),
+			StatusCode: delivery.StatusCode,
+			Error:      delivery.Error,
+			Latency:    delivery.Latency.String(),
+			EventIDs:   delivery.EventIDs,
+		}
+		if summaries[i].EventIDs == nil {
+			summaries[i].EventIDs = []string{}
+		}
+	}
+	writeJSON(
+		w,
+		http.StatusOK,
+		struct {
+			Items []deliverySummary `json:"items"`
+		}{
+			Items: summaries,
+		},
+	)
+}
+
+func (a *api) Redeliver(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	id := mux.Vars(r)["uuid"]
+	delivery, ok := a.deliveries.Get(id)
+	if !ok {
+		writeJSON(
+			w,
+			http.StatusNotFound,
+			errorResponse{Error: "no recent delivery found with the specified id"},
+		)
+		return
+	}
+	events, err := a.replayer.Replay(r.Context(), delivery)
+	if err != nil {
+		log.Printf("error redelivering delivery %s: %s", id, err)
+		statusCode := http.StatusInternalServerError
+		// This mirrors how the webhooks handler responds to the same error.
+		if _, ok := errors.Cause(err).(*webhooks.UnknownWorkspaceError); ok {
+			statusCode = http.StatusForbidden
+		}
+		writeJSON(w, statusCode, errorResponse{Error: err.Error()})
+		return
+	}
+	eventIDs := make([]string, len(events.Items))
+	for i, event := range events.Items {
+		eventIDs[i] = event.ID
+	}
+	log.Printf("redelivered delivery %s: event IDs %v", id, eventIDs)
+	writeJSON(
+		w,
+		http.StatusOK,
+		struct {
+			EventIDs []string `json:"eventIDs"`
+		}{
+			EventIDs: eventIDs,
+		},
+	)
+}
+
+// errorResponse is the body of any unsuccessful response.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes the provided status code and the JSON representation of the
+// provided object to the provided http.ResponseWriter.
+func writeJSON(w http.ResponseWriter, statusCode int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	responseJSON, err := json.Marshal(obj)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{}")) // nolint: errcheck
+		return
+	}
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON) // nolint: errcheck
+}
@@ -0,0 +1,201 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type mockReplayer struct {
+	ReplayFn func(context.Context, webhooks.Delivery) (sdk.EventList, error)
+}
+
+func (m *mockReplayer) Replay(
+	ctx context.Context,
+	delivery webhooks.Delivery,
+) (sdk.EventList, error) {
+	return m.ReplayFn(ctx, delivery)
+}
+
+func TestNewAPI(t *testing.T) {
+	deliveries := webhooks.NewRecentDeliveries(1)
+	replayer := &mockReplayer{}
+	a, ok := NewAPI(deliveries, replayer).(*api)
+	require.True(t, ok)
+	require.Same(t, deliveries, a.deliveries)
+	require.Same(t, replayer, a.replayer)
+}
+
+func TestAPIListDeliveries(t *testing.T) {
+	deliveries := webhooks.NewRecentDeliveries(10)
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(
+			t,
+			deliveries.Archive(
+				webhooks.Delivery{
+					ID:         id,
+					ReceivedAt: time.Now(),
+					Headers: http.Header{
+						"X-Event-Key": []string{"repo:push"},
+					},
+					Body:       `{"repository":{"full_name":"example-org/example"}}`,
+					StatusCode: http.StatusOK,
+					EventIDs:   []string{"event-" + id},
+					Latency:    42 * time.Millisecond,
+				},
+			),
+		)
+	}
+	a := NewAPI(deliveries, &mockReplayer{})
+	testCases := []struct {
+		name       string
+		query      string
+		assertions func(*httptest.ResponseRecorder)
+	}{
+		{
+			name:  "invalid limit",
+			query: "?limit=foo",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "no limit",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				list := struct {
+					Items []deliverySummary `json:"items"`
+				}{}
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+				require.Len(t, list.Items, 3)
+				item := list.Items[0]
+				require.Equal(t, "c", item.ID)
+				require.Equal(t, "repo:push", item.EventKey)
+				require.Equal(t, "example-org/example", item.Repo)
+				require.Equal(t, http.StatusOK, item.StatusCode)
+				require.Equal(t, "42ms", item.Latency)
+				require.Equal(t, []string{"event-c"}, item.EventIDs)
+			},
+		},
+		{
+			name:  "with limit",
+			query: "?limit=2",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				list := struct {
+					Items []deliverySummary `json:"items"`
+				}{}
+				require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+				require.Len(t, list.Items, 2)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			a.ListDeliveries(
+				rr,
+				httptest.NewRequest(
+					http.MethodGet,
+					"/admin/deliveries"+testCase.query,
+					nil,
+				),
+			)
+			testCase.assertions(rr)
+		})
+	}
+}
+
+func TestAPIRedeliver(t *testing.T) {
+	deliveries := webhooks.NewRecentDeliveries(10)
+	require.NoError(t, deliveries.Archive(webhooks.Delivery{ID: "abc"}))
+	testCases := []struct {
+		name       string
+		id         string
+		replayer   webhooks.Replayer
+		assertions func(*httptest.ResponseRecorder)
+	}{
+		{
+			name: "delivery not found",
+			id:   "xyz",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNotFound, rr.Code)
+			},
+		},
+		{
+			name: "error replaying delivery",
+			id:   "abc",
+			replayer: &mockReplayer{
+				ReplayFn: func(
+					context.Context,
+					webhooks.Delivery,
+				) (sdk.EventList, error) {
+					return sdk.EventList{}, errors.New("something went wrong")
+				},
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusInternalServerError, rr.Code)
+				require.Contains(t, rr.Body.String(), "something went wrong")
+			},
+		},
+		{
+			name: "unknown workspace",
+			id:   "abc",
+			replayer: &mockReplayer{
+				ReplayFn: func(
+					context.Context,
+					webhooks.Delivery,
+				) (sdk.EventList, error) {
+					return sdk.EventList{},
+						&webhooks.UnknownWorkspaceError{Workspace: "example-org"}
+				},
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				require.Contains(t, rr.Body.String(), "example-org")
+			},
+		},
+		{
+			name: "success",
+			id:   "abc",
+			replayer: &mockReplayer{
+				ReplayFn: func(
+					_ context.Context,
+					delivery webhooks.Delivery,
+				) (sdk.EventList, error) {
+					require.Equal(t, "abc", delivery.ID)
+					return sdk.EventList{
+						Items: []sdk.Event{{ObjectMeta: meta.ObjectMeta{ID: "123"}}},
+					}, nil
+				},
+			},
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.JSONEq(t, `{"eventIDs":["123"]}`, rr.Body.String())
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(
+				http.MethodPost,
+				"/admin/deliveries/"+testCase.id+"/redeliver",
+				nil,
+			)
+			req = mux.SetURLVars(req, map[string]string{"uuid": testCase.id})
+			NewAPI(deliveries, testCase.replayer).Redeliver(rr, req)
+			testCase.assertions(rr)
+		})
+	}
+}
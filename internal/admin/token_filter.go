@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	libHTTP "github.com/brigadecore/brigade-foundations/http"
+)
+
+// tokenFilter is a component that implements the libHTTP.Filter interface and
+// permits a request to proceed only if it bears the expected bearer token.
+type tokenFilter struct {
+	token string
+}
+
+// NewTokenFilter returns a component that implements the libHTTP.Filter
+// interface and permits a request to proceed only if its Authorization header
+// bears the specified token.
+func NewTokenFilter(token string) libHTTP.Filter {
+	return &tokenFilter{
+		token: token,
+	}
+}
+
+func (t *tokenFilter) Decorate(handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		header := r.Header.Get("Authorization")
+		if t.token == "" ||
+			!strings.HasPrefix(header, prefix) ||
+			subtle.ConstantTimeCompare(
+				[]byte(strings.TrimPrefix(header, prefix)),
+				[]byte(t.token),
+			) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(
+				w,
+				http.StatusUnauthorized,
+				errorResponse{Error: "unauthorized"},
+			)
+			return
+		}
+		handle(w, r)
+	}
+}
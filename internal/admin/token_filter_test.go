@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenFilter(t *testing.T) {
+	filter, ok := NewTokenFilter("foo").(*tokenFilter)
+	require.True(t, ok)
+	require.Equal(t, "foo", filter.token)
+}
+
+func TestTokenFilter(t *testing.T) {
+	testCases := []struct {
+		name          string
+		token         string
+		authorization string
+		authorized    bool
+	}{
+		{
+			name:          "no token configured",
+			authorization: "Bearer ",
+			authorized:    false,
+		},
+		{
+			name:       "no Authorization header",
+			token:      "foo",
+			authorized: false,
+		},
+		{
+			name:          "wrong scheme",
+			token:         "foo",
+			authorization: "Basic foo",
+			authorized:    false,
+		},
+		{
+			name:          "wrong token",
+			token:         "foo",
+			authorization: "Bearer bar",
+			authorized:    false,
+		},
+		{
+			name:          "correct token",
+			token:         "foo",
+			authorization: "Bearer foo",
+			authorized:    true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if testCase.authorization != "" {
+				req.Header.Set("Authorization", testCase.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handlerCalled := false
+			NewTokenFilter(testCase.token).Decorate(
+				func(w http.ResponseWriter, _ *http.Request) {
+					handlerCalled = true
+					w.WriteHeader(http.StatusOK)
+				},
+			)(rr, req)
+			require.Equal(t, testCase.authorized, handlerCalled)
+			if testCase.authorized {
+				require.Equal(t, http.StatusOK, rr.Code)
+			} else {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+			}
+		})
+	}
+}
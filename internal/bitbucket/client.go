@@ -0,0 +1,559 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultAPIAddress is the address of Bitbucket Cloud's REST API.
+const DefaultAPIAddress = "https://api.bitbucket.org"
+
+// ClientConfig encapsulates configuration for a Client.
+type ClientConfig struct {
+	// APIAddress is the address of the Bitbucket REST API, including leading
+	// protocol (http:// or https://).
+	APIAddress string
+	// Username, if non-empty, is presented, along with AppPassword, using basic
+	// authentication.
+	Username string
+	// AppPassword is the app password presented along with Username.
+	AppPassword string
+	// AccessToken, if non-empty, is presented as a bearer token. This may be a
+	// repository, project, or workspace access token. It takes precedence over
+	// Username and AppPassword.
+	AccessToken string
+}
+
+// Webhook models a webhook configured for a Bitbucket repository.
+type Webhook struct {
+	// UUID uniquely identifies the webhook. It is assigned by Bitbucket.
+	UUID string `json:"uuid,omitempty"`
+	// URL is the URL webhooks are sent to.
+	URL string `json:"url"`
+	// Description is the webhook's title, as displayed by Bitbucket.
+	Description string `json:"description"`
+	// Active indicates whether webhooks are sent.
+	Active bool `json:"active"`
+	// Events are the keys (e.g. repo:push) of the events webhooks are sent for.
+	Events []string `json:"events"`
+	// Secret is the secret webhooks are signed with. Bitbucket never discloses
+	// an existing webhook's secret, so this is only used when creating or
+	// updating a webhook.
+	Secret string `json:"secret,omitempty"`
+	// SecretSet indicates whether a secret has been configured for an existing
+	// webhook.
+	SecretSet bool `json:"secret_set,omitempty"`
+}
+
+// Ref models a branch or tag in a Bitbucket repository.
+type Ref struct {
+	// Type is the type of ref: "branch" or "tag".
+	Type string `json:"type"`
+	// Name is the name of the branch or tag, e.g. main.
+	Name string `json:"name"`
+	// Target is the commit the ref points to.
+	Target struct {
+		// Hash is the commit's SHA.
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+// PullRequestEndpoint models the source or destination of a pull request.
+type PullRequestEndpoint struct {
+	// Branch is the branch being merged from or into.
+	Branch struct {
+		// Name is the name of the branch, e.g. main.
+		Name string `json:"name"`
+	} `json:"branch"`
+	// Commit is the commit at the tip of the branch.
+	Commit struct {
+		// Hash is the commit's SHA.
+		Hash string `json:"hash"`
+	} `json:"commit"`
+}
+
+// PullRequest models a pull request for a Bitbucket repository.
+type PullRequest struct {
+	// ID identifies the pull request within its destination repository.
+	ID int64 `json:"id"`
+	// Title is the pull request's title.
+	Title string `json:"title"`
+	// State is the pull request's state, e.g. OPEN, MERGED, or DECLINED.
+	State string `json:"state"`
+	// Source is the branch being merged from.
+	Source PullRequestEndpoint `json:"source"`
+	// Destination is the branch being merged into.
+	Destination PullRequestEndpoint `json:"destination"`
+	// Raw is the pull request exactly as the API represented it, including all
+	// fields not modeled above.
+	Raw json.RawMessage `json:"-"`
+}
+
+// UnmarshalJSON unmarshals the provided JSON into the PullRequest, retaining
+// a copy of it in the Raw field.
+func (p *PullRequest) UnmarshalJSON(data []byte) error {
+	type pullRequest PullRequest
+	if err := json.Unmarshal(data, (*pullRequest)(p)); err != nil {
+		return err
+	}
+	p.Raw = append(json.RawMessage{}, data...)
+	return nil
+}
+
+// APIError represents an unsuccessful response from the Bitbucket REST API.
+type APIError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Message is the error message, if any, included in the response.
+	Message string
+}
+
+func (a *APIError) Error() string {
+	if a.Message == "" {
+		return fmt.Sprintf("Bitbucket API returned %d", a.StatusCode)
+	}
+	return fmt.Sprintf("Bitbucket API returned %d: %s", a.StatusCode, a.Message)
+}
+
+// Client is an interface for components that communicate with the Bitbucket
+// REST API. Repositories are identified by their full names, e.g.
+// example-org/example.
+type Client interface {
+	// ListRepositories returns the full names of all repositories in the
+	// specified workspace.
+	ListRepositories(ctx context.Context, workspace string) ([]string, error)
+	// ListWebhooks returns all webhooks configured for the specified repository.
+	ListWebhooks(ctx context.Context, repo string) ([]Webhook, error)
+	// CreateWebhook creates the provided webhook for the specified repository
+	// and returns the webhook as created, complete with its UUID.
+	CreateWebhook(
+		ctx context.Context,
+		repo string,
+		webhook Webhook,
+	) (Webhook, error)
+	// UpdateWebhook replaces the webhook identified by the provided webhook's
+	// UUID for the specified repository with the provided webhook.
+	UpdateWebhook(ctx context.Context, repo string, webhook Webhook) error
+	// DeleteWebhook deletes the webhook identified by the specified UUID from
+	// the specified repository.
+	DeleteWebhook(ctx context.Context, repo string, uuid string) error
+	// GetRepository returns the specified repository exactly as the API
+	// represents it.
+	GetRepository(ctx context.Context, repo string) (json.RawMessage, error)
+	// ListBranches returns all branches of the specified repository.
+	ListBranches(ctx context.Context, repo string) ([]Ref, error)
+	// ListTags returns all tags of the specified repository.
+	ListTags(ctx context.Context, repo string) ([]Ref, error)
+	// ListPullRequests returns all open pull requests for the specified
+	// repository.
+	ListPullRequests(ctx context.Context, repo string) ([]PullRequest, error)
+	// GetPullRequest returns the pull request identified by the specified ID
+	// for the specified repository, regardless of its state.
+	GetPullRequest(
+		ctx context.Context,
+		repo string,
+		id int64,
+	) (PullRequest, error)
+	// ListChangedPaths returns the paths of all files added, modified, removed,
+	// or renamed (in which case both the old and new paths are included) by the
+	// specified commit or commit range of the specified repository. A commit
+	// range is specified using double dot notation (e.g. abc123..def456) and,
+	// like a pull request, compares the first commit with its merge base with
+	// the second. Paths are returned in lexical order without duplicates.
+	ListChangedPaths(
+		ctx context.Context,
+		repo string,
+		spec string,
+	) ([]string, error)
+}
+
+type client struct {
+	config     ClientConfig
+	httpClient *http.Client
+}
+
+// NewClient returns an implementation of the Client interface that
+// communicates with the Bitbucket REST API at the address specified by the
+// provided ClientConfig.
+func NewClient(config ClientConfig) Client {
+	config.APIAddress = strings.TrimSuffix(config.APIAddress, "/")
+	return &client{
+		config: config,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (c *client) ListRepositories(
+	ctx context.Context,
+	workspace string,
+) ([]string, error) {
+	repos := []string{}
+	err := c.getAllPages(
+		ctx,
+		fmt.Sprintf("/2.0/repositories/%s", url.PathEscape(workspace)),
+		func(values json.RawMessage) error {
+			page := []struct {
+				FullName string `json:"full_name"`
+			}{}
+			if err := json.Unmarshal(values, &page); err != nil {
+				return err
+			}
+			for _, repo := range page {
+				repos = append(repos, repo.FullName)
+			}
+			return nil
+		},
+	)
+	return repos,
+		errors.Wrapf(err, "error listing repositories in workspace %s", workspace)
+}
+
+func (c *client) ListWebhooks(
+	ctx context.Context,
+	repo string,
+) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := c.getAllPages(
+		ctx,
+		hooksPath(repo),
+		func(values json.RawMessage) error {
+			page := []Webhook{}
+			if err := json.Unmarshal(values, &page); err != nil {
+				return err
+			}
+			webhooks = append(webhooks, page...)
+			return nil
+		},
+	)
+	return webhooks, errors.Wrapf(err, "error listing webhooks for %s", repo)
+}
+
+func (c *client) CreateWebhook(
+	ctx context.Context,
+	repo string,
+	webhook Webhook,
+) (Webhook, error) {
+	webhook.UUID = ""
+	webhook.SecretSet = false
+	created := Webhook{}
+	err := c.do(
+		ctx,
+		http.MethodPost,
+		c.config.APIAddress+hooksPath(repo),
+		webhook,
+		&created,
+	)
+	return created, errors.Wrapf(err, "error creating webhook for %s", repo)
+}
+
+func (c *client) UpdateWebhook(
+	ctx context.Context,
+	repo string,
+	webhook Webhook,
+) error {
+	uuid := webhook.UUID
+	webhook.UUID = ""
+	webhook.SecretSet = false
+	return errors.Wrapf(
+		c.do(
+			ctx,
+			http.MethodPut,
+			c.config.APIAddress+hooksPath(repo)+"/"+url.PathEscape(uuid),
+			webhook,
+			nil,
+		),
+		"error updating webhook %s for %s",
+		uuid,
+		repo,
+	)
+}
+
+func (c *client) DeleteWebhook(
+	ctx context.Context,
+	repo string,
+	uuid string,
+) error {
+	return errors.Wrapf(
+		c.do(
+			ctx,
+			http.MethodDelete,
+			c.config.APIAddress+hooksPath(repo)+"/"+url.PathEscape(uuid),
+			nil,
+			nil,
+		),
+		"error deleting webhook %s from %s",
+		uuid,
+		repo,
+	)
+}
+
+func (c *client) GetRepository(
+	ctx context.Context,
+	repo string,
+) (json.RawMessage, error) {
+	repository := json.RawMessage{}
+	err := c.do(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf("%s/2.0/repositories/%s", c.config.APIAddress, repoPath(repo)),
+		nil,
+		&repository,
+	)
+	return repository, errors.Wrapf(err, "error getting repository %s", repo)
+}
+
+func (c *client) ListBranches(ctx context.Context, repo string) ([]Ref, error) {
+	refs, err := c.listRefs(ctx, repo, "branches")
+	return refs, errors.Wrapf(err, "error listing branches of %s", repo)
+}
+
+func (c *client) ListTags(ctx context.Context, repo string) ([]Ref, error) {
+	refs, err := c.listRefs(ctx, repo, "tags")
+	return refs, errors.Wrapf(err, "error listing tags of %s", repo)
+}
+
+// listRefs returns all refs of the specified kind ("branches" or "tags") of
+// the specified repository.
+func (c *client) listRefs(
+	ctx context.Context,
+	repo string,
+	kind string,
+) ([]Ref, error) {
+	refs := []Ref{}
+	err := c.getAllPages(
+		ctx,
+		fmt.Sprintf(
+			"/2.0/repositories/%s/refs/%s?pagelen=100",
+			repoPath(repo),
+			kind,
+		),
+		func(values json.RawMessage) error {
+			page := []Ref{}
+			if err := json.Unmarshal(values, &page); err != nil {
+				return err
+			}
+			refs = append(refs, page...)
+			return nil
+		},
+	)
+	return refs, err
+}
+
+func (c *client) ListPullRequests(
+	ctx context.Context,
+	repo string,
+) ([]PullRequest, error) {
+	pullRequests := []PullRequest{}
+	err := c.getAllPages(
+		ctx,
+		fmt.Sprintf(
+			"/2.0/repositories/%s/pullrequests?state=OPEN&pagelen=50",
+			repoPath(repo),
+		),
+		func(values json.RawMessage) error {
+			page := []PullRequest{}
+			if err := json.Unmarshal(values, &page); err != nil {
+				return err
+			}
+			pullRequests = append(pullRequests, page...)
+			return nil
+		},
+	)
+	return pullRequests,
+		errors.Wrapf(err, "error listing pull requests for %s", repo)
+}
+
+func (c *client) GetPullRequest(
+	ctx context.Context,
+	repo string,
+	id int64,
+) (PullRequest, error) {
+	pullRequest := PullRequest{}
+	err := c.do(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf(
+			"%s/2.0/repositories/%s/pullrequests/%d",
+			c.config.APIAddress,
+			repoPath(repo),
+			id,
+		),
+		nil,
+		&pullRequest,
+	)
+	return pullRequest,
+		errors.Wrapf(err, "error getting pull request %d for %s", id, repo)
+}
+
+func (c *client) ListChangedPaths(
+	ctx context.Context,
+	repo string,
+	spec string,
+) ([]string, error) {
+	paths := map[string]struct{}{}
+	err := c.getAllPages(
+		ctx,
+		fmt.Sprintf(
+			"/2.0/repositories/%s/diffstat/%s?pagelen=500",
+			repoPath(repo),
+			url.PathEscape(spec),
+		),
+		func(values json.RawMessage) error {
+			type file struct {
+				Path string `json:"path"`
+			}
+			page := []struct {
+				Old *file `json:"old"`
+				New *file `json:"new"`
+			}{}
+			if err := json.Unmarshal(values, &page); err != nil {
+				return err
+			}
+			for _, diffstat := range page {
+				for _, f := range []*file{diffstat.Old, diffstat.New} {
+					if f != nil && f.Path != "" {
+						paths[f.Path] = struct{}{}
+					}
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"error listing paths changed by %s of %s",
+			spec,
+			repo,
+		)
+	}
+	sortedPaths := make([]string, 0, len(paths))
+	for path := range paths {
+		sortedPaths = append(sortedPaths, path)
+	}
+	sort.Strings(sortedPaths)
+	return sortedPaths, nil
+}
+
+// hooksPath returns the path, relative to the API address, of the webhooks
+// collection for the specified repository.
+func hooksPath(repo string) string {
+	return fmt.Sprintf("/2.0/repositories/%s/hooks", repoPath(repo))
+}
+
+// repoPath returns the path segments identifying the specified repository,
+// e.g. example-org/example, with each segment escaped.
+func repoPath(repo string) string {
+	segments := strings.SplitN(repo, "/", 2)
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+// getAllPages retrieves every page of the paginated collection at the
+// specified path, relative to the API address, and passes the values from each
+// page, in order, to the provided function.
+func (c *client) getAllPages(
+	ctx context.Context,
+	path string,
+	fn func(values json.RawMessage) error,
+) error {
+	next := c.config.APIAddress + path
+	for next != "" {
+		page := struct {
+			Values json.RawMessage `json:"values"`
+			Next   string          `json:"next"`
+		}{}
+		if err := c.do(ctx, http.MethodGet, next, nil, &page); err != nil {
+			return err
+		}
+		if err := fn(page.Values); err != nil {
+			return errors.Wrap(err, "error unmarshaling response body")
+		}
+		// Never send credentials anywhere but the configured API
+		if page.Next != "" &&
+			!strings.HasPrefix(page.Next, c.config.APIAddress+"/") {
+			return errors.Errorf(
+				"refusing to follow link to next page at %s",
+				page.Next,
+			)
+		}
+		next = page.Next
+	}
+	return nil
+}
+
+// do sends a request with the specified method to the specified target URL,
+// with the provided object, if non-nil, marshaled as the request body. If the
+// response is successful and the provided result is non-nil, the response body
+// is unmarshaled into it. If the response is unsuccessful, an *APIError is
+// returned.
+func (c *client) do(
+	ctx context.Context,
+	method string,
+	target string,
+	body interface{},
+	result interface{},
+) error {
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "error marshaling request body")
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bodyReader)
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.config.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.AccessToken)
+	} else if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.AppPassword)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error sending %s request to %s", method, target)
+	}
+	defer resp.Body.Close()
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "error reading response from %s", target)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		errBody := struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}{}
+		if json.Unmarshal(respBytes, &errBody) == nil {
+			apiErr.Message = errBody.Error.Message
+		}
+		return apiErr
+	}
+	if result != nil {
+		if err = json.Unmarshal(respBytes, result); err != nil {
+			return errors.Wrapf(err, "error unmarshaling response from %s", target)
+		}
+	}
+	return nil
+}
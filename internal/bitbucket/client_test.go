@@ -0,0 +1,332 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	c := NewClient(ClientConfig{APIAddress: "https://api.example.com/"})
+	cl, ok := c.(*client)
+	require.True(t, ok)
+	require.Equal(t, "https://api.example.com", cl.config.APIAddress)
+	require.NotNil(t, cl.httpClient)
+}
+
+func TestClientListRepositories(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/2.0/repositories/example-org", r.URL.Path)
+			username, password, ok := r.BasicAuth()
+			require.True(t, ok)
+			require.Equal(t, "foo", username)
+			require.Equal(t, "bar", password)
+			if r.URL.Query().Get("page") == "" {
+				fmt.Fprintf(
+					w,
+					`{"values":[{"full_name":"example-org/a"}],"next":"%s"}`,
+					server.URL+"/2.0/repositories/example-org?page=2",
+				)
+				return
+			}
+			fmt.Fprint(w, `{"values":[{"full_name":"example-org/b"}]}`)
+		}),
+	)
+	defer server.Close()
+	repos, err := NewClient(
+		ClientConfig{
+			APIAddress:  server.URL,
+			Username:    "foo",
+			AppPassword: "bar",
+		},
+	).ListRepositories(context.Background(), "example-org")
+	require.NoError(t, err)
+	require.Equal(t, []string{"example-org/a", "example-org/b"}, repos)
+}
+
+func TestClientListWebhooks(t *testing.T) {
+	testCases := []struct {
+		name       string
+		handler    http.HandlerFunc
+		assertions func([]Webhook, error)
+	}{
+		{
+			name: "API returns error",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(
+					w,
+					`{"type":"error","error":{"message":"Access denied"}}`,
+				)
+			},
+			assertions: func(_ []Webhook, err error) {
+				require.Error(t, err)
+				apiErr, ok := errors.Cause(err).(*APIError)
+				require.True(t, ok)
+				require.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+				require.Contains(t, err.Error(), "Access denied")
+				require.Contains(t, err.Error(), "example-org/example")
+			},
+		},
+		{
+			name: "next page is elsewhere",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, `{"values":[],"next":"https://evil.example.com/"}`)
+			},
+			assertions: func(_ []Webhook, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "refusing to follow link")
+			},
+		},
+		{
+			name: "success",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(
+					t,
+					"/2.0/repositories/example-org/example/hooks",
+					r.URL.Path,
+				)
+				require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+				fmt.Fprint(
+					w,
+					`{"values":[{"uuid":"{abc}","url":"https://example.com/events",`+
+						`"description":"foo","active":true,"events":["repo:push"],`+
+						`"secret_set":true}]}`,
+				)
+			},
+			assertions: func(webhooks []Webhook, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					[]Webhook{{
+						UUID:        "{abc}",
+						URL:         "https://example.com/events",
+						Description: "foo",
+						Active:      true,
+						Events:      []string{"repo:push"},
+						SecretSet:   true,
+					}},
+					webhooks,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(testCase.handler)
+			defer server.Close()
+			testCase.assertions(
+				NewClient(
+					ClientConfig{
+						APIAddress:  server.URL,
+						AccessToken: "foo",
+						// The access token should take precedence
+						Username: "bar",
+					},
+				).ListWebhooks(context.Background(), "example-org/example"),
+			)
+		})
+	}
+}
+
+func TestClientCreateUpdateAndDeleteWebhook(t *testing.T) {
+	requests := []string{}
+	bodies := []map[string]interface{}{}
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.EscapedPath())
+			if r.Method == http.MethodDelete {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			body := map[string]interface{}{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			bodies = append(bodies, body)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"uuid":"{abc}","url":"https://example.com/events"}`)
+		}),
+	)
+	defer server.Close()
+	c := NewClient(ClientConfig{APIAddress: server.URL})
+	webhook := Webhook{
+		UUID:      "{abc}",
+		URL:       "https://example.com/events",
+		Active:    true,
+		Events:    []string{"repo:push"},
+		Secret:    "secret",
+		SecretSet: true,
+	}
+	created, err :=
+		c.CreateWebhook(context.Background(), "example-org/example", webhook)
+	require.NoError(t, err)
+	require.Equal(t, "{abc}", created.UUID)
+	err = c.UpdateWebhook(context.Background(), "example-org/example", webhook)
+	require.NoError(t, err)
+	err = c.DeleteWebhook(context.Background(), "example-org/example", "{abc}")
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]string{
+			"POST /2.0/repositories/example-org/example/hooks",
+			"PUT /2.0/repositories/example-org/example/hooks/%7Babc%7D",
+			"DELETE /2.0/repositories/example-org/example/hooks/%7Babc%7D",
+		},
+		requests,
+	)
+	for _, body := range bodies {
+		// Read only fields are never sent
+		require.NotContains(t, body, "uuid")
+		require.NotContains(t, body, "secret_set")
+		require.Equal(t, "secret", body["secret"])
+	}
+}
+
+func TestClientGetRepository(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/2.0/repositories/example-org/example", r.URL.Path)
+			fmt.Fprint(w, `{"full_name":"example-org/example","is_private":true}`)
+		}),
+	)
+	defer server.Close()
+	repository, err := NewClient(ClientConfig{APIAddress: server.URL}).
+		GetRepository(context.Background(), "example-org/example")
+	require.NoError(t, err)
+	require.JSONEq(
+		t,
+		`{"full_name":"example-org/example","is_private":true}`,
+		string(repository),
+	)
+}
+
+func TestClientListBranchesAndTags(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "100", r.URL.Query().Get("pagelen"))
+			switch r.URL.Path {
+			case "/2.0/repositories/example-org/example/refs/branches":
+				fmt.Fprint(
+					w,
+					`{"values":[{"type":"branch","name":"main","target":{"hash":"a"}}]}`,
+				)
+			case "/2.0/repositories/example-org/example/refs/tags":
+				fmt.Fprint(
+					w,
+					`{"values":[{"type":"tag","name":"v1.0.0","target":{"hash":"b"}}]}`,
+				)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+	c := NewClient(ClientConfig{APIAddress: server.URL})
+	branches, err := c.ListBranches(context.Background(), "example-org/example")
+	require.NoError(t, err)
+	require.Len(t, branches, 1)
+	require.Equal(t, "branch", branches[0].Type)
+	require.Equal(t, "main", branches[0].Name)
+	require.Equal(t, "a", branches[0].Target.Hash)
+	tags, err := c.ListTags(context.Background(), "example-org/example")
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+	require.Equal(t, "tag", tags[0].Type)
+	require.Equal(t, "v1.0.0", tags[0].Name)
+	require.Equal(t, "b", tags[0].Target.Hash)
+	_, err = c.ListTags(context.Background(), "example-org/missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error listing tags of example-org/missing")
+}
+
+func TestClientListAndGetPullRequests(t *testing.T) {
+	const pullRequestJSON = `{
+		"id": 1,
+		"title": "Add a feature",
+		"state": "OPEN",
+		"source": {"branch": {"name": "feature"}, "commit": {"hash": "a"}},
+		"destination": {"branch": {"name": "main"}, "commit": {"hash": "b"}},
+		"links": {"html": {"href": "https://bitbucket.org/example/pr/1"}}
+	}`
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/2.0/repositories/example-org/example/pullrequests":
+				require.Equal(t, "OPEN", r.URL.Query().Get("state"))
+				fmt.Fprintf(w, `{"values":[%s]}`, pullRequestJSON)
+			case "/2.0/repositories/example-org/example/pullrequests/1":
+				fmt.Fprint(w, pullRequestJSON)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+	c := NewClient(ClientConfig{APIAddress: server.URL})
+	pullRequests, err :=
+		c.ListPullRequests(context.Background(), "example-org/example")
+	require.NoError(t, err)
+	require.Len(t, pullRequests, 1)
+	pullRequest, err :=
+		c.GetPullRequest(context.Background(), "example-org/example", 1)
+	require.NoError(t, err)
+	for _, pr := range []PullRequest{pullRequests[0], pullRequest} {
+		require.Equal(t, int64(1), pr.ID)
+		require.Equal(t, "Add a feature", pr.Title)
+		require.Equal(t, "OPEN", pr.State)
+		require.Equal(t, "feature", pr.Source.Branch.Name)
+		require.Equal(t, "a", pr.Source.Commit.Hash)
+		require.Equal(t, "main", pr.Destination.Branch.Name)
+		require.Equal(t, "b", pr.Destination.Commit.Hash)
+		// Fields that aren't modeled are retained
+		require.JSONEq(t, pullRequestJSON, string(pr.Raw))
+	}
+	_, err = c.GetPullRequest(context.Background(), "example-org/example", 2)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error getting pull request 2")
+}
+
+func TestClientListChangedPaths(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/2.0/repositories/example-org/example/diffstat/a..b":
+				fmt.Fprint(
+					w,
+					`{"values":[
+						{"status":"modified","old":{"path":"foo"},"new":{"path":"foo"}},
+						{"status":"added","old":null,"new":{"path":"bar/baz"}}
+					],"next":"`+
+						"http://"+r.Host+
+						`/2.0/repositories/example-org/example/diffstat/a..b/2"}`,
+				)
+			case "/2.0/repositories/example-org/example/diffstat/a..b/2":
+				fmt.Fprint(
+					w,
+					`{"values":[
+						{"status":"removed","old":{"path":"qux"},"new":null},
+						{"status":"renamed","old":{"path":"a"},"new":{"path":"z"}}
+					]}`,
+				)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+	c := NewClient(ClientConfig{APIAddress: server.URL})
+	paths, err :=
+		c.ListChangedPaths(context.Background(), "example-org/example", "a..b")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "bar/baz", "foo", "qux", "z"}, paths)
+	_, err = c.ListChangedPaths(context.Background(), "example-org/example", "c")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error listing paths changed by c")
+}
@@ -0,0 +1,326 @@
+package bitbucket
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultWebhookDescription is the description (title) given to webhooks that
+// are registered by a Reconciler, unless configured otherwise.
+const DefaultWebhookDescription = "Brigade Bitbucket Gateway"
+
+// ReconcilerConfig encapsulates configuration for a Reconciler.
+type ReconcilerConfig struct {
+	// Repos are the full names (e.g. example-org/example) of repositories
+	// webhooks should be registered for.
+	Repos []string
+	// Workspaces are workspaces for whose every repository webhooks should be
+	// registered.
+	Workspaces []string
+	// URL is the URL webhooks should be sent to.
+	URL string
+	// Description is the description (title) of registered webhooks. Existing
+	// webhooks with this description or with the configured URL are considered
+	// to be managed by the Reconciler.
+	Description string
+	// Events are the keys (e.g. repo:push) of the events webhooks should be
+	// sent for.
+	Events []string
+	// Secret, if non-empty, is the secret webhooks should be signed with.
+	Secret string
+	// Interval is how often webhooks are reconciled.
+	Interval time.Duration
+}
+
+// Reconciler is an interface for components that ensure Bitbucket
+// repositories are configured to send webhooks to the gateway.
+type Reconciler interface {
+	// Reconcile ensures, once, that every configured repository has exactly one
+	// webhook managed by the Reconciler and that the webhook is configured as
+	// desired. Managed webhooks are deleted from repositories that are not
+	// configured but share a workspace with a configured repository. Problems
+	// with individual repositories are logged and do not prevent other
+	// repositories from being reconciled.
+	Reconcile(ctx context.Context) error
+	// ReconcileRepo ensures that the specified repository has exactly one
+	// webhook managed by the Reconciler, that the webhook is otherwise
+	// configured as desired, and that it is sent for the specified events
+	// instead of the configured ones. If no events are specified, all managed
+	// webhooks are deleted from the repository.
+	ReconcileRepo(ctx context.Context, repo string, events []string) error
+	// ManagedWebhook returns the webhook managed by the Reconciler that would
+	// be retained if the specified repository were reconciled, or nil if the
+	// repository has no such webhook.
+	ManagedWebhook(ctx context.Context, repo string) (*Webhook, error)
+	// Run reconciles webhooks immediately and then periodically until the
+	// provided context is canceled.
+	Run(ctx context.Context)
+}
+
+type reconciler struct {
+	config ReconcilerConfig
+	client Client
+	// secretApplied records the UUIDs of webhooks that are known to have been
+	// configured with the current secret. Since Bitbucket never discloses a
+	// webhook's secret, every managed webhook is updated with the secret once
+	// after startup. In this manner, a secret that was changed while the
+	// gateway was not running is still applied.
+	secretApplied map[string]struct{}
+}
+
+// NewReconciler returns an implementation of the Reconciler interface that
+// uses the provided Client to create, update, or delete webhooks in the
+// repositories specified by the provided ReconcilerConfig.
+func NewReconciler(config ReconcilerConfig, client Client) Reconciler {
+	events := make([]string, len(config.Events))
+	copy(events, config.Events)
+	sort.Strings(events)
+	config.Events = events
+	return &reconciler{
+		config:        config,
+		client:        client,
+		secretApplied: map[string]struct{}{},
+	}
+}
+
+func (r *reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Reconcile(ctx); err != nil {
+			log.Printf("error reconciling webhooks: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *reconciler) Reconcile(ctx context.Context) error {
+	repos, err := r.repos(ctx)
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, repo := range repos {
+		if err = r.ReconcileRepo(ctx, repo, r.config.Events); err != nil {
+			log.Println(err)
+			failed++
+		}
+	}
+	// Repositories that are no longer configured may retain managed webhooks
+	// from when they were
+	unconfigured, err := r.unconfiguredRepos(ctx, repos)
+	if err != nil {
+		return errors.Wrap(err, "error listing unconfigured repositories")
+	}
+	for _, repo := range unconfigured {
+		if err = r.ReconcileRepo(ctx, repo, nil); err != nil {
+			log.Println(err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf(
+			"failed to reconcile webhooks for %d of %d repositories",
+			failed,
+			len(repos)+len(unconfigured),
+		)
+	}
+	return nil
+}
+
+// repos returns the sorted, de-duplicated full names of all configured
+// repositories and all repositories in all configured workspaces.
+func (r *reconciler) repos(ctx context.Context) ([]string, error) {
+	repoSet := map[string]struct{}{}
+	for _, repo := range r.config.Repos {
+		repoSet[repo] = struct{}{}
+	}
+	for _, workspace := range r.config.Workspaces {
+		workspaceRepos, err := r.client.ListRepositories(ctx, workspace)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range workspaceRepos {
+			repoSet[repo] = struct{}{}
+		}
+	}
+	return sortedKeys(repoSet), nil
+}
+
+// unconfiguredRepos returns the sorted full names of all repositories that
+// are not among the provided, configured ones, but that belong to the same
+// workspace as a configured repository. Every repository in a configured
+// workspace is itself configured, so those workspaces need not be listed.
+func (r *reconciler) unconfiguredRepos(
+	ctx context.Context,
+	configured []string,
+) ([]string, error) {
+	configuredSet := map[string]struct{}{}
+	for _, repo := range configured {
+		configuredSet[repo] = struct{}{}
+	}
+	configuredWorkspaces := map[string]struct{}{}
+	for _, workspace := range r.config.Workspaces {
+		configuredWorkspaces[workspace] = struct{}{}
+	}
+	workspaces := map[string]struct{}{}
+	for _, repo := range r.config.Repos {
+		workspace := strings.SplitN(repo, "/", 2)[0]
+		if _, ok := configuredWorkspaces[workspace]; !ok {
+			workspaces[workspace] = struct{}{}
+		}
+	}
+	repoSet := map[string]struct{}{}
+	for _, workspace := range sortedKeys(workspaces) {
+		workspaceRepos, err := r.client.ListRepositories(ctx, workspace)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range workspaceRepos {
+			if _, ok := configuredSet[repo]; !ok {
+				repoSet[repo] = struct{}{}
+			}
+		}
+	}
+	return sortedKeys(repoSet), nil
+}
+
+// sortedKeys returns the keys of the provided set in sorted order.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ReconcileRepo prefers, of the existing managed webhooks, one with the
+// desired URL for retention. All others are deleted.
+func (r *reconciler) ReconcileRepo(
+	ctx context.Context,
+	repo string,
+	events []string,
+) error {
+	managed, err := r.managedWebhooks(ctx, repo)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		for _, webhook := range managed {
+			if err = r.client.DeleteWebhook(ctx, repo, webhook.UUID); err != nil {
+				return err
+			}
+			log.Printf("deleted unneeded webhook %s from %s", webhook.UUID, repo)
+		}
+		return nil
+	}
+	sortedEvents := make([]string, len(events))
+	copy(sortedEvents, events)
+	sort.Strings(sortedEvents)
+	desired := Webhook{
+		URL:         r.config.URL,
+		Description: r.config.Description,
+		Active:      true,
+		Events:      sortedEvents,
+		Secret:      r.config.Secret,
+	}
+	if len(managed) == 0 {
+		var created Webhook
+		if created, err = r.client.CreateWebhook(ctx, repo, desired); err != nil {
+			return err
+		}
+		r.secretApplied[created.UUID] = struct{}{}
+		log.Printf("created webhook %s for %s", created.UUID, repo)
+		return nil
+	}
+	current := managed[0]
+	if r.needsUpdate(current, sortedEvents) {
+		desired.UUID = current.UUID
+		if err = r.client.UpdateWebhook(ctx, repo, desired); err != nil {
+			return err
+		}
+		r.secretApplied[current.UUID] = struct{}{}
+		log.Printf("updated webhook %s for %s", current.UUID, repo)
+	}
+	for _, stale := range managed[1:] {
+		if err = r.client.DeleteWebhook(ctx, repo, stale.UUID); err != nil {
+			return err
+		}
+		log.Printf("deleted stale webhook %s from %s", stale.UUID, repo)
+	}
+	return nil
+}
+
+func (r *reconciler) ManagedWebhook(
+	ctx context.Context,
+	repo string,
+) (*Webhook, error) {
+	managed, err := r.managedWebhooks(ctx, repo)
+	if err != nil || len(managed) == 0 {
+		return nil, err
+	}
+	return &managed[0], nil
+}
+
+// managedWebhooks returns all of the specified repository's webhooks that are
+// managed by the reconciler, with those having the desired URL first.
+func (r *reconciler) managedWebhooks(
+	ctx context.Context,
+	repo string,
+) ([]Webhook, error) {
+	webhooks, err := r.client.ListWebhooks(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	managed := []Webhook{}
+	for _, webhook := range webhooks {
+		if webhook.URL == r.config.URL {
+			// Webhooks with the desired URL go first
+			managed = append([]Webhook{webhook}, managed...)
+		} else if webhook.Description == r.config.Description {
+			managed = append(managed, webhook)
+		}
+	}
+	return managed, nil
+}
+
+// needsUpdate returns a bool indicating whether the provided managed webhook
+// differs from the desired configuration, including the provided, sorted
+// events.
+func (r *reconciler) needsUpdate(webhook Webhook, desiredEvents []string) bool {
+	if webhook.URL != r.config.URL ||
+		webhook.Description != r.config.Description ||
+		!webhook.Active {
+		return true
+	}
+	if r.config.Secret != "" {
+		if !webhook.SecretSet {
+			return true
+		}
+		if _, ok := r.secretApplied[webhook.UUID]; !ok {
+			return true
+		}
+	}
+	events := make([]string, len(webhook.Events))
+	copy(events, webhook.Events)
+	sort.Strings(events)
+	if len(events) != len(desiredEvents) {
+		return true
+	}
+	for i := range events {
+		if events[i] != desiredEvents[i] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBitbucket is a minimal, in-memory stand-in for the parts of the
+// Bitbucket REST API used to manage repository webhooks.
+type fakeBitbucket struct {
+	mu sync.Mutex
+	// workspaces maps workspace names to the full names of their repositories.
+	workspaces map[string][]string
+	// webhooks maps repositories' full names to their webhooks.
+	webhooks map[string][]Webhook
+	// secrets maps webhook UUIDs to their secrets.
+	secrets map[string]string
+	// writes counts requests that created, updated, or deleted a webhook.
+	writes  int
+	nextID  int
+	failFor string
+}
+
+func (f *fakeBitbucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	segments := strings.Split(
+		strings.TrimPrefix(r.URL.Path, "/2.0/repositories/"),
+		"/",
+	)
+	if len(segments) == 1 {
+		values := []map[string]string{}
+		for _, repo := range f.workspaces[segments[0]] {
+			values = append(values, map[string]string{"full_name": repo})
+		}
+		f.writeValues(w, values)
+		return
+	}
+	repo := segments[0] + "/" + segments[1]
+	if repo == f.failFor {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet:
+		f.writeValues(w, f.webhooks[repo])
+	case r.Method == http.MethodPost:
+		webhook := Webhook{}
+		json.NewDecoder(r.Body).Decode(&webhook) // nolint: errcheck
+		f.nextID++
+		webhook.UUID = fmt.Sprintf("{%d}", f.nextID)
+		f.store(repo, webhook)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(webhook) // nolint: errcheck
+	case r.Method == http.MethodPut:
+		webhook := Webhook{}
+		json.NewDecoder(r.Body).Decode(&webhook) // nolint: errcheck
+		webhook.UUID = segments[3]
+		f.remove(repo, webhook.UUID)
+		f.store(repo, webhook)
+		json.NewEncoder(w).Encode(webhook) // nolint: errcheck
+	case r.Method == http.MethodDelete:
+		f.remove(repo, segments[3])
+		f.writes++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeValues writes the provided values as a single page of a paginated
+// collection.
+func (f *fakeBitbucket) writeValues(w http.ResponseWriter, values interface{}) {
+	json.NewEncoder(w).Encode( // nolint: errcheck
+		map[string]interface{}{"values": values},
+	)
+}
+
+func (f *fakeBitbucket) store(repo string, webhook Webhook) {
+	f.writes++
+	if webhook.Secret != "" {
+		f.secrets[webhook.UUID] = webhook.Secret
+	}
+	// Like Bitbucket, never disclose the secret
+	webhook.SecretSet = f.secrets[webhook.UUID] != ""
+	webhook.Secret = ""
+	f.webhooks[repo] = append(f.webhooks[repo], webhook)
+}
+
+func (f *fakeBitbucket) remove(repo string, uuid string) {
+	webhooks := []Webhook{}
+	for _, webhook := range f.webhooks[repo] {
+		if webhook.UUID != uuid {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	f.webhooks[repo] = webhooks
+}
+
+func TestNewReconciler(t *testing.T) {
+	config := ReconcilerConfig{Events: []string{"repo:push", "issue:created"}}
+	c := NewClient(ClientConfig{})
+	r := NewReconciler(config, c)
+	rec, ok := r.(*reconciler)
+	require.True(t, ok)
+	require.Same(t, c, rec.client)
+	require.Equal(t, []string{"issue:created", "repo:push"}, rec.config.Events)
+	// The caller's slice should not have been reordered
+	require.Equal(t, []string{"repo:push", "issue:created"}, config.Events)
+	require.NotNil(t, rec.secretApplied)
+}
+
+func TestReconcilerReconcile(t *testing.T) {
+	const gatewayURL = "https://gateway.example.com/events"
+	bitbucket := &fakeBitbucket{
+		workspaces: map[string][]string{
+			"example-org": {"example-org/a", "example-org/b"},
+		},
+		webhooks: map[string][]Webhook{
+			// Has a misconfigured managed webhook, a stale managed webhook, and an
+			// unrelated webhook that should be left alone
+			"example-org/a": {
+				{
+					UUID:        "{a1}",
+					URL:         gatewayURL,
+					Description: "Hand made",
+					Active:      false,
+					Events:      []string{"repo:push"},
+				},
+				{
+					UUID:        "{a2}",
+					URL:         "https://old-gateway.example.com/events",
+					Description: DefaultWebhookDescription,
+					Active:      true,
+				},
+				{
+					UUID:        "{a3}",
+					URL:         "https://ci.example.com/hook",
+					Description: "CI",
+					Active:      true,
+				},
+			},
+		},
+		secrets: map[string]string{},
+	}
+	server := httptest.NewServer(bitbucket)
+	defer server.Close()
+	r := NewReconciler(
+		ReconcilerConfig{
+			Repos:       []string{"another-org/c", "example-org/a"},
+			Workspaces:  []string{"example-org"},
+			URL:         gatewayURL,
+			Description: DefaultWebhookDescription,
+			Events:      []string{"repo:push", "pullrequest:created"},
+			Secret:      "secret",
+		},
+		NewClient(ClientConfig{APIAddress: server.URL}),
+	)
+
+	err := r.Reconcile(context.Background())
+	require.NoError(t, err)
+	desired := func(uuid string) Webhook {
+		return Webhook{
+			UUID:        uuid,
+			URL:         gatewayURL,
+			Description: DefaultWebhookDescription,
+			Active:      true,
+			Events:      []string{"pullrequest:created", "repo:push"},
+			SecretSet:   true,
+		}
+	}
+	require.Equal(
+		t,
+		map[string][]Webhook{
+			"example-org/a": {
+				{
+					UUID:        "{a3}",
+					URL:         "https://ci.example.com/hook",
+					Description: "CI",
+					Active:      true,
+				},
+				desired("{a1}"),
+			},
+			"example-org/b": {desired("{2}")},
+			"another-org/c": {desired("{1}")},
+		},
+		bitbucket.webhooks,
+	)
+	require.Equal(
+		t,
+		map[string]string{"{a1}": "secret", "{1}": "secret", "{2}": "secret"},
+		bitbucket.secrets,
+	)
+
+	// Nothing should change the second time around
+	bitbucket.writes = 0
+	err = r.Reconcile(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, bitbucket.writes)
+
+	// A new reconciler can't know whether the secret is current, so it should
+	// apply it once. Since example-org/b is no longer configured, but shares a
+	// workspace with a configured repository, its managed webhook should be
+	// deleted.
+	r = NewReconciler(
+		ReconcilerConfig{
+			Repos:       []string{"example-org/a"},
+			URL:         gatewayURL,
+			Description: DefaultWebhookDescription,
+			Events:      []string{"repo:push", "pullrequest:created"},
+			Secret:      "new-secret",
+		},
+		NewClient(ClientConfig{APIAddress: server.URL}),
+	)
+	err = r.Reconcile(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, bitbucket.writes)
+	require.Equal(t, "new-secret", bitbucket.secrets["{a1}"])
+	require.Empty(t, bitbucket.webhooks["example-org/b"])
+
+	// A failure for one repository shouldn't prevent others from being
+	// reconciled
+	bitbucket.failFor = "example-org/a"
+	bitbucket.webhooks["example-org/b"] = nil
+	r = NewReconciler(
+		ReconcilerConfig{
+			Workspaces:  []string{"example-org"},
+			URL:         gatewayURL,
+			Description: DefaultWebhookDescription,
+			Events:      []string{"repo:push"},
+			Interval:    time.Minute,
+		},
+		NewClient(ClientConfig{APIAddress: server.URL}),
+	)
+	err = r.Reconcile(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 of 2 repositories")
+	require.Len(t, bitbucket.webhooks["example-org/b"], 1)
+}
+
+func TestReconcilerReconcileRepo(t *testing.T) {
+	const gatewayURL = "https://gateway.example.com/events"
+	bitbucket := &fakeBitbucket{
+		webhooks: map[string][]Webhook{
+			"example-org/a": {
+				{
+					UUID:        "{a1}",
+					URL:         gatewayURL,
+					Description: DefaultWebhookDescription,
+					Active:      true,
+					Events:      []string{"repo:push"},
+				},
+				{
+					UUID:   "{a2}",
+					URL:    "https://ci.example.com/hook",
+					Active: true,
+					Events: []string{"repo:push"},
+				},
+			},
+		},
+		secrets: map[string]string{},
+	}
+	server := httptest.NewServer(bitbucket)
+	defer server.Close()
+	r := NewReconciler(
+		ReconcilerConfig{
+			URL:         gatewayURL,
+			Description: DefaultWebhookDescription,
+			Events:      []string{"repo:push"},
+		},
+		NewClient(ClientConfig{APIAddress: server.URL}),
+	)
+
+	webhook, err := r.ManagedWebhook(context.Background(), "example-org/a")
+	require.NoError(t, err)
+	require.NotNil(t, webhook)
+	require.Equal(t, "{a1}", webhook.UUID)
+
+	webhook, err = r.ManagedWebhook(context.Background(), "example-org/b")
+	require.NoError(t, err)
+	require.Nil(t, webhook)
+
+	// The specified events should be used instead of the configured ones
+	err = r.ReconcileRepo(
+		context.Background(),
+		"example-org/a",
+		[]string{"pullrequest:created", "repo:push"},
+	)
+	require.NoError(t, err)
+	webhook, err = r.ManagedWebhook(context.Background(), "example-org/a")
+	require.NoError(t, err)
+	require.NotNil(t, webhook)
+	require.Equal(
+		t,
+		[]string{"pullrequest:created", "repo:push"},
+		webhook.Events,
+	)
+
+	// No events means no managed webhook is needed, but unrelated webhooks
+	// should be left alone
+	err = r.ReconcileRepo(context.Background(), "example-org/a", nil)
+	require.NoError(t, err)
+	require.Len(t, bitbucket.webhooks["example-org/a"], 1)
+	require.Equal(t, "{a2}", bitbucket.webhooks["example-org/a"][0].UUID)
+
+	bitbucket.failFor = "example-org/a"
+	_, err = r.ManagedWebhook(context.Background(), "example-org/a")
+	require.Error(t, err)
+}
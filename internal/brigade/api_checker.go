@@ -0,0 +1,45 @@
+package brigade
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+)
+
+// APIChecker is an interface for components that can verify that the Brigade
+// API server they communicate with is reachable and accepts their API token.
+// All of the sdk.EventsClient implementations in this package also implement
+// this interface.
+type APIChecker interface {
+	// CheckAPI returns an error if the Brigade API server is unreachable or
+	// rejects the API token.
+	CheckAPI(ctx context.Context) error
+}
+
+// sdkEventsClient is an implementation of the sdk.EventsClient interface that
+// delegates to the Brigade SDK's own client and implements the APIChecker and
+// ProjectLister interfaces using the SDK's authentication and projects
+// clients.
+type sdkEventsClient struct {
+	sdk.EventsClient
+	authnClient    sdk.AuthnClient
+	projectsClient sdk.ProjectsClient
+}
+
+func (s *sdkEventsClient) CheckAPI(ctx context.Context) error {
+	_, err := s.authnClient.WhoAmI(ctx)
+	return err
+}
+
+func (t *tokenFileEventsClient) CheckAPI(ctx context.Context) error {
+	if checker, ok := t.current().(APIChecker); ok {
+		return checker.CheckAPI(ctx)
+	}
+	return nil
+}
+
+// CheckAPI always succeeds, since a dryRunEventsClient never communicates with
+// a Brigade API server.
+func (d *dryRunEventsClient) CheckAPI(context.Context) error {
+	return nil
+}
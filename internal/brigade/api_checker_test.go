@@ -0,0 +1,66 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v3/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSDKEventsClientCheckAPI(t *testing.T) {
+	testCases := []struct {
+		name       string
+		whoAmIErr  error
+		assertions func(error)
+	}{
+		{
+			name:      "error",
+			whoAmIErr: &meta.ErrAuthentication{},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.IsType(t, &meta.ErrAuthentication{}, err)
+			},
+		},
+		{
+			name: "success",
+			assertions: func(err error) {
+				require.NoError(t, err)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := &sdkEventsClient{
+				authnClient: &sdkTesting.MockAuthnClient{
+					WhoAmIFn: func(context.Context) (sdk.PrincipalReference, error) {
+						return sdk.PrincipalReference{}, testCase.whoAmIErr
+					},
+				},
+			}
+			testCase.assertions(client.CheckAPI(context.Background()))
+		})
+	}
+}
+
+func TestTokenFileEventsClientCheckAPI(t *testing.T) {
+	client := &tokenFileEventsClient{
+		client: &sdkEventsClient{
+			authnClient: &sdkTesting.MockAuthnClient{
+				WhoAmIFn: func(context.Context) (sdk.PrincipalReference, error) {
+					return sdk.PrincipalReference{}, errors.New("something went wrong")
+				},
+			},
+		},
+	}
+	err := client.CheckAPI(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "something went wrong")
+}
+
+func TestDryRunEventsClientCheckAPI(t *testing.T) {
+	require.NoError(t, (&dryRunEventsClient{}).CheckAPI(context.Background()))
+}
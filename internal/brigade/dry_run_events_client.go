@@ -0,0 +1,58 @@
+package brigade
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/pkg/errors"
+)
+
+// dryRunEventsClient is an implementation of the sdk.EventsClient interface
+// that never communicates with a Brigade API server. Instead, it logs every
+// event it is asked to create and responds with a synthetic event ID. All other
+// functions return an error, since there are no events to operate on.
+type dryRunEventsClient struct {
+	unsupportedEventsClient
+}
+
+// NewDryRunEventsClient returns an implementation of the sdk.EventsClient
+// interface that merely logs the events it is asked to create instead of
+// emitting them into Brigade's event bus. This is useful for safely observing
+// the effects of configuration changes.
+func NewDryRunEventsClient() sdk.EventsClient {
+	return &dryRunEventsClient{}
+}
+
+func (d *dryRunEventsClient) Create(
+	_ context.Context,
+	event sdk.Event,
+	_ *sdk.EventCreateOptions,
+) (sdk.EventList, error) {
+	events := sdk.EventList{}
+	id, err := syntheticEventID()
+	if err != nil {
+		return events, err
+	}
+	event.ID = id
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return events, errors.Wrap(err, "error marshaling event")
+	}
+	log.Printf("dry run: would have created event: %s", eventJSON)
+	events.Items = []sdk.Event{event}
+	return events, nil
+}
+
+// syntheticEventID returns a random identifier that is recognizably not the ID
+// of a real Brigade event.
+func syntheticEventID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating synthetic event ID")
+	}
+	return "dry-run-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,55 @@
+package brigade
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDryRunEventsClient(t *testing.T) {
+	_, ok := NewDryRunEventsClient().(*dryRunEventsClient)
+	require.True(t, ok)
+}
+
+func TestDryRunEventsClientCreate(t *testing.T) {
+	client := NewDryRunEventsClient()
+	events, err := client.Create(
+		context.Background(),
+		sdk.Event{
+			Source: "brigade.sh/bitbucket",
+			Type:   "repo:push",
+			Qualifiers: map[string]string{
+				"repo": "example-org/example",
+			},
+		},
+		nil,
+	)
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	event := events.Items[0]
+	require.True(t, strings.HasPrefix(event.ID, "dry-run-"))
+	require.Equal(t, "repo:push", event.Type)
+	require.Equal(t, "example-org/example", event.Qualifiers["repo"])
+	// IDs should not repeat
+	moreEvents, err := client.Create(context.Background(), sdk.Event{}, nil)
+	require.NoError(t, err)
+	require.NotEqual(t, event.ID, moreEvents.Items[0].ID)
+}
+
+func TestDryRunEventsClientUnsupported(t *testing.T) {
+	client := NewDryRunEventsClient()
+	_, err := client.Get(context.Background(), "abc", nil)
+	require.Equal(t, errNotSupported, err)
+	_, _, err = client.Logs().Stream(context.Background(), "abc", nil, nil)
+	require.Equal(t, errNotSupported, err)
+	_, err = client.Workers().Jobs().GetStatus(
+		context.Background(),
+		"abc",
+		"foo",
+		nil,
+	)
+	require.Equal(t, errNotSupported, err)
+}
@@ -0,0 +1,188 @@
+package brigade
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+	"reflect"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/restmachinery"
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/pkg/errors"
+)
+
+// TLSConfig encapsulates optional TLS configuration for communicating with the
+// Brigade API server beyond what the Brigade SDK supports.
+type TLSConfig struct {
+	// CACertPath is the path to a PEM-encoded bundle of CA certificates that
+	// should be trusted, in addition to the system's, when verifying the API
+	// server's certificate.
+	CACertPath string
+	// ClientCertPath is the path to a PEM-encoded client certificate to present
+	// to the API server. If specified, ClientKeyPath must also be specified.
+	ClientCertPath string
+	// ClientKeyPath is the path to the PEM-encoded private key corresponding to
+	// the certificate at ClientCertPath.
+	ClientKeyPath string
+}
+
+// empty returns a bool indicating whether the TLSConfig specifies anything.
+func (t TLSConfig) empty() bool {
+	return t.CACertPath == "" && t.ClientCertPath == "" && t.ClientKeyPath == ""
+}
+
+// NewEventsClientFactory returns a function that builds an sdk.EventsClient
+// for communicating with the Brigade API server at the specified address using
+// a given API token. The clients built delegate to the Brigade SDK's own and
+// also implement the APIChecker and ProjectLister interfaces. If the provided
+// TLSConfig is not empty, the clients trust the CAs and present the client
+// certificate it references. Any files referenced by the TLSConfig are read
+// immediately.
+func NewEventsClientFactory(
+	apiAddress string,
+	opts restmachinery.APIClientOptions,
+	tlsConfig TLSConfig,
+) (func(apiToken string) sdk.EventsClient, error) {
+	if tlsConfig.empty() {
+		return func(apiToken string) sdk.EventsClient {
+			return newSDKEventsClient(apiAddress, apiToken, opts)
+		}, nil
+	}
+	cfg, err := newTLSConfig(opts, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Fail fast if the SDK's clients are not built the way setTLSConfig expects.
+	// Every client is built the same way, so subsequent attempts cannot fail.
+	probe := newSDKEventsClient(apiAddress, "", opts)
+	if err = probe.setTLSConfig(cfg); err != nil {
+		return nil, err
+	}
+	return func(apiToken string) sdk.EventsClient {
+		client := newSDKEventsClient(apiAddress, apiToken, opts)
+		client.setTLSConfig(cfg) // nolint: errcheck
+		return client
+	}, nil
+}
+
+// newSDKEventsClient returns an *sdkEventsClient that delegates to the Brigade
+// SDK's events, authentication, and projects clients.
+func newSDKEventsClient(
+	apiAddress string,
+	apiToken string,
+	opts restmachinery.APIClientOptions,
+) *sdkEventsClient {
+	return &sdkEventsClient{
+		EventsClient:   sdk.NewEventsClient(apiAddress, apiToken, &opts),
+		authnClient:    sdk.NewAuthnClient(apiAddress, apiToken, &opts),
+		projectsClient: sdk.NewProjectsClient(apiAddress, apiToken, &opts),
+	}
+}
+
+// setTLSConfig makes the Brigade SDK clients the sdkEventsClient delegates to
+// use the provided *tls.Config. The SDK offers no means of trusting custom CAs
+// or presenting client certificates, so this reaches into the HTTP transport
+// each client builds for itself, leaving the SDK's retry policy and error
+// handling intact. Only the events client itself is affected and not the
+// workers or logs clients it embeds, since the gateway never uses those.
+func (s *sdkEventsClient) setTLSConfig(cfg *tls.Config) error {
+	for _, client := range []interface{}{
+		s.EventsClient,
+		s.authnClient,
+		s.projectsClient,
+	} {
+		transport, err := sdkTransport(client)
+		if err != nil {
+			return err
+		}
+		transport.TLSClientConfig = cfg
+	}
+	return nil
+}
+
+// sdkTransport returns the *http.Transport underlying the provided Brigade SDK
+// client, which is expected to embed the SDK's own *BaseClient.
+func sdkTransport(client interface{}) (*http.Transport, error) {
+	err := errors.Errorf(
+		"unable to configure TLS for Brigade SDK client of type %T",
+		client,
+	)
+	val := reflect.ValueOf(client)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return nil, err
+	}
+	baseClient := val.Elem().FieldByName("BaseClient")
+	if baseClient.Kind() != reflect.Ptr || baseClient.IsNil() {
+		return nil, err
+	}
+	httpClientVal := baseClient.Elem().FieldByName("HTTPClient")
+	if !httpClientVal.IsValid() || !httpClientVal.CanInterface() {
+		return nil, err
+	}
+	httpClient, ok := httpClientVal.Interface().(*http.Client)
+	if !ok || httpClient == nil {
+		return nil, err
+	}
+	roundTripper, ok := httpClient.Transport.(*retryablehttp.RoundTripper)
+	if !ok || roundTripper.Client == nil ||
+		roundTripper.Client.HTTPClient == nil {
+		return nil, err
+	}
+	transport, ok := roundTripper.Client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// newTLSConfig returns a *tls.Config reflecting the provided options and
+// TLSConfig.
+func newTLSConfig(
+	opts restmachinery.APIClientOptions,
+	tlsConfig TLSConfig,
+) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.AllowInsecureConnections, // nolint: gosec
+	}
+	if tlsConfig.CACertPath != "" {
+		caCertPool, err := x509.SystemCertPool()
+		if err != nil {
+			caCertPool = x509.NewCertPool()
+		}
+		caCertBytes, err := os.ReadFile(tlsConfig.CACertPath)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"error reading CA certificates from %s",
+				tlsConfig.CACertPath,
+			)
+		}
+		if !caCertPool.AppendCertsFromPEM(caCertBytes) {
+			return nil, errors.Errorf(
+				"no PEM-encoded CA certificates found in %s",
+				tlsConfig.CACertPath,
+			)
+		}
+		cfg.RootCAs = caCertPool
+	}
+	if tlsConfig.ClientCertPath != "" || tlsConfig.ClientKeyPath != "" {
+		if tlsConfig.ClientCertPath == "" || tlsConfig.ClientKeyPath == "" {
+			return nil, errors.New(
+				"a client certificate and key must both be specified or neither " +
+					"may be specified",
+			)
+		}
+		clientCert, err := tls.LoadX509KeyPair(
+			tlsConfig.ClientCertPath,
+			tlsConfig.ClientKeyPath,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading client certificate")
+		}
+		cfg.Certificates = []tls.Certificate{clientCert}
+	}
+	return cfg, nil
+}
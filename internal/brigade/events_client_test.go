@@ -0,0 +1,256 @@
+package brigade
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	"github.com/brigadecore/brigade/sdk/v3/restmachinery"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEventsClientFactory(t *testing.T) {
+	dir := t.TempDir()
+	notPEMPath := filepath.Join(dir, "not-pem")
+	require.NoError(t, os.WriteFile(notPEMPath, []byte("foo"), 0600))
+	testCases := []struct {
+		name       string
+		tlsConfig  TLSConfig
+		assertions func(func(string) sdk.EventsClient, error)
+	}{
+		{
+			name: "empty TLS config",
+			assertions: func(newClient func(string) sdk.EventsClient, err error) {
+				require.NoError(t, err)
+				client, ok := newClient("foo").(*sdkEventsClient)
+				require.True(t, ok)
+				require.NotNil(t, client.projectsClient)
+			},
+		},
+		{
+			name: "CA certificates file does not exist",
+			tlsConfig: TLSConfig{
+				CACertPath: filepath.Join(dir, "does-not-exist"),
+			},
+			assertions: func(_ func(string) sdk.EventsClient, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reading CA certificates")
+			},
+		},
+		{
+			name: "CA certificates file contains no certificates",
+			tlsConfig: TLSConfig{
+				CACertPath: notPEMPath,
+			},
+			assertions: func(_ func(string) sdk.EventsClient, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no PEM-encoded CA certificates")
+			},
+		},
+		{
+			name: "client certificate without key",
+			tlsConfig: TLSConfig{
+				ClientCertPath: notPEMPath,
+			},
+			assertions: func(_ func(string) sdk.EventsClient, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "must both be specified")
+			},
+		},
+		{
+			name: "invalid client certificate",
+			tlsConfig: TLSConfig{
+				ClientCertPath: notPEMPath,
+				ClientKeyPath:  notPEMPath,
+			},
+			assertions: func(_ func(string) sdk.EventsClient, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error loading client certificate")
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(
+				NewEventsClientFactory(
+					"https://brigade.example.com",
+					restmachinery.APIClientOptions{},
+					testCase.tlsConfig,
+				),
+			)
+		})
+	}
+}
+
+func TestNewEventsClientFactoryWithTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	// Create a CA and use it to issue a client certificate
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caCertDER, err := x509.CreateCertificate(
+		rand.Reader,
+		caTemplate,
+		caTemplate,
+		&caKey.PublicKey,
+		caKey,
+	)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caCertDER)
+	require.NoError(t, err)
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientCertDER, err := x509.CreateCertificate(
+		rand.Reader,
+		&x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "gateway"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		},
+		caCert,
+		&clientKey.PublicKey,
+		caKey,
+	)
+	require.NoError(t, err)
+	clientKeyDER, err := x509.MarshalECPrivateKey(clientKey)
+	require.NoError(t, err)
+	clientCertPath := filepath.Join(dir, "client.crt")
+	writePEM(t, clientCertPath, "CERTIFICATE", clientCertDER)
+	clientKeyPath := filepath.Join(dir, "client.key")
+	writePEM(t, clientKeyPath, "EC PRIVATE KEY", clientKeyDER)
+
+	// Start an API server that requires client certificates issued by the CA.
+	// It responds with 503 to the number of requests specified by unavailable
+	// before responding with statusCode.
+	var statusCode int
+	var unavailable, requests int32
+	server := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if atomic.AddInt32(&unavailable, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+			require.Len(t, r.TLS.PeerCertificates, 1)
+			require.Equal(
+				t,
+				"gateway",
+				r.TLS.PeerCertificates[0].Subject.CommonName,
+			)
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path == "/v2/whoami" {
+				w.Write([]byte(`{}`)) // nolint: errcheck
+				return
+			}
+			require.Equal(t, "/v2/events", r.URL.Path)
+			w.WriteHeader(statusCode)
+			if statusCode == http.StatusCreated {
+				w.Write( // nolint: errcheck
+					[]byte(`{"items":[{"metadata":{"id":"abc"}}]}`),
+				)
+				return
+			}
+			w.Write([]byte(`{"reason":"nope"}`)) // nolint: errcheck
+		}),
+	)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+	caCertPath := filepath.Join(dir, "ca.crt")
+	writePEM(t, caCertPath, "CERTIFICATE", server.Certificate().Raw)
+
+	newClient, err := NewEventsClientFactory(
+		server.URL,
+		restmachinery.APIClientOptions{},
+		TLSConfig{
+			CACertPath:     caCertPath,
+			ClientCertPath: clientCertPath,
+			ClientKeyPath:  clientKeyPath,
+		},
+	)
+	require.NoError(t, err)
+	client := newClient("foo")
+
+	statusCode = http.StatusCreated
+	events, err := client.Create(context.Background(), sdk.Event{}, nil)
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	require.Equal(t, "abc", events.Items[0].ID)
+
+	// Transient errors are retried
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&unavailable, 1)
+	events, err = client.Create(context.Background(), sdk.Event{}, nil)
+	require.NoError(t, err)
+	require.Len(t, events.Items, 1)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// Other errors are not
+	atomic.StoreInt32(&requests, 0)
+	statusCode = http.StatusForbidden
+	_, err = client.Create(context.Background(), sdk.Event{}, nil)
+	require.Error(t, err)
+	require.IsType(t, &meta.ErrAuthorization{}, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// The client used for checking the API is configured the same way
+	checker, ok := client.(APIChecker)
+	require.True(t, ok)
+	require.NoError(t, checker.CheckAPI(context.Background()))
+}
+
+func TestSDKTransport(t *testing.T) {
+	transport, err := sdkTransport(
+		sdk.NewEventsClient("https://brigade.example.com", "foo", nil),
+	)
+	require.NoError(t, err)
+	require.NotNil(t, transport)
+	_, err = sdkTransport(&dryRunEventsClient{})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to configure TLS")
+}
+
+func writePEM(t *testing.T, path string, blockType string, der []byte) {
+	require.NoError(
+		t,
+		os.WriteFile(
+			path,
+			pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}),
+			0600,
+		),
+	)
+}
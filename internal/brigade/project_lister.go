@@ -0,0 +1,44 @@
+package brigade
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+)
+
+// ProjectLister is an interface for components that can list all projects
+// known to the Brigade API server they communicate with. All of the
+// sdk.EventsClient implementations in this package that communicate with a
+// Brigade API server also implement this interface.
+type ProjectLister interface {
+	// ListProjects returns all projects, across all pages of results.
+	ListProjects(ctx context.Context) ([]sdk.Project, error)
+}
+
+func (s *sdkEventsClient) ListProjects(
+	ctx context.Context,
+) ([]sdk.Project, error) {
+	projects := []sdk.Project{}
+	opts := &meta.ListOptions{}
+	for {
+		page, err := s.projectsClient.List(ctx, nil, opts)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, page.Items...)
+		if page.Continue == "" {
+			return projects, nil
+		}
+		opts.Continue = page.Continue
+	}
+}
+
+func (t *tokenFileEventsClient) ListProjects(
+	ctx context.Context,
+) ([]sdk.Project, error) {
+	if lister, ok := t.current().(ProjectLister); ok {
+		return lister.ListProjects(ctx)
+	}
+	return nil, errNotSupported
+}
@@ -0,0 +1,87 @@
+package brigade
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v3/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSDKEventsClientListProjects(t *testing.T) {
+	testCases := []struct {
+		name       string
+		listFn     func(*meta.ListOptions) (sdk.ProjectList, error)
+		assertions func([]sdk.Project, error)
+	}{
+		{
+			name: "error",
+			listFn: func(*meta.ListOptions) (sdk.ProjectList, error) {
+				return sdk.ProjectList{}, &meta.ErrAuthentication{}
+			},
+			assertions: func(_ []sdk.Project, err error) {
+				require.Error(t, err)
+				require.IsType(t, &meta.ErrAuthentication{}, err)
+			},
+		},
+		{
+			name: "success across multiple pages",
+			listFn: func(opts *meta.ListOptions) (sdk.ProjectList, error) {
+				if opts.Continue == "" {
+					return sdk.ProjectList{
+						ListMeta: meta.ListMeta{Continue: "bar"},
+						Items:    []sdk.Project{{ObjectMeta: meta.ObjectMeta{ID: "foo"}}},
+					}, nil
+				}
+				require.Equal(t, "bar", opts.Continue)
+				return sdk.ProjectList{
+					Items: []sdk.Project{{ObjectMeta: meta.ObjectMeta{ID: "bar"}}},
+				}, nil
+			},
+			assertions: func(projects []sdk.Project, err error) {
+				require.NoError(t, err)
+				require.Len(t, projects, 2)
+				require.Equal(t, "foo", projects[0].ID)
+				require.Equal(t, "bar", projects[1].ID)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			client := &sdkEventsClient{
+				projectsClient: &sdkTesting.MockProjectsClient{
+					ListFn: func(
+						_ context.Context,
+						_ *sdk.ProjectsSelector,
+						opts *meta.ListOptions,
+					) (sdk.ProjectList, error) {
+						return testCase.listFn(opts)
+					},
+				},
+			}
+			testCase.assertions(client.ListProjects(context.Background()))
+		})
+	}
+}
+
+func TestTokenFileEventsClientListProjects(t *testing.T) {
+	client := &tokenFileEventsClient{
+		client: &sdkEventsClient{
+			projectsClient: &sdkTesting.MockProjectsClient{
+				ListFn: func(
+					context.Context,
+					*sdk.ProjectsSelector,
+					*meta.ListOptions,
+				) (sdk.ProjectList, error) {
+					return sdk.ProjectList{}, errors.New("something went wrong")
+				},
+			},
+		},
+	}
+	_, err := client.ListProjects(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "something went wrong")
+}
@@ -0,0 +1,211 @@
+package brigade
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	"github.com/pkg/errors"
+)
+
+// TokenFileConfig encapsulates configuration for an implementation of the
+// sdk.EventsClient interface that reads its API token from a file.
+type TokenFileConfig struct {
+	// Path is the path to the file containing the API token.
+	Path string
+	// PollInterval is how often the file is checked for a new token.
+	PollInterval time.Duration
+}
+
+// tokenFileEventsClient is an implementation of the sdk.EventsClient interface
+// that delegates to an underlying sdk.EventsClient built using a token read
+// from a file. Whenever the token in the file changes, a new underlying client
+// is built and swapped in. Requests already in flight complete using the client
+// they started with.
+type tokenFileEventsClient struct {
+	config    TokenFileConfig
+	newClient func(apiToken string) sdk.EventsClient
+	mu        sync.RWMutex
+	token     string
+	client    sdk.EventsClient
+}
+
+// NewTokenFileEventsClient returns an implementation of the sdk.EventsClient
+// interface that reads its API token from the file specified by the provided
+// TokenFileConfig and uses the provided function to build an sdk.EventsClient
+// from that token. The file is polled for changes until the provided context
+// is canceled, so that a rotated token is picked up without a restart.
+func NewTokenFileEventsClient(
+	ctx context.Context,
+	config TokenFileConfig,
+	newClient func(apiToken string) sdk.EventsClient,
+) (sdk.EventsClient, error) {
+	t := &tokenFileEventsClient{
+		config:    config,
+		newClient: newClient,
+	}
+	if _, err := t.reload(); err != nil {
+		return nil, err
+	}
+	go t.watch(ctx)
+	return t, nil
+}
+
+// watch periodically reloads the API token until the provided context is
+// canceled.
+func (t *tokenFileEventsClient) watch(ctx context.Context) {
+	ticker := time.NewTicker(t.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if reloaded, err := t.reload(); err != nil {
+				log.Printf(
+					"error reloading API token; continuing to use previous token: %s",
+					err,
+				)
+			} else if reloaded {
+				log.Printf("reloaded API token from %s", t.config.Path)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload reads the API token from file and, if it has changed, swaps in a new
+// underlying client. The bool return value indicates whether a new client was
+// swapped in.
+func (t *tokenFileEventsClient) reload() (bool, error) {
+	tokenBytes, err := os.ReadFile(t.config.Path)
+	if err != nil {
+		return false, errors.Wrapf(
+			err,
+			"error reading API token from %s",
+			t.config.Path,
+		)
+	}
+	token := strings.TrimSpace(string(tokenBytes))
+	if token == "" {
+		return false, errors.Errorf("API token file %s is empty", t.config.Path)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token == t.token {
+		return false, nil
+	}
+	t.token = token
+	t.client = t.newClient(token)
+	return true, nil
+}
+
+// current returns the underlying client built using the most recently read
+// API token.
+func (t *tokenFileEventsClient) current() sdk.EventsClient {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.client
+}
+
+func (t *tokenFileEventsClient) Create(
+	ctx context.Context,
+	event sdk.Event,
+	opts *sdk.EventCreateOptions,
+) (sdk.EventList, error) {
+	return t.current().Create(ctx, event, opts)
+}
+
+func (t *tokenFileEventsClient) List(
+	ctx context.Context,
+	selector *sdk.EventsSelector,
+	opts *meta.ListOptions,
+) (sdk.EventList, error) {
+	return t.current().List(ctx, selector, opts)
+}
+
+func (t *tokenFileEventsClient) Get(
+	ctx context.Context,
+	id string,
+	opts *sdk.EventGetOptions,
+) (sdk.Event, error) {
+	return t.current().Get(ctx, id, opts)
+}
+
+func (t *tokenFileEventsClient) Clone(
+	ctx context.Context,
+	id string,
+	opts *sdk.EventCloneOptions,
+) (sdk.Event, error) {
+	return t.current().Clone(ctx, id, opts)
+}
+
+func (t *tokenFileEventsClient) UpdateSourceState(
+	ctx context.Context,
+	id string,
+	sourceState sdk.SourceState,
+	opts *sdk.EventSourceStateUpdateOptions,
+) error {
+	return t.current().UpdateSourceState(ctx, id, sourceState, opts)
+}
+
+func (t *tokenFileEventsClient) UpdateSummary(
+	ctx context.Context,
+	id string,
+	summary sdk.EventSummary,
+	opts *sdk.EventSummaryUpdateOptions,
+) error {
+	return t.current().UpdateSummary(ctx, id, summary, opts)
+}
+
+func (t *tokenFileEventsClient) Cancel(
+	ctx context.Context,
+	id string,
+	opts *sdk.EventCancelOptions,
+) error {
+	return t.current().Cancel(ctx, id, opts)
+}
+
+func (t *tokenFileEventsClient) CancelMany(
+	ctx context.Context,
+	selector sdk.EventsSelector,
+	opts *sdk.EventCancelManyOptions,
+) (sdk.CancelManyEventsResult, error) {
+	return t.current().CancelMany(ctx, selector, opts)
+}
+
+func (t *tokenFileEventsClient) Delete(
+	ctx context.Context,
+	id string,
+	opts *sdk.EventDeleteOptions,
+) error {
+	return t.current().Delete(ctx, id, opts)
+}
+
+func (t *tokenFileEventsClient) DeleteMany(
+	ctx context.Context,
+	selector sdk.EventsSelector,
+	opts *sdk.EventDeleteManyOptions,
+) (sdk.DeleteManyEventsResult, error) {
+	return t.current().DeleteMany(ctx, selector, opts)
+}
+
+func (t *tokenFileEventsClient) Retry(
+	ctx context.Context,
+	id string,
+	opts *sdk.EventRetryOptions,
+) (sdk.Event, error) {
+	return t.current().Retry(ctx, id, opts)
+}
+
+func (t *tokenFileEventsClient) Workers() sdk.WorkersClient {
+	return t.current().Workers()
+}
+
+func (t *tokenFileEventsClient) Logs() sdk.LogsClient {
+	return t.current().Logs()
+}
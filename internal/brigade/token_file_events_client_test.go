@@ -0,0 +1,118 @@
+package brigade
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTokenFileEventsClient(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	config := TokenFileConfig{
+		Path:         tokenPath,
+		PollInterval: time.Minute,
+	}
+	newClient := func(string) sdk.EventsClient {
+		return NewDryRunEventsClient()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// File does not exist
+	_, err := NewTokenFileEventsClient(ctx, config, newClient)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error reading API token")
+
+	// File is empty
+	require.NoError(t, os.WriteFile(tokenPath, []byte("\n"), 0600))
+	_, err = NewTokenFileEventsClient(ctx, config, newClient)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is empty")
+
+	// Success
+	require.NoError(t, os.WriteFile(tokenPath, []byte("foo\n"), 0600))
+	client, err := NewTokenFileEventsClient(ctx, config, newClient)
+	require.NoError(t, err)
+	c, ok := client.(*tokenFileEventsClient)
+	require.True(t, ok)
+	require.Equal(t, "foo", c.token)
+	require.NotNil(t, c.current())
+}
+
+func TestTokenFileEventsClientRotation(t *testing.T) {
+	// The first request made using the original token blocks until released so
+	// that it is still in flight when the token is rotated.
+	release := make(chan struct{})
+	received := make(chan string, 10)
+	var once sync.Once
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("Authorization")
+			if token == "Bearer old" {
+				once.Do(func() {
+					received <- token
+					<-release
+				})
+			} else {
+				received <- token
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"items":[{"metadata":{"id":"abc"}}]}`)) // nolint: errcheck
+		}),
+	)
+	defer server.Close()
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("old"), 0600))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := NewTokenFileEventsClient(
+		ctx,
+		TokenFileConfig{
+			Path:         tokenPath,
+			PollInterval: 10 * time.Millisecond,
+		},
+		func(token string) sdk.EventsClient {
+			return sdk.NewEventsClient(server.URL, token, nil)
+		},
+	)
+	require.NoError(t, err)
+
+	inFlightErr := make(chan error)
+	go func() {
+		_, err := client.Create(context.Background(), sdk.Event{}, nil)
+		inFlightErr <- err
+	}()
+	require.Equal(t, "Bearer old", <-received)
+
+	// Rotate the token while the first request is still in flight
+	require.NoError(t, os.WriteFile(tokenPath, []byte("new"), 0600))
+	require.Eventually(
+		t,
+		func() bool {
+			c := client.(*tokenFileEventsClient)
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.token == "new"
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+	events, err := client.Create(context.Background(), sdk.Event{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "abc", events.Items[0].ID)
+	require.Equal(t, "Bearer new", <-received)
+
+	// The in-flight request should complete successfully
+	close(release)
+	require.NoError(t, <-inFlightErr)
+}
@@ -0,0 +1,255 @@
+package brigade
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	"github.com/pkg/errors"
+)
+
+// errNotSupported is returned by every function of unsupportedEventsClient,
+// unsupportedWorkersClient, unsupportedJobsClient, and unsupportedLogsClient.
+var errNotSupported = errors.New("not supported")
+
+// unsupportedEventsClient is an implementation of the sdk.EventsClient
+// interface whose functions all return an error. It is intended to be embedded
+// in implementations of the sdk.EventsClient interface that override only the
+// functions the gateway actually calls.
+type unsupportedEventsClient struct{}
+
+func (unsupportedEventsClient) Create(
+	context.Context,
+	sdk.Event,
+	*sdk.EventCreateOptions,
+) (sdk.EventList, error) {
+	return sdk.EventList{}, errNotSupported
+}
+
+func (unsupportedEventsClient) List(
+	context.Context,
+	*sdk.EventsSelector,
+	*meta.ListOptions,
+) (sdk.EventList, error) {
+	return sdk.EventList{}, errNotSupported
+}
+
+func (unsupportedEventsClient) Get(
+	context.Context,
+	string,
+	*sdk.EventGetOptions,
+) (sdk.Event, error) {
+	return sdk.Event{}, errNotSupported
+}
+
+func (unsupportedEventsClient) Clone(
+	context.Context,
+	string,
+	*sdk.EventCloneOptions,
+) (sdk.Event, error) {
+	return sdk.Event{}, errNotSupported
+}
+
+func (unsupportedEventsClient) UpdateSourceState(
+	context.Context,
+	string,
+	sdk.SourceState,
+	*sdk.EventSourceStateUpdateOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedEventsClient) UpdateSummary(
+	context.Context,
+	string,
+	sdk.EventSummary,
+	*sdk.EventSummaryUpdateOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedEventsClient) Cancel(
+	context.Context,
+	string,
+	*sdk.EventCancelOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedEventsClient) CancelMany(
+	context.Context,
+	sdk.EventsSelector,
+	*sdk.EventCancelManyOptions,
+) (sdk.CancelManyEventsResult, error) {
+	return sdk.CancelManyEventsResult{}, errNotSupported
+}
+
+func (unsupportedEventsClient) Delete(
+	context.Context,
+	string,
+	*sdk.EventDeleteOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedEventsClient) DeleteMany(
+	context.Context,
+	sdk.EventsSelector,
+	*sdk.EventDeleteManyOptions,
+) (sdk.DeleteManyEventsResult, error) {
+	return sdk.DeleteManyEventsResult{}, errNotSupported
+}
+
+func (unsupportedEventsClient) Retry(
+	context.Context,
+	string,
+	*sdk.EventRetryOptions,
+) (sdk.Event, error) {
+	return sdk.Event{}, errNotSupported
+}
+
+func (unsupportedEventsClient) Workers() sdk.WorkersClient {
+	return unsupportedWorkersClient{}
+}
+
+func (unsupportedEventsClient) Logs() sdk.LogsClient {
+	return unsupportedLogsClient{}
+}
+
+// unsupportedWorkersClient is an implementation of the sdk.WorkersClient
+// interface whose functions all return an error.
+type unsupportedWorkersClient struct{}
+
+func (unsupportedWorkersClient) Start(
+	context.Context,
+	string,
+	*sdk.WorkerStartOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedWorkersClient) GetStatus(
+	context.Context,
+	string,
+	*sdk.WorkerStatusGetOptions,
+) (sdk.WorkerStatus, error) {
+	return sdk.WorkerStatus{}, errNotSupported
+}
+
+func (unsupportedWorkersClient) WatchStatus(
+	context.Context,
+	string,
+	*sdk.WorkerStatusWatchOptions,
+) (<-chan sdk.WorkerStatus, <-chan error, error) {
+	return nil, nil, errNotSupported
+}
+
+func (unsupportedWorkersClient) UpdateStatus(
+	context.Context,
+	string,
+	sdk.WorkerStatus,
+	*sdk.WorkerStatusUpdateOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedWorkersClient) Cleanup(
+	context.Context,
+	string,
+	*sdk.WorkerCleanupOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedWorkersClient) Timeout(
+	context.Context,
+	string,
+	*sdk.WorkerTimeoutOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedWorkersClient) Jobs() sdk.JobsClient {
+	return unsupportedJobsClient{}
+}
+
+// unsupportedJobsClient is an implementation of the sdk.JobsClient interface
+// whose functions all return an error.
+type unsupportedJobsClient struct{}
+
+func (unsupportedJobsClient) Create(
+	context.Context,
+	string,
+	sdk.Job,
+	*sdk.JobCreateOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedJobsClient) Start(
+	context.Context,
+	string,
+	string,
+	*sdk.JobStartOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedJobsClient) GetStatus(
+	context.Context,
+	string,
+	string,
+	*sdk.JobStatusGetOptions,
+) (sdk.JobStatus, error) {
+	return sdk.JobStatus{}, errNotSupported
+}
+
+func (unsupportedJobsClient) WatchStatus(
+	context.Context,
+	string,
+	string,
+	*sdk.JobStatusWatchOptions,
+) (<-chan sdk.JobStatus, <-chan error, error) {
+	return nil, nil, errNotSupported
+}
+
+func (unsupportedJobsClient) UpdateStatus(
+	context.Context,
+	string,
+	string,
+	sdk.JobStatus,
+	*sdk.JobStatusUpdateOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedJobsClient) Cleanup(
+	context.Context,
+	string,
+	string,
+	*sdk.JobCleanupOptions,
+) error {
+	return errNotSupported
+}
+
+func (unsupportedJobsClient) Timeout(
+	context.Context,
+	string,
+	string,
+	*sdk.JobTimeoutOptions,
+) error {
+	return errNotSupported
+}
+
+// unsupportedLogsClient is an implementation of the sdk.LogsClient interface
+// whose functions all return an error.
+type unsupportedLogsClient struct{}
+
+func (unsupportedLogsClient) Stream(
+	context.Context,
+	string,
+	*sdk.LogsSelector,
+	*sdk.LogStreamOptions,
+) (<-chan sdk.LogEntry, <-chan error, error) {
+	return nil, nil, errNotSupported
+}
@@ -0,0 +1,485 @@
+package connect
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultKey is the key that uniquely identifies the app, unless configured
+	// otherwise.
+	DefaultKey = "brigade-bitbucket-gateway"
+	// DefaultName is the name of the app, unless configured otherwise.
+	DefaultName = "Brigade Bitbucket Gateway"
+
+	descriptorPath  = "/connect/descriptor"
+	installedPath   = "/connect/installed"
+	uninstalledPath = "/connect/uninstalled"
+	eventsPath      = "/connect/events"
+)
+
+// AppConfig encapsulates configuration for a Bitbucket Connect app.
+type AppConfig struct {
+	// Key uniquely identifies the app.
+	Key string
+	// Name is the app's name, as displayed to users installing it.
+	Name string
+	// BaseURL is the gateway's public URL, e.g. https://gateway.example.com.
+	BaseURL string
+	// Events are the keys (e.g. repo:push) of the events the app subscribes to.
+	Events []string
+	// InstallationsPath is the path to the file installations are persisted to.
+	InstallationsPath string
+	// AllowedWorkspaces are the only workspaces (or users) permitted to install
+	// the app. If empty, no workspace is permitted to install it.
+	AllowedWorkspaces []string
+	// APIAddress is the address of the Bitbucket REST API, e.g.
+	// https://api.bitbucket.org, with which installations are confirmed.
+	APIAddress string
+}
+
+// descriptor is the app descriptor Bitbucket reads to install the app.
+type descriptor struct {
+	Key            string               `json:"key"`
+	Name           string               `json:"name"`
+	Description    string               `json:"description"`
+	BaseURL        string               `json:"baseUrl"`
+	Authentication descriptorAuth       `json:"authentication"`
+	Lifecycle      descriptorLifecycle  `json:"lifecycle"`
+	Contexts       []string             `json:"contexts"`
+	Scopes         []string             `json:"scopes"`
+	Modules        descriptorModuleList `json:"modules"`
+}
+
+type descriptorAuth struct {
+	Type string `json:"type"`
+}
+
+type descriptorLifecycle struct {
+	Installed   string `json:"installed"`
+	Uninstalled string `json:"uninstalled"`
+}
+
+type descriptorModuleList struct {
+	Webhooks []descriptorWebhook `json:"webhooks"`
+}
+
+type descriptorWebhook struct {
+	Event string `json:"event"`
+	URL   string `json:"url"`
+}
+
+// lifecycleEvent is the payload of an installed or uninstalled lifecycle
+// callback.
+type lifecycleEvent struct {
+	Key          string    `json:"key"`
+	EventType    string    `json:"eventType"`
+	ClientKey    string    `json:"clientKey"`
+	SharedSecret string    `json:"sharedSecret"`
+	BaseURL      string    `json:"baseUrl"`
+	Principal    Principal `json:"principal"`
+}
+
+// app is an implementation of the http.Handler interface that serves a
+// Bitbucket Connect app.
+type app struct {
+	config        AppConfig
+	handler       http.Handler
+	installations *installationStore
+	router        *mux.Router
+	httpClient    *http.Client
+	now           func() time.Time
+}
+
+// NewApp returns an implementation of the http.Handler interface that serves a
+// Bitbucket Connect app. The app's descriptor is served at
+// /connect/descriptor, installed and uninstalled lifecycle callbacks are
+// handled at /connect/installed and /connect/uninstalled, and webhooks are
+// received at /connect/events. Each webhook that bears a valid JWT for a known
+// installation and pertains to the installing workspace is handed off to the
+// provided http.Handler exactly as if Bitbucket had sent it directly to the
+// gateway. Any installations persisted by a previous app are read immediately.
+func NewApp(config AppConfig, handler http.Handler) (http.Handler, error) {
+	installations, err := newInstallationStore(config.InstallationsPath)
+	if err != nil {
+		return nil, err
+	}
+	a := &app{
+		config:        config,
+		handler:       handler,
+		installations: installations,
+		router:        mux.NewRouter(),
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+		now:           time.Now,
+	}
+	a.router.HandleFunc(descriptorPath, a.serveDescriptor).
+		Methods(http.MethodGet)
+	a.router.HandleFunc(installedPath, a.installed).Methods(http.MethodPost)
+	a.router.HandleFunc(uninstalledPath, a.uninstalled).Methods(http.MethodPost)
+	a.router.HandleFunc(eventsPath, a.receive).Methods(http.MethodPost)
+	return a, nil
+}
+
+func (a *app) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
+}
+
+func (a *app) serveDescriptor(w http.ResponseWriter, _ *http.Request) {
+	d := descriptor{
+		Key:  a.config.Key,
+		Name: a.config.Name,
+		Description: "Emits events from Bitbucket repositories into " +
+			"Brigade's event bus",
+		BaseURL:        a.config.BaseURL,
+		Authentication: descriptorAuth{Type: "jwt"},
+		Lifecycle: descriptorLifecycle{
+			Installed:   installedPath,
+			Uninstalled: uninstalledPath,
+		},
+		Contexts: []string{"account"},
+		Scopes:   []string{"account", "issue", "pullrequest", "repository"},
+		Modules: descriptorModuleList{
+			Webhooks: make([]descriptorWebhook, len(a.config.Events)),
+		},
+	}
+	for i, event := range a.config.Events {
+		d.Modules.Webhooks[i] = descriptorWebhook{Event: event, URL: eventsPath}
+	}
+	descriptorJSON, err := json.Marshal(d)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(descriptorJSON) // nolint: errcheck
+}
+
+// installed handles the installed lifecycle callback. A new installation's
+// callback must be signed with the shared secret it conveys. A callback that
+// replaces an existing installation must be signed with the existing
+// installation's shared secret so that an installation cannot be hijacked.
+// Since anyone can sign a callback with a secret of their choosing, every
+// installation is also confirmed with Bitbucket before it is stored.
+func (a *app) installed(w http.ResponseWriter, r *http.Request) {
+	event, err := a.lifecycleEvent(r, "installed")
+	if err != nil {
+		log.Printf("error handling installed callback: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if event.SharedSecret == "" {
+		log.Printf(
+			"error handling installed callback: installation %s did not specify "+
+				"a shared secret",
+			event.ClientKey,
+		)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	secret := event.SharedSecret
+	if existing, ok := a.installations.get(event.ClientKey); ok {
+		secret = existing.SharedSecret
+	}
+	if _, err = a.verifyRequest(r, secret, event.ClientKey); err != nil {
+		log.Printf(
+			"error authenticating installed callback for installation %s: %s",
+			event.ClientKey,
+			err,
+		)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !a.workspaceAllowed(event.Principal) {
+		log.Printf(
+			"rejected installation %s by %s, which is not an allowed workspace",
+			event.ClientKey,
+			event.Principal.Username,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// The principal Bitbucket confirms is stored in place of the event's, which
+	// may lack identifiers that were therefore not compared.
+	if event.Principal, err =
+		a.confirmInstallation(r.Context(), event); err != nil {
+		log.Printf(
+			"error confirming installation %s with Bitbucket: %s",
+			event.ClientKey,
+			err,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err = a.installations.put(
+		Installation{
+			ClientKey:    event.ClientKey,
+			SharedSecret: event.SharedSecret,
+			BaseURL:      event.BaseURL,
+			Principal:    event.Principal,
+			InstalledAt:  a.now().UTC(),
+		},
+	); err != nil {
+		log.Printf("error saving installation %s: %s", event.ClientKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf(
+		"app installed by %s (installation %s)",
+		event.Principal.Username,
+		event.ClientKey,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uninstalled handles the uninstalled lifecycle callback, which must be signed
+// with the installation's shared secret.
+func (a *app) uninstalled(w http.ResponseWriter, r *http.Request) {
+	event, err := a.lifecycleEvent(r, "uninstalled")
+	if err != nil {
+		log.Printf("error handling uninstalled callback: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	installation, ok := a.installations.get(event.ClientKey)
+	if !ok {
+		// Nothing to do
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if _, err = a.verifyRequest(
+		r,
+		installation.SharedSecret,
+		event.ClientKey,
+	); err != nil {
+		log.Printf(
+			"error authenticating uninstalled callback for installation %s: %s",
+			event.ClientKey,
+			err,
+		)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err = a.installations.delete(event.ClientKey); err != nil {
+		log.Printf("error deleting installation %s: %s", event.ClientKey, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf(
+		"app uninstalled by %s (installation %s)",
+		installation.Principal.Username,
+		event.ClientKey,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lifecycleEvent reads and validates the lifecycle event of the specified type
+// from the provided request's body.
+func (a *app) lifecycleEvent(
+	r *http.Request,
+	eventType string,
+) (lifecycleEvent, error) {
+	defer r.Body.Close()
+	event := lifecycleEvent{}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		return event, errors.Wrap(err, "error parsing request body")
+	}
+	if event.EventType != "" && event.EventType != eventType {
+		return event, errors.Errorf(
+			"received %s event instead of %s event",
+			event.EventType,
+			eventType,
+		)
+	}
+	if event.Key != a.config.Key {
+		return event, errors.Errorf("event pertains to unknown app %q", event.Key)
+	}
+	if event.ClientKey == "" {
+		return event, errors.New("event does not specify a client key")
+	}
+	return event, nil
+}
+
+// receive authenticates a webhook and hands it off to the handler.
+func (a *app) receive(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	token := requestJWT(r)
+	if token == "" {
+		log.Println("rejected webhook without a JWT")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	unverified, err := decodeJWT(token)
+	if err != nil {
+		log.Printf("rejected webhook: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	installation, ok := a.installations.get(unverified.Issuer)
+	if !ok {
+		log.Printf(
+			"rejected webhook for unknown installation %s",
+			unverified.Issuer,
+		)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if _, err = a.verifyRequest(
+		r,
+		installation.SharedSecret,
+		installation.ClientKey,
+	); err != nil {
+		log.Printf(
+			"rejected webhook for installation %s: %s",
+			installation.ClientKey,
+			err,
+		)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("error reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	payload, eventKey := unwrap(body)
+	if err = checkWorkspace(payload, installation.Principal); err != nil {
+		log.Printf(
+			"rejected webhook for installation %s: %s",
+			installation.ClientKey,
+			err,
+		)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	req := r.Clone(r.Context())
+	req.Body = io.NopCloser(bytes.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+	// The JWT has served its purpose and need not be archived
+	req.Header.Del("Authorization")
+	if req.Header.Get("X-Event-Key") == "" && eventKey != "" {
+		req.Header.Set("X-Event-Key", eventKey)
+	}
+	a.handler.ServeHTTP(w, req)
+}
+
+// verifyRequest verifies that the provided request bears a JWT issued by the
+// specified installation, signed with the provided secret, that has not
+// expired, and that is bound to the request.
+func (a *app) verifyRequest(
+	r *http.Request,
+	secret string,
+	clientKey string,
+) (claims, error) {
+	token := requestJWT(r)
+	if token == "" {
+		return claims{}, errors.New("request does not bear a JWT")
+	}
+	c, err := verifyJWT(token, secret, a.now())
+	if err != nil {
+		return c, err
+	}
+	if c.Issuer != clientKey {
+		return c, errors.Errorf("JWT was issued by %q", c.Issuer)
+	}
+	if c.QueryStringHash == "" {
+		return c, errors.New("JWT does not specify a query string hash")
+	}
+	if c.QueryStringHash !=
+		queryStringHash(r.Method, r.URL.Path, r.URL.Query()) {
+		return c, errors.New("JWT is not bound to the request")
+	}
+	return c, nil
+}
+
+// workspaceAllowed returns a bool indicating whether the provided principal is
+// permitted to install the app.
+func (a *app) workspaceAllowed(principal Principal) bool {
+	for _, workspace := range a.config.AllowedWorkspaces {
+		if strings.EqualFold(workspace, principal.Username) ||
+			(principal.UUID != "" && workspace == principal.UUID) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestJWT returns the JWT borne by the provided request's Authorization
+// header or jwt query parameter, or an empty string if it bears none.
+func requestJWT(r *http.Request) string {
+	const prefix = "JWT "
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, prefix) {
+		return strings.TrimPrefix(header, prefix)
+	}
+	return r.URL.Query().Get("jwt")
+}
+
+// unwrap returns the Bitbucket webhook payload contained in the provided body
+// of a webhook sent to a Connect app, along with the event key the body
+// specifies, if any. Connect apps may receive the payload wrapped in an
+// envelope of the form {"event": "repo:push", "data": {...}}. A body that is
+// not so wrapped is returned as is.
+func unwrap(body []byte) ([]byte, string) {
+	envelope := struct {
+		Event string          `json:"event"`
+		Data  json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(body, &envelope); err != nil ||
+		len(envelope.Data) == 0 || envelope.Data[0] != '{' {
+		return body, ""
+	}
+	return envelope.Data, envelope.Event
+}
+
+// checkWorkspace returns an error if the provided webhook payload does not
+// pertain to a repository owned by the provided principal. This ensures that
+// an installation can only ever emit events for its own workspace.
+func checkWorkspace(payload []byte, principal Principal) error {
+	body := struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+			Owner    struct {
+				UUID string `json:"uuid"`
+			} `json:"owner"`
+			Workspace struct {
+				UUID string `json:"uuid"`
+				Slug string `json:"slug"`
+			} `json:"workspace"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return errors.Wrap(err, "error parsing payload")
+	}
+	repo := body.Repository
+	if repo.FullName == "" {
+		return errors.New("payload does not identify a repository")
+	}
+	if principal.UUID != "" &&
+		(repo.Owner.UUID == principal.UUID ||
+			repo.Workspace.UUID == principal.UUID) {
+		return nil
+	}
+	workspace := repo.Workspace.Slug
+	if workspace == "" {
+		workspace = strings.SplitN(repo.FullName, "/", 2)[0]
+	}
+	if principal.Username != "" &&
+		strings.EqualFold(workspace, principal.Username) {
+		return nil
+	}
+	return errors.Errorf(
+		"repository %s does not belong to the installing workspace",
+		repo.FullName,
+	)
+}
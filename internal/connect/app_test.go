@@ -0,0 +1,654 @@
+package connect
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// signedRequest returns a request bearing a JWT issued by the specified
+// installation, signed with the specified secret, and bound to the request.
+func signedRequest(
+	t *testing.T,
+	path string,
+	body string,
+	clientKey string,
+	secret string,
+) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	token, err := encodeJWT(
+		claims{
+			Issuer:          clientKey,
+			IssuedAt:        time.Now().Unix(),
+			Expiry:          time.Now().Add(time.Minute).Unix(),
+			QueryStringHash: queryStringHash(req.Method, path, nil),
+		},
+		secret,
+	)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "JWT "+token)
+	return req
+}
+
+// lifecycleBody returns the body of a lifecycle callback.
+func lifecycleBody(
+	t *testing.T,
+	eventType string,
+	clientKey string,
+	secret string,
+	workspace string,
+) string {
+	bodyJSON, err := json.Marshal(
+		lifecycleEvent{
+			Key:          DefaultKey,
+			EventType:    eventType,
+			ClientKey:    clientKey,
+			SharedSecret: secret,
+			Principal:    Principal{Type: "team", Username: workspace},
+		},
+	)
+	require.NoError(t, err)
+	return string(bodyJSON)
+}
+
+// newFakeBitbucketAPI returns a server that stands in for the Bitbucket REST
+// API's principal endpoint. It responds with the principal of the provided
+// installation if, and only if, a request bears a JWT for that installation
+// that the app signed with its shared secret.
+func newFakeBitbucketAPI(
+	t *testing.T,
+	installation Installation,
+) *httptest.Server {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, principalPath, r.URL.Path)
+			c, err := verifyJWT(
+				strings.TrimPrefix(r.Header.Get("Authorization"), "JWT "),
+				installation.SharedSecret,
+				time.Now(),
+			)
+			if err != nil || c.Issuer != DefaultKey ||
+				c.Subject != installation.ClientKey ||
+				c.QueryStringHash !=
+					queryStringHash(http.MethodGet, principalPath, nil) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(installation.Principal) // nolint: errcheck
+		}),
+	)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestApp returns an app whose webhooks are handed off to a handler that
+// records the last request it received.
+func newTestApp(
+	t *testing.T,
+	config AppConfig,
+) (*app, func() *http.Request) {
+	if config.Key == "" {
+		config.Key = DefaultKey
+	}
+	if config.InstallationsPath == "" {
+		config.InstallationsPath =
+			filepath.Join(t.TempDir(), "installations.json")
+	}
+	var received *http.Request
+	handler, err := NewApp(
+		config,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	require.NoError(t, err)
+	a, ok := handler.(*app)
+	require.True(t, ok)
+	return a, func() *http.Request { return received }
+}
+
+func TestNewApp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "installations.json")
+	require.NoError(t, os.WriteFile(path, []byte("foo"), 0600))
+	_, err := NewApp(AppConfig{InstallationsPath: path}, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error parsing")
+
+	a, _ := newTestApp(t, AppConfig{})
+	require.NotNil(t, a.installations)
+	require.NotNil(t, a.router)
+}
+
+func TestAppServeDescriptor(t *testing.T) {
+	a, _ := newTestApp(
+		t,
+		AppConfig{
+			Name:    DefaultName,
+			BaseURL: "https://gateway.example.com",
+			Events:  []string{"pullrequest:created", "repo:push"},
+		},
+	)
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, descriptorPath, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	d := descriptor{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &d))
+	require.Equal(t, DefaultKey, d.Key)
+	require.Equal(t, DefaultName, d.Name)
+	require.Equal(t, "https://gateway.example.com", d.BaseURL)
+	require.Equal(t, "jwt", d.Authentication.Type)
+	require.Equal(t, installedPath, d.Lifecycle.Installed)
+	require.Equal(t, uninstalledPath, d.Lifecycle.Uninstalled)
+	require.Equal(
+		t,
+		[]descriptorWebhook{
+			{Event: "pullrequest:created", URL: eventsPath},
+			{Event: "repo:push", URL: eventsPath},
+		},
+		d.Modules.Webhooks,
+	)
+}
+
+func TestAppInstalled(t *testing.T) {
+	// The installation Bitbucket knows of, unless a test case specifies another
+	known := Installation{
+		ClientKey:    "foo",
+		SharedSecret: "secret",
+		Principal: Principal{
+			Type:     "team",
+			UUID:     "{1}",
+			Username: "example-org",
+		},
+	}
+	testCases := []struct {
+		name       string
+		existing   *Installation
+		known      *Installation
+		req        func() *http.Request
+		assertions func(*app, *httptest.ResponseRecorder)
+	}{
+		{
+			name: "unparsable body",
+			req: func() *http.Request {
+				return signedRequest(t, installedPath, "foo", "foo", "secret")
+			},
+			assertions: func(_ *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "unknown app",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					`{"key":"bogus","clientKey":"foo","sharedSecret":"secret"}`,
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(_ *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "no shared secret",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "", "example-org"),
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(_ *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "not signed with conveyed secret",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "secret", "example-org"),
+					"foo",
+					"wrong",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.False(t, ok)
+			},
+		},
+		{
+			name: "workspace not allowed",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "secret", "another-org"),
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.False(t, ok)
+			},
+		},
+		{
+			name:     "existing installation not signed with existing secret",
+			existing: &Installation{ClientKey: "foo", SharedSecret: "old"},
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "new", "example-org"),
+					"foo",
+					"new",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				installation, ok := a.installations.get("foo")
+				require.True(t, ok)
+				require.Equal(t, "old", installation.SharedSecret)
+			},
+		},
+		{
+			name: "installation unknown to Bitbucket",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "forged", "example-org"),
+					"foo",
+					"forged",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.False(t, ok)
+			},
+		},
+		{
+			name: "principal does not match Bitbucket's",
+			known: &Installation{
+				ClientKey:    "foo",
+				SharedSecret: "secret",
+				Principal:    Principal{Username: "another-org"},
+			},
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "secret", "example-org"),
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.False(t, ok)
+			},
+		},
+		{
+			name:     "existing installation signed with existing secret",
+			existing: &Installation{ClientKey: "foo", SharedSecret: "old"},
+			known: &Installation{
+				ClientKey:    "foo",
+				SharedSecret: "new",
+				Principal:    Principal{Username: "example-org"},
+			},
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "new", "example-org"),
+					"foo",
+					"old",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNoContent, rr.Code)
+				installation, ok := a.installations.get("foo")
+				require.True(t, ok)
+				require.Equal(t, "new", installation.SharedSecret)
+			},
+		},
+		{
+			name: "success",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					installedPath,
+					lifecycleBody(t, "installed", "foo", "secret", "Example-Org"),
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNoContent, rr.Code)
+				installation, ok := a.installations.get("foo")
+				require.True(t, ok)
+				require.Equal(t, "secret", installation.SharedSecret)
+				// The principal Bitbucket confirmed should have been stored
+				require.Equal(t, known.Principal, installation.Principal)
+				require.NotZero(t, installation.InstalledAt)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bitbucketInstallation := known
+			if testCase.known != nil {
+				bitbucketInstallation = *testCase.known
+			}
+			a, _ := newTestApp(
+				t,
+				AppConfig{
+					AllowedWorkspaces: []string{"example-org"},
+					APIAddress:        newFakeBitbucketAPI(t, bitbucketInstallation).URL,
+				},
+			)
+			if testCase.existing != nil {
+				require.NoError(t, a.installations.put(*testCase.existing))
+			}
+			rr := httptest.NewRecorder()
+			a.ServeHTTP(rr, testCase.req())
+			testCase.assertions(a, rr)
+		})
+	}
+}
+
+func TestAppUninstalled(t *testing.T) {
+	testCases := []struct {
+		name       string
+		req        func() *http.Request
+		assertions func(*app, *httptest.ResponseRecorder)
+	}{
+		{
+			name: "unknown installation",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					uninstalledPath,
+					lifecycleBody(t, "uninstalled", "bar", "", ""),
+					"bar",
+					"secret",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNoContent, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.True(t, ok)
+			},
+		},
+		{
+			name: "not signed with installation's secret",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					uninstalledPath,
+					lifecycleBody(t, "uninstalled", "foo", "", ""),
+					"foo",
+					"wrong",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.True(t, ok)
+			},
+		},
+		{
+			name: "success",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					uninstalledPath,
+					lifecycleBody(t, "uninstalled", "foo", "", ""),
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(a *app, rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNoContent, rr.Code)
+				_, ok := a.installations.get("foo")
+				require.False(t, ok)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			a, _ := newTestApp(t, AppConfig{})
+			require.NoError(
+				t,
+				a.installations.put(
+					Installation{ClientKey: "foo", SharedSecret: "secret"},
+				),
+			)
+			rr := httptest.NewRecorder()
+			a.ServeHTTP(rr, testCase.req())
+			testCase.assertions(a, rr)
+		})
+	}
+}
+
+func TestAppReceive(t *testing.T) {
+	const payload = `{"repository":{"full_name":"example-org/example",` +
+		`"owner":{"uuid":"{123}"}}}`
+	testCases := []struct {
+		name       string
+		req        func() *http.Request
+		assertions func(*httptest.ResponseRecorder, *http.Request)
+	}{
+		{
+			name: "no JWT",
+			req: func() *http.Request {
+				return httptest.NewRequest(
+					http.MethodPost,
+					eventsPath,
+					strings.NewReader(payload),
+				)
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Nil(t, received)
+			},
+		},
+		{
+			name: "unknown installation",
+			req: func() *http.Request {
+				return signedRequest(t, eventsPath, payload, "bar", "secret")
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Nil(t, received)
+			},
+		},
+		{
+			name: "invalid signature",
+			req: func() *http.Request {
+				return signedRequest(t, eventsPath, payload, "foo", "wrong")
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Nil(t, received)
+			},
+		},
+		{
+			name: "JWT without query string hash",
+			req: func() *http.Request {
+				req := httptest.NewRequest(
+					http.MethodPost,
+					eventsPath,
+					strings.NewReader(payload),
+				)
+				token, err := encodeJWT(
+					claims{
+						Issuer:   "foo",
+						IssuedAt: time.Now().Unix(),
+						Expiry:   time.Now().Add(time.Minute).Unix(),
+					},
+					"secret",
+				)
+				require.NoError(t, err)
+				req.Header.Set("Authorization", "JWT "+token)
+				return req
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Nil(t, received)
+			},
+		},
+		{
+			name: "JWT not bound to request",
+			req: func() *http.Request {
+				req := signedRequest(t, eventsPath, payload, "foo", "secret")
+				req.URL.RawQuery = "foo=bar"
+				return req
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusUnauthorized, rr.Code)
+				require.Nil(t, received)
+			},
+		},
+		{
+			name: "repository in another workspace",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					eventsPath,
+					`{"repository":{"full_name":"another-org/example"}}`,
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				require.Nil(t, received)
+			},
+		},
+		{
+			name: "success",
+			req: func() *http.Request {
+				req := signedRequest(t, eventsPath, payload, "foo", "secret")
+				req.Header.Set("X-Event-Key", "repo:push")
+				return req
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.NotNil(t, received)
+				require.Empty(t, received.Header.Get("Authorization"))
+				require.Equal(t, "repo:push", received.Header.Get("X-Event-Key"))
+				body, err := io.ReadAll(received.Body)
+				require.NoError(t, err)
+				require.Equal(t, payload, string(body))
+			},
+		},
+		{
+			name: "success with envelope",
+			req: func() *http.Request {
+				return signedRequest(
+					t,
+					eventsPath,
+					`{"event":"repo:push","data":`+payload+`}`,
+					"foo",
+					"secret",
+				)
+			},
+			assertions: func(rr *httptest.ResponseRecorder, received *http.Request) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.NotNil(t, received)
+				require.Equal(t, "repo:push", received.Header.Get("X-Event-Key"))
+				body, err := io.ReadAll(received.Body)
+				require.NoError(t, err)
+				require.Equal(t, payload, string(body))
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			a, received := newTestApp(t, AppConfig{})
+			require.NoError(
+				t,
+				a.installations.put(
+					Installation{
+						ClientKey:    "foo",
+						SharedSecret: "secret",
+						Principal:    Principal{Username: "example-org"},
+					},
+				),
+			)
+			rr := httptest.NewRecorder()
+			a.ServeHTTP(rr, testCase.req())
+			testCase.assertions(rr, received())
+		})
+	}
+}
+
+func TestCheckWorkspace(t *testing.T) {
+	testCases := []struct {
+		name      string
+		payload   string
+		principal Principal
+		allowed   bool
+	}{
+		{
+			name:      "no repository",
+			payload:   `{}`,
+			principal: Principal{Username: "example-org"},
+		},
+		{
+			name:      "owner UUID matches",
+			payload:   `{"repository":{"full_name":"a/b","owner":{"uuid":"{1}"}}}`,
+			principal: Principal{UUID: "{1}", Username: "example-org"},
+			allowed:   true,
+		},
+		{
+			name: "workspace slug matches",
+			payload: `{"repository":{"full_name":"a/b",` +
+				`"workspace":{"slug":"example-org"}}}`,
+			principal: Principal{Username: "example-org"},
+			allowed:   true,
+		},
+		{
+			name:      "full name matches",
+			payload:   `{"repository":{"full_name":"Example-Org/b"}}`,
+			principal: Principal{Username: "example-org"},
+			allowed:   true,
+		},
+		{
+			name:      "nothing matches",
+			payload:   `{"repository":{"full_name":"a/b","owner":{"uuid":"{2}"}}}`,
+			principal: Principal{UUID: "{1}", Username: "example-org"},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := checkWorkspace([]byte(testCase.payload), testCase.principal)
+			if testCase.allowed {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package connect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// principalPath is the path, relative to the address of the Bitbucket REST
+// API, of the endpoint that describes the principal the caller acts as.
+const principalPath = "/2.0/user"
+
+// confirmInstallation confirms with Bitbucket that the provided installed
+// event describes a genuine installation. The installation's principal is
+// requested from the Bitbucket REST API using a JWT the app signs with the
+// shared secret the event conveys. Bitbucket accepts the JWT only if it knows
+// of an installation with the event's client key and shared secret, in which
+// case the principal it returns must match the event's and is returned. The
+// event's base URL is deliberately disregarded in favor of the configured API
+// address, since it, too, could have been specified by anyone.
+func (a *app) confirmInstallation(
+	ctx context.Context,
+	event lifecycleEvent,
+) (Principal, error) {
+	now := a.now()
+	token, err := encodeJWT(
+		claims{
+			Issuer:          a.config.Key,
+			Subject:         event.ClientKey,
+			IssuedAt:        now.Unix(),
+			Expiry:          now.Add(jwtLeeway).Unix(),
+			QueryStringHash: queryStringHash(http.MethodGet, principalPath, nil),
+		},
+		event.SharedSecret,
+	)
+	if err != nil {
+		return Principal{}, err
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		strings.TrimSuffix(a.config.APIAddress, "/")+principalPath,
+		nil,
+	)
+	if err != nil {
+		return Principal{}, errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Authorization", "JWT "+token)
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return Principal{},
+			errors.Wrap(err, "error requesting installation's principal")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Principal{}, errors.Errorf(
+			"received unexpected status code %d from Bitbucket",
+			resp.StatusCode,
+		)
+	}
+	principal := Principal{}
+	if err = json.NewDecoder(resp.Body).Decode(&principal); err != nil {
+		return principal,
+			errors.Wrap(err, "error parsing installation's principal")
+	}
+	if !principal.matches(event.Principal) {
+		return principal, errors.Errorf(
+			"installation's principal is %s (%s), not %s (%s)",
+			principal.Username,
+			principal.UUID,
+			event.Principal.Username,
+			event.Principal.UUID,
+		)
+	}
+	return principal, nil
+}
+
+// matches returns a bool indicating whether the Principal and the provided
+// one identify the same workspace or user. Every identifier both specify must
+// match and at least one must be specified by both.
+func (p Principal) matches(other Principal) bool {
+	var compared bool
+	if p.UUID != "" && other.UUID != "" {
+		if p.UUID != other.UUID {
+			return false
+		}
+		compared = true
+	}
+	if p.Username != "" && other.Username != "" {
+		if !strings.EqualFold(p.Username, other.Username) {
+			return false
+		}
+		compared = true
+	}
+	return compared
+}
@@ -0,0 +1,125 @@
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppConfirmInstallation(t *testing.T) {
+	event := lifecycleEvent{
+		ClientKey:    "foo",
+		SharedSecret: "secret",
+		Principal:    Principal{Username: "example-org"},
+	}
+	testCases := []struct {
+		name       string
+		handler    http.HandlerFunc
+		assertions func(Principal, error)
+	}{
+		{
+			name: "unexpected status code",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			assertions: func(_ Principal, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "unexpected status code 401")
+			},
+		},
+		{
+			name: "unparsable principal",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, "foo")
+			},
+			assertions: func(_ Principal, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing")
+			},
+		},
+		{
+			name: "principal does not match",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, `{"uuid":"{2}","username":"another-org"}`)
+			},
+			assertions: func(_ Principal, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "another-org ({2}), not example-org")
+			},
+		},
+		{
+			name: "success",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, `{"type":"team","uuid":"{1}","username":"example-org"}`)
+			},
+			assertions: func(principal Principal, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					Principal{Type: "team", UUID: "{1}", Username: "example-org"},
+					principal,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(testCase.handler)
+			defer server.Close()
+			a, _ := newTestApp(t, AppConfig{APIAddress: server.URL})
+			testCase.assertions(
+				a.confirmInstallation(context.Background(), event),
+			)
+		})
+	}
+}
+
+func TestPrincipalMatches(t *testing.T) {
+	testCases := []struct {
+		name    string
+		p       Principal
+		other   Principal
+		matches bool
+	}{
+		{
+			name:  "nothing to compare",
+			p:     Principal{UUID: "{1}"},
+			other: Principal{Username: "example-org"},
+		},
+		{
+			name:  "UUIDs differ",
+			p:     Principal{UUID: "{1}", Username: "example-org"},
+			other: Principal{UUID: "{2}", Username: "example-org"},
+		},
+		{
+			name:  "usernames differ",
+			p:     Principal{UUID: "{1}", Username: "example-org"},
+			other: Principal{UUID: "{1}", Username: "another-org"},
+		},
+		{
+			name:    "UUIDs match",
+			p:       Principal{UUID: "{1}", Username: "example-org"},
+			other:   Principal{UUID: "{1}"},
+			matches: true,
+		},
+		{
+			name:    "usernames match",
+			p:       Principal{UUID: "{1}", Username: "example-org"},
+			other:   Principal{Username: "Example-Org"},
+			matches: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(
+				t,
+				testCase.matches,
+				testCase.p.matches(testCase.other),
+			)
+		})
+	}
+}
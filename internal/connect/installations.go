@@ -0,0 +1,125 @@
+package connect
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Principal identifies the Bitbucket workspace or user that installed the app.
+type Principal struct {
+	// Type is the type of the principal, e.g. team or user.
+	Type string `json:"type,omitempty"`
+	// UUID uniquely identifies the principal.
+	UUID string `json:"uuid,omitempty"`
+	// Username is the principal's username, which, for a workspace, is the
+	// workspace's slug (e.g. example-org).
+	Username string `json:"username,omitempty"`
+}
+
+// Installation represents a single installation of the app.
+type Installation struct {
+	// ClientKey uniquely identifies the installation.
+	ClientKey string `json:"clientKey"`
+	// SharedSecret is the secret JWTs pertaining to the installation are signed
+	// with.
+	SharedSecret string `json:"sharedSecret"`
+	// BaseURL is the base URL of the Bitbucket API the installation belongs to.
+	BaseURL string `json:"baseUrl,omitempty"`
+	// Principal identifies the workspace or user that installed the app.
+	Principal Principal `json:"principal"`
+	// InstalledAt is when the app was (most recently) installed.
+	InstalledAt time.Time `json:"installedAt"`
+}
+
+// installationStore is a thread-safe collection of installations, keyed by
+// client key, that is persisted to a file whenever it is modified.
+type installationStore struct {
+	path          string
+	mu            sync.RWMutex
+	installations map[string]Installation
+}
+
+// newInstallationStore returns an installationStore persisted to the specified
+// file. Any installations previously persisted to the file are read
+// immediately.
+func newInstallationStore(path string) (*installationStore, error) {
+	s := &installationStore{
+		path:          path,
+		installations: map[string]Installation{},
+	}
+	installationsBytes, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", path)
+	}
+	if err = json.Unmarshal(installationsBytes, &s.installations); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", path)
+	}
+	return s, nil
+}
+
+// get returns the installation with the specified client key and a bool
+// indicating whether it was found.
+func (s *installationStore) get(clientKey string) (Installation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	installation, ok := s.installations[clientKey]
+	return installation, ok
+}
+
+// put adds or replaces the provided installation and persists the result.
+func (s *installationStore) put(installation Installation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.installations[installation.ClientKey]
+	s.installations[installation.ClientKey] = installation
+	if err := s.save(); err != nil {
+		if existed {
+			s.installations[installation.ClientKey] = previous
+		} else {
+			delete(s.installations, installation.ClientKey)
+		}
+		return err
+	}
+	return nil
+}
+
+// delete removes the installation with the specified client key, if any, and
+// persists the result.
+func (s *installationStore) delete(clientKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.installations[clientKey]
+	if !existed {
+		return nil
+	}
+	delete(s.installations, clientKey)
+	if err := s.save(); err != nil {
+		s.installations[clientKey] = previous
+		return err
+	}
+	return nil
+}
+
+// save atomically persists all installations. The caller must hold the lock.
+func (s *installationStore) save() error {
+	installationsBytes, err := json.MarshalIndent(s.installations, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshaling installations")
+	}
+	tmpPath := s.path + ".tmp"
+	if err = os.WriteFile(tmpPath, installationsBytes, 0600); err != nil {
+		return errors.Wrapf(err, "error writing %s", tmpPath)
+	}
+	return errors.Wrapf(
+		os.Rename(tmpPath, s.path),
+		"error replacing %s",
+		s.path,
+	)
+}
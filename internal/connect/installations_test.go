@@ -0,0 +1,102 @@
+package connect
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewInstallationStore(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name       string
+		setup      func() string
+		assertions func(*installationStore, error)
+	}{
+		{
+			name: "file does not exist",
+			setup: func() string {
+				return filepath.Join(dir, "does-not-exist")
+			},
+			assertions: func(s *installationStore, err error) {
+				require.NoError(t, err)
+				require.Empty(t, s.installations)
+			},
+		},
+		{
+			name: "file not parsable",
+			setup: func() string {
+				path := filepath.Join(dir, "invalid")
+				require.NoError(t, os.WriteFile(path, []byte("foo"), 0600))
+				return path
+			},
+			assertions: func(_ *installationStore, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing")
+			},
+		},
+		{
+			name: "file exists",
+			setup: func() string {
+				path := filepath.Join(dir, "valid")
+				require.NoError(
+					t,
+					os.WriteFile(
+						path,
+						[]byte(`{"foo":{"clientKey":"foo","sharedSecret":"bar"}}`),
+						0600,
+					),
+				)
+				return path
+			},
+			assertions: func(s *installationStore, err error) {
+				require.NoError(t, err)
+				installation, ok := s.get("foo")
+				require.True(t, ok)
+				require.Equal(t, "bar", installation.SharedSecret)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(newInstallationStore(testCase.setup()))
+		})
+	}
+}
+
+func TestInstallationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "installations.json")
+	s, err := newInstallationStore(path)
+	require.NoError(t, err)
+
+	installation := Installation{
+		ClientKey:    "foo",
+		SharedSecret: "bar",
+		Principal:    Principal{Username: "example-org"},
+		InstalledAt:  time.Now().UTC().Truncate(time.Second),
+	}
+	require.NoError(t, s.put(installation))
+
+	// Installations survive a restart
+	s, err = newInstallationStore(path)
+	require.NoError(t, err)
+	got, ok := s.get("foo")
+	require.True(t, ok)
+	require.Equal(t, installation, got)
+
+	require.NoError(t, s.delete("foo"))
+	require.NoError(t, s.delete("foo"))
+	s, err = newInstallationStore(path)
+	require.NoError(t, err)
+	_, ok = s.get("foo")
+	require.False(t, ok)
+
+	// Installations that cannot be persisted are not retained
+	s.path = filepath.Join(t.TempDir(), "does-not-exist", "installations.json")
+	require.Error(t, s.put(installation))
+	_, ok = s.get("foo")
+	require.False(t, ok)
+}
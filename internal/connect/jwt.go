@@ -0,0 +1,170 @@
+package connect
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jwtLeeway is how far a JWT's expiry may lie in the past before the JWT is
+// rejected, which accommodates clock skew between Bitbucket and the gateway.
+const jwtLeeway = 3 * time.Minute
+
+// claims are the JWT claims used by Bitbucket Connect.
+type claims struct {
+	// Issuer is the client key of the installation the JWT was issued for or,
+	// if the app issued the JWT, the app's key.
+	Issuer string `json:"iss"`
+	// Subject, if the app issued the JWT, is the client key of the installation
+	// the JWT was issued for.
+	Subject string `json:"sub,omitempty"`
+	// IssuedAt is the time, in seconds since the epoch, the JWT was issued.
+	IssuedAt int64 `json:"iat"`
+	// Expiry is the time, in seconds since the epoch, after which the JWT must
+	// not be accepted.
+	Expiry int64 `json:"exp"`
+	// QueryStringHash binds the JWT to a specific request. See queryStringHash.
+	QueryStringHash string `json:"qsh,omitempty"`
+}
+
+// jwtHeader is the header of a JWT.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// encodeJWT returns a JWT bearing the provided claims, signed using HS256 with
+// the provided secret.
+func encodeJWT(c claims, secret string) (string, error) {
+	headerJSON, err := json.Marshal(jwtHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", errors.Wrap(err, "error marshaling JWT header")
+	}
+	claimsJSON, err := json.Marshal(c)
+	if err != nil {
+		return "", errors.Wrap(err, "error marshaling JWT claims")
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(
+		sign(signingInput, secret),
+	), nil
+}
+
+// decodeJWT returns the claims borne by the provided JWT without verifying its
+// signature. This permits the issuer to be identified so that the secret the
+// JWT should have been signed with can be determined.
+func decodeJWT(token string) (claims, error) {
+	c := claims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, errors.New("JWT is malformed")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return c, errors.Wrap(err, "error decoding JWT header")
+	}
+	header := jwtHeader{}
+	if err = json.Unmarshal(headerJSON, &header); err != nil {
+		return c, errors.Wrap(err, "error parsing JWT header")
+	}
+	// Only HS256 is supported. In particular, the "none" algorithm must never be
+	// accepted.
+	if header.Algorithm != "HS256" {
+		return c, errors.Errorf(
+			"JWT signing algorithm %q is not supported",
+			header.Algorithm,
+		)
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return c, errors.Wrap(err, "error decoding JWT claims")
+	}
+	if err = json.Unmarshal(claimsJSON, &c); err != nil {
+		return c, errors.Wrap(err, "error parsing JWT claims")
+	}
+	return c, nil
+}
+
+// verifyJWT verifies that the provided JWT was signed using HS256 with the
+// provided secret and has not expired as of the provided time, then returns
+// its claims.
+func verifyJWT(token string, secret string, now time.Time) (claims, error) {
+	c, err := decodeJWT(token)
+	if err != nil {
+		return c, err
+	}
+	lastDot := strings.LastIndex(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(token[lastDot+1:])
+	if err != nil {
+		return c, errors.Wrap(err, "error decoding JWT signature")
+	}
+	if !hmac.Equal(signature, sign(token[:lastDot], secret)) {
+		return c, errors.New("JWT signature is invalid")
+	}
+	if c.Expiry == 0 {
+		return c, errors.New("JWT does not specify an expiry")
+	}
+	if now.Add(-jwtLeeway).Unix() > c.Expiry {
+		return c, errors.New("JWT has expired")
+	}
+	return c, nil
+}
+
+// sign returns the HMAC-SHA256 of the provided JWT signing input, keyed with
+// the provided secret.
+func sign(signingInput string, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput)) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// queryStringHash returns the hash Atlassian Connect uses to bind a JWT to a
+// specific request. It is the hex-encoded SHA-256 of the request's canonical
+// form: its upper-cased method, its path, and its sorted query parameters
+// (excluding any jwt parameter), separated by ampersands.
+func queryStringHash(method string, path string, query url.Values) string {
+	if path == "" {
+		path = "/"
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		if key != "jwt" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, key := range keys {
+		values := make([]string, len(query[key]))
+		for j, value := range query[key] {
+			values[j] = percentEncode(value)
+		}
+		sort.Strings(values)
+		params[i] = percentEncode(key) + "=" + strings.Join(values, ",")
+	}
+	canonical := strings.ToUpper(method) + "&" +
+		strings.ReplaceAll(path, "&", "%26") + "&" +
+		strings.Join(params, "&")
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:])
+}
+
+// percentEncode encodes the provided string as specified by RFC 3986, which
+// differs from url.QueryEscape in its treatment of spaces and tildes.
+func percentEncode(s string) string {
+	return strings.NewReplacer("+", "%20", "*", "%2A", "%7E", "~").Replace(
+		url.QueryEscape(s),
+	)
+}
@@ -0,0 +1,189 @@
+package connect
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeAndVerifyJWT(t *testing.T) {
+	now := time.Now()
+	valid := claims{
+		Issuer:   "foo",
+		IssuedAt: now.Unix(),
+		Expiry:   now.Add(time.Minute).Unix(),
+	}
+	testCases := []struct {
+		name       string
+		token      func() string
+		assertions func(claims, error)
+	}{
+		{
+			name: "malformed",
+			token: func() string {
+				return "foo.bar"
+			},
+			assertions: func(_ claims, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "malformed")
+			},
+		},
+		{
+			name: "unsupported algorithm",
+			token: func() string {
+				token, err := encodeJWT(valid, "secret")
+				require.NoError(t, err)
+				parts := strings.Split(token, ".")
+				parts[0] = base64.RawURLEncoding.EncodeToString(
+					[]byte(`{"alg":"none"}`),
+				)
+				return strings.Join(parts, ".")
+			},
+			assertions: func(_ claims, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), `"none" is not supported`)
+			},
+		},
+		{
+			name: "wrong secret",
+			token: func() string {
+				token, err := encodeJWT(valid, "wrong")
+				require.NoError(t, err)
+				return token
+			},
+			assertions: func(_ claims, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "signature is invalid")
+			},
+		},
+		{
+			name: "tampered claims",
+			token: func() string {
+				token, err := encodeJWT(valid, "secret")
+				require.NoError(t, err)
+				parts := strings.Split(token, ".")
+				parts[1] = base64.RawURLEncoding.EncodeToString(
+					[]byte(`{"iss":"bar","exp":9999999999}`),
+				)
+				return strings.Join(parts, ".")
+			},
+			assertions: func(_ claims, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "signature is invalid")
+			},
+		},
+		{
+			name: "no expiry",
+			token: func() string {
+				token, err := encodeJWT(claims{Issuer: "foo"}, "secret")
+				require.NoError(t, err)
+				return token
+			},
+			assertions: func(_ claims, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify an expiry")
+			},
+		},
+		{
+			name: "expired",
+			token: func() string {
+				token, err := encodeJWT(
+					claims{Issuer: "foo", Expiry: now.Add(-time.Hour).Unix()},
+					"secret",
+				)
+				require.NoError(t, err)
+				return token
+			},
+			assertions: func(_ claims, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "has expired")
+			},
+		},
+		{
+			name: "expired within leeway",
+			token: func() string {
+				token, err := encodeJWT(
+					claims{Issuer: "foo", Expiry: now.Add(-time.Minute).Unix()},
+					"secret",
+				)
+				require.NoError(t, err)
+				return token
+			},
+			assertions: func(c claims, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "foo", c.Issuer)
+			},
+		},
+		{
+			name: "valid",
+			token: func() string {
+				token, err := encodeJWT(valid, "secret")
+				require.NoError(t, err)
+				return token
+			},
+			assertions: func(c claims, err error) {
+				require.NoError(t, err)
+				require.Equal(t, valid, c)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(verifyJWT(testCase.token(), "secret", now))
+		})
+	}
+}
+
+func TestQueryStringHash(t *testing.T) {
+	testCases := []struct {
+		name      string
+		method    string
+		path      string
+		query     url.Values
+		canonical string
+	}{
+		{
+			name:      "no query",
+			method:    "post",
+			path:      "/connect/events",
+			canonical: "POST&/connect/events&",
+		},
+		{
+			name:      "empty path",
+			method:    "GET",
+			canonical: "GET&/&",
+		},
+		{
+			name:   "query",
+			method: "GET",
+			path:   "/foo/",
+			query: url.Values{
+				"b":   {"two words", "a~b"},
+				"a":   {"1"},
+				"jwt": {"ignored"},
+			},
+			canonical: "GET&/foo&a=1&b=a~b,two%20words",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(
+				t,
+				sha256Hex(testCase.canonical),
+				queryStringHash(testCase.method, testCase.path, testCase.query),
+			)
+		})
+	}
+}
+
+// sha256Hex returns the hex-encoded SHA-256 of the provided string.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,148 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// clientIPResolver determines the IP address of the client that sent a
+// request.
+type clientIPResolver struct {
+	// trustedProxies are the IP ranges of reverse proxies whose claims, via the
+	// Forwarded or X-Forwarded-For headers, about which address they received a
+	// request from are believed. If empty, the X-Forwarded-For header is always
+	// believed.
+	trustedProxies []net.IPNet
+}
+
+// clientIP returns the IP address of the client that sent the provided
+// request. If no trusted proxies are configured, the IP is taken from the
+// X-Forwarded-For header if it is populated and from the request's remote
+// address otherwise. If trusted proxies are configured, the IP is that of the
+// right-most hop, starting with the request's remote address and continuing
+// through the hops recorded by the Forwarded header (or, if it is absent, the
+// X-Forwarded-For header), that is not a trusted proxy. If the IP cannot be
+// determined, nil is returned.
+func (c *clientIPResolver) clientIP(r *http.Request) (net.IP, error) {
+	if len(c.trustedProxies) == 0 {
+		ipStr := r.Header.Get("X-Forwarded-For")
+		if ipStr == "" {
+			ipStr = r.RemoteAddr
+		}
+		if ipStr == "" {
+			return nil, nil
+		}
+		return parseIP(ipStr)
+	}
+	if r.RemoteAddr == "" {
+		return nil, nil
+	}
+	ip, err := parseIP(r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		hops = forwardedFor(forwarded)
+	} else {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+	for i := len(hops) - 1; i >= 0 && c.trusted(ip); i-- {
+		// RFC 7239 permits proxies to record a hop as "unknown" or using an
+		// obfuscated identifier. In either case, the client's IP cannot be known.
+		if hops[i] == "unknown" || strings.HasPrefix(hops[i], "_") {
+			return nil, nil
+		}
+		if ip, err = parseIP(hops[i]); err != nil {
+			return nil, err
+		}
+	}
+	return ip, nil
+}
+
+// trusted returns a bool indicating whether the provided IP falls within the
+// range of any trusted proxy.
+func (c *clientIPResolver) trusted(ip net.IP) bool {
+	for _, trustedProxy := range c.trustedProxies {
+		if trustedProxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// xForwardedFor returns the hops recorded by the provided values of the
+// X-Forwarded-For header, from left (furthest from this gateway) to right.
+func xForwardedFor(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the values of the "for" parameter of each element of the
+// provided values of the Forwarded header (RFC 7239), from left (furthest from
+// this gateway) to right. Elements lacking a "for" parameter are recorded as
+// "unknown".
+func forwardedFor(values []string) []string {
+	hops := []string{}
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			if strings.TrimSpace(element) == "" {
+				continue
+			}
+			hop := "unknown"
+			for _, pair := range splitQuoted(element, ';') {
+				tokens := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(tokens) == 2 && strings.EqualFold(tokens[0], "for") {
+					hop = strings.Trim(tokens[1], `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits the provided string on every occurrence of the specified
+// separator that does not fall within a quoted string.
+func splitQuoted(str string, sep rune) []string {
+	parts := []string{}
+	var quoted bool
+	var start int
+	for i, char := range str {
+		switch char {
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, str[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, str[start:])
+}
+
+// parseIP parses an IPv4 or IPv6 address that may be accompanied by a port,
+// e.g. 192.0.2.1, 192.0.2.1:8080, 2001:db8::1, or [2001:db8::1]:8080.
+func parseIP(ipStr string) (net.IP, error) {
+	if host, _, err := net.SplitHostPort(ipStr); err == nil {
+		ipStr = host
+	} else {
+		ipStr = strings.TrimSuffix(strings.TrimPrefix(ipStr, "["), "]")
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, errors.Errorf("could not parse %q as an IP", ipStr)
+	}
+	return ip, nil
+}
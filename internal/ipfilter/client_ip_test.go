@@ -0,0 +1,221 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	trustedProxies := []net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8:ffff::/48"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		trustedProxies = append(trustedProxies, *ipNet)
+	}
+	testCases := []struct {
+		name           string
+		trustedProxies []net.IPNet
+		remoteAddr     string
+		headers        map[string][]string
+		assertions     func(net.IP, error)
+	}{
+		{
+			name: "no trusted proxies; no remote address",
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Nil(t, ip)
+			},
+		},
+		{
+			name:       "no trusted proxies; remote address",
+			remoteAddr: "192.0.2.1:12345",
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1", ip.String())
+			},
+		},
+		{
+			name:       "no trusted proxies; X-Forwarded-For believed",
+			remoteAddr: "192.0.2.1:12345",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "198.51.100.1", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; remote address untrusted",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "192.0.2.1:12345",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; spoofed X-Forwarded-For ignored",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1, 192.0.2.1, 10.0.0.1"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; multiple X-Forwarded-For headers",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1", "192.0.2.1"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; all hops trusted",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.0.0.3, 10.0.0.1"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "10.0.0.3", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; unparsable hop",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"foo"},
+			},
+			assertions: func(_ net.IP, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "could not parse")
+			},
+		},
+		{
+			name:           "trusted proxies; Forwarded preferred",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"Forwarded": {
+					`for=198.51.100.1;proto=https, For="192.0.2.1:4711";by=10.0.0.1`,
+					"for=10.0.0.1",
+				},
+				"X-Forwarded-For": {"203.0.113.1"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; IPv6 in Forwarded",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "[2001:db8:ffff::1]:12345",
+			headers: map[string][]string{
+				"Forwarded": {`for="[2001:db8:cafe::17]:4711"`},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Equal(t, "2001:db8:cafe::17", ip.String())
+			},
+		},
+		{
+			name:           "trusted proxies; unknown hop in Forwarded",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"Forwarded": {"for=192.0.2.1, for=unknown"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Nil(t, ip)
+			},
+		},
+		{
+			name:           "trusted proxies; obfuscated hop in Forwarded",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"Forwarded": {"for=_hidden"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Nil(t, ip)
+			},
+		},
+		{
+			name:           "trusted proxies; Forwarded element without for",
+			trustedProxies: trustedProxies,
+			remoteAddr:     "10.0.0.2:12345",
+			headers: map[string][]string{
+				"Forwarded": {"proto=https"},
+			},
+			assertions: func(ip net.IP, err error) {
+				require.NoError(t, err)
+				require.Nil(t, ip)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/events", nil)
+			req.RemoteAddr = testCase.remoteAddr
+			for key, values := range testCase.headers {
+				for _, value := range values {
+					req.Header.Add(key, value)
+				}
+			}
+			resolver := clientIPResolver{trustedProxies: testCase.trustedProxies}
+			testCase.assertions(resolver.clientIP(req))
+		})
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	require.Equal(
+		t,
+		[]string{`for="a,b"`, " for=c", ""},
+		splitQuoted(`for="a,b", for=c,`, ','),
+	)
+}
+
+func TestParseIP(t *testing.T) {
+	testCases := []struct {
+		ipStr      string
+		expectedIP string
+	}{
+		{ipStr: "192.0.2.1", expectedIP: "192.0.2.1"},
+		{ipStr: "192.0.2.1:8080", expectedIP: "192.0.2.1"},
+		{ipStr: "2001:db8::1", expectedIP: "2001:db8::1"},
+		{ipStr: "[2001:db8::1]", expectedIP: "2001:db8::1"},
+		{ipStr: "[2001:db8::1]:8080", expectedIP: "2001:db8::1"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.ipStr, func(t *testing.T) {
+			ip, err := parseIP(testCase.ipStr)
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedIP, ip.String())
+		})
+	}
+	_, err := parseIP("foo")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not parse")
+}
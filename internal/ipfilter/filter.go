@@ -0,0 +1,118 @@
+package ipfilter
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	libHTTP "github.com/brigadecore/brigade-foundations/http"
+)
+
+// Config encapsulates IP filter configuration.
+type Config struct {
+	// AllowedRanges are the IP ranges that are initially permitted to send
+	// requests.
+	AllowedRanges []net.IPNet
+	// TrustedProxies are the IP ranges of reverse proxies that are trusted to
+	// accurately report, via the Forwarded or X-Forwarded-For headers, which
+	// address they received each request from. If any are specified, the client
+	// IP is that of the right-most hop that is not a trusted proxy. If none are
+	// specified, the X-Forwarded-For header, if present, is trusted
+	// unconditionally.
+	TrustedProxies []net.IPNet
+}
+
+// Filter is an interface for components that implement the libHTTP.Filter
+// interface and conditionally allow or disallow a request on the basis of the
+// client's IP address. Unlike the IP filter in
+// github.com/brigadecore/brigade-foundations/http, the permitted IP ranges can
+// be replaced while the filter is in use.
+type Filter interface {
+	libHTTP.Filter
+	// SetAllowedRanges atomically replaces the IP ranges that are permitted to
+	// send requests.
+	SetAllowedRanges([]net.IPNet)
+}
+
+// filter is an implementation of the Filter interface that delegates to an IP
+// filter from github.com/brigadecore/brigade-foundations/http, which it
+// rebuilds whenever the permitted IP ranges are replaced.
+type filter struct {
+	clientIPResolver
+	mu            sync.RWMutex
+	allowedRanges []net.IPNet
+	ipFilter      libHTTP.Filter
+}
+
+// New returns an implementation of the Filter interface.
+func New(config Config) Filter {
+	f := &filter{
+		clientIPResolver: clientIPResolver{
+			trustedProxies: config.TrustedProxies,
+		},
+	}
+	f.SetAllowedRanges(config.AllowedRanges)
+	return f
+}
+
+func (f *filter) SetAllowedRanges(allowedRanges []net.IPNet) {
+	ipFilter := libHTTP.NewIPFilter(
+		libHTTP.IPFilterConfig{
+			AllowedRanges: allowedRanges,
+		},
+	)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allowedRanges = allowedRanges
+	f.ipFilter = ipFilter
+}
+
+func (f *filter) Decorate(handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip, err := f.clientIP(r)
+		if err != nil {
+			// A malformed address or header is the client's (or a proxy's) fault,
+			// so the request is rejected like any other whose client IP cannot be
+			// determined.
+			log.Printf(
+				"rejecting request from %s: error determining client IP: %s",
+				r.RemoteAddr,
+				err,
+			)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// If we couldn't determine the IP, we don't allow the request to proceed
+		if ip == nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.mu.RLock()
+		allowedRanges := f.allowedRanges
+		ipFilter := f.ipFilter
+		f.mu.RUnlock()
+		// The IP filter from brigade-foundations cannot parse IPv6 addresses, so
+		// those are checked here.
+		if ip.To4() == nil {
+			for _, allowedRange := range allowedRanges {
+				if allowedRange.Contains(ip) {
+					handle(w, r)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// The IP filter from brigade-foundations looks for the client IP in the
+		// X-Forwarded-For header first, so present it with a copy of the request
+		// that carries the resolved client IP there. The handler receives the
+		// original request.
+		filterReq := r.WithContext(r.Context())
+		filterReq.Header = r.Header.Clone()
+		filterReq.Header.Set("X-Forwarded-For", ip.String())
+		ipFilter.Decorate(func(w http.ResponseWriter, _ *http.Request) {
+			handle(w, r)
+		})(w, filterReq)
+	}
+}
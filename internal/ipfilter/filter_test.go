@@ -0,0 +1,149 @@
+package ipfilter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	f, ok := New(Config{AllowedRanges: []net.IPNet{*ipNet}}).(*filter)
+	require.True(t, ok)
+	require.Equal(t, []net.IPNet{*ipNet}, f.allowedRanges)
+	require.NotNil(t, f.ipFilter)
+}
+
+func TestFilterDecorate(t *testing.T) {
+	_, ipNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	_, ipv6Net, err := net.ParseCIDR("2001:db8::/32")
+	require.NoError(t, err)
+	testCases := []struct {
+		name           string
+		remoteAddr     string
+		xForwardedFor  string
+		expectedStatus int
+	}{
+		{
+			name:           "no client IP",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "unparsable client IP",
+			remoteAddr:     "foo",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "unparsable client IP from X-Forwarded-For",
+			remoteAddr:     "192.168.1.1:12345",
+			xForwardedFor:  "foo",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "client IP not allowed",
+			remoteAddr:     "10.0.0.1:12345",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "client IP allowed",
+			remoteAddr:     "192.168.1.1:12345",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "client IP from X-Forwarded-For allowed",
+			remoteAddr:     "10.0.0.1:12345",
+			xForwardedFor:  "192.168.1.1",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "IPv6 client IP not allowed",
+			remoteAddr:     "[2001:db9::1]:12345",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "IPv6 client IP allowed",
+			remoteAddr:     "[2001:db8::1]:12345",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "IPv6 client IP from X-Forwarded-For allowed",
+			remoteAddr:     "10.0.0.1:12345",
+			xForwardedFor:  "2001:db8::1",
+			expectedStatus: http.StatusOK,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := New(Config{AllowedRanges: []net.IPNet{*ipNet, *ipv6Net}})
+			req := httptest.NewRequest(http.MethodPost, "/events", nil)
+			req.RemoteAddr = testCase.remoteAddr
+			if testCase.xForwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", testCase.xForwardedFor)
+			}
+			rr := httptest.NewRecorder()
+			f.Decorate(func(w http.ResponseWriter, r *http.Request) {
+				// The handler should receive the original request
+				require.Same(t, req, r)
+				w.WriteHeader(http.StatusOK)
+			})(rr, req)
+			require.Equal(t, testCase.expectedStatus, rr.Code)
+		})
+	}
+}
+
+func TestFilterSetAllowedRanges(t *testing.T) {
+	_, oldNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	_, newNet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	f := New(Config{AllowedRanges: []net.IPNet{*oldNet}})
+	handle := f.Decorate(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	statusFor := func(remoteAddr string) int {
+		req := httptest.NewRequest(http.MethodPost, "/events", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr.Code
+	}
+	require.Equal(t, http.StatusOK, statusFor("192.168.1.1:12345"))
+	require.Equal(t, http.StatusForbidden, statusFor("10.0.0.1:12345"))
+	f.SetAllowedRanges([]net.IPNet{*newNet})
+	require.Equal(t, http.StatusForbidden, statusFor("192.168.1.1:12345"))
+	require.Equal(t, http.StatusOK, statusFor("10.0.0.1:12345"))
+}
+
+func TestFilterDecorateWithTrustedProxies(t *testing.T) {
+	_, allowedNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	_, trustedNet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	f := New(
+		Config{
+			AllowedRanges:  []net.IPNet{*allowedNet},
+			TrustedProxies: []net.IPNet{*trustedNet},
+		},
+	)
+	handle := f.Decorate(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	statusFor := func(xForwardedFor string) int {
+		req := httptest.NewRequest(http.MethodPost, "/events", nil)
+		req.RemoteAddr = "10.0.0.1:12345"
+		req.Header.Set("X-Forwarded-For", xForwardedFor)
+		rr := httptest.NewRecorder()
+		handle(rr, req)
+		return rr.Code
+	}
+	require.Equal(t, http.StatusOK, statusFor("192.168.1.1"))
+	// A client cannot spoof its way past the filter by prepending an allowed IP
+	require.Equal(t, http.StatusForbidden, statusFor("192.168.1.1, 172.16.0.1"))
+	// A malformed hop is rejected rather than treated as a server error
+	require.Equal(t, http.StatusForbidden, statusFor("192.168.1.1, foo"))
+}
@@ -0,0 +1,199 @@
+package ipfilter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AtlassianIPRangesURL is the URL at which Atlassian publishes the IP ranges
+// used by its cloud products, including those Bitbucket sends webhooks from.
+const AtlassianIPRangesURL = "https://ip-ranges.atlassian.com/"
+
+// RefresherConfig encapsulates configuration for a Refresher.
+type RefresherConfig struct {
+	// Source is the URL (beginning with http:// or https://) or local path from
+	// which a document in the format of Atlassian's ip-ranges.json is loaded.
+	Source string
+	// Interval is how often the IP ranges are refreshed.
+	Interval time.Duration
+	// AdditionalRanges are IP ranges that remain permitted in addition to the
+	// refreshed ones. These are typically the statically configured ranges, so
+	// that any ranges added by an operator are not lost upon refresh.
+	AdditionalRanges []net.IPNet
+}
+
+// Refresher is an interface for components that keep the IP ranges permitted
+// by a Filter up to date.
+type Refresher interface {
+	// Run refreshes the IP ranges permitted by a Filter immediately and then
+	// periodically until the provided context is canceled.
+	Run(ctx context.Context)
+}
+
+// ipRanges models the subset of Atlassian's ip-ranges.json format that is of
+// interest.
+type ipRanges struct {
+	Items []struct {
+		CIDR      string   `json:"cidr"`
+		Product   []string `json:"product"`
+		Direction []string `json:"direction"`
+	} `json:"items"`
+}
+
+type refresher struct {
+	config     RefresherConfig
+	filter     Filter
+	httpClient *http.Client
+}
+
+// NewRefresher returns an implementation of the Refresher interface that
+// periodically loads IP ranges in Atlassian's ip-ranges.json format from the
+// source specified by the provided RefresherConfig and, retaining only those
+// that Bitbucket sends webhooks from, uses them, along with any additional
+// ranges specified by the RefresherConfig, to replace the IP ranges permitted
+// by the provided Filter. If a refresh fails, the Filter continues to permit
+// the IP ranges from the last successful refresh.
+func NewRefresher(config RefresherConfig, filter Filter) Refresher {
+	return &refresher{
+		config: config,
+		filter: filter,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+func (r *refresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.refresh(ctx); err != nil {
+			log.Printf(
+				"error refreshing allowed IP ranges; continuing to use previous "+
+					"ranges: %s",
+				err,
+			)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refresh loads IP ranges from the configured source and, if successful, uses
+// them, along with any additional ranges, to replace the IP ranges permitted by
+// the Filter.
+func (r *refresher) refresh(ctx context.Context) error {
+	docBytes, err := r.load(ctx)
+	if err != nil {
+		return err
+	}
+	refreshedRanges, err := bitbucketEgressRanges(docBytes)
+	if err != nil {
+		return errors.Wrapf(err, "error parsing IP ranges from %s", r.config.Source)
+	}
+	allowedRanges := make(
+		[]net.IPNet,
+		0,
+		len(r.config.AdditionalRanges)+len(refreshedRanges),
+	)
+	allowedRanges = append(allowedRanges, r.config.AdditionalRanges...)
+	allowedRanges = append(allowedRanges, refreshedRanges...)
+	r.filter.SetAllowedRanges(allowedRanges)
+	log.Printf(
+		"refreshed allowed IP ranges from %s; %d refreshed and %d additional "+
+			"ranges are allowed",
+		r.config.Source,
+		len(refreshedRanges),
+		len(r.config.AdditionalRanges),
+	)
+	return nil
+}
+
+// load returns the raw contents of the configured source.
+func (r *refresher) load(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(r.config.Source, "http://") &&
+		!strings.HasPrefix(r.config.Source, "https://") {
+		docBytes, err := os.ReadFile(r.config.Source)
+		return docBytes,
+			errors.Wrapf(err, "error reading IP ranges from %s", r.config.Source)
+	}
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		r.config.Source,
+		nil,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"error creating request for IP ranges from %s",
+			r.config.Source,
+		)
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil,
+			errors.Wrapf(err, "error fetching IP ranges from %s", r.config.Source)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(
+			"received %d fetching IP ranges from %s",
+			resp.StatusCode,
+			r.config.Source,
+		)
+	}
+	docBytes, err := io.ReadAll(resp.Body)
+	return docBytes,
+		errors.Wrapf(err, "error reading IP ranges from %s", r.config.Source)
+}
+
+// bitbucketEgressRanges parses a document in Atlassian's ip-ranges.json format
+// and returns only those IP ranges that Bitbucket sends webhooks from. Since
+// permitting no IP ranges at all would block every webhook, a document that
+// yields no such ranges is treated as an error.
+func bitbucketEgressRanges(docBytes []byte) ([]net.IPNet, error) {
+	doc := ipRanges{}
+	if err := json.Unmarshal(docBytes, &doc); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling IP ranges")
+	}
+	allowedRanges := []net.IPNet{}
+	for _, item := range doc.Items {
+		if !contains(item.Product, "bitbucket") ||
+			!contains(item.Direction, "egress") {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item.CIDR)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing CIDR %q", item.CIDR)
+		}
+		allowedRanges = append(allowedRanges, *ipNet)
+	}
+	if len(allowedRanges) == 0 {
+		return nil, errors.New("found no Bitbucket egress IP ranges")
+	}
+	return allowedRanges, nil
+}
+
+// contains returns a bool indicating whether the provided slice contains the
+// specified string.
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package ipfilter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testIPRanges = `{
+  "syncToken": 1234567890,
+  "items": [
+    {
+      "cidr": "104.192.136.0/21",
+      "product": ["bitbucket"],
+      "direction": ["egress", "ingress"]
+    },
+    {
+      "cidr": "185.166.140.0/22",
+      "product": ["bitbucket", "jira"],
+      "direction": ["egress"]
+    },
+    {
+      "cidr": "2401:1d80:1010::/64",
+      "product": ["bitbucket"],
+      "direction": ["egress"]
+    },
+    {
+      "cidr": "13.52.5.0/25",
+      "product": ["bitbucket"],
+      "direction": ["ingress"]
+    },
+    {
+      "cidr": "52.41.219.63/32",
+      "product": ["jira"],
+      "direction": ["egress"]
+    }
+  ]
+}`
+
+func TestNewRefresher(t *testing.T) {
+	f := New(Config{})
+	config := RefresherConfig{
+		Source:   AtlassianIPRangesURL,
+		Interval: time.Hour,
+	}
+	r, ok := NewRefresher(config, f).(*refresher)
+	require.True(t, ok)
+	require.Equal(t, config, r.config)
+	require.Same(t, f, r.filter)
+	require.NotNil(t, r.httpClient)
+}
+
+func TestRefresherRefresh(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/ip-ranges.json":
+				w.Write([]byte(testIPRanges)) // nolint: errcheck
+			case "/empty.json":
+				w.Write([]byte(`{"items":[]}`)) // nolint: errcheck
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+	localPath := filepath.Join(t.TempDir(), "ip-ranges.json")
+	require.NoError(t, os.WriteFile(localPath, []byte(testIPRanges), 0600))
+	_, initialNet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	testCases := []struct {
+		name             string
+		source           string
+		additionalRanges []net.IPNet
+		assertions       func(allowedRanges []net.IPNet, err error)
+	}{
+		{
+			name:   "URL not found",
+			source: server.URL + "/not-found.json",
+			assertions: func(allowedRanges []net.IPNet, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "received 404")
+				require.Equal(t, []net.IPNet{*initialNet}, allowedRanges)
+			},
+		},
+		{
+			name:   "file not found",
+			source: filepath.Join(t.TempDir(), "ip-ranges.json"),
+			assertions: func(allowedRanges []net.IPNet, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error reading IP ranges")
+				require.Equal(t, []net.IPNet{*initialNet}, allowedRanges)
+			},
+		},
+		{
+			name:   "no Bitbucket egress ranges",
+			source: server.URL + "/empty.json",
+			assertions: func(allowedRanges []net.IPNet, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "found no Bitbucket egress")
+				require.Equal(t, []net.IPNet{*initialNet}, allowedRanges)
+			},
+		},
+		{
+			name:   "success from URL",
+			source: server.URL + "/ip-ranges.json",
+			assertions: func(allowedRanges []net.IPNet, err error) {
+				require.NoError(t, err)
+				require.Len(t, allowedRanges, 3)
+				require.Equal(t, "104.192.136.0/21", allowedRanges[0].String())
+				require.Equal(t, "185.166.140.0/22", allowedRanges[1].String())
+				require.Equal(t, "2401:1d80:1010::/64", allowedRanges[2].String())
+			},
+		},
+		{
+			name:   "success from file",
+			source: localPath,
+			assertions: func(allowedRanges []net.IPNet, err error) {
+				require.NoError(t, err)
+				require.Len(t, allowedRanges, 3)
+			},
+		},
+		{
+			name:             "success with additional ranges",
+			source:           localPath,
+			additionalRanges: []net.IPNet{*initialNet},
+			assertions: func(allowedRanges []net.IPNet, err error) {
+				require.NoError(t, err)
+				require.Len(t, allowedRanges, 4)
+				require.Equal(t, *initialNet, allowedRanges[0])
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := New(Config{AllowedRanges: []net.IPNet{*initialNet}})
+			r, ok := NewRefresher(
+				RefresherConfig{
+					Source:           testCase.source,
+					Interval:         time.Hour,
+					AdditionalRanges: testCase.additionalRanges,
+				},
+				f,
+			).(*refresher)
+			require.True(t, ok)
+			err := r.refresh(context.Background())
+			ff, ok := f.(*filter)
+			require.True(t, ok)
+			testCase.assertions(ff.allowedRanges, err)
+		})
+	}
+}
+
+func TestBitbucketEgressRanges(t *testing.T) {
+	_, err := bitbucketEgressRanges([]byte("foo"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error unmarshaling IP ranges")
+
+	_, err = bitbucketEgressRanges(
+		[]byte(`{
+  "items": [
+    {"cidr": "foo", "product": ["bitbucket"], "direction": ["egress"]}
+  ]
+}`),
+	)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error parsing CIDR")
+}
+
+func TestRefresherRun(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "ip-ranges.json")
+	require.NoError(t, os.WriteFile(localPath, []byte(testIPRanges), 0600))
+	f := New(Config{})
+	r := NewRefresher(
+		RefresherConfig{
+			Source:   localPath,
+			Interval: time.Hour,
+		},
+		f,
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	ff, ok := f.(*filter)
+	require.True(t, ok)
+	require.Eventually(
+		t,
+		func() bool {
+			ff.mu.RLock()
+			defer ff.mu.RUnlock()
+			return len(ff.allowedRanges) == 3
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "refresher did not stop after context was canceled")
+	}
+}
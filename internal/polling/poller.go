@@ -0,0 +1,484 @@
+package polling
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	bbPayloads "github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/pkg/errors"
+)
+
+// PollerConfig encapsulates configuration for a Poller.
+type PollerConfig struct {
+	// Repos are the full names (e.g. example-org/example) of repositories that
+	// should be polled.
+	Repos []string
+	// Interval is how often repositories are polled.
+	Interval time.Duration
+	// StatePath is the path to a file in which the state of every repository,
+	// as of the last time it was polled, is persisted. This permits changes
+	// that occur while the gateway is not running to be detected after it
+	// restarts.
+	StatePath string
+}
+
+// Poller is an interface for components that periodically query the Bitbucket
+// REST API for changes to repositories' branches, tags, and open pull requests
+// and, for each change, synthesize the webhook (event) Bitbucket would have
+// sent. This permits the gateway to be used where Bitbucket cannot deliver
+// webhooks to it.
+type Poller interface {
+	// Poll polls every configured repository once. Problems with individual
+	// repositories are logged and do not prevent other repositories from being
+	// polled.
+	Poll(ctx context.Context) error
+	// Run polls repositories immediately and then periodically until the
+	// provided context is canceled.
+	Run(ctx context.Context)
+}
+
+// repoState is the state of a single repository as of the last time it was
+// polled.
+type repoState struct {
+	// Branches maps branch names to the commits they point to.
+	Branches map[string]string `json:"branches"`
+	// Tags maps tag names to the commits they point to.
+	Tags map[string]string `json:"tags"`
+	// PullRequests maps the IDs of open pull requests to their state.
+	PullRequests map[int64]pullRequestState `json:"pullRequests"`
+}
+
+// pullRequestState is the state of a single open pull request as of the last
+// time it was polled. A change to any of these fields is reported as an
+// update to the pull request.
+type pullRequestState struct {
+	Title             string `json:"title"`
+	SourceCommit      string `json:"sourceCommit"`
+	DestinationBranch string `json:"destinationBranch"`
+}
+
+// change is a single change to a repository, detected by comparing its
+// current state to its state as of the last time it was polled.
+type change struct {
+	// eventKey is the key (e.g. repo:push) of the event Bitbucket would have
+	// sent for the change.
+	eventKey bbPayloads.Event
+	// body returns the body of the webhook Bitbucket would have sent for the
+	// change, given the repository exactly as the API represents it.
+	body func(repository json.RawMessage) interface{}
+	// apply records the change in the provided state.
+	apply func(*repoState)
+}
+
+type poller struct {
+	config   PollerConfig
+	client   bitbucket.Client
+	replayer webhooks.Replayer
+	state    map[string]repoState
+}
+
+// NewPoller returns an implementation of the Poller interface that uses the
+// provided Client to poll repositories and hands synthesized webhooks off to
+// the provided Replayer exactly as if they had been received from Bitbucket.
+// Any state persisted by a previous Poller is read immediately.
+func NewPoller(
+	config PollerConfig,
+	client bitbucket.Client,
+	replayer webhooks.Replayer,
+) (Poller, error) {
+	p := &poller{
+		config:   config,
+		client:   client,
+		replayer: replayer,
+		state:    map[string]repoState{},
+	}
+	stateBytes, err := os.ReadFile(config.StatePath)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", config.StatePath)
+	}
+	if err = json.Unmarshal(stateBytes, &p.state); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", config.StatePath)
+	}
+	return p, nil
+}
+
+func (p *poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Poll(ctx); err != nil {
+			log.Printf("error polling repositories: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *poller) Poll(ctx context.Context) error {
+	var failed int
+	for _, repo := range p.config.Repos {
+		if err := p.pollRepo(ctx, repo); err != nil {
+			log.Println(err)
+			failed++
+		}
+	}
+	// Changes that were successfully handled are persisted even if others were
+	// not, so they are not handled a second time.
+	if err := p.saveState(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf(
+			"failed to poll %d of %d repositories",
+			failed,
+			len(p.config.Repos),
+		)
+	}
+	return nil
+}
+
+// pollRepo compares the current state of the specified repository to its
+// state as of the last time it was polled and hands a synthesized webhook for
+// each change off to the replayer. The first time a repository is polled, its
+// state is merely recorded.
+func (p *poller) pollRepo(ctx context.Context, repo string) error {
+	current, pullRequests, err := p.currentState(ctx, repo)
+	if err != nil {
+		return err
+	}
+	previous, ok := p.state[repo]
+	if !ok {
+		p.state[repo] = current
+		log.Printf(
+			"recorded initial state of %s; changes will be detected from the "+
+				"next poll onward",
+			repo,
+		)
+		return nil
+	}
+	changes := refChanges("branch", previous.Branches, current.Branches)
+	changes = append(
+		changes,
+		refChanges("tag", previous.Tags, current.Tags)...,
+	)
+	prChanges, err := p.pullRequestChanges(ctx, repo, previous, pullRequests)
+	if err != nil {
+		return err
+	}
+	changes = append(changes, prChanges...)
+	if len(changes) == 0 {
+		return nil
+	}
+	repository, err := p.client.GetRepository(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if err = p.handle(ctx, repo, c, repository); err != nil {
+			return err
+		}
+		c.apply(&previous)
+		p.state[repo] = previous
+	}
+	return nil
+}
+
+// currentState returns the current state of the specified repository, along
+// with its open pull requests.
+func (p *poller) currentState(
+	ctx context.Context,
+	repo string,
+) (repoState, []bitbucket.PullRequest, error) {
+	state := repoState{
+		Branches:     map[string]string{},
+		Tags:         map[string]string{},
+		PullRequests: map[int64]pullRequestState{},
+	}
+	branches, err := p.client.ListBranches(ctx, repo)
+	if err != nil {
+		return state, nil, err
+	}
+	for _, branch := range branches {
+		state.Branches[branch.Name] = branch.Target.Hash
+	}
+	tags, err := p.client.ListTags(ctx, repo)
+	if err != nil {
+		return state, nil, err
+	}
+	for _, tag := range tags {
+		state.Tags[tag.Name] = tag.Target.Hash
+	}
+	pullRequests, err := p.client.ListPullRequests(ctx, repo)
+	if err != nil {
+		return state, nil, err
+	}
+	for _, pr := range pullRequests {
+		state.PullRequests[pr.ID] = pullRequestStateOf(pr)
+	}
+	return state, pullRequests, nil
+}
+
+// handle hands a synthesized webhook for the provided change off to the
+// replayer.
+func (p *poller) handle(
+	ctx context.Context,
+	repo string,
+	c change,
+	repository json.RawMessage,
+) error {
+	bodyBytes, err := json.Marshal(c.body(repository))
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling %s payload", c.eventKey)
+	}
+	delivery := webhooks.Delivery{
+		ReceivedAt: time.Now().UTC(),
+		Headers: http.Header{
+			"Content-Type": []string{"application/json"},
+			"X-Event-Key":  []string{string(c.eventKey)},
+		},
+		Body: string(bodyBytes),
+	}
+	events, err := p.replayer.Replay(ctx, delivery)
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"error handling synthesized %s webhook for %s",
+			c.eventKey,
+			repo,
+		)
+	}
+	log.Printf(
+		"synthesized %s webhook for %s; %d event(s) emitted",
+		c.eventKey,
+		repo,
+		len(events.Items),
+	)
+	return nil
+}
+
+// refChanges returns a repo:push change for every ref of the specified type
+// ("branch" or "tag") that was created, moved, or deleted.
+func refChanges(
+	refType string,
+	previous map[string]string,
+	current map[string]string,
+) []change {
+	names := map[string]struct{}{}
+	for name := range previous {
+		names[name] = struct{}{}
+	}
+	for name := range current {
+		names[name] = struct{}{}
+	}
+	sortedNames := make([]string, 0, len(names))
+	for name := range names {
+		sortedNames = append(sortedNames, name)
+	}
+	sort.Strings(sortedNames)
+	changes := []change{}
+	for _, name := range sortedNames {
+		oldHash, existed := previous[name]
+		newHash, exists := current[name]
+		if existed && exists && oldHash == newHash {
+			continue
+		}
+		changes = append(
+			changes,
+			pushChange(refType, name, oldHash, newHash, existed, exists),
+		)
+	}
+	return changes
+}
+
+// pushChange returns a repo:push change for a single ref.
+func pushChange(
+	refType string,
+	name string,
+	oldHash string,
+	newHash string,
+	existed bool,
+	exists bool,
+) change {
+	refOf := func(hash string) map[string]interface{} {
+		return map[string]interface{}{
+			"type": refType,
+			"name": name,
+			"target": map[string]string{
+				"type": "commit",
+				"hash": hash,
+			},
+		}
+	}
+	pushedChange := map[string]interface{}{
+		"new":     nil,
+		"old":     nil,
+		"created": !existed,
+		"closed":  !exists,
+		"forced":  false,
+	}
+	if existed {
+		pushedChange["old"] = refOf(oldHash)
+	}
+	if exists {
+		pushedChange["new"] = refOf(newHash)
+	}
+	return change{
+		eventKey: bbPayloads.RepoPushEvent,
+		body: func(repository json.RawMessage) interface{} {
+			return map[string]interface{}{
+				"repository": repository,
+				"push": map[string]interface{}{
+					"changes": []interface{}{pushedChange},
+				},
+			}
+		},
+		apply: func(state *repoState) {
+			refs := state.Branches
+			if refType == "tag" {
+				refs = state.Tags
+			}
+			if exists {
+				refs[name] = newHash
+			} else {
+				delete(refs, name)
+			}
+		},
+	}
+}
+
+// pullRequestChanges returns a change for every pull request that was opened
+// or updated, given the currently open pull requests, and for every pull
+// request that was merged or declined since the repository was last polled.
+func (p *poller) pullRequestChanges(
+	ctx context.Context,
+	repo string,
+	previous repoState,
+	pullRequests []bitbucket.PullRequest,
+) ([]change, error) {
+	changes := []change{}
+	// Synthesize webhooks for pull requests in the order they were opened
+	sorted := make([]bitbucket.PullRequest, len(pullRequests))
+	copy(sorted, pullRequests)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	open := map[int64]struct{}{}
+	for _, pr := range sorted {
+		open[pr.ID] = struct{}{}
+		prevState, existed := previous.PullRequests[pr.ID]
+		switch {
+		case !existed:
+			changes = append(
+				changes,
+				pullRequestChange(bbPayloads.PullRequestCreatedEvent, pr),
+			)
+		case prevState != pullRequestStateOf(pr):
+			changes = append(
+				changes,
+				pullRequestChange(bbPayloads.PullRequestUpdatedEvent, pr),
+			)
+		}
+	}
+	closedIDs := []int64{}
+	for id := range previous.PullRequests {
+		if _, ok := open[id]; !ok {
+			closedIDs = append(closedIDs, id)
+		}
+	}
+	sort.Slice(closedIDs, func(i, j int) bool {
+		return closedIDs[i] < closedIDs[j]
+	})
+	for _, id := range closedIDs {
+		pr, err := p.client.GetPullRequest(ctx, repo, id)
+		if err != nil {
+			return nil, err
+		}
+		switch pr.State {
+		case "MERGED":
+			changes = append(
+				changes,
+				pullRequestChange(bbPayloads.PullRequestMergedEvent, pr),
+			)
+		case "DECLINED", "SUPERSEDED":
+			changes = append(
+				changes,
+				pullRequestChange(bbPayloads.PullRequestDeclinedEvent, pr),
+			)
+		case "OPEN":
+			// The pull request was opened or updated between being listed and
+			// being retrieved. It will be picked up by the next poll.
+		}
+	}
+	return changes, nil
+}
+
+// pullRequestChange returns a change of the specified type for the provided
+// pull request.
+func pullRequestChange(
+	eventKey bbPayloads.Event,
+	pr bitbucket.PullRequest,
+) change {
+	return change{
+		eventKey: eventKey,
+		body: func(repository json.RawMessage) interface{} {
+			return map[string]interface{}{
+				"repository":  repository,
+				"pullrequest": pr.Raw,
+			}
+		},
+		apply: func(state *repoState) {
+			if pr.State == "OPEN" {
+				state.PullRequests[pr.ID] = pullRequestStateOf(pr)
+			} else {
+				delete(state.PullRequests, pr.ID)
+			}
+		},
+	}
+}
+
+// pullRequestStateOf returns the pullRequestState of the provided pull
+// request.
+func pullRequestStateOf(pr bitbucket.PullRequest) pullRequestState {
+	return pullRequestState{
+		Title:             pr.Title,
+		SourceCommit:      pr.Source.Commit.Hash,
+		DestinationBranch: pr.Destination.Branch.Name,
+	}
+}
+
+// saveState persists the state of every configured repository. The file is
+// replaced atomically so that a crash cannot leave it partially written.
+func (p *poller) saveState() error {
+	state := map[string]repoState{}
+	for _, repo := range p.config.Repos {
+		if repoStat, ok := p.state[repo]; ok {
+			state[repo] = repoStat
+		}
+	}
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshaling polling state")
+	}
+	tmpPath := p.config.StatePath + ".tmp"
+	if err = os.WriteFile(tmpPath, stateBytes, 0600); err != nil {
+		return errors.Wrapf(err, "error writing %s", tmpPath)
+	}
+	return errors.Wrapf(
+		os.Rename(tmpPath, p.config.StatePath),
+		"error replacing %s",
+		p.config.StatePath,
+	)
+}
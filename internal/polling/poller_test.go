@@ -0,0 +1,295 @@
+package polling
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/brigadecore/brigade/sdk/v3"
+	bbPayloads "github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBitbucket is a minimal, in-memory stand-in for the parts of the
+// Bitbucket REST API used to poll a single repository.
+type fakeBitbucket struct {
+	mu       sync.Mutex
+	branches map[string]string
+	tags     map[string]string
+	// pullRequests maps pull request IDs to their JSON representations.
+	pullRequests map[int64]map[string]interface{}
+	fail         bool
+}
+
+func (f *fakeBitbucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/2.0/repositories/example-org/a")
+	switch {
+	case path == "":
+		fmt.Fprint(w, `{"full_name":"example-org/a","name":"a"}`)
+	case path == "/refs/branches":
+		f.writeRefs(w, "branch", f.branches)
+	case path == "/refs/tags":
+		f.writeRefs(w, "tag", f.tags)
+	case path == "/pullrequests":
+		values := []interface{}{}
+		for _, pr := range f.pullRequests {
+			if pr["state"] == "OPEN" {
+				values = append(values, pr)
+			}
+		}
+		json.NewEncoder(w).Encode( // nolint: errcheck
+			map[string]interface{}{"values": values},
+		)
+	case strings.HasPrefix(path, "/pullrequests/"):
+		var id int64
+		fmt.Sscanf(path, "/pullrequests/%d", &id) // nolint: errcheck
+		pr, ok := f.pullRequests[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pr) // nolint: errcheck
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeBitbucket) writeRefs(
+	w http.ResponseWriter,
+	refType string,
+	refs map[string]string,
+) {
+	values := []interface{}{}
+	for name, hash := range refs {
+		values = append(values, map[string]interface{}{
+			"type":   refType,
+			"name":   name,
+			"target": map[string]string{"hash": hash},
+		})
+	}
+	json.NewEncoder(w).Encode( // nolint: errcheck
+		map[string]interface{}{"values": values},
+	)
+}
+
+func (f *fakeBitbucket) setPullRequest(
+	id int64,
+	state string,
+	sourceCommit string,
+) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pullRequests[id] = map[string]interface{}{
+		"id":    id,
+		"title": fmt.Sprintf("Pull request %d", id),
+		"state": state,
+		"source": map[string]interface{}{
+			"branch": map[string]string{"name": "feature"},
+			"commit": map[string]string{"hash": sourceCommit},
+		},
+		"destination": map[string]interface{}{
+			"branch": map[string]string{"name": "main"},
+			"commit": map[string]string{"hash": "abc"},
+		},
+	}
+}
+
+// mockService records every payload it is asked to handle.
+type mockService struct {
+	payloads []interface{}
+	err      error
+}
+
+func (m *mockService) Handle(
+	_ context.Context,
+	payload interface{},
+) (sdk.EventList, error) {
+	if m.err != nil {
+		return sdk.EventList{}, m.err
+	}
+	m.payloads = append(m.payloads, payload)
+	return sdk.EventList{Items: []sdk.Event{{}}}, nil
+}
+
+func TestNewPoller(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name       string
+		setup      func() string
+		assertions func(Poller, error)
+	}{
+		{
+			name: "state file does not exist",
+			setup: func() string {
+				return filepath.Join(dir, "does-not-exist")
+			},
+			assertions: func(p Poller, err error) {
+				require.NoError(t, err)
+				pl, ok := p.(*poller)
+				require.True(t, ok)
+				require.Empty(t, pl.state)
+			},
+		},
+		{
+			name: "state file not parsable",
+			setup: func() string {
+				path := filepath.Join(dir, "invalid")
+				require.NoError(t, os.WriteFile(path, []byte("foo"), 0600))
+				return path
+			},
+			assertions: func(_ Poller, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing")
+			},
+		},
+		{
+			name: "state file exists",
+			setup: func() string {
+				path := filepath.Join(dir, "valid")
+				require.NoError(
+					t,
+					os.WriteFile(
+						path,
+						[]byte(`{"example-org/a":{"branches":{"main":"abc"}}}`),
+						0600,
+					),
+				)
+				return path
+			},
+			assertions: func(p Poller, err error) {
+				require.NoError(t, err)
+				pl, ok := p.(*poller)
+				require.True(t, ok)
+				require.Equal(
+					t,
+					map[string]string{"main": "abc"},
+					pl.state["example-org/a"].Branches,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(
+				NewPoller(
+					PollerConfig{StatePath: testCase.setup()},
+					bitbucket.NewClient(bitbucket.ClientConfig{}),
+					nil,
+				),
+			)
+		})
+	}
+}
+
+func TestPollerPoll(t *testing.T) {
+	bb := &fakeBitbucket{
+		branches:     map[string]string{"main": "abc", "old": "def"},
+		tags:         map[string]string{},
+		pullRequests: map[int64]map[string]interface{}{},
+	}
+	bb.setPullRequest(1, "OPEN", "111")
+	bb.setPullRequest(2, "OPEN", "222")
+	server := httptest.NewServer(bb)
+	defer server.Close()
+	client := bitbucket.NewClient(bitbucket.ClientConfig{APIAddress: server.URL})
+	service := &mockService{}
+	replayer, err := webhooks.NewReplayer(service)
+	require.NoError(t, err)
+	config := PollerConfig{
+		Repos:     []string{"example-org/a"},
+		Interval:  time.Minute,
+		StatePath: filepath.Join(t.TempDir(), "state.json"),
+	}
+	p, err := NewPoller(config, client, replayer)
+	require.NoError(t, err)
+
+	// The first poll only records the repository's state
+	require.NoError(t, p.Poll(context.Background()))
+	require.Empty(t, service.payloads)
+	require.FileExists(t, config.StatePath)
+
+	// A new poller picks up where the last one left off
+	p, err = NewPoller(config, client, replayer)
+	require.NoError(t, err)
+
+	bb.mu.Lock()
+	bb.branches["main"] = "ghi" // Moved
+	delete(bb.branches, "old")  // Deleted
+	bb.tags["v1.0.0"] = "ghi"   // Created
+	bb.mu.Unlock()
+	bb.setPullRequest(1, "MERGED", "111") // Merged
+	bb.setPullRequest(2, "OPEN", "333")   // Updated
+	bb.setPullRequest(3, "OPEN", "444")   // Created
+	require.NoError(t, p.Poll(context.Background()))
+	require.Len(t, service.payloads, 6)
+
+	moved, ok := service.payloads[0].(bbPayloads.RepoPushPayload)
+	require.True(t, ok)
+	require.Equal(t, "example-org/a", moved.Repository.FullName)
+	require.Equal(t, "main", moved.Push.Changes[0].New.Name)
+	require.Equal(t, "ghi", moved.Push.Changes[0].New.Target.Hash)
+	require.Equal(t, "abc", moved.Push.Changes[0].Old.Target.Hash)
+
+	deleted, ok := service.payloads[1].(bbPayloads.RepoPushPayload)
+	require.True(t, ok)
+	require.Empty(t, deleted.Push.Changes[0].New.Name)
+	require.Equal(t, "old", deleted.Push.Changes[0].Old.Name)
+
+	created, ok := service.payloads[2].(bbPayloads.RepoPushPayload)
+	require.True(t, ok)
+	require.Equal(t, "tag", created.Push.Changes[0].New.Type)
+	require.Equal(t, "v1.0.0", created.Push.Changes[0].New.Name)
+
+	updated, ok := service.payloads[3].(bbPayloads.PullRequestUpdatedPayload)
+	require.True(t, ok)
+	require.Equal(t, int64(2), updated.PullRequest.ID)
+	require.Equal(t, "333", updated.PullRequest.Source.Commit.Hash)
+
+	opened, ok := service.payloads[4].(bbPayloads.PullRequestCreatedPayload)
+	require.True(t, ok)
+	require.Equal(t, int64(3), opened.PullRequest.ID)
+	require.Equal(t, "example-org/a", opened.Repository.FullName)
+
+	merged, ok := service.payloads[5].(bbPayloads.PullRequestMergedPayload)
+	require.True(t, ok)
+	require.Equal(t, int64(1), merged.PullRequest.ID)
+
+	// Nothing has changed since the last poll
+	require.NoError(t, p.Poll(context.Background()))
+	require.Len(t, service.payloads, 6)
+
+	// Changes that could not be handled are handled again by the next poll
+	bb.setPullRequest(3, "DECLINED", "444")
+	service.err = fmt.Errorf("something went wrong")
+	err = p.Poll(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to poll 1 of 1 repositories")
+	service.err = nil
+	require.NoError(t, p.Poll(context.Background()))
+	require.Len(t, service.payloads, 7)
+	declined, ok := service.payloads[6].(bbPayloads.PullRequestDeclinedPayload)
+	require.True(t, ok)
+	require.Equal(t, int64(3), declined.PullRequest.ID)
+
+	// Problems communicating with Bitbucket are reported
+	bb.mu.Lock()
+	bb.fail = true
+	bb.mu.Unlock()
+	require.Error(t, p.Poll(context.Background()))
+}
@@ -0,0 +1,188 @@
+package readiness
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check is a function that returns an error if some dependency of the gateway
+// is not in a state that permits the gateway to do its job.
+type Check func(ctx context.Context) error
+
+// CheckerConfig encapsulates configuration for a Checker.
+type CheckerConfig struct {
+	// Interval is how often all checks are performed.
+	Interval time.Duration
+	// Timeout is how long each check may take before it is considered to have
+	// failed.
+	Timeout time.Duration
+}
+
+// Checker is an interface for components that periodically perform a set of
+// checks and report, via HTTP, whether the gateway is ready to receive
+// webhooks. Results are cached between checks so that frequent requests, e.g.
+// from Kubernetes readiness probes, do not translate into frequent requests to
+// the gateway's dependencies. ServeHTTP responds with only the gateway's
+// overall readiness, since it is meant to be served to anonymous clients.
+type Checker interface {
+	http.Handler
+	// Run performs all checks immediately and then periodically until the
+	// provided context is canceled.
+	Run(ctx context.Context)
+	// ServeReport responds with the gateway's overall readiness as well as the
+	// outcome of each individual check, including any errors. It should only be
+	// served to authenticated clients.
+	ServeReport(w http.ResponseWriter, r *http.Request)
+}
+
+// result is the outcome of a single check.
+type result struct {
+	Ready     bool      `json:"ready"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// summary describes only the gateway's overall readiness.
+type summary struct {
+	Ready bool `json:"ready"`
+}
+
+// report summarizes the outcomes of all checks.
+type report struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]result `json:"checks"`
+}
+
+type checker struct {
+	config   CheckerConfig
+	checks   map[string]Check
+	critical map[string]bool
+	mu       sync.RWMutex
+	results  map[string]result
+}
+
+// NewChecker returns an implementation of the Checker interface that performs
+// the provided checks, identified by name. The gateway is reported as ready
+// only if every critical check has been performed at least once and most
+// recently succeeded. Non-critical checks are performed and reported in the
+// same manner, but their failures do not affect the gateway's readiness.
+func NewChecker(
+	config CheckerConfig,
+	criticalChecks map[string]Check,
+	nonCriticalChecks map[string]Check,
+) Checker {
+	c := &checker{
+		config:   config,
+		checks:   map[string]Check{},
+		critical: map[string]bool{},
+		results:  map[string]result{},
+	}
+	for name, check := range nonCriticalChecks {
+		c.checks[name] = check
+	}
+	for name, check := range criticalChecks {
+		c.checks[name] = check
+		c.critical[name] = true
+	}
+	return c
+}
+
+func (c *checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkAll performs all checks concurrently and records their results.
+func (c *checker) checkAll(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for name, check := range c.checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			res := c.check(ctx, check)
+			if !res.Ready {
+				log.Printf("readiness check %q failed: %s", name, res.Error)
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.results[name] = res
+		}(name, check)
+	}
+	wg.Wait()
+}
+
+// check performs a single check, subject to the configured timeout.
+func (c *checker) check(ctx context.Context, check Check) result {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	res := result{Ready: true}
+	if err := check(ctx); err != nil {
+		res.Ready = false
+		res.Error = err.Error()
+	}
+	res.CheckedAt = time.Now().UTC()
+	return res
+}
+
+func (c *checker) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	rep := c.report()
+	writeJSON(w, rep.Ready, summary{Ready: rep.Ready})
+}
+
+func (c *checker) ServeReport(w http.ResponseWriter, _ *http.Request) {
+	rep := c.report()
+	writeJSON(w, rep.Ready, rep)
+}
+
+// report returns the most recent outcome of every check.
+func (c *checker) report() report {
+	rep := report{
+		Ready:  true,
+		Checks: map[string]result{},
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name := range c.checks {
+		res, ok := c.results[name]
+		if !ok {
+			res = result{Error: "check has not yet been performed"}
+		}
+		res.Critical = c.critical[name]
+		rep.Checks[name] = res
+		if res.Critical {
+			rep.Ready = rep.Ready && res.Ready
+		}
+	}
+	return rep
+}
+
+// writeJSON writes the provided object to the provided http.ResponseWriter as
+// JSON, along with a status code reflecting the provided readiness.
+func writeJSON(w http.ResponseWriter, ready bool, obj interface{}) {
+	statusCode := http.StatusOK
+	if !ready {
+		statusCode = http.StatusServiceUnavailable
+	}
+	responseJSON, err := json.Marshal(obj)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON) // nolint: errcheck
+}
@@ -0,0 +1,217 @@
+package readiness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewChecker(t *testing.T) {
+	config := CheckerConfig{
+		Interval: time.Minute,
+		Timeout:  time.Second,
+	}
+	c, ok := NewChecker(
+		config,
+		map[string]Check{
+			"foo": func(context.Context) error { return nil },
+		},
+		map[string]Check{
+			"bar": func(context.Context) error { return nil },
+		},
+	).(*checker)
+	require.True(t, ok)
+	require.Equal(t, config, c.config)
+	require.Len(t, c.checks, 2)
+	require.Equal(t, map[string]bool{"foo": true}, c.critical)
+	require.NotNil(t, c.results)
+}
+
+func TestCheckerServeReport(t *testing.T) {
+	testCases := []struct {
+		name              string
+		checks            map[string]Check
+		nonCriticalChecks map[string]Check
+		performed         bool
+		assertions        func(*httptest.ResponseRecorder, report)
+	}{
+		{
+			name: "checks not yet performed",
+			checks: map[string]Check{
+				"foo": func(context.Context) error { return nil },
+			},
+			assertions: func(rr *httptest.ResponseRecorder, rep report) {
+				require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+				require.False(t, rep.Ready)
+				require.Contains(t, rep.Checks, "foo")
+				require.False(t, rep.Checks["foo"].Ready)
+				require.Equal(
+					t,
+					"check has not yet been performed",
+					rep.Checks["foo"].Error,
+				)
+			},
+		},
+		{
+			name: "a check failed",
+			checks: map[string]Check{
+				"foo": func(context.Context) error { return nil },
+				"bar": func(context.Context) error {
+					return errors.New("something went wrong")
+				},
+			},
+			performed: true,
+			assertions: func(rr *httptest.ResponseRecorder, rep report) {
+				require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+				require.False(t, rep.Ready)
+				require.True(t, rep.Checks["foo"].Ready)
+				require.False(t, rep.Checks["bar"].Ready)
+				require.True(t, rep.Checks["bar"].Critical)
+				require.Equal(t, "something went wrong", rep.Checks["bar"].Error)
+				require.False(t, rep.Checks["bar"].CheckedAt.IsZero())
+			},
+		},
+		{
+			name: "a non-critical check failed",
+			checks: map[string]Check{
+				"foo": func(context.Context) error { return nil },
+			},
+			nonCriticalChecks: map[string]Check{
+				"bar": func(context.Context) error {
+					return errors.New("something went wrong")
+				},
+			},
+			performed: true,
+			assertions: func(rr *httptest.ResponseRecorder, rep report) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.True(t, rep.Ready)
+				require.True(t, rep.Checks["foo"].Ready)
+				require.False(t, rep.Checks["bar"].Ready)
+				require.False(t, rep.Checks["bar"].Critical)
+				require.Equal(t, "something went wrong", rep.Checks["bar"].Error)
+			},
+		},
+		{
+			name: "a check timed out",
+			checks: map[string]Check{
+				"foo": func(ctx context.Context) error {
+					<-ctx.Done()
+					return ctx.Err()
+				},
+			},
+			performed: true,
+			assertions: func(rr *httptest.ResponseRecorder, rep report) {
+				require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+				require.False(t, rep.Ready)
+				require.Equal(
+					t,
+					context.DeadlineExceeded.Error(),
+					rep.Checks["foo"].Error,
+				)
+			},
+		},
+		{
+			name: "all checks passed",
+			checks: map[string]Check{
+				"foo": func(context.Context) error { return nil },
+				"bar": func(context.Context) error { return nil },
+			},
+			performed: true,
+			assertions: func(rr *httptest.ResponseRecorder, rep report) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.True(t, rep.Ready)
+				require.Len(t, rep.Checks, 2)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			c, ok := NewChecker(
+				CheckerConfig{
+					Interval: time.Minute,
+					Timeout:  10 * time.Millisecond,
+				},
+				testCase.checks,
+				testCase.nonCriticalChecks,
+			).(*checker)
+			require.True(t, ok)
+			if testCase.performed {
+				c.checkAll(context.Background())
+			}
+			rr := httptest.NewRecorder()
+			c.ServeReport(
+				rr,
+				httptest.NewRequest(http.MethodGet, "/admin/readiness", nil),
+			)
+			require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			rep := report{}
+			require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &rep))
+			testCase.assertions(rr, rep)
+		})
+	}
+}
+
+func TestCheckerServeHTTP(t *testing.T) {
+	c, ok := NewChecker(
+		CheckerConfig{
+			Interval: time.Minute,
+			Timeout:  time.Second,
+		},
+		map[string]Check{
+			"foo": func(context.Context) error {
+				return errors.New("something went wrong")
+			},
+		},
+		nil,
+	).(*checker)
+	require.True(t, ok)
+	c.checkAll(context.Background())
+	rr := httptest.NewRecorder()
+	c.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	// Details of individual checks are not disclosed
+	require.JSONEq(t, `{"ready":false}`, rr.Body.String())
+}
+
+func TestCheckerRun(t *testing.T) {
+	var count int32
+	c := NewChecker(
+		CheckerConfig{
+			Interval: 10 * time.Millisecond,
+			Timeout:  time.Second,
+		},
+		map[string]Check{
+			"foo": func(context.Context) error {
+				atomic.AddInt32(&count, 1)
+				return nil
+			},
+		},
+		nil,
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	require.Eventually(
+		t,
+		func() bool { return atomic.LoadInt32(&count) >= 2 },
+		time.Second,
+		5*time.Millisecond,
+	)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "Run did not return after context was canceled")
+	}
+}
@@ -0,0 +1,250 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pollWait is how long the client asks a relay server to hold each request for
+// the next delivery open while no deliveries are pending.
+const pollWait = 30 * time.Second
+
+// DefaultMaxConcurrency is the maximum number of deliveries a Client handles
+// concurrently, unless configured otherwise.
+const DefaultMaxConcurrency = 10
+
+// ClientConfig encapsulates configuration for a Client.
+type ClientConfig struct {
+	// Address is the base URL of the relay server, e.g.
+	// https://relay.example.com.
+	Address string
+	// Token is the bearer token presented to the relay server.
+	Token string
+	// RetryInterval is how long to wait before requesting deliveries again after
+	// failing to communicate with the relay server.
+	RetryInterval time.Duration
+	// MaxConcurrency is the maximum number of deliveries handled concurrently.
+	// No further deliveries are requested from the relay server while this many
+	// are being handled. If not positive, DefaultMaxConcurrency is used.
+	MaxConcurrency int
+}
+
+// Client is an interface for components that receive webhooks relayed by a
+// relay server over an outbound connection and hand them off to a local
+// http.Handler.
+type Client interface {
+	// Run requests deliveries from the relay server, handles each, and returns
+	// each response to the relay server until the provided context is canceled.
+	// Deliveries are handled concurrently, up to the configured maximum.
+	Run(ctx context.Context)
+}
+
+type client struct {
+	config     ClientConfig
+	handler    http.Handler
+	httpClient *http.Client
+	// slots holds one element for each delivery being handled and so bounds
+	// how many are handled concurrently.
+	slots chan struct{}
+}
+
+// NewClient returns an implementation of the Client interface that hands each
+// delivery received from the relay server specified by the provided
+// ClientConfig off to the provided http.Handler, exactly as if the webhook had
+// been sent directly to the gateway.
+func NewClient(config ClientConfig, handler http.Handler) Client {
+	if config.MaxConcurrency <= 0 {
+		config.MaxConcurrency = DefaultMaxConcurrency
+	}
+	return &client{
+		config:  config,
+		handler: handler,
+		httpClient: &http.Client{
+			// Allow ample time beyond how long the relay server is asked to wait
+			Timeout: pollWait + 30*time.Second,
+		},
+		slots: make(chan struct{}, config.MaxConcurrency),
+	}
+}
+
+func (c *client) Run(ctx context.Context) {
+	log.Printf("Receiving webhooks relayed by %s", c.config.Address)
+	for {
+		// Wait for a free slot before requesting a delivery, so that deliveries
+		// in excess of what can be handled remain pending at the relay server
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		delivery, err := c.receive(ctx)
+		if err != nil || delivery == nil {
+			<-c.slots
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("error receiving delivery from relay: %s", err)
+			select {
+			case <-time.After(c.config.RetryInterval):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if delivery != nil {
+			go func() {
+				defer func() { <-c.slots }()
+				c.handle(ctx, *delivery)
+			}()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// receive requests the next delivery from the relay server. If none was
+// pending by the time the relay server stopped waiting for one, nil is
+// returned.
+func (c *client) receive(ctx context.Context) (*Delivery, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodGet,
+		fmt.Sprintf(
+			"%s/tunnel/deliveries?wait=%s",
+			strings.TrimSuffix(c.config.Address, "/"),
+			url.QueryEscape(pollWait.String()),
+		),
+		nil,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.Token))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error requesting delivery")
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, errors.Errorf(
+			"received unexpected status code %d from relay",
+			resp.StatusCode,
+		)
+	}
+	delivery := &Delivery{}
+	if err = json.NewDecoder(resp.Body).Decode(delivery); err != nil {
+		return nil, errors.Wrap(err, "error parsing delivery")
+	}
+	return delivery, nil
+}
+
+// handle forwards the provided delivery and logs any error.
+func (c *client) handle(ctx context.Context, delivery Delivery) {
+	if err := c.forward(ctx, delivery); err != nil {
+		log.Printf(
+			"error responding to delivery %s from relay: %s",
+			delivery.ID,
+			err,
+		)
+	}
+}
+
+// forward hands the provided delivery off to the handler and returns the
+// handler's response to the relay server.
+func (c *client) forward(ctx context.Context, delivery Delivery) error {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		delivery.Path,
+		bytes.NewReader(delivery.Body),
+	)
+	if err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header = delivery.Headers
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	recorder := &responseRecorder{header: http.Header{}}
+	c.handler.ServeHTTP(recorder, req)
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	responseJSON, err := json.Marshal(
+		Response{
+			StatusCode: recorder.statusCode,
+			Headers:    recorder.header,
+			Body:       recorder.body.Bytes(),
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling response")
+	}
+	if req, err = http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		fmt.Sprintf(
+			"%s/tunnel/deliveries/%s/response",
+			strings.TrimSuffix(c.config.Address, "/"),
+			url.PathEscape(delivery.ID),
+		),
+		bytes.NewReader(responseJSON),
+	); err != nil {
+		return errors.Wrap(err, "error creating request")
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.Token))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error sending response")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.Errorf(
+			"received unexpected status code %d from relay",
+			resp.StatusCode,
+		)
+	}
+	return nil
+}
+
+// responseRecorder is a minimal implementation of the http.ResponseWriter
+// interface that captures a response in memory.
+type responseRecorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+}
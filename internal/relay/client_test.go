@@ -0,0 +1,261 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClient(t *testing.T) {
+	config := ClientConfig{
+		Address:       "https://relay.example.com",
+		Token:         "foo",
+		RetryInterval: time.Second,
+	}
+	handler := http.NotFoundHandler()
+	c, ok := NewClient(config, handler).(*client)
+	require.True(t, ok)
+	// Concurrency should be bounded even if no maximum was specified
+	config.MaxConcurrency = DefaultMaxConcurrency
+	require.Equal(t, config, c.config)
+	require.NotNil(t, c.handler)
+	require.NotNil(t, c.httpClient)
+	require.Equal(t, DefaultMaxConcurrency, cap(c.slots))
+}
+
+func TestClientRun(t *testing.T) {
+	relayServer := httptest.NewServer(
+		NewServer(
+			ServerConfig{
+				Token:           "foo",
+				ResponseTimeout: 10 * time.Second,
+				MaxPending:      10,
+			},
+		),
+	)
+	defer relayServer.Close()
+
+	// The handler stands in for the gateway's webhook handler
+	router := mux.NewRouter()
+	router.HandleFunc(
+		"/events/projects/{projectID}",
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(
+				w,
+				`{"project":%q,"event":%q,"body":%q}`,
+				mux.Vars(r)["projectID"],
+				r.Header.Get("X-Event-Key"),
+				body,
+			)
+		},
+	).Methods(http.MethodPost)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewClient(
+		ClientConfig{
+			Address:       relayServer.URL,
+			Token:         "foo",
+			RetryInterval: 10 * time.Millisecond,
+		},
+		router,
+	).Run(ctx)
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(
+			http.MethodPost,
+			fmt.Sprintf("%s/events/projects/italian", relayServer.URL),
+			strings.NewReader(fmt.Sprintf("delivery %d", i)),
+		)
+		require.NoError(t, err)
+		req.Header.Set("X-Event-Key", "repo:push")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.Equal(
+			t,
+			fmt.Sprintf(
+				`{"project":"italian","event":"repo:push","body":"delivery %d"}`,
+				i,
+			),
+			bodyOf(t, resp),
+		)
+	}
+
+	// Deliveries the handler cannot route are relayed as such
+	resp, err := http.Post(
+		fmt.Sprintf("%s/events", relayServer.URL),
+		"application/json",
+		strings.NewReader("{}"),
+	)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	bodyOf(t, resp)
+}
+
+func TestClientRunBoundsConcurrency(t *testing.T) {
+	const maxConcurrency = 2
+	var mu sync.Mutex
+	var requested, handling, maxHandling int
+	// The relay server always has another delivery pending
+	relayServer := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			mu.Lock()
+			requested++
+			id := requested
+			mu.Unlock()
+			fmt.Fprintf(w, `{"id":"%d","path":"/events"}`, id)
+		}),
+	)
+	defer relayServer.Close()
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		mu.Lock()
+		handling++
+		if handling > maxHandling {
+			maxHandling = handling
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		handling--
+		mu.Unlock()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewClient(
+		ClientConfig{
+			Address:        relayServer.URL,
+			Token:          "foo",
+			RetryInterval:  10 * time.Millisecond,
+			MaxConcurrency: maxConcurrency,
+		},
+		handler,
+	).Run(ctx)
+
+	require.Eventually(
+		t,
+		func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return handling == maxConcurrency
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+	// No further deliveries should be requested while the maximum number are
+	// being handled
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	require.Equal(t, maxConcurrency, requested)
+	mu.Unlock()
+
+	// Once handling completes, further deliveries should be requested
+	close(release)
+	require.Eventually(
+		t,
+		func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return requested > maxConcurrency
+		},
+		time.Second,
+		10*time.Millisecond,
+	)
+	cancel()
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, maxConcurrency, maxHandling)
+}
+
+func TestClientReceive(t *testing.T) {
+	testCases := []struct {
+		name       string
+		handler    http.HandlerFunc
+		assertions func(*Delivery, error)
+	}{
+		{
+			name: "unexpected status code",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+			assertions: func(_ *Delivery, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "unexpected status code 401")
+			},
+		},
+		{
+			name: "unparsable delivery",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprint(w, "foo")
+			},
+			assertions: func(_ *Delivery, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error parsing delivery")
+			},
+		},
+		{
+			name: "no delivery pending",
+			handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+			assertions: func(delivery *Delivery, err error) {
+				require.NoError(t, err)
+				require.Nil(t, delivery)
+			},
+		},
+		{
+			name: "delivery pending",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "Bearer foo", r.Header.Get("Authorization"))
+				require.Equal(t, pollWait.String(), r.URL.Query().Get("wait"))
+				fmt.Fprint(w, `{"id":"abc","path":"/events"}`)
+			},
+			assertions: func(delivery *Delivery, err error) {
+				require.NoError(t, err)
+				require.Equal(t, &Delivery{ID: "abc", Path: "/events"}, delivery)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			server := httptest.NewServer(testCase.handler)
+			defer server.Close()
+			c, ok := NewClient(
+				ClientConfig{Address: server.URL, Token: "foo"},
+				nil,
+			).(*client)
+			require.True(t, ok)
+			testCase.assertions(c.receive(context.Background()))
+		})
+	}
+}
+
+// bodyOf returns the provided response's body as a string.
+func bodyOf(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	buf := &bytes.Buffer{}
+	_, err := buf.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	return buf.String()
+}
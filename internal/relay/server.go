@@ -0,0 +1,243 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/admin"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultWait is how long a request for the next delivery is held open
+	// while no deliveries are pending, unless the requester specifies otherwise.
+	defaultWait = 30 * time.Second
+	// maxWait is the longest a request for the next delivery is ever held open.
+	maxWait = time.Minute
+)
+
+// Delivery is a webhook received by a relay server on behalf of a gateway.
+type Delivery struct {
+	// ID uniquely identifies the delivery.
+	ID string `json:"id"`
+	// Path is the path (e.g. /events) the webhook was sent to.
+	Path string `json:"path"`
+	// Headers are the webhook's HTTP headers.
+	Headers http.Header `json:"headers"`
+	// Body is the webhook's body.
+	Body []byte `json:"body"`
+}
+
+// Response is a gateway's response to a Delivery, which a relay server
+// returns to the webhook's original sender.
+type Response struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int `json:"statusCode"`
+	// Headers are the response's HTTP headers.
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is the response's body.
+	Body []byte `json:"body,omitempty"`
+}
+
+// ServerConfig encapsulates configuration for a relay server.
+type ServerConfig struct {
+	// Token is the bearer token a gateway must present to receive deliveries and
+	// respond to them.
+	Token string
+	// ResponseTimeout is how long a webhook's sender is kept waiting for a
+	// gateway to respond to the corresponding Delivery. A webhook that is not
+	// responded to in time is rejected with a 504 status code.
+	ResponseTimeout time.Duration
+	// MaxPending is the maximum number of deliveries that may await a gateway
+	// at once. Webhooks received while this many are pending are rejected with
+	// a 503 status code.
+	MaxPending int
+}
+
+// pendingDelivery is a Delivery awaiting a gateway's Response.
+type pendingDelivery struct {
+	delivery Delivery
+	response chan Response
+}
+
+// server is an implementation of the http.Handler interface that accepts
+// webhooks from Bitbucket and relays them to a gateway that requests them over
+// an outbound connection.
+type server struct {
+	config  ServerConfig
+	router  *mux.Router
+	queue   chan *pendingDelivery
+	mu      sync.Mutex
+	pending map[string]*pendingDelivery
+}
+
+// NewServer returns an implementation of the http.Handler interface that
+// accepts webhooks from Bitbucket at /events and /events/projects/{projectID}
+// and relays each to a gateway, which requests deliveries from
+// /tunnel/deliveries and responds to each at
+// /tunnel/deliveries/{id}/response. The gateway's response to each delivery is
+// returned to Bitbucket.
+func NewServer(config ServerConfig) http.Handler {
+	s := &server{
+		config:  config,
+		router:  mux.NewRouter(),
+		queue:   make(chan *pendingDelivery, config.MaxPending),
+		pending: map[string]*pendingDelivery{},
+	}
+	s.router.StrictSlash(true)
+	s.router.HandleFunc("/events", s.receive).Methods(http.MethodPost)
+	s.router.HandleFunc(
+		"/events/projects/{projectID}",
+		s.receive,
+	).Methods(http.MethodPost)
+	tokenFilter := admin.NewTokenFilter(config.Token)
+	s.router.HandleFunc(
+		"/tunnel/deliveries",
+		tokenFilter.Decorate(s.next),
+	).Methods(http.MethodGet)
+	s.router.HandleFunc(
+		"/tunnel/deliveries/{id}/response",
+		tokenFilter.Decorate(s.respond),
+	).Methods(http.MethodPost)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// receive queues a webhook for delivery to a gateway and waits for the
+// gateway's response.
+func (s *server) receive(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("error reading request body: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	p := &pendingDelivery{
+		delivery: Delivery{
+			ID:      newID(),
+			Path:    r.URL.Path,
+			Headers: r.Header.Clone(),
+			Body:    body,
+		},
+		response: make(chan Response, 1),
+	}
+	s.mu.Lock()
+	s.pending[p.delivery.ID] = p
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, p.delivery.ID)
+		s.mu.Unlock()
+	}()
+	select {
+	case s.queue <- p:
+	default:
+		log.Printf(
+			"rejected delivery %s; %d deliveries are already pending",
+			p.delivery.ID,
+			s.config.MaxPending,
+		)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	timer := time.NewTimer(s.config.ResponseTimeout)
+	defer timer.Stop()
+	select {
+	case response := <-p.response:
+		for key, values := range response.Headers {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(response.StatusCode)
+		w.Write(response.Body) // nolint: errcheck
+	case <-timer.C:
+		log.Printf("timed out waiting for a response to delivery %s", p.delivery.ID)
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+	}
+}
+
+// next returns the next pending delivery, waiting for one to arrive if
+// necessary. If none arrives before the duration specified by the wait query
+// parameter (or a default) elapses, a 204 status code is returned.
+func (s *server) next(w http.ResponseWriter, r *http.Request) {
+	wait := defaultWait
+	if waitStr := r.URL.Query().Get("wait"); waitStr != "" {
+		var err error
+		if wait, err = time.ParseDuration(waitStr); err != nil || wait < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case p := <-s.queue:
+			s.mu.Lock()
+			_, ok := s.pending[p.delivery.ID]
+			s.mu.Unlock()
+			if !ok {
+				// The webhook's sender is no longer waiting for a response
+				continue
+			}
+			deliveryJSON, err := json.Marshal(p.delivery)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(deliveryJSON) // nolint: errcheck
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// respond relays a gateway's response to a delivery to the webhook's sender.
+// If the sender is no longer waiting for it, a 404 status code is returned.
+func (s *server) respond(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	response := Response{}
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil ||
+		response.StatusCode < 100 || response.StatusCode > 999 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	s.mu.Lock()
+	p, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p.response <- response
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newID returns a new, random delivery ID.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b) // nolint: errcheck
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,235 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tunnelRequest returns a request to the specified path of a relay server's
+// tunnel API that bears the specified token.
+func tunnelRequest(method, path, token, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestServerTunnelAuthentication(t *testing.T) {
+	s := NewServer(ServerConfig{Token: "foo", MaxPending: 1})
+	testCases := []struct {
+		name string
+		req  *http.Request
+	}{
+		{
+			name: "no token",
+			req:  httptest.NewRequest(http.MethodGet, "/tunnel/deliveries", nil),
+		},
+		{
+			name: "wrong token requesting delivery",
+			req: tunnelRequest(
+				http.MethodGet,
+				"/tunnel/deliveries?wait=0s",
+				"bar",
+				"",
+			),
+		},
+		{
+			name: "wrong token responding",
+			req: tunnelRequest(
+				http.MethodPost,
+				"/tunnel/deliveries/abc/response",
+				"bar",
+				`{"statusCode":200}`,
+			),
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, testCase.req)
+			require.Equal(t, http.StatusUnauthorized, rr.Code)
+		})
+	}
+}
+
+func TestServerNext(t *testing.T) {
+	s := NewServer(ServerConfig{Token: "foo", MaxPending: 1})
+	testCases := []struct {
+		name       string
+		path       string
+		assertions func(*httptest.ResponseRecorder)
+	}{
+		{
+			name: "invalid wait",
+			path: "/tunnel/deliveries?wait=bogus",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "no deliveries pending",
+			path: "/tunnel/deliveries?wait=10ms",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNoContent, rr.Code)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, tunnelRequest(http.MethodGet, testCase.path, "foo", ""))
+			testCase.assertions(rr)
+		})
+	}
+}
+
+func TestServerRespond(t *testing.T) {
+	s := NewServer(ServerConfig{Token: "foo", MaxPending: 1})
+	testCases := []struct {
+		name       string
+		body       string
+		assertions func(*httptest.ResponseRecorder)
+	}{
+		{
+			name: "invalid response",
+			body: "foo",
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "invalid status code",
+			body: `{"statusCode":0}`,
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusBadRequest, rr.Code)
+			},
+		},
+		{
+			name: "unknown delivery",
+			body: `{"statusCode":200}`,
+			assertions: func(rr *httptest.ResponseRecorder) {
+				require.Equal(t, http.StatusNotFound, rr.Code)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(
+				rr,
+				tunnelRequest(
+					http.MethodPost,
+					"/tunnel/deliveries/abc/response",
+					"foo",
+					testCase.body,
+				),
+			)
+			testCase.assertions(rr)
+		})
+	}
+}
+
+func TestServerReceive(t *testing.T) {
+	t.Run("no response from gateway", func(t *testing.T) {
+		s := NewServer(
+			ServerConfig{
+				Token:           "foo",
+				ResponseTimeout: 10 * time.Millisecond,
+				MaxPending:      1,
+			},
+		)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/events", nil))
+		require.Equal(t, http.StatusGatewayTimeout, rr.Code)
+		// A delivery that was given up on is never relayed
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(
+			rr,
+			tunnelRequest(
+				http.MethodGet,
+				"/tunnel/deliveries?wait=10ms",
+				"foo",
+				"",
+			),
+		)
+		require.Equal(t, http.StatusNoContent, rr.Code)
+	})
+
+	t.Run("too many pending deliveries", func(t *testing.T) {
+		s := NewServer(
+			ServerConfig{
+				Token:           "foo",
+				ResponseTimeout: time.Minute,
+				MaxPending:      0,
+			},
+		)
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/events", nil))
+		require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	})
+
+	t.Run("response from gateway", func(t *testing.T) {
+		s := NewServer(
+			ServerConfig{
+				Token:           "foo",
+				ResponseTimeout: time.Minute,
+				MaxPending:      1,
+			},
+		)
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			req := httptest.NewRequest(
+				http.MethodPost,
+				"/events/projects/italian",
+				strings.NewReader(`{"foo":"bar"}`),
+			)
+			req.Header.Set("X-Event-Key", "repo:push")
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+			done <- rr
+		}()
+
+		rr := httptest.NewRecorder()
+		s.ServeHTTP(
+			rr,
+			tunnelRequest(http.MethodGet, "/tunnel/deliveries", "foo", ""),
+		)
+		require.Equal(t, http.StatusOK, rr.Code)
+		delivery := Delivery{}
+		require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &delivery))
+		require.NotEmpty(t, delivery.ID)
+		require.Equal(t, "/events/projects/italian", delivery.Path)
+		require.Equal(t, "repo:push", delivery.Headers.Get("X-Event-Key"))
+		require.Equal(t, []byte(`{"foo":"bar"}`), delivery.Body)
+
+		responseJSON, err := json.Marshal(
+			Response{
+				StatusCode: http.StatusAccepted,
+				Headers:    http.Header{"Content-Type": {"application/json"}},
+				Body:       []byte("{}"),
+			},
+		)
+		require.NoError(t, err)
+		rr = httptest.NewRecorder()
+		s.ServeHTTP(
+			rr,
+			tunnelRequest(
+				http.MethodPost,
+				"/tunnel/deliveries/"+delivery.ID+"/response",
+				"foo",
+				string(responseJSON),
+			),
+		)
+		require.Equal(t, http.StatusNoContent, rr.Code)
+
+		rr = <-done
+		require.Equal(t, http.StatusAccepted, rr.Code)
+		require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		require.Equal(t, "{}", rr.Body.String())
+	})
+}
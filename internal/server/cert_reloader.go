@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// certReloader supplies the TLS certificate for every handshake, reloading the
+// certificate and key from file whenever either has changed. Files are checked
+// for changes at most once per poll interval so that handshakes do not
+// routinely incur the cost of accessing the file system.
+type certReloader struct {
+	certPath     string
+	keyPath      string
+	pollInterval time.Duration
+	mu           sync.Mutex
+	cert         *tls.Certificate
+	certModTime  time.Time
+	keyModTime   time.Time
+	lastChecked  time.Time
+	// now is overridable for testing purposes
+	now func() time.Time
+}
+
+// newCertReloader returns a certReloader for the certificate and key at the
+// specified paths. An error is returned if they cannot initially be loaded.
+func newCertReloader(
+	certPath string,
+	keyPath string,
+	pollInterval time.Duration,
+) (*certReloader, error) {
+	c := &certReloader{
+		certPath:     certPath,
+		keyPath:      keyPath,
+		pollInterval: pollInterval,
+		now:          time.Now,
+	}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	c.lastChecked = c.now()
+	return c, nil
+}
+
+// getCertificate implements the signature of tls.Config.GetCertificate.
+func (c *certReloader) getCertificate(
+	*tls.ClientHelloInfo,
+) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := c.now(); now.Sub(c.lastChecked) >= c.pollInterval {
+		c.lastChecked = now
+		if reloaded, err := c.reload(); err != nil {
+			log.Printf(
+				"error reloading TLS certificate; continuing to use previous "+
+					"certificate: %s",
+				err,
+			)
+		} else if reloaded {
+			log.Printf("reloaded TLS certificate from %s", c.certPath)
+		}
+	}
+	return c.cert, nil
+}
+
+// reload loads the certificate and key from file if either has been modified
+// since they were last loaded. The bool return value indicates whether they
+// were loaded. Callers other than the constructor must hold the lock.
+func (c *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.certPath)
+	if err != nil {
+		return false,
+			errors.Wrapf(err, "error checking TLS certificate %s", c.certPath)
+	}
+	keyInfo, err := os.Stat(c.keyPath)
+	if err != nil {
+		return false, errors.Wrapf(err, "error checking TLS key %s", c.keyPath)
+	}
+	if c.cert != nil &&
+		certInfo.ModTime().Equal(c.certModTime) &&
+		keyInfo.ModTime().Equal(c.keyModTime) {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return false, errors.Wrap(err, "error loading TLS certificate and key")
+	}
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return true, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+
+	// Files do not exist
+	_, err := newCertReloader(certPath, keyPath, time.Minute)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error checking TLS certificate")
+
+	// Files are not valid
+	require.NoError(t, os.WriteFile(certPath, []byte("foo"), 0600))
+	require.NoError(t, os.WriteFile(keyPath, []byte("foo"), 0600))
+	_, err = newCertReloader(certPath, keyPath, time.Minute)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error loading TLS certificate and key")
+
+	// Success
+	writeCert(t, certPath, keyPath, "foo")
+	c, err := newCertReloader(certPath, keyPath, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "foo", commonName(t, c.cert))
+}
+
+func TestCertReloaderGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	writeCert(t, certPath, keyPath, "foo")
+	c, err := newCertReloader(certPath, keyPath, time.Minute)
+	require.NoError(t, err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	c.lastChecked = now
+
+	// Renew the certificate. Make sure modification times differ even on file
+	// systems with coarse timestamps.
+	writeCert(t, certPath, keyPath, "bar")
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(certPath, later, later))
+	require.NoError(t, os.Chtimes(keyPath, later, later))
+
+	// The renewed certificate should not be picked up before the poll interval
+	// has elapsed
+	cert, err := c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "foo", commonName(t, cert))
+
+	// But it should be picked up after
+	now = now.Add(time.Minute)
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "bar", commonName(t, cert))
+
+	// A broken renewal should not displace the previous certificate
+	require.NoError(t, os.WriteFile(keyPath, []byte("foo"), 0600))
+	evenLater := later.Add(time.Second)
+	require.NoError(t, os.Chtimes(keyPath, evenLater, evenLater))
+	now = now.Add(time.Minute)
+	cert, err = c.getCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "bar", commonName(t, cert))
+}
+
+// writeCert writes a self-signed certificate with the specified common name,
+// and its key, to the specified paths.
+func writeCert(t *testing.T, certPath, keyPath, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err :=
+		x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(
+		t,
+		os.WriteFile(
+			certPath,
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			0600,
+		),
+	)
+	require.NoError(
+		t,
+		os.WriteFile(
+			keyPath,
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+			0600,
+		),
+	)
+}
+
+// commonName returns the common name of the provided certificate's subject.
+func commonName(t *testing.T, cert *tls.Certificate) string {
+	require.NotNil(t, cert)
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return x509Cert.Subject.CommonName
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// proxyProtocolV1Prefix is the prefix of every PROXY protocol v1 header.
+	proxyProtocolV1Prefix = "PROXY "
+	// proxyProtocolV1MaxLength is the maximum length, in bytes, of a PROXY
+	// protocol v1 header, including the terminating CRLF.
+	proxyProtocolV1MaxLength = 107
+)
+
+// proxyProtocolV2Signature is the signature that begins every PROXY protocol
+// v2 header.
+var proxyProtocolV2Signature = []byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+// proxyProtocolListener is a net.Listener that, for each accepted connection,
+// reads a PROXY protocol (v1 or v2) header, if present, and reports the client
+// address it contains as the connection's remote address. Connections that do
+// not begin with a header, such as those from Kubernetes probes, are served
+// using their actual remote address.
+type proxyProtocolListener struct {
+	net.Listener
+	// trustedSources are the IP ranges from which PROXY protocol headers are
+	// accepted. Connections from elsewhere are served as if they had no header.
+	// If empty, headers are accepted from no source.
+	trustedSources []net.IPNet
+	// headerTimeout is how long to wait for a connection's header.
+	headerTimeout time.Duration
+}
+
+func (p *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !p.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: p.headerTimeout,
+	}, nil
+}
+
+// trusted returns a bool indicating whether PROXY protocol headers are
+// accepted from the provided address.
+func (p *proxyProtocolListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, trustedSource := range p.trustedSources {
+		if trustedSource.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolConn is a net.Conn whose PROXY protocol header, if any, is read
+// upon the first call to Read or RemoteAddr. This ensures the header is read
+// by the goroutine serving the connection and not by the goroutine accepting
+// connections.
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+	once          sync.Once
+	remoteAddr    net.Addr
+	err           error
+}
+
+// readHeader reads the connection's PROXY protocol header, if any. Any error
+// encountered is returned from all subsequent calls to Read.
+func (p *proxyProtocolConn) readHeader() {
+	p.once.Do(func() {
+		if err :=
+			p.Conn.SetReadDeadline(time.Now().Add(p.headerTimeout)); err != nil {
+			p.err = err
+			return
+		}
+		p.remoteAddr, p.err = readProxyProtocolHeader(p.reader)
+		if p.err != nil {
+			log.Printf(
+				"error reading PROXY protocol header from %s: %s",
+				p.Conn.RemoteAddr(),
+				p.err,
+			)
+		} else {
+			p.err = p.Conn.SetReadDeadline(time.Time{})
+		}
+	})
+}
+
+func (p *proxyProtocolConn) Read(b []byte) (int, error) {
+	p.readHeader()
+	if p.err != nil {
+		return 0, p.err
+	}
+	return p.reader.Read(b)
+}
+
+func (p *proxyProtocolConn) RemoteAddr() net.Addr {
+	p.readHeader()
+	if p.remoteAddr != nil {
+		return p.remoteAddr
+	}
+	return p.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol v1 or v2 header from the
+// provided reader, if one is present, and returns the client address it
+// contains. If no header is present, or the header does not convey a client
+// address (as is the case for health checks performed by the proxy itself), a
+// nil address is returned and nothing is consumed from the reader.
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "error reading connection preface")
+	}
+	if bytes.Equal(prefix, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(reader)
+	}
+	if bytes.HasPrefix(prefix, []byte(proxyProtocolV1Prefix)) {
+		return readProxyProtocolV1Header(reader)
+	}
+	return nil, nil
+}
+
+// readProxyProtocolV1Header reads a human-readable PROXY protocol v1 header
+// from the provided reader, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443",
+// and returns the client address it contains.
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyProtocolV1MaxLength)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading PROXY protocol v1 header")
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, errors.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, errors.Errorf(
+			"PROXY protocol v1 header contains invalid source address %q",
+			fields[2],
+		)
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, errors.Errorf(
+				"PROXY protocol v1 header contains non-IPv4 source address %q",
+				fields[2],
+			)
+		}
+	case "TCP6":
+		if ip.To4() != nil {
+			return nil, errors.Errorf(
+				"PROXY protocol v1 header contains non-IPv6 source address %q",
+				fields[2],
+			)
+		}
+	default:
+		return nil, errors.Errorf(
+			"PROXY protocol v1 header contains unsupported protocol %q",
+			fields[1],
+		)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.Errorf(
+			"PROXY protocol v1 header contains invalid source port %q",
+			fields[4],
+		)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtocolV2Header reads a binary PROXY protocol v2 header from the
+// provided reader and returns the client address it contains.
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errors.Wrap(err, "error reading PROXY protocol v2 header")
+	}
+	versionAndCommand := header[12]
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errors.Wrap(err, "error reading PROXY protocol v2 addresses")
+	}
+	if versionAndCommand>>4 != 2 {
+		return nil, errors.Errorf(
+			"unsupported PROXY protocol version %d",
+			versionAndCommand>>4,
+		)
+	}
+	switch versionAndCommand & 0x0F {
+	case 0x00: // LOCAL; e.g. a health check performed by the proxy itself
+		return nil, nil
+	case 0x01: // PROXY
+	default:
+		return nil, errors.Errorf(
+			"unsupported PROXY protocol v2 command %d",
+			versionAndCommand&0x0F,
+		)
+	}
+	// The payload begins with the source address, followed by the destination
+	// address, the source port, the destination port, and then any TLVs.
+	var addrLen int
+	switch family >> 4 {
+	case 0x01: // AF_INET
+		addrLen = net.IPv4len
+	case 0x02: // AF_INET6
+		addrLen = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+	if len(payload) < 2*addrLen+4 {
+		return nil, errors.New("PROXY protocol v2 addresses are truncated")
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(payload[:addrLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*addrLen:])),
+	}, nil
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyProtocolV2Header returns a PROXY protocol v2 header with the specified
+// command, address family, and address payload.
+func proxyProtocolV2Header(command byte, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	ipv4Payload := append(
+		append(
+			net.ParseIP("192.0.2.1").To4(),
+			net.ParseIP("198.51.100.1").To4()...,
+		),
+		0xDC, 0x04, 0x01, 0xBB, // 56324, 443
+	)
+	ipv6Payload := append(
+		append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...),
+		0xDC, 0x04, 0x01, 0xBB, // 56324, 443
+	)
+	testCases := []struct {
+		name       string
+		input      []byte
+		assertions func(addr net.Addr, err error, rest string)
+	}{
+		{
+			name:  "no header",
+			input: []byte("GET / HTTP/1.1\r\n"),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Nil(t, addr)
+				require.Equal(t, "GET / HTTP/1.1\r\n", rest)
+			},
+		},
+		{
+			name:  "short connection without header",
+			input: []byte("GET"),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Nil(t, addr)
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name:  "v1 TCP4",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET"),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1:56324", addr.String())
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name:  "v1 TCP6",
+			input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET"),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Equal(t, "[2001:db8::1]:56324", addr.String())
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name:  "v1 UNKNOWN",
+			input: []byte("PROXY UNKNOWN\r\nGET"),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Nil(t, addr)
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name:  "v1 malformed",
+			input: []byte("PROXY TCP4 192.0.2.1\r\nGET"),
+			assertions: func(_ net.Addr, err error, _ string) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "malformed")
+			},
+		},
+		{
+			name:  "v1 address family mismatch",
+			input: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			assertions: func(_ net.Addr, err error, _ string) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "non-IPv4")
+			},
+		},
+		{
+			name:  "v1 invalid port",
+			input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n"),
+			assertions: func(_ net.Addr, err error, _ string) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "invalid source port")
+			},
+		},
+		{
+			name:  "v1 too long",
+			input: []byte("PROXY " + strings.Repeat("A", 200) + "\r\n"),
+			assertions: func(_ net.Addr, err error, _ string) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "too long")
+			},
+		},
+		{
+			name: "v2 PROXY IPv4",
+			input: append(
+				proxyProtocolV2Header(0x01, 0x11, ipv4Payload),
+				[]byte("GET")...,
+			),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Equal(t, "192.0.2.1:56324", addr.String())
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name: "v2 PROXY IPv6 with TLVs",
+			input: append(
+				proxyProtocolV2Header(
+					0x01,
+					0x21,
+					append(ipv6Payload, 0x04, 0x00, 0x01, 0x00),
+				),
+				[]byte("GET")...,
+			),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Equal(t, "[2001:db8::1]:56324", addr.String())
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name: "v2 LOCAL",
+			input: append(
+				proxyProtocolV2Header(0x00, 0x00, nil),
+				[]byte("GET")...,
+			),
+			assertions: func(addr net.Addr, err error, rest string) {
+				require.NoError(t, err)
+				require.Nil(t, addr)
+				require.Equal(t, "GET", rest)
+			},
+		},
+		{
+			name:  "v2 unsupported command",
+			input: proxyProtocolV2Header(0x02, 0x11, ipv4Payload),
+			assertions: func(_ net.Addr, err error, _ string) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "unsupported PROXY protocol v2")
+			},
+		},
+		{
+			name:  "v2 truncated addresses",
+			input: proxyProtocolV2Header(0x01, 0x21, ipv4Payload),
+			assertions: func(_ net.Addr, err error, _ string) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "truncated")
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(testCase.input))
+			addr, err := readProxyProtocolHeader(reader)
+			rest, readErr := io.ReadAll(reader)
+			require.NoError(t, readErr)
+			testCase.assertions(addr, err, string(rest))
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	testCases := []struct {
+		name               string
+		trustedSources     []net.IPNet
+		preface            string
+		expectedRemoteAddr func(localAddr string) string
+	}{
+		{
+			name: "with header",
+			trustedSources: []net.IPNet{
+				{IP: net.ParseIP("127.0.0.0"), Mask: net.CIDRMask(8, 32)},
+			},
+			preface: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			expectedRemoteAddr: func(string) string {
+				return "192.0.2.1:56324"
+			},
+		},
+		{
+			name: "without header",
+			expectedRemoteAddr: func(localAddr string) string {
+				return localAddr
+			},
+		},
+		{
+			name: "with header from untrusted source",
+			trustedSources: []net.IPNet{
+				{IP: net.ParseIP("192.0.2.0"), Mask: net.CIDRMask(24, 32)},
+			},
+			preface: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			// The header is treated as the beginning of a malformed request
+			expectedRemoteAddr: nil,
+		},
+		{
+			name:    "with header and no trusted sources",
+			preface: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			// The header is treated as the beginning of a malformed request
+			expectedRemoteAddr: nil,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			srv := &http.Server{
+				Handler: http.HandlerFunc(
+					func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte(r.RemoteAddr)) // nolint: errcheck
+					},
+				),
+				ReadHeaderTimeout: 5 * time.Second,
+			}
+			go srv.Serve( // nolint: errcheck
+				&proxyProtocolListener{
+					Listener:       listener,
+					trustedSources: testCase.trustedSources,
+					headerTimeout:  5 * time.Second,
+				},
+			)
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write(
+				[]byte(
+					testCase.preface +
+						"GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+				),
+			)
+			require.NoError(t, err)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			if testCase.expectedRemoteAddr == nil {
+				require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+				return
+			}
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(
+				t,
+				testCase.expectedRemoteAddr(conn.LocalAddr().String()),
+				string(body),
+			)
+		})
+	}
+}
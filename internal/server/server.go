@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config represents optional configuration for an HTTP/S server.
+type Config struct {
+	// Port specifies the port the server should bind to / listen on.
+	Port int
+	// TLSEnabled specifies whether the server should serve HTTP (false) or HTTPS
+	// (true).
+	TLSEnabled bool
+	// TLSCertPath is the path to a PEM-encoded x509 certificate that can be used
+	// for serving HTTPS.
+	TLSCertPath string
+	// TLSKeyPath is the path to a PEM-encoded x509 private key that can be used
+	// for serving HTTPS.
+	TLSKeyPath string
+	// TLSCertPollInterval is how often the certificate and key are checked for
+	// changes. When either changes, both are reloaded and used for all
+	// subsequent TLS handshakes. A zero value means a default of 30 seconds.
+	TLSCertPollInterval time.Duration
+	// TLSMinVersion is the minimum TLS version the server will accept. A zero
+	// value means TLS 1.2.
+	TLSMinVersion uint16
+	// TLSCipherSuites, if non-empty, restricts the cipher suites the server
+	// will negotiate for TLS 1.2 connections. TLS 1.3 cipher suites are not
+	// configurable.
+	TLSCipherSuites []uint16
+	// ProxyProtocolEnabled specifies whether connections may begin with a PROXY
+	// protocol (v1 or v2) header, as sent by many L4 load balancers, conveying
+	// the address of the client the load balancer received the connection from.
+	// When a header is present, that address is used as the remote address of
+	// every request received over the connection. Connections without a header
+	// are served using their actual remote address.
+	ProxyProtocolEnabled bool
+	// ProxyProtocolTrustedSources are the IP ranges from which PROXY protocol
+	// headers are accepted. Connections from elsewhere are served as if they had
+	// no header. If empty, no headers are accepted.
+	ProxyProtocolTrustedSources []net.IPNet
+}
+
+// Server is an interface for an HTTP/S server. It is similar to the server in
+// github.com/brigadecore/brigade-foundations/http, but additionally reloads its
+// TLS certificate without a restart whenever the certificate is renewed and
+// optionally supports the PROXY protocol.
+type Server interface {
+	// ListenAndServe runs the HTTP/S server until the provided context is
+	// canceled. This function always returns a non-nil error.
+	ListenAndServe(ctx context.Context) error
+}
+
+// proxyProtocolHeaderTimeout is how long to wait for a connection's PROXY
+// protocol header.
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+type server struct {
+	config  Config
+	handler http.Handler
+}
+
+// New returns a new HTTP/S server.
+func New(handler http.Handler, config *Config) Server {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.Port == 0 {
+		config.Port = 8080
+	}
+	if config.TLSCertPollInterval == 0 {
+		config.TLSCertPollInterval = 30 * time.Second
+	}
+	if config.TLSMinVersion == 0 {
+		config.TLSMinVersion = tls.VersionTLS12
+	}
+	return &server{
+		config:  *config,
+		handler: handler,
+	}
+}
+
+func (s *server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%d", s.config.Port),
+		Handler:           s.handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	if s.config.TLSEnabled {
+		if s.config.TLSCertPath == "" {
+			return errors.New(
+				"TLS was enabled, but no certificate path was specified",
+			)
+		}
+		if s.config.TLSKeyPath == "" {
+			return errors.New(
+				"TLS was enabled, but no key path was specified",
+			)
+		}
+		certs, err := newCertReloader(
+			s.config.TLSCertPath,
+			s.config.TLSKeyPath,
+			s.config.TLSCertPollInterval,
+		)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.getCertificate,
+			MinVersion:     s.config.TLSMinVersion,
+			CipherSuites:   s.config.TLSCipherSuites,
+		}
+	}
+
+	listener, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "error listening on %s", srv.Addr)
+	}
+	if s.config.ProxyProtocolEnabled {
+		log.Println("Server will accept PROXY protocol headers")
+		listener = &proxyProtocolListener{
+			Listener:       listener,
+			trustedSources: s.config.ProxyProtocolTrustedSources,
+			headerTimeout:  proxyProtocolHeaderTimeout,
+		}
+	}
+
+	errCh := make(chan error)
+
+	if s.config.TLSEnabled {
+		log.Printf(
+			"Server is listening with TLS enabled on 0.0.0.0:%d",
+			s.config.Port,
+		)
+
+		go func() {
+			// The certificate and key are obtained via the GetCertificate callback,
+			// so no paths are passed here.
+			serveErr := srv.ServeTLS(listener, "", "")
+			select {
+			case errCh <- serveErr:
+			case <-ctx.Done():
+			}
+		}()
+	} else {
+		log.Printf(
+			"Server is listening without TLS on 0.0.0.0:%d",
+			s.config.Port,
+		)
+
+		go func() {
+			serveErr := srv.Serve(listener)
+			select {
+			case errCh <- serveErr:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	select {
+	case err = <-errCh:
+		return err
+	case <-ctx.Done():
+		// Five second grace period on shutdown
+		shutdownCtx, cancel :=
+			context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx) // nolint: errcheck
+		return ctx.Err()
+	}
+}
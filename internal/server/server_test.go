@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     *Config
+		assertions func(s *server)
+	}{
+		{
+			name: "without optional config",
+			assertions: func(s *server) {
+				require.Equal(t, 8080, s.config.Port)
+				require.Equal(t, 30*time.Second, s.config.TLSCertPollInterval)
+				require.Equal(t, uint16(tls.VersionTLS12), s.config.TLSMinVersion)
+			},
+		},
+		{
+			name: "with optional config",
+			config: &Config{
+				Port:                1234,
+				TLSCertPollInterval: time.Minute,
+				TLSMinVersion:       tls.VersionTLS13,
+			},
+			assertions: func(s *server) {
+				require.Equal(t, 1234, s.config.Port)
+				require.Equal(t, time.Minute, s.config.TLSCertPollInterval)
+				require.Equal(t, uint16(tls.VersionTLS13), s.config.TLSMinVersion)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s, ok := New(http.NotFoundHandler(), testCase.config).(*server)
+			require.True(t, ok)
+			testCase.assertions(s)
+		})
+	}
+}
+
+func TestServerListenAndServe(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     Config
+		assertions func(error)
+	}{
+		{
+			name: "TLS enabled without cert path",
+			config: Config{
+				TLSEnabled: true,
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no certificate path")
+			},
+		},
+		{
+			name: "TLS enabled without key path",
+			config: Config{
+				TLSEnabled:  true,
+				TLSCertPath: "/var/ssl/cert",
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no key path")
+			},
+		},
+		{
+			name: "TLS enabled with non-existent cert",
+			config: Config{
+				TLSEnabled:  true,
+				TLSCertPath: "/var/ssl/cert",
+				TLSKeyPath:  "/var/ssl/key",
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error checking TLS certificate")
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(
+				New(http.NotFoundHandler(), &testCase.config).
+					ListenAndServe(context.Background()),
+			)
+		})
+	}
+}
+
+func TestServerListenAndServeWithCertRenewal(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "tls.crt")
+	keyPath := filepath.Join(dir, "tls.key")
+	writeCert(t, certPath, keyPath, "foo")
+
+	port := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error)
+	go func() {
+		errCh <- New(
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}),
+			&Config{
+				Port:                port,
+				TLSEnabled:          true,
+				TLSCertPath:         certPath,
+				TLSKeyPath:          keyPath,
+				TLSCertPollInterval: 10 * time.Millisecond,
+				TLSMinVersion:       tls.VersionTLS13,
+			},
+		).ListenAndServe(ctx)
+	}()
+
+	// servedCommonName returns the common name of the certificate presented by
+	// the server during a new TLS handshake.
+	servedCommonName := func(maxVersion uint16) (string, error) {
+		conn, err := tls.Dial(
+			"tcp",
+			fmt.Sprintf("localhost:%d", port),
+			&tls.Config{
+				InsecureSkipVerify: true, // nolint: gosec
+				MaxVersion:         maxVersion,
+			},
+		)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	require.Eventually(
+		t,
+		func() bool {
+			cn, err := servedCommonName(tls.VersionTLS13)
+			return err == nil && cn == "foo"
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+
+	// Versions older than the configured minimum should be refused
+	_, err := servedCommonName(tls.VersionTLS12)
+	require.Error(t, err)
+
+	// Renew the certificate; the server should pick it up without a restart
+	writeCert(t, certPath, keyPath, "bar")
+	require.Eventually(
+		t,
+		func() bool {
+			cn, dialErr := servedCommonName(tls.VersionTLS13)
+			return dialErr == nil && cn == "bar"
+		},
+		5*time.Second,
+		10*time.Millisecond,
+	)
+
+	cancel()
+	require.ErrorIs(t, <-errCh, context.Canceled)
+}
+
+// freePort returns a TCP port that is not currently in use.
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	require.True(t, ok)
+	return addr.Port
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// tlsVersions maps supported names of TLS versions to their identifiers.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion returns the identifier of the TLS version with the specified
+// name (e.g. 1.2). Versions older than TLS 1.2 are not supported.
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, errors.Errorf(
+			"unsupported TLS version %q; supported versions are 1.2 and 1.3",
+			name,
+		)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites returns the identifiers of the cipher suites with the
+// specified names (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). Only cipher
+// suites that Go does not consider insecure are supported.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	supported := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		var ok bool
+		if ids[i], ok = supported[strings.TrimSpace(name)]; !ok {
+			return nil, errors.Errorf("unsupported cipher suite %q", name)
+		}
+	}
+	return ids, nil
+}
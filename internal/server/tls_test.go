@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTLSVersion(t *testing.T) {
+	version, err := ParseTLSVersion("1.2")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), version)
+	version, err = ParseTLSVersion("1.3")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), version)
+	_, err = ParseTLSVersion("1.1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported TLS version")
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := ParseCipherSuites(
+		[]string{
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			" TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(
+		t,
+		[]uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		ids,
+	)
+	// Insecure cipher suites are not supported
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported cipher suite")
+}
@@ -0,0 +1,430 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/brigade"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/pkg/errors"
+)
+
+// AuditorConfig encapsulates configuration for an Auditor.
+type AuditorConfig struct {
+	// Source is the value of the Source field of events emitted into Brigade by
+	// the gateway. Only event subscriptions to this source are considered.
+	Source string
+	// SupportedEvents are the keys (e.g. repo:push) of all events the gateway
+	// is able to handle. Event subscriptions to any other types are ignored and
+	// a subscription to all types (*) is considered a subscription to each of
+	// these.
+	SupportedEvents []string
+	// Repos are the full names (e.g. example-org/example) of repositories that
+	// should be audited even if no project subscribes to their events.
+	Repos []string
+	// Workspaces are workspaces whose every repository should be audited even
+	// if no project subscribes to its events.
+	Workspaces []string
+	// ProjectMappings map matching repositories to a single Brigade project
+	// regardless of its event subscriptions. Events are never removed from the
+	// webhooks of repositories that any of these apply to.
+	ProjectMappings []webhooks.ProjectMapping
+	// Interval is how often audits are performed.
+	Interval time.Duration
+	// Reconcile indicates whether, following each audit, webhooks should be
+	// created or updated so that each audited repository sends exactly those
+	// events that some project subscribes to. Webhooks are never deleted, and
+	// events are never removed from repositories that ProjectMappings apply to.
+	// Instead, the unconsumed events are reported.
+	Reconcile bool
+}
+
+// Report summarizes the outcome of an audit.
+type Report struct {
+	// AuditedAt is the time at which the audit was performed.
+	AuditedAt time.Time `json:"auditedAt"`
+	// Error, if non-empty, explains why the audit failed.
+	Error string `json:"error,omitempty"`
+	// Repos summarizes the audit of each repository.
+	Repos []RepoReport `json:"repos,omitempty"`
+}
+
+// RepoReport summarizes the audit of a single repository.
+type RepoReport struct {
+	// Repo is the repository's full name, e.g. example-org/example.
+	Repo string `json:"repo"`
+	// Projects are the IDs of projects subscribing to events from the
+	// repository.
+	Projects []string `json:"projects,omitempty"`
+	// ConsumedEvents are the keys of events that some project subscribes to.
+	ConsumedEvents []string `json:"consumedEvents,omitempty"`
+	// SentEvents are the keys of events the repository's webhook is configured
+	// to send to the gateway. A repository with no webhook or an inactive one
+	// sends none.
+	SentEvents []string `json:"sentEvents,omitempty"`
+	// MissingEvents are the keys of events that some project subscribes to, but
+	// which the repository does not send.
+	MissingEvents []string `json:"missingEvents,omitempty"`
+	// UnconsumedEvents are the keys of events the repository sends, but which
+	// no project subscribes to.
+	UnconsumedEvents []string `json:"unconsumedEvents,omitempty"`
+	// Mapped indicates whether a project mapping applies to the repository, in
+	// which case its events may be consumed regardless of subscriptions.
+	Mapped bool `json:"mapped,omitempty"`
+	// Reconciled indicates whether the repository's webhook was reconciled
+	// following the audit.
+	Reconciled bool `json:"reconciled,omitempty"`
+	// Error, if non-empty, explains why the repository could not be audited or
+	// reconciled.
+	Error string `json:"error,omitempty"`
+}
+
+// Auditor is an interface for components that periodically compare the
+// Bitbucket events Brigade projects subscribe to with the events Bitbucket
+// repositories are configured to send to the gateway and report, via HTTP,
+// any discrepancies.
+type Auditor interface {
+	http.Handler
+	// Audit performs a single audit and returns its outcome. An error is
+	// returned if the audit failed as a whole or for any repository.
+	Audit(ctx context.Context) (Report, error)
+	// Run performs an audit immediately and then periodically until the
+	// provided context is canceled.
+	Run(ctx context.Context)
+}
+
+// subscription is a single project's subscription to events from a single
+// repository.
+type subscription struct {
+	project string
+	events  map[string]struct{}
+}
+
+type auditor struct {
+	config     AuditorConfig
+	listers    map[string]brigade.ProjectLister
+	client     bitbucket.Client
+	reconciler bitbucket.Reconciler
+	mu         sync.RWMutex
+	report     *Report
+}
+
+// NewAuditor returns an implementation of the Auditor interface. Projects are
+// listed using the provided ProjectListers, which are keyed by the Bitbucket
+// workspace whose events are emitted into the Brigade API server each
+// communicates with. A ProjectLister keyed by the empty string is used for
+// all workspaces. The provided Client is used to list the repositories in
+// configured workspaces and the provided Reconciler is used to find and, if
+// so configured, reconcile each repository's webhook.
+func NewAuditor(
+	config AuditorConfig,
+	listers map[string]brigade.ProjectLister,
+	client bitbucket.Client,
+	reconciler bitbucket.Reconciler,
+) Auditor {
+	return &auditor{
+		config:     config,
+		listers:    listers,
+		client:     client,
+		reconciler: reconciler,
+	}
+}
+
+func (a *auditor) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := a.Audit(ctx); err != nil {
+			log.Printf("error auditing event subscriptions: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *auditor) Audit(ctx context.Context) (Report, error) {
+	report, err := a.audit(ctx)
+	report.AuditedAt = time.Now().UTC()
+	if err != nil {
+		report.Error = err.Error()
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.report = &report
+	return report, err
+}
+
+// audit performs a single audit, returning an error if the audit failed as a
+// whole or for any repository.
+func (a *auditor) audit(ctx context.Context) (Report, error) {
+	report := Report{}
+	subscriptions, err := a.subscriptions(ctx)
+	if err != nil {
+		return report, err
+	}
+	repos, err := a.repos(ctx, subscriptions)
+	if err != nil {
+		return report, err
+	}
+	var failed int
+	for _, repo := range repos {
+		repoReport := a.auditRepo(ctx, repo, subscriptions[repo])
+		if repoReport.Error != "" {
+			log.Printf(
+				"error auditing event subscriptions for %s: %s",
+				repo,
+				repoReport.Error,
+			)
+			failed++
+		}
+		report.Repos = append(report.Repos, repoReport)
+	}
+	if failed > 0 {
+		return report, errors.Errorf(
+			"failed to audit %d of %d repositories",
+			failed,
+			len(repos),
+		)
+	}
+	return report, nil
+}
+
+// subscriptions lists all projects and returns a map of repositories' full
+// names to the projects' subscriptions to events from each.
+func (a *auditor) subscriptions(
+	ctx context.Context,
+) (map[string][]subscription, error) {
+	subscriptions := map[string][]subscription{}
+	workspaces := make([]string, 0, len(a.listers))
+	for workspace := range a.listers {
+		workspaces = append(workspaces, workspace)
+	}
+	sort.Strings(workspaces)
+	for _, workspace := range workspaces {
+		projects, err := a.listers[workspace].ListProjects(ctx)
+		if err != nil {
+			if workspace == "" {
+				return nil, errors.Wrap(err, "error listing projects")
+			}
+			return nil, errors.Wrapf(
+				err,
+				"error listing projects for workspace %s",
+				workspace,
+			)
+		}
+		for _, project := range projects {
+			for _, eventSub := range project.Spec.EventSubscriptions {
+				if eventSub.Source != a.config.Source {
+					continue
+				}
+				// The gateway qualifies every event with the repository's full
+				// name and Brigade requires qualifiers to match exactly, so a
+				// subscription without a repo qualifier matches nothing.
+				repo := eventSub.Qualifiers["repo"]
+				if repo == "" ||
+					(workspace != "" && !strings.HasPrefix(repo, workspace+"/")) {
+					continue
+				}
+				events := a.events(eventSub.Types)
+				if len(events) == 0 {
+					continue
+				}
+				subscriptions[repo] = append(
+					subscriptions[repo],
+					subscription{project: project.ID, events: events},
+				)
+			}
+		}
+	}
+	return subscriptions, nil
+}
+
+// events returns the set of supported events matching the provided event
+// types.
+func (a *auditor) events(types []string) map[string]struct{} {
+	events := map[string]struct{}{}
+	for _, supported := range a.config.SupportedEvents {
+		for _, t := range types {
+			if t == "*" || t == supported {
+				events[supported] = struct{}{}
+			}
+		}
+	}
+	return events
+}
+
+// repos returns the sorted, de-duplicated full names of all repositories that
+// are subscribed to, that are configured, and that belong to configured
+// workspaces.
+func (a *auditor) repos(
+	ctx context.Context,
+	subscriptions map[string][]subscription,
+) ([]string, error) {
+	repoSet := map[string]struct{}{}
+	for repo := range subscriptions {
+		repoSet[repo] = struct{}{}
+	}
+	for _, repo := range a.config.Repos {
+		repoSet[repo] = struct{}{}
+	}
+	for _, workspace := range a.config.Workspaces {
+		workspaceRepos, err := a.client.ListRepositories(ctx, workspace)
+		if err != nil {
+			return nil, err
+		}
+		for _, repo := range workspaceRepos {
+			repoSet[repo] = struct{}{}
+		}
+	}
+	repos := make([]string, 0, len(repoSet))
+	for repo := range repoSet {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// auditRepo compares the events the provided subscriptions consume with the
+// events the specified repository sends and, if so configured, reconciles the
+// repository's webhook, provided doing so would not delete it.
+func (a *auditor) auditRepo(
+	ctx context.Context,
+	repo string,
+	subscriptions []subscription,
+) RepoReport {
+	report := RepoReport{Repo: repo}
+	consumed := map[string]struct{}{}
+	projects := map[string]struct{}{}
+	for _, sub := range subscriptions {
+		projects[sub.project] = struct{}{}
+		for event := range sub.events {
+			consumed[event] = struct{}{}
+		}
+	}
+	for _, mapping := range a.config.ProjectMappings {
+		if mapping.Applies(repo) {
+			report.Mapped = true
+			break
+		}
+	}
+	report.Projects = sortedKeys(projects)
+	report.ConsumedEvents = sortedKeys(consumed)
+	webhook, err := a.reconciler.ManagedWebhook(ctx, repo)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	sent := map[string]struct{}{}
+	if webhook != nil && webhook.Active {
+		for _, event := range webhook.Events {
+			sent[event] = struct{}{}
+		}
+	}
+	report.SentEvents = sortedKeys(sent)
+	report.MissingEvents = difference(report.ConsumedEvents, sent)
+	report.UnconsumedEvents = difference(report.SentEvents, consumed)
+	if len(report.MissingEvents) > 0 {
+		log.Printf(
+			"projects subscribe to events %s from %s, but it does not send them",
+			strings.Join(report.MissingEvents, ", "),
+			repo,
+		)
+	}
+	if len(report.UnconsumedEvents) > 0 {
+		log.Printf(
+			"%s sends events %s, but no project subscribes to them",
+			repo,
+			strings.Join(report.UnconsumedEvents, ", "),
+		)
+	}
+	if !a.config.Reconcile {
+		return report
+	}
+	desired := report.ConsumedEvents
+	if report.Mapped {
+		// Events from mapped repositories may be consumed without any project
+		// subscribing to them, so none are removed
+		desired = sortedKeys(union(consumed, sent))
+	}
+	if len(desired) == 0 {
+		// Reconciling would delete the webhook, which is left to an operator
+		if webhook != nil {
+			log.Printf(
+				"not reconciling webhook for %s, since no project subscribes to any "+
+					"of its events",
+				repo,
+			)
+		}
+		return report
+	}
+	if err = a.reconciler.ReconcileRepo(ctx, repo, desired); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Reconciled = true
+	return report
+}
+
+func (a *auditor) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	a.mu.RLock()
+	report := a.report
+	a.mu.RUnlock()
+	statusCode := http.StatusOK
+	if report == nil {
+		statusCode = http.StatusServiceUnavailable
+		report = &Report{Error: "audit has not yet been performed"}
+	}
+	responseJSON, err := json.Marshal(report)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(responseJSON) // nolint: errcheck
+}
+
+// sortedKeys returns the keys of the provided set in sorted order.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// union returns a set containing the members of both provided sets.
+func union(a, b map[string]struct{}) map[string]struct{} {
+	set := map[string]struct{}{}
+	for key := range a {
+		set[key] = struct{}{}
+	}
+	for key := range b {
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+// difference returns those of the provided, sorted values that are not in the
+// provided set.
+func difference(values []string, set map[string]struct{}) []string {
+	diff := []string{}
+	for _, value := range values {
+		if _, ok := set[value]; !ok {
+			diff = append(diff, value)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,444 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/brigade"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	"github.com/stretchr/testify/require"
+)
+
+type mockProjectLister struct {
+	ListProjectsFn func(context.Context) ([]sdk.Project, error)
+}
+
+func (m *mockProjectLister) ListProjects(
+	ctx context.Context,
+) ([]sdk.Project, error) {
+	return m.ListProjectsFn(ctx)
+}
+
+type mockClient struct {
+	bitbucket.Client
+	ListRepositoriesFn func(context.Context, string) ([]string, error)
+}
+
+func (m *mockClient) ListRepositories(
+	ctx context.Context,
+	workspace string,
+) ([]string, error) {
+	return m.ListRepositoriesFn(ctx, workspace)
+}
+
+type mockReconciler struct {
+	bitbucket.Reconciler
+	ManagedWebhookFn func(context.Context, string) (*bitbucket.Webhook, error)
+	ReconcileRepoFn  func(context.Context, string, []string) error
+}
+
+func (m *mockReconciler) ManagedWebhook(
+	ctx context.Context,
+	repo string,
+) (*bitbucket.Webhook, error) {
+	return m.ManagedWebhookFn(ctx, repo)
+}
+
+func (m *mockReconciler) ReconcileRepo(
+	ctx context.Context,
+	repo string,
+	events []string,
+) error {
+	return m.ReconcileRepoFn(ctx, repo, events)
+}
+
+// project returns a project with the specified ID and event subscriptions.
+func project(id string, subs ...sdk.EventSubscription) sdk.Project {
+	return sdk.Project{
+		ObjectMeta: meta.ObjectMeta{ID: id},
+		Spec:       sdk.ProjectSpec{EventSubscriptions: subs},
+	}
+}
+
+// repoSubscription returns a subscription to events of the specified types
+// from the specified repository.
+func repoSubscription(repo string, types ...string) sdk.EventSubscription {
+	return sdk.EventSubscription{
+		Source:     "brigade.sh/bitbucket",
+		Types:      types,
+		Qualifiers: map[string]string{"repo": repo},
+	}
+}
+
+func TestNewAuditor(t *testing.T) {
+	config := AuditorConfig{Interval: time.Minute}
+	listers := map[string]brigade.ProjectLister{"": &mockProjectLister{}}
+	client := &mockClient{}
+	reconciler := &mockReconciler{}
+	a, ok := NewAuditor(config, listers, client, reconciler).(*auditor)
+	require.True(t, ok)
+	require.Equal(t, config, a.config)
+	require.Equal(t, listers, a.listers)
+	require.Same(t, client, a.client)
+	require.Same(t, reconciler, a.reconciler)
+	require.Nil(t, a.report)
+}
+
+func TestAuditorAudit(t *testing.T) {
+	projects := []sdk.Project{
+		project(
+			"foo",
+			repoSubscription("example-org/a", "repo:push"),
+			// Subscriptions to other sources should be ignored
+			sdk.EventSubscription{
+				Source:     "brigade.sh/github",
+				Types:      []string{"*"},
+				Qualifiers: map[string]string{"repo": "example-org/a"},
+			},
+			// Subscriptions without a repo qualifier match nothing
+			sdk.EventSubscription{
+				Source: "brigade.sh/bitbucket",
+				Types:  []string{"*"},
+			},
+		),
+		project(
+			"bar",
+			repoSubscription("example-org/a", "pullrequest:created", "bogus"),
+			repoSubscription("example-org/b", "*"),
+		),
+	}
+	managedWebhooks := map[string]*bitbucket.Webhook{
+		"example-org/a": {
+			Active: true,
+			Events: []string{"repo:push", "issue:created"},
+		},
+		"example-org/b": {
+			Active: false,
+			Events: []string{"repo:push", "pullrequest:created"},
+		},
+		"example-org/c": {
+			Active: true,
+			Events: []string{"repo:push"},
+		},
+	}
+	config := AuditorConfig{
+		Source: "brigade.sh/bitbucket",
+		SupportedEvents: []string{
+			"issue:created",
+			"pullrequest:created",
+			"repo:push",
+		},
+		Workspaces: []string{"example-org"},
+		Interval:   time.Minute,
+	}
+	testCases := []struct {
+		name        string
+		listers     map[string]brigade.ProjectLister
+		mappings    []webhooks.ProjectMapping
+		reconcile   bool
+		webhookErr  error
+		reconcileFn func(context.Context, string, []string) error
+		assertions  func(Report, error)
+	}{
+		{
+			name: "error listing projects",
+			listers: map[string]brigade.ProjectLister{
+				"": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return nil, errors.New("something went wrong")
+					},
+				},
+			},
+			assertions: func(report Report, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error listing projects")
+				require.Contains(t, report.Error, "something went wrong")
+				require.NotZero(t, report.AuditedAt)
+			},
+		},
+		{
+			name: "error getting webhook",
+			listers: map[string]brigade.ProjectLister{
+				"": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return projects, nil
+					},
+				},
+			},
+			webhookErr: errors.New("something went wrong"),
+			assertions: func(report Report, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "failed to audit 3 of 3")
+				require.Len(t, report.Repos, 3)
+				require.Equal(t, "something went wrong", report.Repos[0].Error)
+			},
+		},
+		{
+			name: "success",
+			listers: map[string]brigade.ProjectLister{
+				"": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return projects, nil
+					},
+				},
+			},
+			assertions: func(report Report, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					[]RepoReport{
+						{
+							Repo:           "example-org/a",
+							Projects:       []string{"bar", "foo"},
+							ConsumedEvents: []string{"pullrequest:created", "repo:push"},
+							SentEvents:     []string{"issue:created", "repo:push"},
+							MissingEvents:  []string{"pullrequest:created"},
+							UnconsumedEvents: []string{
+								"issue:created",
+							},
+						},
+						{
+							Repo:     "example-org/b",
+							Projects: []string{"bar"},
+							ConsumedEvents: []string{
+								"issue:created",
+								"pullrequest:created",
+								"repo:push",
+							},
+							SentEvents: []string{},
+							MissingEvents: []string{
+								"issue:created",
+								"pullrequest:created",
+								"repo:push",
+							},
+							UnconsumedEvents: []string{},
+						},
+						{
+							Repo:             "example-org/c",
+							Projects:         []string{},
+							ConsumedEvents:   []string{},
+							SentEvents:       []string{"repo:push"},
+							MissingEvents:    []string{},
+							UnconsumedEvents: []string{"repo:push"},
+						},
+					},
+					report.Repos,
+				)
+			},
+		},
+		{
+			name: "tenant projects only consume events from their workspace",
+			listers: map[string]brigade.ProjectLister{
+				"another-org": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return projects, nil
+					},
+				},
+			},
+			assertions: func(report Report, err error) {
+				require.NoError(t, err)
+				require.Len(t, report.Repos, 1)
+				require.Equal(t, "example-org/c", report.Repos[0].Repo)
+				require.Empty(t, report.Repos[0].Projects)
+			},
+		},
+		{
+			name: "error reconciling",
+			listers: map[string]brigade.ProjectLister{
+				"": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return projects, nil
+					},
+				},
+			},
+			reconcile: true,
+			reconcileFn: func(_ context.Context, repo string, _ []string) error {
+				if repo == "example-org/b" {
+					return errors.New("something went wrong")
+				}
+				return nil
+			},
+			assertions: func(report Report, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "failed to audit 1 of 3")
+				require.True(t, report.Repos[0].Reconciled)
+				require.False(t, report.Repos[1].Reconciled)
+				require.Equal(t, "something went wrong", report.Repos[1].Error)
+			},
+		},
+		{
+			name: "success reconciling",
+			listers: map[string]brigade.ProjectLister{
+				"": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return projects, nil
+					},
+				},
+			},
+			reconcile: true,
+			reconcileFn: func(
+				_ context.Context,
+				repo string,
+				events []string,
+			) error {
+				switch repo {
+				case "example-org/a":
+					require.Equal(
+						t,
+						[]string{"pullrequest:created", "repo:push"},
+						events,
+					)
+				case "example-org/c":
+					require.Fail(t, "webhook should not have been deleted")
+				}
+				return nil
+			},
+			assertions: func(report Report, err error) {
+				require.NoError(t, err)
+				require.True(t, report.Repos[0].Reconciled)
+				require.True(t, report.Repos[1].Reconciled)
+				// No project subscribes to example-org/c's events, but its webhook
+				// should only be reported, not deleted
+				require.False(t, report.Repos[2].Reconciled)
+				require.Equal(
+					t,
+					[]string{"repo:push"},
+					report.Repos[2].UnconsumedEvents,
+				)
+			},
+		},
+		{
+			name: "success reconciling mapped repositories",
+			listers: map[string]brigade.ProjectLister{
+				"": &mockProjectLister{
+					ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+						return projects, nil
+					},
+				},
+			},
+			mappings: []webhooks.ProjectMapping{
+				{Repo: "example-org/[ac]", Project: "baz"},
+			},
+			reconcile: true,
+			reconcileFn: func(
+				_ context.Context,
+				repo string,
+				events []string,
+			) error {
+				// Events should be added, but never removed
+				switch repo {
+				case "example-org/a":
+					require.Equal(
+						t,
+						[]string{"issue:created", "pullrequest:created", "repo:push"},
+						events,
+					)
+				case "example-org/c":
+					require.Equal(t, []string{"repo:push"}, events)
+				}
+				return nil
+			},
+			assertions: func(report Report, err error) {
+				require.NoError(t, err)
+				for _, repoReport := range report.Repos {
+					require.True(t, repoReport.Reconciled)
+				}
+				require.True(t, report.Repos[0].Mapped)
+				require.False(t, report.Repos[1].Mapped)
+				require.True(t, report.Repos[2].Mapped)
+				require.Equal(
+					t,
+					[]string{"repo:push"},
+					report.Repos[2].UnconsumedEvents,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg := config
+			cfg.ProjectMappings = testCase.mappings
+			cfg.Reconcile = testCase.reconcile
+			a := NewAuditor(
+				cfg,
+				testCase.listers,
+				&mockClient{
+					ListRepositoriesFn: func(
+						_ context.Context,
+						workspace string,
+					) ([]string, error) {
+						require.Equal(t, "example-org", workspace)
+						return []string{"example-org/c"}, nil
+					},
+				},
+				&mockReconciler{
+					ManagedWebhookFn: func(
+						_ context.Context,
+						repo string,
+					) (*bitbucket.Webhook, error) {
+						return managedWebhooks[repo], testCase.webhookErr
+					},
+					ReconcileRepoFn: testCase.reconcileFn,
+				},
+			)
+			testCase.assertions(a.Audit(context.Background()))
+		})
+	}
+}
+
+func TestAuditorServeHTTP(t *testing.T) {
+	a := NewAuditor(
+		AuditorConfig{
+			Source:          "brigade.sh/bitbucket",
+			SupportedEvents: []string{"repo:push"},
+		},
+		map[string]brigade.ProjectLister{
+			"": &mockProjectLister{
+				ListProjectsFn: func(context.Context) ([]sdk.Project, error) {
+					return []sdk.Project{
+						project("foo", repoSubscription("example-org/a", "*")),
+					}, nil
+				},
+			},
+		},
+		&mockClient{},
+		&mockReconciler{
+			ManagedWebhookFn: func(
+				context.Context,
+				string,
+			) (*bitbucket.Webhook, error) {
+				return nil, nil
+			},
+		},
+	)
+
+	// Before the first audit
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	report := Report{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Equal(t, "audit has not yet been performed", report.Error)
+
+	// After the first audit
+	_, err := a.Audit(context.Background())
+	require.NoError(t, err)
+	rr = httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	report = Report{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	require.Empty(t, report.Error)
+	require.Len(t, report.Repos, 1)
+	require.Equal(t, "example-org/a", report.Repos[0].Repo)
+	require.Equal(t, []string{"foo"}, report.Repos[0].Projects)
+}
@@ -0,0 +1,171 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// archiveFileTimeFormat is the format used for timestamps that prefix the names
+// of files written by the directory archive. It sorts lexically in
+// chronological order.
+const archiveFileTimeFormat = "20060102T150405.000000000Z"
+
+// archivePruneInterval is the minimum amount of time that must elapse between
+// two successive enforcements of the directory archive's retention policy.
+const archivePruneInterval = time.Minute
+
+// unsafeFileNameChars matches characters that should not be included in the
+// names of files written by the directory archive.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// DeliveryArchive is an interface for components that can persist a record of
+// webhooks delivered by Bitbucket, including the outcome of handling each.
+type DeliveryArchive interface {
+	// Archive persists a record of the provided Delivery.
+	Archive(Delivery) error
+}
+
+// DirectoryArchiveConfig encapsulates configuration for an implementation of
+// the DeliveryArchive interface that writes each Delivery to a file in a local
+// directory.
+type DirectoryArchiveConfig struct {
+	// Dir is the path to the directory deliveries should be written to.
+	Dir string
+	// MaxAge is the amount of time for which deliveries are retained. A zero
+	// value means deliveries are never pruned on the basis of their age.
+	MaxAge time.Duration
+	// MaxFiles is the maximum number of deliveries that are retained. When
+	// exceeded, the oldest deliveries are pruned first. A zero value means
+	// deliveries are never pruned on the basis of their number.
+	MaxFiles int
+}
+
+type directoryArchive struct {
+	config     DirectoryArchiveConfig
+	mu         sync.Mutex
+	lastPruned time.Time
+	// now is overridable for testing purposes
+	now func() time.Time
+}
+
+// NewDirectoryArchive returns an implementation of the DeliveryArchive
+// interface that writes each Delivery, in the same format consumed by the
+// replay subcommand, to a file in a local directory. Retention settings are
+// enforced periodically, such that the directory behaves like a rotating log.
+func NewDirectoryArchive(
+	config DirectoryArchiveConfig,
+) (DeliveryArchive, error) {
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return nil, errors.Wrapf(
+			err,
+			"error creating delivery archive directory %s",
+			config.Dir,
+		)
+	}
+	return &directoryArchive{
+		config: config,
+		now:    time.Now,
+	}, nil
+}
+
+func (d *directoryArchive) Archive(delivery Delivery) error {
+	deliveryJSON, err := json.MarshalIndent(delivery, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshaling delivery")
+	}
+	fileName := fmt.Sprintf(
+		"%s-%s.json",
+		delivery.ReceivedAt.UTC().Format(archiveFileTimeFormat),
+		unsafeFileNameChars.ReplaceAllString(delivery.ID, ""),
+	)
+	if err = os.WriteFile(
+		filepath.Join(d.config.Dir, fileName),
+		deliveryJSON,
+		0600,
+	); err != nil {
+		return errors.Wrapf(err, "error writing delivery to %s", fileName)
+	}
+	return d.prune()
+}
+
+// prune enforces the archive's retention settings, but only if that has not
+// already been done within the last archivePruneInterval.
+func (d *directoryArchive) prune() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	if now.Sub(d.lastPruned) < archivePruneInterval {
+		return nil
+	}
+	d.lastPruned = now
+	entries, err := os.ReadDir(d.config.Dir)
+	if err != nil {
+		return errors.Wrapf(
+			err,
+			"error listing delivery archive directory %s",
+			d.config.Dir,
+		)
+	}
+	fileNames := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			fileNames = append(fileNames, entry.Name())
+		}
+	}
+	// Oldest first
+	sort.Strings(fileNames)
+	var expired int
+	if d.config.MaxAge > 0 {
+		cutoff := now.Add(-d.config.MaxAge).UTC().Format(archiveFileTimeFormat)
+		for expired < len(fileNames) && fileNames[expired] < cutoff {
+			expired++
+		}
+	}
+	if d.config.MaxFiles > 0 && len(fileNames)-expired > d.config.MaxFiles {
+		expired = len(fileNames) - d.config.MaxFiles
+	}
+	for _, fileName := range fileNames[:expired] {
+		if err = os.Remove(filepath.Join(d.config.Dir, fileName)); err != nil &&
+			!os.IsNotExist(err) {
+			return errors.Wrapf(err, "error pruning delivery %s", fileName)
+		}
+	}
+	return nil
+}
+
+type multiArchive struct {
+	archives []DeliveryArchive
+}
+
+// NewMultiArchive returns an implementation of the DeliveryArchive interface
+// that archives every Delivery to each of the provided DeliveryArchives.
+func NewMultiArchive(archives ...DeliveryArchive) DeliveryArchive {
+	return &multiArchive{
+		archives: archives,
+	}
+}
+
+func (m *multiArchive) Archive(delivery Delivery) error {
+	errs := []string{}
+	for _, archive := range m.archives {
+		if err := archive.Archive(delivery); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf(
+			"error archiving delivery: %s",
+			strings.Join(errs, "; "),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDirectoryArchive(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "archive")
+	a, err := NewDirectoryArchive(DirectoryArchiveConfig{Dir: dir})
+	require.NoError(t, err)
+	require.IsType(t, &directoryArchive{}, a)
+	require.DirExists(t, dir)
+}
+
+func TestDirectoryArchive(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := &directoryArchive{
+		config: DirectoryArchiveConfig{
+			Dir:      dir,
+			MaxAge:   time.Hour,
+			MaxFiles: 2,
+		},
+		now: func() time.Time { return now },
+	}
+	archive := func(receivedAt time.Time, id string) {
+		require.NoError(
+			t,
+			a.Archive(
+				Delivery{
+					ID:         id,
+					ReceivedAt: receivedAt,
+					Headers: http.Header{
+						"X-Event-Key": []string{"repo:push"},
+					},
+					Body:       "{}",
+					StatusCode: http.StatusOK,
+					EventIDs:   []string{"abc"},
+				},
+			),
+		)
+	}
+	listFiles := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		fileNames := make([]string, len(entries))
+		for i, entry := range entries {
+			fileNames[i] = entry.Name()
+		}
+		return fileNames
+	}
+
+	// An expired delivery should be pruned right away
+	archive(now.Add(-2*time.Hour), "{expired}")
+	require.Empty(t, listFiles())
+
+	archive(now.Add(-3*time.Minute), "{a}")
+	archive(now.Add(-2*time.Minute), "{b}")
+	archive(now.Add(-time.Minute), "{c}")
+	// Pruning shouldn't happen again until archivePruneInterval has elapsed
+	require.Len(t, listFiles(), 3)
+
+	now = now.Add(archivePruneInterval)
+	archive(now, "{d}")
+	fileNames := listFiles()
+	require.Equal(
+		t,
+		[]string{
+			"20220601T115900.000000000Z-c.json",
+			"20220601T120100.000000000Z-d.json",
+		},
+		fileNames,
+	)
+
+	deliveryJSON, err := os.ReadFile(filepath.Join(dir, fileNames[1]))
+	require.NoError(t, err)
+	delivery := Delivery{}
+	require.NoError(t, json.Unmarshal(deliveryJSON, &delivery))
+	require.Equal(t, "{d}", delivery.ID)
+	require.Equal(t, http.StatusOK, delivery.StatusCode)
+	require.Equal(t, []string{"abc"}, delivery.EventIDs)
+}
+
+func TestMultiArchive(t *testing.T) {
+	archive1 := &mockDeliveryArchive{}
+	archive2 := &mockDeliveryArchive{}
+	a := NewMultiArchive(archive1, archive2)
+	require.NoError(t, a.Archive(Delivery{ID: "abc"}))
+	require.Len(t, archive1.deliveries, 1)
+	require.Len(t, archive2.deliveries, 1)
+	require.Equal(t, "abc", archive2.deliveries[0].ID)
+}
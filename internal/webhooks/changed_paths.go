@@ -0,0 +1,199 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/pkg/errors"
+)
+
+// ChangedPathsLister is an interface for components that can list the paths
+// of files changed by a commit or commit range of a Bitbucket repository. The
+// bitbucket.Client interface from this gateway's internal/bitbucket package
+// satisfies it.
+type ChangedPathsLister interface {
+	// ListChangedPaths returns the paths of all files changed by the specified
+	// commit or commit range (e.g. abc123..def456) of the specified repository.
+	ListChangedPaths(
+		ctx context.Context,
+		repo string,
+		spec string,
+	) ([]string, error)
+}
+
+// changedPathsKey identifies a commit or commit range of a repository.
+type changedPathsKey struct {
+	repo string
+	spec string
+}
+
+// cachingChangedPathsLister is an implementation of the ChangedPathsLister
+// interface that decorates another, remembering the paths it lists. The keys
+// of remembered paths are tracked in a ring buffer so that, when the cache is
+// full, the oldest entry is evicted first.
+type cachingChangedPathsLister struct {
+	lister ChangedPathsLister
+	mu     sync.Mutex
+	paths  map[changedPathsKey][]string
+	keys   []changedPathsKey
+	// next is the index in keys that the next key will be written to
+	next int
+	// count is the number of keys currently retained
+	count int
+}
+
+// NewCachingChangedPathsLister returns an implementation of the
+// ChangedPathsLister interface that remembers the paths listed by the provided
+// ChangedPathsLister for, at most, the specified number of commits or commit
+// ranges. Since commits are immutable, remembered paths never become stale.
+// Errors are not remembered.
+func NewCachingChangedPathsLister(
+	lister ChangedPathsLister,
+	size int,
+) ChangedPathsLister {
+	if size < 1 {
+		size = 1
+	}
+	return &cachingChangedPathsLister{
+		lister: lister,
+		paths:  map[changedPathsKey][]string{},
+		keys:   make([]changedPathsKey, size),
+	}
+}
+
+func (c *cachingChangedPathsLister) ListChangedPaths(
+	ctx context.Context,
+	repo string,
+	spec string,
+) ([]string, error) {
+	key := changedPathsKey{repo: repo, spec: spec}
+	c.mu.Lock()
+	paths, ok := c.paths[key]
+	c.mu.Unlock()
+	if ok {
+		return paths, nil
+	}
+	paths, err := c.lister.ListChangedPaths(ctx, repo, spec)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok = c.paths[key]; ok {
+		// Another caller listed the same paths in the meantime
+		return paths, nil
+	}
+	if c.count == len(c.keys) {
+		delete(c.paths, c.keys[c.next])
+	} else {
+		c.count++
+	}
+	c.keys[c.next] = key
+	c.next = (c.next + 1) % len(c.keys)
+	c.paths[key] = paths
+	return paths, nil
+}
+
+// changedPathsSpecs returns the commit ranges whose changed paths, combined,
+// should be added to the event emitted for the provided payload. For pull
+// requests, this is a single range comparing the source commit with the
+// destination commit. For pushes, this is one range for each change, comparing
+// its new commit with its old commit. The bool return value is false for
+// payloads that do not pertain to pull requests or to pushes, and for pushes
+// that created or deleted any branch or tag, since the paths changed by such a
+// push cannot all be listed.
+func changedPathsSpecs(payload interface{}) ([]string, bool) {
+	var pr bitbucket.PullRequest
+	switch p := payload.(type) {
+	case bitbucket.RepoPushPayload:
+		if len(p.Push.Changes) == 0 {
+			return nil, false
+		}
+		specs := make([]string, len(p.Push.Changes))
+		for i, change := range p.Push.Changes {
+			// Newly created and deleted branches and tags have no range to compare
+			if change.New.Target.Hash == "" || change.Old.Target.Hash == "" {
+				return nil, false
+			}
+			specs[i] = change.New.Target.Hash + ".." + change.Old.Target.Hash
+		}
+		return specs, true
+	case bitbucket.PullRequestApprovedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestCommentCreatedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestCommentDeletedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestCommentUpdatedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestCreatedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestDeclinedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestMergedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestUnapprovedPayload:
+		pr = p.PullRequest
+	case bitbucket.PullRequestUpdatedPayload:
+		pr = p.PullRequest
+	default:
+		return nil, false
+	}
+	if pr.Source.Commit.Hash == "" || pr.Destination.Commit.Hash == "" {
+		return nil, false
+	}
+	return []string{pr.Source.Commit.Hash + ".." + pr.Destination.Commit.Hash},
+		true
+}
+
+// listChangedPaths uses the provided ChangedPathsLister to list the paths
+// changed by each of the specified commit ranges of the specified repository
+// and returns them combined, without duplicates, in the order first listed.
+func listChangedPaths(
+	ctx context.Context,
+	lister ChangedPathsLister,
+	repo string,
+	specs []string,
+) ([]string, error) {
+	paths := []string{}
+	seen := map[string]struct{}{}
+	for _, spec := range specs {
+		specPaths, err := lister.ListChangedPaths(ctx, repo, spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, specPath := range specPaths {
+			if _, ok := seen[specPath]; !ok {
+				seen[specPath] = struct{}{}
+				paths = append(paths, specPath)
+			}
+		}
+	}
+	return paths, nil
+}
+
+// withChangedPaths returns the provided JSON payload with the provided paths
+// added to it in a top-level changed_paths field. All other fields are left
+// exactly as they were.
+func withChangedPaths(payload string, paths []string) (string, error) {
+	if paths == nil {
+		paths = []string{}
+	}
+	pathsBytes, err := json.Marshal(paths)
+	if err != nil {
+		return payload, errors.Wrap(err, "error marshaling changed paths")
+	}
+	// Splice the new field in rather than round-tripping the payload through a
+	// map so that the order of existing fields is preserved.
+	if len(payload) < 2 || payload[len(payload)-1] != '}' {
+		return payload, errors.New("event payload is not a JSON object")
+	}
+	separator := ","
+	if payload == "{}" {
+		separator = ""
+	}
+	return payload[:len(payload)-1] + separator +
+		`"changed_paths":` + string(pathsBytes) + "}", nil
+}
@@ -0,0 +1,214 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/stretchr/testify/require"
+)
+
+// mockChangedPathsLister is a mock implementation of the ChangedPathsLister
+// interface.
+type mockChangedPathsLister func(
+	ctx context.Context,
+	repo string,
+	spec string,
+) ([]string, error)
+
+func (m mockChangedPathsLister) ListChangedPaths(
+	ctx context.Context,
+	repo string,
+	spec string,
+) ([]string, error) {
+	return m(ctx, repo, spec)
+}
+
+func TestCachingChangedPathsLister(t *testing.T) {
+	calls := map[string]int{}
+	var fail bool
+	c := NewCachingChangedPathsLister(
+		mockChangedPathsLister(
+			func(_ context.Context, repo, spec string) ([]string, error) {
+				calls[repo+" "+spec]++
+				if fail {
+					return nil, errors.New("something went wrong")
+				}
+				return []string{spec}, nil
+			},
+		),
+		2,
+	)
+	list := func(repo, spec string) {
+		paths, err := c.ListChangedPaths(context.Background(), repo, spec)
+		require.NoError(t, err)
+		require.Equal(t, []string{spec}, paths)
+	}
+	list("example-org/example", "a..b")
+	list("example-org/example", "a..b")
+	require.Equal(t, 1, calls["example-org/example a..b"])
+	// The same range of another repository is cached separately
+	list("example-org/another", "a..b")
+	require.Equal(t, 1, calls["example-org/another a..b"])
+	// The oldest entry is evicted once the cache is full
+	list("example-org/example", "c..d")
+	list("example-org/another", "a..b")
+	require.Equal(t, 1, calls["example-org/another a..b"])
+	list("example-org/example", "a..b")
+	require.Equal(t, 2, calls["example-org/example a..b"])
+	// Errors are not cached
+	fail = true
+	_, err := c.ListChangedPaths(context.Background(), "example-org/x", "e")
+	require.Error(t, err)
+	_, err = c.ListChangedPaths(context.Background(), "example-org/x", "e")
+	require.Error(t, err)
+	require.Equal(t, 2, calls["example-org/x e"])
+}
+
+func TestChangedPathsSpecs(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload interface{}
+		specs   []string
+		ok      bool
+	}{
+		{
+			name:    "unsupported payload",
+			payload: bitbucket.RepoForkPayload{},
+		},
+		{
+			name:    "push without changes",
+			payload: bitbucket.RepoPushPayload{},
+		},
+		{
+			name: "push creating a branch",
+			payload: func() bitbucket.RepoPushPayload {
+				p := pushPayload(t, "example-org/example", "branch", "main")
+				p.Push.Changes[0].Old.Target.Hash = ""
+				return p
+			}(),
+		},
+		{
+			name: "push updating a branch",
+			payload: func() bitbucket.RepoPushPayload {
+				p := pushPayload(t, "example-org/example", "branch", "main")
+				p.Push.Changes[0].Old.Target.Hash = "7654321"
+				return p
+			}(),
+			specs: []string{"1234567..7654321"},
+			ok:    true,
+		},
+		{
+			name:    "push updating several branches",
+			payload: multiChangePushPayload(t, "example-org/example"),
+			specs:   []string{"1234567..7654321", "abcdef0..1234567"},
+			ok:      true,
+		},
+		{
+			name: "push updating one branch and creating another",
+			payload: func() bitbucket.RepoPushPayload {
+				p := multiChangePushPayload(t, "example-org/example")
+				p.Push.Changes[1].Old.Target.Hash = ""
+				return p
+			}(),
+		},
+		{
+			name: "pull request",
+			payload: func() bitbucket.PullRequestCreatedPayload {
+				p := pullRequestCreatedPayload(
+					t,
+					"example-org/example",
+					"feature",
+					"main",
+				)
+				p.PullRequest.Destination.Commit.Hash = "7654321"
+				return p
+			}(),
+			specs: []string{"1234567..7654321"},
+			ok:    true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			specs, ok := changedPathsSpecs(testCase.payload)
+			require.Equal(t, testCase.ok, ok)
+			require.Equal(t, testCase.specs, specs)
+		})
+	}
+}
+
+func TestListChangedPaths(t *testing.T) {
+	var listErr error
+	lister := mockChangedPathsLister(
+		func(_ context.Context, _ string, spec string) ([]string, error) {
+			if spec == "b" {
+				return []string{"bar", "baz"}, listErr
+			}
+			return []string{"foo", "bar"}, nil
+		},
+	)
+	paths, err := listChangedPaths(
+		context.Background(),
+		lister,
+		"example-org/example",
+		[]string{"a", "b"},
+	)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo", "bar", "baz"}, paths)
+
+	listErr = errors.New("something went wrong")
+	_, err = listChangedPaths(
+		context.Background(),
+		lister,
+		"example-org/example",
+		[]string{"a", "b"},
+	)
+	require.Error(t, err)
+}
+
+func TestWithChangedPaths(t *testing.T) {
+	testCases := []struct {
+		name       string
+		payload    string
+		paths      []string
+		assertions func(string, error)
+	}{
+		{
+			name:    "not an object",
+			payload: "[]",
+			assertions: func(_ string, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "not a JSON object")
+			},
+		},
+		{
+			name:    "empty object",
+			payload: "{}",
+			assertions: func(payload string, err error) {
+				require.NoError(t, err)
+				require.Equal(t, `{"changed_paths":[]}`, payload)
+			},
+		},
+		{
+			name:    "object",
+			payload: `{"b":1,"a":2}`,
+			paths:   []string{"foo", "bar/baz"},
+			assertions: func(payload string, err error) {
+				require.NoError(t, err)
+				require.Equal(
+					t,
+					`{"b":1,"a":2,"changed_paths":["foo","bar/baz"]}`,
+					payload,
+				)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(
+				withChangedPaths(testCase.payload, testCase.paths),
+			)
+		})
+	}
+}
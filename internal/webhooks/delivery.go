@@ -0,0 +1,117 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// deliveryHeaders enumerates the only HTTP headers that are recorded with a
+// Delivery. Others, such as Authorization or any signature, may be sensitive
+// and are never persisted.
+var deliveryHeaders = []string{
+	"Content-Type",
+	"User-Agent",
+	"X-Event-Key",
+	"X-Hook-UUID",
+	"X-Request-UUID",
+}
+
+// Delivery is a record of a single webhook delivered by Bitbucket, complete
+// with all the details required to process it again at a later time.
+type Delivery struct {
+	// ID uniquely identifies the delivery. When available, this is the value of
+	// the X-Request-UUID header Bitbucket includes with every delivery.
+	// Otherwise, it is a randomly generated identifier.
+	ID string `json:"id,omitempty"`
+	// ReceivedAt is the time at which the webhook was received.
+	ReceivedAt time.Time `json:"receivedAt"`
+	// Headers are the HTTP headers that accompanied the webhook, limited to
+	// those that are not sensitive.
+	Headers http.Header `json:"headers"`
+	// Body is the webhook's (JSON) payload, exactly as it was received.
+	Body string `json:"body"`
+	// ProjectID is the ID of the Brigade project, if any, that the webhook's URL
+	// explicitly targeted.
+	ProjectID string `json:"projectID,omitempty"`
+	// StatusCode is the HTTP status code that was returned to Bitbucket.
+	StatusCode int `json:"statusCode,omitempty"`
+	// Error is a description of any error that was encountered while handling
+	// the webhook.
+	Error string `json:"error,omitempty"`
+	// EventIDs are the IDs of any Brigade events that were created as a result
+	// of handling the webhook.
+	EventIDs []string `json:"eventIDs,omitempty"`
+	// Latency is the amount of time that elapsed between the webhook being
+	// received and a response being returned to Bitbucket.
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// EventKey returns the Bitbucket event key (e.g. repo:push) of the delivery.
+func (d Delivery) EventKey() string {
+	return d.Headers.Get("X-Event-Key")
+}
+
+// deliveryHeadersFrom returns a copy of the provided http.Header containing
+// only those headers that may be recorded with a Delivery.
+func deliveryHeadersFrom(header http.Header) http.Header {
+	headers := http.Header{}
+	for _, key := range deliveryHeaders {
+		if values := header.Values(key); len(values) > 0 {
+			headers[http.CanonicalHeaderKey(key)] =
+				append([]string(nil), values...)
+		}
+	}
+	return headers
+}
+
+// deliveryID returns the value of the X-Request-UUID header from the provided
+// http.Header or, if that is not set, a randomly generated identifier.
+func deliveryID(header http.Header) string {
+	if id := header.Get("X-Request-UUID"); id != "" {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b) // nolint: errcheck
+	return hex.EncodeToString(b)
+}
+
+// Repo returns the full name (e.g. example-org/example) of the repository the
+// delivery pertains to. An empty string is returned if the body does not
+// identify a repository.
+func (d Delivery) Repo() string {
+	body := struct {
+		Repository struct {
+			FullName string `json:"full_name"`
+		} `json:"repository"`
+	}{}
+	if err := json.Unmarshal([]byte(d.Body), &body); err != nil {
+		return ""
+	}
+	return body.Repository.FullName
+}
+
+// request returns an *http.Request equivalent to the one that originally
+// carried the delivery.
+func (d Delivery) request(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		"/events",
+		bytes.NewBufferString(d.Body),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "error building request from delivery")
+	}
+	req.Header = d.Headers.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	return req, nil
+}
@@ -0,0 +1,62 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelivery(t *testing.T) {
+	delivery := Delivery{
+		Headers: http.Header{
+			"X-Event-Key": []string{"repo:push"},
+		},
+		Body: `{"repository":{"full_name":"example-org/example"}}`,
+	}
+	require.Equal(t, "repo:push", delivery.EventKey())
+	require.Equal(t, "example-org/example", delivery.Repo())
+	req, err := delivery.request(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, req.Method)
+	require.Equal(t, "repo:push", req.Header.Get("X-Event-Key"))
+	body, err := io.ReadAll(req.Body)
+	require.NoError(t, err)
+	require.Equal(t, delivery.Body, string(body))
+}
+
+func TestDeliveryRepoWithInvalidBody(t *testing.T) {
+	require.Empty(t, Delivery{Body: "foo"}.Repo())
+}
+
+func TestDeliveryHeadersFrom(t *testing.T) {
+	headers := deliveryHeadersFrom(http.Header{
+		"Authorization":   []string{"JWT abc"},
+		"Content-Type":    []string{"application/json"},
+		"X-Event-Key":     []string{"repo:push"},
+		"X-Hub-Signature": []string{"sha256=abc"},
+		"X-Request-Uuid":  []string{"123"},
+	})
+	require.Equal(
+		t,
+		http.Header{
+			"Content-Type":   []string{"application/json"},
+			"X-Event-Key":    []string{"repo:push"},
+			"X-Request-Uuid": []string{"123"},
+		},
+		headers,
+	)
+}
+
+func TestDeliveryID(t *testing.T) {
+	require.Equal(
+		t,
+		"abc",
+		deliveryID(http.Header{"X-Request-Uuid": []string{"abc"}}),
+	)
+	id := deliveryID(http.Header{})
+	require.Len(t, id, 32)
+	require.NotEqual(t, id, deliveryID(http.Header{}))
+}
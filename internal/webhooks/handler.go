@@ -1,26 +1,80 @@
 package webhooks
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 )
 
+// supportedEvents enumerates all the Bitbucket webhooks this gateway is able to
+// handle.
+var supportedEvents = []bitbucket.Event{
+	bitbucket.IssueCommentCreatedEvent,
+	bitbucket.IssueCreatedEvent,
+	bitbucket.IssueUpdatedEvent,
+	bitbucket.PullRequestApprovedEvent,
+	bitbucket.PullRequestCommentCreatedEvent,
+	bitbucket.PullRequestCommentDeletedEvent,
+	bitbucket.PullRequestCommentUpdatedEvent,
+	bitbucket.PullRequestCreatedEvent,
+	bitbucket.PullRequestDeclinedEvent,
+	bitbucket.PullRequestMergedEvent,
+	bitbucket.PullRequestUnapprovedEvent,
+	bitbucket.PullRequestUpdatedEvent,
+	bitbucket.RepoCommitCommentCreatedEvent,
+	bitbucket.RepoCommitStatusCreatedEvent,
+	bitbucket.RepoCommitStatusUpdatedEvent,
+	bitbucket.RepoForkEvent,
+	bitbucket.RepoPushEvent,
+	bitbucket.RepoUpdatedEvent,
+}
+
+// SupportedEventKeys returns the keys (e.g. repo:push) of all the Bitbucket
+// events this gateway is able to handle.
+func SupportedEventKeys() []string {
+	keys := make([]string, len(supportedEvents))
+	for i, event := range supportedEvents {
+		keys[i] = string(event)
+	}
+	return keys
+}
+
+// HandlerConfig encapsulates optional configuration for the handler.
+type HandlerConfig struct {
+	// Archive, if non-nil, is used to persist a record of every webhook the
+	// handler receives, along with the outcome of handling it.
+	Archive DeliveryArchive
+	// RateLimiter, if non-nil, is consulted before each webhook is handed off to
+	// the Service. Webhooks that exceed a rate limit are rejected with a 429
+	// status code.
+	RateLimiter RateLimiter
+	// Secret, if non-empty, is the secret Bitbucket signs webhooks with.
+	// Webhooks without a valid signature are rejected with a 403 status code.
+	Secret string
+}
+
 // handler is an implementation of the http.Handler interface that can handle
 // webhooks (events) from Bitbucket by delegating to a transport-agnostic
 // Service interface.
 type handler struct {
 	service Service
 	hook    *bitbucket.Webhook
+	config  HandlerConfig
 }
 
 // handler is an implementation of the http.Handler interface that can handle
 // webhooks (events) from Bitbucket by delegating to a transport-agnostic
 // Service interface.
-func NewHandler(service Service) (http.Handler, error) {
+func NewHandler(service Service, config HandlerConfig) (http.Handler, error) {
 	hook, err := bitbucket.New()
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating handler")
@@ -28,6 +82,7 @@ func NewHandler(service Service) (http.Handler, error) {
 	return &handler{
 		service: service,
 		hook:    hook,
+		config:  config,
 	}, nil
 }
 
@@ -36,62 +91,111 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	payload, err := h.hook.Parse(
-		r,
-		bitbucket.IssueCommentCreatedEvent,
-		bitbucket.IssueCreatedEvent,
-		bitbucket.IssueUpdatedEvent,
-		bitbucket.PullRequestApprovedEvent,
-		bitbucket.PullRequestCommentCreatedEvent,
-		bitbucket.PullRequestCommentDeletedEvent,
-		bitbucket.PullRequestCommentUpdatedEvent,
-		bitbucket.PullRequestCreatedEvent,
-		bitbucket.PullRequestDeclinedEvent,
-		bitbucket.PullRequestMergedEvent,
-		bitbucket.PullRequestUnapprovedEvent,
-		bitbucket.PullRequestUpdatedEvent,
-		bitbucket.RepoCommitCommentCreatedEvent,
-		bitbucket.RepoCommitStatusCreatedEvent,
-		bitbucket.RepoCommitStatusUpdatedEvent,
-		bitbucket.RepoForkEvent,
-		bitbucket.RepoPushEvent,
-		bitbucket.RepoUpdatedEvent,
-	)
+	delivery := Delivery{
+		ID:         deliveryID(r.Header),
+		ReceivedAt: time.Now(),
+		Headers:    deliveryHeadersFrom(r.Header),
+		ProjectID:  mux.Vars(r)["projectID"],
+	}
+
+	var err error
+	delivery.StatusCode, delivery.EventIDs, err = h.handle(r, &delivery)
 	if err != nil {
-		if err == bitbucket.ErrEventNotFound {
-			w.WriteHeader(http.StatusNotImplemented)
-		} else {
+		delivery.Error = err.Error()
+		if delivery.StatusCode == http.StatusInternalServerError ||
+			delivery.StatusCode == http.StatusForbidden ||
+			delivery.StatusCode == http.StatusTooManyRequests {
 			log.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
 		}
-		w.Write([]byte("{}")) // nolint: errcheck
-		return
+		if rlErr, ok := errors.Cause(err).(*RateLimitedError); ok {
+			w.Header().Set(
+				"Retry-After",
+				strconv.Itoa(int(math.Ceil(rlErr.RetryAfter.Seconds()))),
+			)
+		}
 	}
 
-	events, err := h.service.Handle(r.Context(), payload)
+	responseJSON := []byte("{}")
+	if delivery.StatusCode == http.StatusOK {
+		responseObj := struct {
+			EventIDs []string `json:"eventIDs"`
+		}{
+			EventIDs: delivery.EventIDs,
+		}
+		if responseJSON, err = json.Marshal(responseObj); err != nil {
+			log.Println(err)
+			delivery.StatusCode = http.StatusInternalServerError
+			delivery.Error = err.Error()
+			responseJSON = []byte("{}")
+		}
+	}
+	w.WriteHeader(delivery.StatusCode)
+	w.Write(responseJSON) // nolint: errcheck
+	delivery.Latency = time.Since(delivery.ReceivedAt)
+
+	if h.config.Archive != nil {
+		if err = h.config.Archive.Archive(delivery); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// handle captures the body of the provided request in the provided Delivery
+// before parsing it and handing the resulting payload off to the Service. It
+// returns the HTTP status code that should be returned to Bitbucket, the IDs of
+// any events that were created, and any error that was encountered.
+func (h *handler) handle(
+	r *http.Request,
+	delivery *Delivery,
+) (int, []string, error) {
+	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("{}")) // nolint: errcheck
-		return
+		return http.StatusInternalServerError,
+			nil,
+			errors.Wrap(err, "error reading request body")
 	}
+	delivery.Body = string(bodyBytes)
+	r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 
-	responseObj := struct {
-		EventIDs []string `json:"eventIDs"`
-	}{
-		EventIDs: make([]string, len(events.Items)),
+	if h.config.Secret != "" {
+		if err = verifySignature(
+			h.config.Secret,
+			r.Header.Get(signatureHeader),
+			bodyBytes,
+		); err != nil {
+			return http.StatusForbidden, nil, err
+		}
 	}
-	for i, event := range events.Items {
-		responseObj.EventIDs[i] = event.ID
+
+	payload, err := h.hook.Parse(r, supportedEvents...)
+	if err != nil {
+		if err == bitbucket.ErrEventNotFound {
+			return http.StatusNotImplemented, nil, err
+		}
+		return http.StatusInternalServerError, nil, err
 	}
 
-	responseJSON, err := json.Marshal(responseObj)
+	if h.config.RateLimiter != nil {
+		if err = h.config.RateLimiter.Allow(delivery.Repo()); err != nil {
+			return http.StatusTooManyRequests, nil, err
+		}
+	}
+
+	ctx := r.Context()
+	if delivery.ProjectID != "" {
+		ctx = ContextWithProjectID(ctx, delivery.ProjectID)
+	}
+	events, err := h.service.Handle(ctx, payload)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("{}")) // nolint: errcheck
-		return
+		if _, ok := errors.Cause(err).(*UnknownWorkspaceError); ok {
+			return http.StatusForbidden, nil, err
+		}
+		return http.StatusInternalServerError, nil, err
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(responseJSON) // nolint: errcheck
+
+	eventIDs := make([]string, len(events.Items))
+	for i, event := range events.Items {
+		eventIDs[i] = event.ID
+	}
+	return http.StatusOK, eventIDs, nil
 }
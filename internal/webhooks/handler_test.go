@@ -0,0 +1,324 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/meta"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v3/testing"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+)
+
+type mockDeliveryArchive struct {
+	deliveries []Delivery
+}
+
+func (m *mockDeliveryArchive) Archive(delivery Delivery) error {
+	m.deliveries = append(m.deliveries, delivery)
+	return nil
+}
+
+func TestNewHandler(t *testing.T) {
+	svc := NewService(&sdkTesting.MockEventsClient{}, ServiceConfig{})
+	archive := &mockDeliveryArchive{}
+	h, err := NewHandler(svc, HandlerConfig{Archive: archive})
+	require.NoError(t, err)
+	hndlr, ok := h.(*handler)
+	require.True(t, ok)
+	require.Same(t, svc, hndlr.service)
+	require.NotNil(t, hndlr.hook)
+	require.Same(t, archive, hndlr.config.Archive)
+}
+
+func TestHandlerServeHTTP(t *testing.T) {
+	const body = `{"repository":{"full_name":"example-org/example"}}`
+	testCases := []struct {
+		name       string
+		eventKey   string
+		createErr  error
+		assertions func(*httptest.ResponseRecorder, Delivery)
+	}{
+		{
+			name:     "unsupported event",
+			eventKey: "foo:bar",
+			assertions: func(rr *httptest.ResponseRecorder, delivery Delivery) {
+				require.Equal(t, http.StatusNotImplemented, rr.Code)
+				require.Equal(t, "{}", rr.Body.String())
+				require.Equal(t, http.StatusNotImplemented, delivery.StatusCode)
+				require.NotEmpty(t, delivery.Error)
+			},
+		},
+		{
+			name:      "error creating event",
+			eventKey:  "repo:fork",
+			createErr: errors.New("something went wrong"),
+			assertions: func(rr *httptest.ResponseRecorder, delivery Delivery) {
+				require.Equal(t, http.StatusInternalServerError, rr.Code)
+				require.Equal(t, "{}", rr.Body.String())
+				require.Equal(t, http.StatusInternalServerError, delivery.StatusCode)
+				require.Contains(t, delivery.Error, "something went wrong")
+			},
+		},
+		{
+			name:     "success",
+			eventKey: "repo:fork",
+			assertions: func(rr *httptest.ResponseRecorder, delivery Delivery) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.JSONEq(t, `{"eventIDs":["abc"]}`, rr.Body.String())
+				require.Equal(t, http.StatusOK, delivery.StatusCode)
+				require.Empty(t, delivery.Error)
+				require.Equal(t, []string{"abc"}, delivery.EventIDs)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			archive := &mockDeliveryArchive{}
+			h, err := NewHandler(
+				NewService(
+					&sdkTesting.MockEventsClient{
+						CreateFn: func(
+							context.Context,
+							sdk.Event,
+							*sdk.EventCreateOptions,
+						) (sdk.EventList, error) {
+							return sdk.EventList{
+								Items: []sdk.Event{{ObjectMeta: meta.ObjectMeta{ID: "abc"}}},
+							}, testCase.createErr
+						},
+					},
+					ServiceConfig{},
+				),
+				HandlerConfig{Archive: archive},
+			)
+			require.NoError(t, err)
+			req := httptest.NewRequest(
+				http.MethodPost,
+				"/events",
+				bytes.NewBufferString(body),
+			)
+			req.Header.Set("X-Event-Key", testCase.eventKey)
+			req.Header.Set("X-Request-UUID", "123")
+			req.Header.Set("Authorization", "Bearer abc")
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			require.Len(t, archive.deliveries, 1)
+			delivery := archive.deliveries[0]
+			require.Equal(t, "123", delivery.ID)
+			require.Empty(t, delivery.Headers.Get("Authorization"))
+			require.Equal(t, body, delivery.Body)
+			require.NotZero(t, delivery.Latency)
+			require.Equal(t, testCase.eventKey, delivery.EventKey())
+			require.False(t, delivery.ReceivedAt.IsZero())
+			testCase.assertions(rr, delivery)
+		})
+	}
+}
+
+func TestHandlerServeHTTPWithProjectID(t *testing.T) {
+	var projectID string
+	archive := &mockDeliveryArchive{}
+	h, err := NewHandler(
+		NewService(
+			&sdkTesting.MockEventsClient{
+				CreateFn: func(
+					_ context.Context,
+					event sdk.Event,
+					_ *sdk.EventCreateOptions,
+				) (sdk.EventList, error) {
+					projectID = event.ProjectID
+					return sdk.EventList{}, nil
+				},
+			},
+			ServiceConfig{},
+		),
+		HandlerConfig{Archive: archive},
+	)
+	require.NoError(t, err)
+	router := mux.NewRouter()
+	router.Handle("/events/projects/{projectID}", h)
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/events/projects/example",
+		bytes.NewBufferString(
+			`{"repository":{"full_name":"example-org/example"}}`,
+		),
+	)
+	req.Header.Set("X-Event-Key", "repo:fork")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "example", projectID)
+	require.Len(t, archive.deliveries, 1)
+	require.Equal(t, "example", archive.deliveries[0].ProjectID)
+}
+
+func TestHandlerServeHTTPWithUnknownWorkspace(t *testing.T) {
+	h, err := NewHandler(
+		NewService(
+			nil,
+			ServiceConfig{
+				TenantEventsClients: map[string]sdk.EventsClient{
+					"another-org": &sdkTesting.MockEventsClient{},
+				},
+			},
+		),
+		HandlerConfig{},
+	)
+	require.NoError(t, err)
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/events",
+		bytes.NewBufferString(
+			`{"repository":{"full_name":"example-org/example"}}`,
+		),
+	)
+	req.Header.Set("X-Event-Key", "repo:fork")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusForbidden, rr.Code)
+	require.Equal(t, "{}", rr.Body.String())
+}
+
+type mockRateLimiter struct {
+	allowFn func(repo string) error
+}
+
+func (m *mockRateLimiter) Allow(repo string) error {
+	return m.allowFn(repo)
+}
+
+func TestHandlerServeHTTPWithRateLimiter(t *testing.T) {
+	var created bool
+	archive := &mockDeliveryArchive{}
+	h, err := NewHandler(
+		NewService(
+			&sdkTesting.MockEventsClient{
+				CreateFn: func(
+					context.Context,
+					sdk.Event,
+					*sdk.EventCreateOptions,
+				) (sdk.EventList, error) {
+					created = true
+					return sdk.EventList{}, nil
+				},
+			},
+			ServiceConfig{},
+		),
+		HandlerConfig{
+			Archive: archive,
+			RateLimiter: &mockRateLimiter{
+				allowFn: func(repo string) error {
+					return &RateLimitedError{
+						Repo:       repo,
+						RetryAfter: 1500 * time.Millisecond,
+					}
+				},
+			},
+		},
+	)
+	require.NoError(t, err)
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/events",
+		bytes.NewBufferString(
+			`{"repository":{"full_name":"example-org/example"}}`,
+		),
+	)
+	req.Header.Set("X-Event-Key", "repo:fork")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusTooManyRequests, rr.Code)
+	require.Equal(t, "2", rr.Header().Get("Retry-After"))
+	require.Equal(t, "{}", rr.Body.String())
+	require.False(t, created)
+	require.Len(t, archive.deliveries, 1)
+	require.Equal(
+		t,
+		http.StatusTooManyRequests,
+		archive.deliveries[0].StatusCode,
+	)
+	require.Contains(t, archive.deliveries[0].Error, "example-org/example")
+}
+
+func TestSupportedEventKeys(t *testing.T) {
+	keys := SupportedEventKeys()
+	require.Len(t, keys, len(supportedEvents))
+	require.Contains(t, keys, "repo:push")
+	require.Contains(t, keys, "pullrequest:created")
+}
+
+func TestHandlerServeHTTPWithSecret(t *testing.T) {
+	const body = `{"repository":{"full_name":"example-org/example"}}`
+	testCases := []struct {
+		name       string
+		signature  string
+		assertions func(*httptest.ResponseRecorder, bool)
+	}{
+		{
+			name: "signature missing",
+			assertions: func(rr *httptest.ResponseRecorder, created bool) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				require.Equal(t, "{}", rr.Body.String())
+				require.False(t, created)
+			},
+		},
+		{
+			name:      "signature invalid",
+			signature: sign("wrong", body),
+			assertions: func(rr *httptest.ResponseRecorder, created bool) {
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				require.False(t, created)
+			},
+		},
+		{
+			name:      "signature valid",
+			signature: sign("secret", body),
+			assertions: func(rr *httptest.ResponseRecorder, created bool) {
+				require.Equal(t, http.StatusOK, rr.Code)
+				require.True(t, created)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var created bool
+			h, err := NewHandler(
+				NewService(
+					&sdkTesting.MockEventsClient{
+						CreateFn: func(
+							context.Context,
+							sdk.Event,
+							*sdk.EventCreateOptions,
+						) (sdk.EventList, error) {
+							created = true
+							return sdk.EventList{}, nil
+						},
+					},
+					ServiceConfig{},
+				),
+				HandlerConfig{Secret: "secret"},
+			)
+			require.NoError(t, err)
+			req := httptest.NewRequest(
+				http.MethodPost,
+				"/events",
+				bytes.NewBufferString(body),
+			)
+			req.Header.Set("X-Event-Key", "repo:fork")
+			if testCase.signature != "" {
+				req.Header.Set("X-Hub-Signature", testCase.signature)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			testCase.assertions(rr, created)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package webhooks
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PathFilter describes which changes to matching repositories should result in
+// events being emitted into Brigade when repo:push and pullrequest:* webhooks
+// are received, based on the paths of the files changed. This is only possible
+// when changed paths are being listed (see ServiceConfig.ChangedPaths).
+type PathFilter struct {
+	// Repo is a pattern (e.g. example-org/*) matched against the full names of
+	// repositories.
+	Repo string `yaml:"repo"`
+	// Include, if non-empty, is a list of patterns (e.g. services/**), at least
+	// one of which a changed path must match for it to be considered.
+	Include []string `yaml:"include"`
+	// Exclude is a list of patterns (e.g. **/*.md), none of which a changed
+	// path may match for it to be considered. Exclusions take precedence over
+	// inclusions.
+	Exclude []string `yaml:"exclude"`
+	// Components, if non-empty, causes one event to be emitted for each
+	// Component that any considered path belongs to, instead of a single event.
+	// Each such event is qualified by the name of its Component.
+	Components []Component `yaml:"components"`
+}
+
+// Component is a named subset of a repository's files, e.g. a single service
+// in a monorepo.
+type Component struct {
+	// Name is the name of the component, e.g. billing. It becomes the value of
+	// the component qualifier of events emitted for the component.
+	Name string `yaml:"name"`
+	// Paths is a list of patterns (e.g. services/billing/**), any of which a
+	// path may match to belong to the component.
+	Paths []string `yaml:"paths"`
+}
+
+// Validate returns an error if the PathFilter is incomplete or contains any
+// malformed patterns.
+func (p PathFilter) Validate() error {
+	if p.Repo == "" {
+		return errors.New("path filter does not specify a repo pattern")
+	}
+	if _, err := path.Match(p.Repo, ""); err != nil {
+		return errors.Wrapf(
+			err,
+			"path filter contains invalid repo pattern %q",
+			p.Repo,
+		)
+	}
+	patterns := append([]string{}, p.Include...)
+	patterns = append(patterns, p.Exclude...)
+	names := map[string]struct{}{}
+	for _, component := range p.Components {
+		if component.Name == "" {
+			return errors.Errorf(
+				"path filter for repo %q contains a component without a name",
+				p.Repo,
+			)
+		}
+		if _, ok := names[component.Name]; ok {
+			return errors.Errorf(
+				"path filter for repo %q contains more than one component named %q",
+				p.Repo,
+				component.Name,
+			)
+		}
+		names[component.Name] = struct{}{}
+		if len(component.Paths) == 0 {
+			return errors.Errorf(
+				"path filter for repo %q does not specify paths for component %q",
+				p.Repo,
+				component.Name,
+			)
+		}
+		patterns = append(patterns, component.Paths...)
+	}
+	for _, pattern := range patterns {
+		if err := validatePathPattern(pattern); err != nil {
+			return errors.Wrapf(
+				err,
+				"path filter for repo %q contains invalid pattern %q",
+				p.Repo,
+				pattern,
+			)
+		}
+	}
+	return nil
+}
+
+// pathFilterFor returns the first of the provided PathFilters that applies to
+// the specified repository. The bool return value indicates whether any
+// PathFilter applies.
+func pathFilterFor(filters []PathFilter, repo string) (PathFilter, bool) {
+	for _, filter := range filters {
+		if match, _ := path.Match(filter.Repo, repo); match {
+			return filter, true
+		}
+	}
+	return PathFilter{}, false
+}
+
+// apply returns a bool indicating whether any of the provided changed paths
+// are considered by the PathFilter and, if the PathFilter specifies
+// Components, the names of the Components the considered paths belong to. The
+// names are nil if the PathFilter does not specify Components. If the changed
+// paths are unknown, as indicated by the provided bool, every change is assumed
+// to be relevant, so true and the names of all Components are returned.
+func (p PathFilter) apply(paths []string, known bool) (bool, []string) {
+	var components []string
+	if !known {
+		for _, component := range p.Components {
+			components = append(components, component.Name)
+		}
+		return true, components
+	}
+	considered := []string{}
+	for _, changedPath := range paths {
+		if (len(p.Include) == 0 || matchesAnyPath(p.Include, changedPath)) &&
+			!matchesAnyPath(p.Exclude, changedPath) {
+			considered = append(considered, changedPath)
+		}
+	}
+	if len(considered) == 0 {
+		return false, components
+	}
+	if len(p.Components) == 0 {
+		return true, components
+	}
+	for _, component := range p.Components {
+		for _, consideredPath := range considered {
+			if matchesAnyPath(component.Paths, consideredPath) {
+				components = append(components, component.Name)
+				break
+			}
+		}
+	}
+	return len(components) > 0, components
+}
+
+// pertainsToChanges returns a bool indicating whether the provided payload
+// pertains to a pull request or push, i.e. to changes to files.
+func pertainsToChanges(payload interface{}) bool {
+	_, _, ok := refOf(payload)
+	return ok
+}
+
+// matchesAnyPath returns a bool indicating whether the specified path matches
+// any of the provided patterns.
+func matchesAnyPath(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath returns a bool indicating whether the specified slash-separated
+// path matches the provided pattern. Each segment of the pattern uses shell
+// glob syntax, except for a segment that is exactly **, which matches zero or
+// more whole segments of the path. Malformed patterns match nothing.
+func matchPath(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchSegments returns a bool indicating whether the provided path segments
+// match the provided pattern segments.
+func matchSegments(patterns []string, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			// Try to match the remaining patterns against every suffix of the
+			// remaining names, including the empty suffix.
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(patterns[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if match, _ := path.Match(patterns[0], names[0]); !match {
+			return false
+		}
+		patterns = patterns[1:]
+		names = names[1:]
+	}
+	return len(names) == 0
+}
+
+// validatePathPattern returns an error if any segment of the provided pattern
+// is malformed.
+func validatePathPattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("pattern is empty")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
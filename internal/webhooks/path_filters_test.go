@@ -0,0 +1,221 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathFilterValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		filter PathFilter
+		errMsg string
+	}{
+		{
+			name:   "no repo pattern",
+			filter: PathFilter{},
+			errMsg: "does not specify a repo pattern",
+		},
+		{
+			name:   "invalid repo pattern",
+			filter: PathFilter{Repo: "[example-org/*"},
+			errMsg: `invalid repo pattern "[example-org/*"`,
+		},
+		{
+			name: "invalid path pattern",
+			filter: PathFilter{
+				Repo:    "example-org/*",
+				Exclude: []string{"docs/[**"},
+			},
+			errMsg: `invalid pattern "docs/[**"`,
+		},
+		{
+			name: "component without a name",
+			filter: PathFilter{
+				Repo:       "example-org/*",
+				Components: []Component{{Paths: []string{"services/**"}}},
+			},
+			errMsg: "component without a name",
+		},
+		{
+			name: "duplicate component",
+			filter: PathFilter{
+				Repo: "example-org/*",
+				Components: []Component{
+					{Name: "billing", Paths: []string{"services/billing/**"}},
+					{Name: "billing", Paths: []string{"lib/billing/**"}},
+				},
+			},
+			errMsg: `more than one component named "billing"`,
+		},
+		{
+			name: "component without paths",
+			filter: PathFilter{
+				Repo:       "example-org/*",
+				Components: []Component{{Name: "billing"}},
+			},
+			errMsg: `does not specify paths for component "billing"`,
+		},
+		{
+			name: "valid",
+			filter: PathFilter{
+				Repo:    "example-org/*",
+				Include: []string{"services/**"},
+				Exclude: []string{"**/*.md"},
+				Components: []Component{
+					{Name: "billing", Paths: []string{"services/billing/**"}},
+				},
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.filter.Validate()
+			if testCase.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), testCase.errMsg)
+		})
+	}
+}
+
+func TestPathFilterFor(t *testing.T) {
+	filters := []PathFilter{
+		{Repo: "example-org/example", Include: []string{"foo/**"}},
+		{Repo: "example-org/*"},
+	}
+	filter, ok := pathFilterFor(filters, "example-org/example")
+	require.True(t, ok)
+	require.Equal(t, filters[0], filter)
+	filter, ok = pathFilterFor(filters, "example-org/another")
+	require.True(t, ok)
+	require.Equal(t, filters[1], filter)
+	_, ok = pathFilterFor(filters, "another-org/example")
+	require.False(t, ok)
+}
+
+func TestPathFilterApply(t *testing.T) {
+	filter := PathFilter{
+		Repo:    "example-org/*",
+		Include: []string{"services/**", "lib/**"},
+		Exclude: []string{"**/*.md"},
+		Components: []Component{
+			{Name: "billing", Paths: []string{"services/billing/**"}},
+			{Name: "orders", Paths: []string{"services/orders/**"}},
+			{Name: "all", Paths: []string{"lib/**"}},
+		},
+	}
+	testCases := []struct {
+		name       string
+		filter     PathFilter
+		paths      []string
+		known      bool
+		emit       bool
+		components []string
+	}{
+		{
+			name:   "paths unknown without components",
+			filter: PathFilter{Repo: "example-org/*"},
+			emit:   true,
+		},
+		{
+			name:       "paths unknown with components",
+			filter:     filter,
+			emit:       true,
+			components: []string{"billing", "orders", "all"},
+		},
+		{
+			name:   "no paths changed",
+			filter: PathFilter{Repo: "example-org/*"},
+			known:  true,
+		},
+		{
+			name:   "any path considered without include patterns",
+			filter: PathFilter{Repo: "example-org/*"},
+			paths:  []string{"README.md"},
+			known:  true,
+			emit:   true,
+		},
+		{
+			name:   "no path included",
+			filter: filter,
+			paths:  []string{"docs/index.html", "Makefile"},
+			known:  true,
+		},
+		{
+			name:   "only excluded paths included",
+			filter: filter,
+			paths:  []string{"services/billing/README.md"},
+			known:  true,
+		},
+		{
+			name:   "included path belongs to no component",
+			filter: filter,
+			paths:  []string{"services/shipping/main.go"},
+			known:  true,
+		},
+		{
+			name:   "included paths without components",
+			filter: PathFilter{Repo: "example-org/*", Include: []string{"lib/*"}},
+			paths:  []string{"lib/util.go", "lib/deep/util.go"},
+			known:  true,
+			emit:   true,
+		},
+		{
+			name:   "included paths with components",
+			filter: filter,
+			paths: []string{
+				"README.md",
+				"lib/util.go",
+				"services/billing/README.md",
+				"services/orders/main.go",
+			},
+			known:      true,
+			emit:       true,
+			components: []string{"orders", "all"},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			emit, components :=
+				testCase.filter.apply(testCase.paths, testCase.known)
+			require.Equal(t, testCase.emit, emit)
+			require.Equal(t, testCase.components, components)
+		})
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"README.md", "README.md", true},
+		{"README.md", "docs/README.md", false},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/api/README.md", true},
+		{"services/billing/**", "services/billing", true},
+		{"services/billing/**", "services/billing/cmd/main.go", true},
+		{"services/billing/**", "services/billing-v2/main.go", false},
+		{"services/*/Dockerfile", "services/billing/Dockerfile", true},
+		{"services/*/Dockerfile", "services/billing/cmd/Dockerfile", false},
+		{"services/**/Dockerfile", "services/billing/cmd/Dockerfile", true},
+		{"**", "anything/at/all", true},
+		{"[docs/**", "docs/README.md", false},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.pattern+" "+testCase.path, func(t *testing.T) {
+			require.Equal(
+				t,
+				testCase.matches,
+				matchPath(testCase.pattern, testCase.path),
+			)
+		})
+	}
+}
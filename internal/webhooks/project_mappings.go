@@ -0,0 +1,82 @@
+package webhooks
+
+import (
+	"context"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// projectIDContextKey is the key under which an explicitly requested Brigade
+// project ID is stored in a context.Context.
+type projectIDContextKey struct{}
+
+// ProjectMapping maps matching repositories to a single Brigade project. Events
+// emitted for webhooks from those repositories are delivered directly to that
+// project instead of to all projects with matching subscriptions.
+type ProjectMapping struct {
+	// Repo is a pattern (e.g. example-org/*) matched against the full names of
+	// repositories.
+	Repo string `yaml:"repo"`
+	// Project is the ID of the Brigade project events should be delivered to.
+	Project string `yaml:"project"`
+}
+
+// Validate returns an error if the ProjectMapping is incomplete or contains a
+// malformed pattern.
+func (p ProjectMapping) Validate() error {
+	if p.Repo == "" {
+		return errors.New("project mapping does not specify a repo pattern")
+	}
+	if _, err := path.Match(p.Repo, ""); err != nil {
+		return errors.Wrapf(
+			err,
+			"project mapping contains invalid pattern %q",
+			p.Repo,
+		)
+	}
+	if p.Project == "" {
+		return errors.Errorf(
+			"project mapping for repo %q does not specify a project",
+			p.Repo,
+		)
+	}
+	return nil
+}
+
+// Applies returns a bool indicating whether the ProjectMapping applies to the
+// repository with the specified full name.
+func (p ProjectMapping) Applies(repo string) bool {
+	match, _ := path.Match(p.Repo, repo)
+	return match
+}
+
+// ContextWithProjectID returns a copy of the provided context.Context that
+// carries the specified Brigade project ID. When the context is passed to a
+// Service, events are delivered directly to that project, regardless of any
+// ProjectMappings.
+func ContextWithProjectID(
+	ctx context.Context,
+	projectID string,
+) context.Context {
+	return context.WithValue(ctx, projectIDContextKey{}, projectID)
+}
+
+// projectIDFromContext returns the Brigade project ID, if any, carried by the
+// provided context.Context.
+func projectIDFromContext(ctx context.Context) string {
+	projectID, _ := ctx.Value(projectIDContextKey{}).(string)
+	return projectID
+}
+
+// projectFor returns the ID of the Brigade project that the first of the
+// provided ProjectMappings that applies to the specified repository maps it
+// to. If no ProjectMapping applies, an empty string is returned.
+func projectFor(mappings []ProjectMapping, repo string) string {
+	for _, mapping := range mappings {
+		if mapping.Applies(repo) {
+			return mapping.Project
+		}
+	}
+	return ""
+}
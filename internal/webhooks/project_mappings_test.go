@@ -0,0 +1,105 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectMappingValidate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		mapping    ProjectMapping
+		assertions func(error)
+	}{
+		{
+			name:    "repo pattern not specified",
+			mapping: ProjectMapping{Project: "example"},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify a repo pattern")
+			},
+		},
+		{
+			name: "invalid repo pattern",
+			mapping: ProjectMapping{
+				Repo:    "example-org/[",
+				Project: "example",
+			},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "invalid pattern")
+			},
+		},
+		{
+			name:    "project not specified",
+			mapping: ProjectMapping{Repo: "example-org/*"},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not specify a project")
+			},
+		},
+		{
+			name: "valid",
+			mapping: ProjectMapping{
+				Repo:    "example-org/*",
+				Project: "example",
+			},
+			assertions: func(err error) {
+				require.NoError(t, err)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(testCase.mapping.Validate())
+		})
+	}
+}
+
+func TestProjectIDFromContext(t *testing.T) {
+	ctx := context.Background()
+	require.Empty(t, projectIDFromContext(ctx))
+	ctx = ContextWithProjectID(ctx, "example")
+	require.Equal(t, "example", projectIDFromContext(ctx))
+}
+
+func TestProjectFor(t *testing.T) {
+	mappings := []ProjectMapping{
+		{
+			Repo:    "example-org/special",
+			Project: "special",
+		},
+		{
+			Repo:    "example-org/*",
+			Project: "example",
+		},
+	}
+	testCases := []struct {
+		name    string
+		repo    string
+		project string
+	}{
+		{
+			name:    "first mapping applies",
+			repo:    "example-org/special",
+			project: "special",
+		},
+		{
+			name:    "second mapping applies",
+			repo:    "example-org/example",
+			project: "example",
+		},
+		{
+			name:    "no mapping applies",
+			repo:    "another-org/example",
+			project: "",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(t, testCase.project, projectFor(mappings, testCase.repo))
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package webhooks
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// rateLimitedPerRepo counts the webhooks that were rejected because their
+	// repository's rate limit was exceeded. These are deliberately not counted
+	// by repository, since repository names are taken from unverified payloads
+	// and the number of them is unbounded.
+	rateLimitedPerRepo = expvar.NewInt("rateLimitedWebhooksPerRepo")
+	// rateLimitedGlobally counts the webhooks that were rejected because the
+	// global rate limit was exceeded.
+	rateLimitedGlobally = expvar.NewInt("rateLimitedWebhooksGlobal")
+)
+
+// RateLimit describes a token bucket rate limit.
+type RateLimit struct {
+	// PerMinute is the number of webhooks per minute that are sustainably
+	// permitted. A zero value means no limit.
+	PerMinute int
+	// Burst is the number of webhooks that may be received in rapid succession
+	// before PerMinute takes effect. A zero value means the same as PerMinute.
+	Burst int
+}
+
+// RateLimiterConfig encapsulates configuration for a RateLimiter.
+type RateLimiterConfig struct {
+	// Global limits webhooks pertaining to all repositories combined.
+	Global RateLimit
+	// PerRepo limits webhooks pertaining to each individual repository.
+	PerRepo RateLimit
+}
+
+// RateLimitedError is returned by a RateLimiter when a webhook should be
+// rejected because a rate limit has been exceeded.
+type RateLimitedError struct {
+	// Repo is the full name of the repository the webhook pertained to.
+	Repo string
+	// Global indicates whether it was the global rate limit, rather than the
+	// repository's own, that was exceeded.
+	Global bool
+	// RetryAfter is how long to wait before a webhook will be permitted.
+	RetryAfter time.Duration
+}
+
+func (r *RateLimitedError) Error() string {
+	if r.Global {
+		return fmt.Sprintf(
+			"global rate limit exceeded by webhook for repo %q; retry after %s",
+			r.Repo,
+			r.RetryAfter,
+		)
+	}
+	return fmt.Sprintf(
+		"rate limit exceeded for repo %q; retry after %s",
+		r.Repo,
+		r.RetryAfter,
+	)
+}
+
+// RateLimiter is an interface for components that protect Brigade from storms
+// of webhooks, e.g. from a misconfigured repository or a bot pushing in a loop.
+type RateLimiter interface {
+	// Allow returns a *RateLimitedError if a webhook pertaining to the specified
+	// repository should be rejected. Otherwise, it returns nil and the webhook
+	// counts against all applicable rate limits.
+	Allow(repo string) error
+}
+
+type rateLimiter struct {
+	config      RateLimiterConfig
+	mu          sync.Mutex
+	global      *tokenBucket
+	perRepo     map[string]*tokenBucket
+	lastCleanup time.Time
+	// now is overridable for testing purposes
+	now func() time.Time
+}
+
+// NewRateLimiter returns an implementation of the RateLimiter interface that
+// applies token bucket rate limits globally and to each repository. Rejected
+// webhooks are counted in expvar metrics.
+func NewRateLimiter(config RateLimiterConfig) RateLimiter {
+	r := &rateLimiter{
+		config:  config,
+		perRepo: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+	r.lastCleanup = r.now()
+	if config.Global.PerMinute > 0 {
+		r.global = newTokenBucket(config.Global, r.lastCleanup)
+	}
+	return r
+}
+
+func (r *rateLimiter) Allow(repo string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.cleanup(now)
+	var repoBucket *tokenBucket
+	if r.config.PerRepo.PerMinute > 0 {
+		var ok bool
+		if repoBucket, ok = r.perRepo[repo]; !ok {
+			repoBucket = newTokenBucket(r.config.PerRepo, now)
+			r.perRepo[repo] = repoBucket
+		}
+		if wait := repoBucket.wait(now); wait > 0 {
+			rateLimitedPerRepo.Add(1)
+			return &RateLimitedError{Repo: repo, RetryAfter: wait}
+		}
+	}
+	if r.global != nil {
+		if wait := r.global.wait(now); wait > 0 {
+			rateLimitedGlobally.Add(1)
+			return &RateLimitedError{Repo: repo, Global: true, RetryAfter: wait}
+		}
+		r.global.take()
+	}
+	if repoBucket != nil {
+		repoBucket.take()
+	}
+	return nil
+}
+
+// cleanup discards, at most once per minute, the buckets of repositories that
+// haven't sent webhooks recently enough to have any effect on their limit.
+// This prevents the number of buckets from growing without bound.
+func (r *rateLimiter) cleanup(now time.Time) {
+	if now.Sub(r.lastCleanup) < time.Minute {
+		return
+	}
+	r.lastCleanup = now
+	for repo, bucket := range r.perRepo {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.capacity {
+			delete(r.perRepo, repo)
+		}
+	}
+}
+
+// tokenBucket is a simple token bucket. It is not safe for concurrent use.
+type tokenBucket struct {
+	// ratePerSecond is how many tokens are added to the bucket per second.
+	ratePerSecond float64
+	// capacity is the maximum number of tokens the bucket can hold.
+	capacity   float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// newTokenBucket returns a full tokenBucket reflecting the provided RateLimit.
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.PerMinute
+	}
+	return &tokenBucket{
+		ratePerSecond: float64(limit.PerMinute) / 60,
+		capacity:      float64(burst),
+		tokens:        float64(burst),
+		lastRefill:    now,
+	}
+}
+
+// refill adds the tokens accrued since the bucket was last refilled.
+func (t *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(t.lastRefill).Seconds(); elapsed > 0 {
+		t.tokens = math.Min(t.capacity, t.tokens+elapsed*t.ratePerSecond)
+	}
+	t.lastRefill = now
+}
+
+// wait refills the bucket and returns how long it will be until a token is
+// available. A zero value indicates a token is available now.
+func (t *tokenBucket) wait(now time.Time) time.Duration {
+	t.refill(now)
+	if t.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - t.tokens) / t.ratePerSecond * float64(time.Second))
+}
+
+// take removes a token from the bucket. It should only be called after wait
+// has indicated a token is available.
+func (t *tokenBucket) take() {
+	t.tokens--
+}
@@ -0,0 +1,140 @@
+package webhooks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     RateLimiterConfig
+		assertions func(*rateLimiter)
+	}{
+		{
+			name:   "no global limit",
+			config: RateLimiterConfig{PerRepo: RateLimit{PerMinute: 60}},
+			assertions: func(r *rateLimiter) {
+				require.Nil(t, r.global)
+				require.NotNil(t, r.perRepo)
+			},
+		},
+		{
+			name:   "global limit",
+			config: RateLimiterConfig{Global: RateLimit{PerMinute: 60, Burst: 10}},
+			assertions: func(r *rateLimiter) {
+				require.NotNil(t, r.global)
+				require.Equal(t, float64(1), r.global.ratePerSecond)
+				require.Equal(t, float64(10), r.global.capacity)
+				require.Equal(t, float64(10), r.global.tokens)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r, ok := NewRateLimiter(testCase.config).(*rateLimiter)
+			require.True(t, ok)
+			require.Equal(t, testCase.config, r.config)
+			require.NotNil(t, r.now)
+			testCase.assertions(r)
+		})
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	const repo = "example-org/example"
+	const otherRepo = "example-org/other"
+	testCases := []struct {
+		name       string
+		config     RateLimiterConfig
+		assertions func(r *rateLimiter, advance func(time.Duration))
+	}{
+		{
+			name: "no limits",
+			assertions: func(r *rateLimiter, _ func(time.Duration)) {
+				for i := 0; i < 1000; i++ {
+					require.NoError(t, r.Allow(repo))
+				}
+			},
+		},
+		{
+			name: "per repo limit exceeded",
+			config: RateLimiterConfig{
+				PerRepo: RateLimit{PerMinute: 60, Burst: 2},
+			},
+			assertions: func(r *rateLimiter, advance func(time.Duration)) {
+				require.NoError(t, r.Allow(repo))
+				require.NoError(t, r.Allow(repo))
+				before := rateLimitedPerRepo.Value()
+				err := r.Allow(repo)
+				require.Error(t, err)
+				rlErr, ok := err.(*RateLimitedError)
+				require.True(t, ok)
+				require.Equal(t, repo, rlErr.Repo)
+				require.False(t, rlErr.Global)
+				require.Equal(t, time.Second, rlErr.RetryAfter)
+				require.Equal(t, before+1, rateLimitedPerRepo.Value())
+				// Other repos are unaffected
+				require.NoError(t, r.Allow(otherRepo))
+				// Tokens are replenished over time
+				advance(time.Second)
+				require.NoError(t, r.Allow(repo))
+				require.Error(t, r.Allow(repo))
+			},
+		},
+		{
+			name: "global limit exceeded",
+			config: RateLimiterConfig{
+				Global:  RateLimit{PerMinute: 120},
+				PerRepo: RateLimit{PerMinute: 60, Burst: 2},
+			},
+			assertions: func(r *rateLimiter, advance func(time.Duration)) {
+				r.global.tokens = 1
+				before := rateLimitedGlobally.Value()
+				require.NoError(t, r.Allow(repo))
+				err := r.Allow(otherRepo)
+				require.Error(t, err)
+				rlErr, ok := err.(*RateLimitedError)
+				require.True(t, ok)
+				require.Equal(t, otherRepo, rlErr.Repo)
+				require.True(t, rlErr.Global)
+				require.Equal(t, 500*time.Millisecond, rlErr.RetryAfter)
+				require.Equal(t, before+1, rateLimitedGlobally.Value())
+				// The rejected webhook didn't count against the repo's own limit
+				require.Equal(t, float64(2), r.perRepo[otherRepo].tokens)
+				advance(500 * time.Millisecond)
+				require.NoError(t, r.Allow(otherRepo))
+			},
+		},
+		{
+			name: "idle repo buckets are discarded",
+			config: RateLimiterConfig{
+				PerRepo: RateLimit{PerMinute: 60, Burst: 2},
+			},
+			assertions: func(r *rateLimiter, advance func(time.Duration)) {
+				require.NoError(t, r.Allow(repo))
+				require.Contains(t, r.perRepo, repo)
+				advance(time.Minute)
+				require.NoError(t, r.Allow(otherRepo))
+				require.NotContains(t, r.perRepo, repo)
+				require.Contains(t, r.perRepo, otherRepo)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			now := time.Now()
+			r, ok := NewRateLimiter(testCase.config).(*rateLimiter)
+			require.True(t, ok)
+			r.now = func() time.Time {
+				return now
+			}
+			r.lastCleanup = now
+			testCase.assertions(r, func(d time.Duration) {
+				now = now.Add(d)
+			})
+		})
+	}
+}
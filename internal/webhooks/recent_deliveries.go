@@ -0,0 +1,80 @@
+package webhooks
+
+import "sync"
+
+// RecentDeliveries is an interface for DeliveryArchives that retain, in memory,
+// a bounded number of the most recently received webhooks so they can be
+// inspected or redelivered.
+type RecentDeliveries interface {
+	DeliveryArchive
+	// List returns up to limit of the retained deliveries, most recent first. A
+	// limit less than or equal to zero returns all retained deliveries.
+	List(limit int) []Delivery
+	// Get returns the retained Delivery having the specified ID. The bool return
+	// value indicates whether such a Delivery was found.
+	Get(id string) (Delivery, bool)
+}
+
+// recentDeliveries is an implementation of the RecentDeliveries interface
+// backed by a ring buffer.
+type recentDeliveries struct {
+	mu         sync.RWMutex
+	deliveries []Delivery
+	// next is the index in deliveries that the next Delivery will be written to
+	next int
+	// count is the number of deliveries currently retained
+	count int
+}
+
+// NewRecentDeliveries returns an implementation of the RecentDeliveries
+// interface that retains, at most, the specified number of deliveries. When
+// that number is exceeded, the oldest deliveries are discarded first.
+func NewRecentDeliveries(size int) RecentDeliveries {
+	if size < 1 {
+		size = 1
+	}
+	return &recentDeliveries{
+		deliveries: make([]Delivery, size),
+	}
+}
+
+func (r *recentDeliveries) Archive(delivery Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveries[r.next] = delivery
+	r.next = (r.next + 1) % len(r.deliveries)
+	if r.count < len(r.deliveries) {
+		r.count++
+	}
+	return nil
+}
+
+func (r *recentDeliveries) List(limit int) []Delivery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if limit <= 0 || limit > r.count {
+		limit = r.count
+	}
+	deliveries := make([]Delivery, limit)
+	for i := range deliveries {
+		deliveries[i] = r.deliveries[r.index(i)]
+	}
+	return deliveries
+}
+
+func (r *recentDeliveries) Get(id string) (Delivery, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := 0; i < r.count; i++ {
+		if delivery := r.deliveries[r.index(i)]; delivery.ID == id {
+			return delivery, true
+		}
+	}
+	return Delivery{}, false
+}
+
+// index returns the index in the ring buffer of the ith most recent Delivery.
+func (r *recentDeliveries) index(i int) int {
+	size := len(r.deliveries)
+	return ((r.next-1-i)%size + size) % size
+}
@@ -0,0 +1,50 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRecentDeliveries(t *testing.T) {
+	r, ok := NewRecentDeliveries(5).(*recentDeliveries)
+	require.True(t, ok)
+	require.Len(t, r.deliveries, 5)
+	r, ok = NewRecentDeliveries(0).(*recentDeliveries)
+	require.True(t, ok)
+	require.Len(t, r.deliveries, 1)
+}
+
+func TestRecentDeliveries(t *testing.T) {
+	r := NewRecentDeliveries(3)
+	require.Empty(t, r.List(0))
+	_, ok := r.Get("a")
+	require.False(t, ok)
+
+	for _, id := range []string{"a", "b"} {
+		require.NoError(t, r.Archive(Delivery{ID: id}))
+	}
+	require.Equal(t, []string{"b", "a"}, deliveryIDs(r.List(0)))
+
+	for _, id := range []string{"c", "d", "e"} {
+		require.NoError(t, r.Archive(Delivery{ID: id}))
+	}
+	require.Equal(t, []string{"e", "d", "c"}, deliveryIDs(r.List(0)))
+	require.Equal(t, []string{"e", "d"}, deliveryIDs(r.List(2)))
+	require.Equal(t, []string{"e", "d", "c"}, deliveryIDs(r.List(10)))
+
+	delivery, ok := r.Get("c")
+	require.True(t, ok)
+	require.Equal(t, "c", delivery.ID)
+	// "a" should have been discarded
+	_, ok = r.Get("a")
+	require.False(t, ok)
+}
+
+func deliveryIDs(deliveries []Delivery) []string {
+	ids := make([]string, len(deliveries))
+	for i, delivery := range deliveries {
+		ids[i] = delivery.ID
+	}
+	return ids
+}
@@ -0,0 +1,135 @@
+package webhooks
+
+import (
+	"path"
+
+	"github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/pkg/errors"
+)
+
+// RefFilter describes which branches and tags of matching repositories should
+// result in events being emitted into Brigade when repo:push and
+// pullrequest:* webhooks are received. For pull requests, it is the
+// destination branch that is considered.
+type RefFilter struct {
+	// Repo is a pattern (e.g. example-org/*) matched against the full names of
+	// repositories.
+	Repo string `yaml:"repo"`
+	// Branches selects branches.
+	Branches RefPatterns `yaml:"branches"`
+	// Tags selects tags.
+	Tags RefPatterns `yaml:"tags"`
+}
+
+// RefPatterns selects refs by name.
+type RefPatterns struct {
+	// Include, if non-empty, is a list of patterns (e.g. release/*), at least one
+	// of which a ref's name must match for the ref to be selected.
+	Include []string `yaml:"include"`
+	// Exclude is a list of patterns, none of which a ref's name may match for the
+	// ref to be selected. Exclusions take precedence over inclusions.
+	Exclude []string `yaml:"exclude"`
+}
+
+// Validate returns an error if the RefFilter contains any malformed patterns.
+func (r RefFilter) Validate() error {
+	if r.Repo == "" {
+		return errors.New("ref filter does not specify a repo pattern")
+	}
+	patterns := []string{r.Repo}
+	patterns = append(patterns, r.Branches.Include...)
+	patterns = append(patterns, r.Branches.Exclude...)
+	patterns = append(patterns, r.Tags.Include...)
+	patterns = append(patterns, r.Tags.Exclude...)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(
+				err,
+				"ref filter for repo %q contains invalid pattern %q",
+				r.Repo,
+				pattern,
+			)
+		}
+	}
+	return nil
+}
+
+// selects returns a bool indicating whether the specified ref name is selected
+// by the RefPatterns.
+func (r RefPatterns) selects(name string) bool {
+	for _, pattern := range r.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	if len(r.Include) == 0 {
+		return true
+	}
+	for _, pattern := range r.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// refAllowed returns a bool indicating whether the ref (if any) that the
+// provided payload pertains to is selected by the first of the provided
+// RefFilters that applies to the specified repository. If no RefFilter applies
+// or the payload does not pertain to a branch or tag, true is returned.
+func refAllowed(filters []RefFilter, repo string, payload interface{}) bool {
+	refType, refName, ok := refOf(payload)
+	if !ok {
+		return true
+	}
+	for _, filter := range filters {
+		if match, _ := path.Match(filter.Repo, repo); !match {
+			continue
+		}
+		switch refType {
+		case "branch":
+			return filter.Branches.selects(refName)
+		case "tag":
+			return filter.Tags.selects(refName)
+		}
+		return true
+	}
+	return true
+}
+
+// refOf returns the type ("branch" or "tag") and name of the ref that the
+// provided payload pertains to. The bool return value is false for payloads
+// that are not subject to ref filtering.
+func refOf(payload interface{}) (string, string, bool) {
+	switch p := payload.(type) {
+	case bitbucket.RepoPushPayload:
+		if len(p.Push.Changes) == 0 {
+			return "", "", false
+		}
+		change := p.Push.Changes[0]
+		// When a branch or tag is deleted, there is no "new" ref.
+		if change.New.Name != "" {
+			return change.New.Type, change.New.Name, true
+		}
+		return change.Old.Type, change.Old.Name, true
+	case bitbucket.PullRequestApprovedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestCommentCreatedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestCommentDeletedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestCommentUpdatedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestCreatedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestDeclinedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestMergedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestUnapprovedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	case bitbucket.PullRequestUpdatedPayload:
+		return "branch", p.PullRequest.Destination.Branch.Name, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,112 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefFilterValidate(t *testing.T) {
+	require.Error(t, RefFilter{}.Validate())
+	err := RefFilter{
+		Repo: "example-org/*",
+		Branches: RefPatterns{
+			Include: []string{"[main"},
+		},
+	}.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `invalid pattern "[main"`)
+	require.NoError(
+		t,
+		RefFilter{
+			Repo: "example-org/*",
+			Branches: RefPatterns{
+				Include: []string{"main"},
+			},
+		}.Validate(),
+	)
+}
+
+func TestRefPatternsSelects(t *testing.T) {
+	testCases := []struct {
+		name     string
+		patterns RefPatterns
+		ref      string
+		selected bool
+	}{
+		{
+			name:     "no patterns",
+			ref:      "main",
+			selected: true,
+		},
+		{
+			name: "included",
+			patterns: RefPatterns{
+				Include: []string{"release/*"},
+			},
+			ref:      "release/1.0",
+			selected: true,
+		},
+		{
+			name: "not included",
+			patterns: RefPatterns{
+				Include: []string{"release/*"},
+			},
+			ref:      "main",
+			selected: false,
+		},
+		{
+			name: "excluded",
+			patterns: RefPatterns{
+				Exclude: []string{"feature/*"},
+			},
+			ref:      "feature/foo",
+			selected: false,
+		},
+		{
+			name: "exclusion takes precedence over inclusion",
+			patterns: RefPatterns{
+				Include: []string{"release/*"},
+				Exclude: []string{"release/old"},
+			},
+			ref:      "release/old",
+			selected: false,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(
+				t,
+				testCase.selected,
+				testCase.patterns.selects(testCase.ref),
+			)
+		})
+	}
+}
+
+func TestRefOf(t *testing.T) {
+	refType, refName, ok :=
+		refOf(pushPayload(t, "example-org/example", "tag", "v1.0.0"))
+	require.True(t, ok)
+	require.Equal(t, "tag", refType)
+	require.Equal(t, "v1.0.0", refName)
+
+	// Deleted branch
+	payload := pushPayload(t, "example-org/example", "branch", "")
+	payload.Push.Changes[0].Old.Type = "branch"
+	payload.Push.Changes[0].Old.Name = "feature/foo"
+	refType, refName, ok = refOf(payload)
+	require.True(t, ok)
+	require.Equal(t, "branch", refType)
+	require.Equal(t, "feature/foo", refName)
+
+	refType, refName, ok = refOf(
+		pullRequestCreatedPayload(t, "example-org/example", "feature/foo", "main"),
+	)
+	require.True(t, ok)
+	require.Equal(t, "branch", refType)
+	require.Equal(t, "main", refName)
+
+	_, _, ok = refOf(struct{}{})
+	require.False(t, ok)
+}
@@ -0,0 +1,58 @@
+package webhooks
+
+import (
+	"context"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/go-playground/webhooks/v6/bitbucket"
+	"github.com/pkg/errors"
+)
+
+// Replayer is an interface for components that can process previously captured
+// webhooks (events) from Bitbucket a second time.
+type Replayer interface {
+	// Replay parses the provided Delivery exactly as if it had just been
+	// received from Bitbucket and hands the result off to a Service.
+	Replay(ctx context.Context, delivery Delivery) (sdk.EventList, error)
+}
+
+type replayer struct {
+	service Service
+	hook    *bitbucket.Webhook
+}
+
+// NewReplayer returns an implementation of the Replayer interface that hands
+// parsed deliveries off to the provided Service.
+func NewReplayer(service Service) (Replayer, error) {
+	hook, err := bitbucket.New()
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating replayer")
+	}
+	return &replayer{
+		service: service,
+		hook:    hook,
+	}, nil
+}
+
+func (r *replayer) Replay(
+	ctx context.Context,
+	delivery Delivery,
+) (sdk.EventList, error) {
+	var events sdk.EventList
+	req, err := delivery.request(ctx)
+	if err != nil {
+		return events, err
+	}
+	payload, err := r.hook.Parse(req, supportedEvents...)
+	if err != nil {
+		return events, errors.Wrapf(
+			err,
+			"error parsing %q delivery",
+			delivery.EventKey(),
+		)
+	}
+	if delivery.ProjectID != "" {
+		ctx = ContextWithProjectID(ctx, delivery.ProjectID)
+	}
+	return r.service.Handle(ctx, payload)
+}
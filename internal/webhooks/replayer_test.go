@@ -0,0 +1,90 @@
+package webhooks
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/brigadecore/brigade/sdk/v3"
+	sdkTesting "github.com/brigadecore/brigade/sdk/v3/testing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReplayer(t *testing.T) {
+	svc := NewService(&sdkTesting.MockEventsClient{}, ServiceConfig{})
+	r, err := NewReplayer(svc)
+	require.NoError(t, err)
+	rep, ok := r.(*replayer)
+	require.True(t, ok)
+	require.Same(t, svc, rep.service)
+	require.NotNil(t, rep.hook)
+}
+
+func TestReplayerReplay(t *testing.T) {
+	testCases := []struct {
+		name       string
+		delivery   Delivery
+		assertions func(sdk.EventList, error)
+	}{
+		{
+			name: "unsupported event",
+			delivery: Delivery{
+				Headers: http.Header{"X-Event-Key": []string{"foo:bar"}},
+				Body:    "{}",
+			},
+			assertions: func(_ sdk.EventList, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), `error parsing "foo:bar" delivery`)
+			},
+		},
+		{
+			name: "success",
+			delivery: Delivery{
+				Headers: http.Header{"X-Event-Key": []string{"repo:fork"}},
+				Body:    `{"repository":{"full_name":"example-org/example"}}`,
+			},
+			assertions: func(events sdk.EventList, err error) {
+				require.NoError(t, err)
+				require.Len(t, events.Items, 1)
+				require.Equal(t, "abc", events.Items[0].ID)
+				require.Empty(t, events.Items[0].ProjectID)
+			},
+		},
+		{
+			name: "success with project ID",
+			delivery: Delivery{
+				Headers:   http.Header{"X-Event-Key": []string{"repo:fork"}},
+				Body:      `{"repository":{"full_name":"example-org/example"}}`,
+				ProjectID: "example",
+			},
+			assertions: func(events sdk.EventList, err error) {
+				require.NoError(t, err)
+				require.Len(t, events.Items, 1)
+				require.Equal(t, "example", events.Items[0].ProjectID)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r, err := NewReplayer(
+				NewService(
+					&sdkTesting.MockEventsClient{
+						CreateFn: func(
+							_ context.Context,
+							event sdk.Event,
+							_ *sdk.EventCreateOptions,
+						) (sdk.EventList, error) {
+							require.Equal(t, "repo:fork", event.Type)
+							require.Equal(t, "example-org/example", event.Qualifiers["repo"])
+							event.ID = "abc"
+							return sdk.EventList{Items: []sdk.Event{event}}, nil
+						},
+					},
+					ServiceConfig{},
+				),
+			)
+			require.NoError(t, err)
+			testCase.assertions(r.Replay(context.Background(), testCase.delivery))
+		})
+	}
+}
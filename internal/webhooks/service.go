@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 
 	"github.com/brigadecore/brigade/sdk/v3"
@@ -11,6 +12,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// DefaultSource is the value used in the Source field of all events emitted
+// into Brigade when no other source has been configured.
+const DefaultSource = "brigade.sh/bitbucket"
+
 // Service is an interface for components that can handle webhooks (events) from
 // Bitbucket. Implementations of this interface are transport-agnostic.
 type Service interface {
@@ -21,15 +26,61 @@ type Service interface {
 	) (sdk.EventList, error)
 }
 
+// ServiceConfig encapsulates optional configuration for the service.
+type ServiceConfig struct {
+	// Source is the value used in the Source field of all events emitted into
+	// Brigade. If unspecified, DefaultSource is used. Distinct sources permit
+	// multiple gateway instances to be distinguished by project subscriptions
+	// and role grants.
+	Source string
+	// RefFilters, if non-empty, restrict which branches and tags of matching
+	// repositories result in events being emitted into Brigade when repo:push
+	// and pullrequest:* webhooks are received. Only the first RefFilter that
+	// applies to a given repository is considered.
+	RefFilters []RefFilter
+	// ProjectMappings, if non-empty, map matching repositories to a single
+	// Brigade project, causing events to be delivered directly to that project.
+	// Only the first ProjectMapping that applies to a given repository is
+	// considered. A project ID carried by the context.Context passed to Handle
+	// takes precedence over any ProjectMapping.
+	ProjectMappings []ProjectMapping
+	// TenantEventsClients, if non-empty, maps Bitbucket workspaces (e.g.
+	// example-org) to the clients that should be used for emitting events for
+	// repositories in each, permitting one gateway to serve multiple Brigade
+	// installations. Webhooks pertaining to any other workspace are rejected
+	// with an *UnknownWorkspaceError.
+	TenantEventsClients map[string]sdk.EventsClient
+	// ChangedPaths, if non-nil, is used to list the paths of the files changed
+	// by the pull request or push that each pullrequest:* or repo:push webhook
+	// pertains to. These are added to the payload of the corresponding event in
+	// a top-level changed_paths field.
+	ChangedPaths ChangedPathsLister
+	// PathFilters, if non-empty, restrict which changes to matching repositories
+	// result in events being emitted into Brigade when repo:push and
+	// pullrequest:* webhooks are received, based on the paths of the files
+	// changed, and optionally cause one event to be emitted for each affected
+	// component of a repository. Only the first PathFilter that applies to a
+	// given repository is considered. PathFilters are only effective when
+	// ChangedPaths is non-nil. When changed paths cannot be listed, every change
+	// is assumed to be relevant.
+	PathFilters []PathFilter
+}
+
 type service struct {
 	eventsClient sdk.EventsClient
+	config       ServiceConfig
 }
 
 // NewService returns an implementation of the Service interface for handling
-// webhooks (events) from Bitbucket.
-func NewService(eventsClient sdk.EventsClient) Service {
+// webhooks (events) from Bitbucket. The provided sdk.EventsClient is not used,
+// and may be nil, if the provided ServiceConfig specifies TenantEventsClients.
+func NewService(eventsClient sdk.EventsClient, config ServiceConfig) Service {
+	if config.Source == "" {
+		config.Source = DefaultSource
+	}
 	return &service{
 		eventsClient: eventsClient,
+		config:       config,
 	}
 }
 
@@ -45,7 +96,7 @@ func (s *service) Handle(
 		return events, errors.Wrap(err, "error marshaling event payload")
 	}
 	event := sdk.Event{
-		Source:  "brigade.sh/bitbucket",
+		Source:  s.config.Source,
 		Payload: string(payloadBytes),
 	}
 
@@ -309,6 +360,127 @@ func (s *service) Handle(
 		return events, nil
 	}
 
-	events, err = s.eventsClient.Create(ctx, event, nil)
-	return events, errors.Wrap(err, "error emitting event(s) into Brigade")
+	if !refAllowed(s.config.RefFilters, event.Qualifiers["repo"], payload) {
+		log.Printf(
+			"not emitting %s event for repo %s; excluded by ref filters",
+			event.Type,
+			event.Qualifiers["repo"],
+		)
+		return events, nil
+	}
+
+	var changedPaths []string
+	var changedPathsKnown bool
+	if s.config.ChangedPaths != nil {
+		changedPaths, changedPathsKnown = s.addChangedPaths(ctx, &event, payload)
+	}
+
+	// Path filters only apply to payloads that pertain to changes. A nil slice
+	// of components results in a single event being emitted.
+	var components []string
+	if filter, ok :=
+		pathFilterFor(s.config.PathFilters, event.Qualifiers["repo"]); ok &&
+		pertainsToChanges(payload) {
+		var emit bool
+		if emit, components =
+			filter.apply(changedPaths, changedPathsKnown); !emit {
+			log.Printf(
+				"not emitting %s event for repo %s; excluded by path filters",
+				event.Type,
+				event.Qualifiers["repo"],
+			)
+			return events, nil
+		}
+	}
+
+	if event.ProjectID = projectIDFromContext(ctx); event.ProjectID == "" {
+		event.ProjectID =
+			projectFor(s.config.ProjectMappings, event.Qualifiers["repo"])
+	}
+
+	eventsClient := s.eventsClient
+	if len(s.config.TenantEventsClients) > 0 {
+		workspace := workspaceOf(event.Qualifiers["repo"])
+		var ok bool
+		if eventsClient, ok = s.config.TenantEventsClients[workspace]; !ok {
+			return events, &UnknownWorkspaceError{Workspace: workspace}
+		}
+	}
+
+	if components == nil {
+		events, err = eventsClient.Create(ctx, event, nil)
+		return events, errors.Wrap(err, "error emitting event(s) into Brigade")
+	}
+	// An event is emitted for every component, even if emitting another fails,
+	// and an error is returned only if none could be emitted. Since Bitbucket
+	// redelivers a webhook only in its entirety, reporting a partial failure
+	// would cause the events that were emitted to be emitted again.
+	var failed []string
+	var firstErr error
+	for _, component := range components {
+		componentEvent := event
+		componentEvent.Qualifiers = map[string]string{"component": component}
+		for key, value := range event.Qualifiers {
+			componentEvent.Qualifiers[key] = value
+		}
+		var componentEvents sdk.EventList
+		if componentEvents, err =
+			eventsClient.Create(ctx, componentEvent, nil); err != nil {
+			log.Printf(
+				"error emitting %s event(s) for component %s of repo %s into "+
+					"Brigade: %s",
+				event.Type,
+				component,
+				event.Qualifiers["repo"],
+				err,
+			)
+			failed = append(failed, component)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		events.Items = append(events.Items, componentEvents.Items...)
+	}
+	if len(failed) == len(components) {
+		return events, errors.Wrapf(
+			firstErr,
+			"error emitting event(s) for component(s) %s into Brigade",
+			strings.Join(failed, ", "),
+		)
+	}
+	return events, nil
+}
+
+// addChangedPaths adds the paths of the files changed by the pull request or
+// push that the provided payload pertains to, if any, to the provided event's
+// payload. For a push, these are the paths changed by all of its changes.
+// Failure to list the paths is logged, but is not fatal; the event is then
+// emitted without them. The paths are also returned, along with a bool
+// indicating whether they are known.
+func (s *service) addChangedPaths(
+	ctx context.Context,
+	event *sdk.Event,
+	payload interface{},
+) ([]string, bool) {
+	specs, ok := changedPathsSpecs(payload)
+	if !ok {
+		return nil, false
+	}
+	repo := event.Qualifiers["repo"]
+	paths, err := listChangedPaths(ctx, s.config.ChangedPaths, repo, specs)
+	if err == nil {
+		event.Payload, err = withChangedPaths(event.Payload, paths)
+	}
+	if err != nil {
+		log.Printf(
+			"error adding paths changed by %s of repo %s to %s event: %s",
+			strings.Join(specs, ", "),
+			repo,
+			event.Type,
+			err,
+		)
+		return nil, false
+	}
+	return paths, true
 }
@@ -1,20 +1,622 @@
 package webhooks
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	bitbucketAPI "github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade/sdk/v3"
 	sdkTesting "github.com/brigadecore/brigade/sdk/v3/testing"
+	"github.com/go-playground/webhooks/v6/bitbucket"
 	"github.com/stretchr/testify/require"
 )
 
 func TestNewService(t *testing.T) {
+	config := ServiceConfig{
+		Source:     "example.com/bitbucket",
+		RefFilters: []RefFilter{{Repo: "*/*"}},
+	}
 	s, ok := NewService(
 		// Totally unusable client that is enough to fulfill the dependencies for
 		// this test...
 		&sdkTesting.MockEventsClient{
 			LogsClient: &sdkTesting.MockLogsClient{},
 		},
+		config,
 	).(*service)
 	require.True(t, ok)
 	require.NotNil(t, s.eventsClient)
+	require.Equal(t, config, s.config)
+	// Source should be defaulted if unspecified
+	s, ok = NewService(&sdkTesting.MockEventsClient{}, ServiceConfig{}).(*service)
+	require.True(t, ok)
+	require.Equal(t, DefaultSource, s.config.Source)
+}
+
+func TestServiceHandleWithCustomSource(t *testing.T) {
+	var source string
+	s := NewService(
+		&sdkTesting.MockEventsClient{
+			CreateFn: func(
+				_ context.Context,
+				event sdk.Event,
+				_ *sdk.EventCreateOptions,
+			) (sdk.EventList, error) {
+				source = event.Source
+				return sdk.EventList{}, nil
+			},
+		},
+		ServiceConfig{Source: "example.com/bitbucket-partner"},
+	)
+	payload := bitbucket.RepoForkPayload{}
+	payload.Repository.FullName = "example-org/example"
+	_, err := s.Handle(context.Background(), payload)
+	require.NoError(t, err)
+	require.Equal(t, "example.com/bitbucket-partner", source)
+}
+
+func TestServiceHandleWithRefFilters(t *testing.T) {
+	config := ServiceConfig{
+		RefFilters: []RefFilter{
+			{
+				Repo: "example-org/*",
+				Branches: RefPatterns{
+					Include: []string{"main", "release/*"},
+				},
+				Tags: RefPatterns{
+					Exclude: []string{"*-rc*"},
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		name    string
+		payload interface{}
+		emitted bool
+	}{
+		{
+			name: "push to included branch",
+			payload: pushPayload(
+				t,
+				"example-org/example",
+				"branch",
+				"release/1.0",
+			),
+			emitted: true,
+		},
+		{
+			name: "push to branch that is not included",
+			payload: pushPayload(
+				t,
+				"example-org/example",
+				"branch",
+				"feature/foo",
+			),
+			emitted: false,
+		},
+		{
+			name:    "push to excluded tag",
+			payload: pushPayload(t, "example-org/example", "tag", "v1.0.0-rc1"),
+			emitted: false,
+		},
+		{
+			name:    "push to tag that is not excluded",
+			payload: pushPayload(t, "example-org/example", "tag", "v1.0.0"),
+			emitted: true,
+		},
+		{
+			name: "push to repo without applicable filter",
+			payload: pushPayload(
+				t,
+				"another-org/example",
+				"branch",
+				"feature/foo",
+			),
+			emitted: true,
+		},
+		{
+			name: "pull request into branch that is not included",
+			payload: pullRequestCreatedPayload(
+				t,
+				"example-org/example",
+				"main",
+				"feature/foo",
+			),
+			emitted: false,
+		},
+		{
+			name: "pull request into included branch",
+			payload: pullRequestCreatedPayload(
+				t,
+				"example-org/example",
+				"feature/foo",
+				"main",
+			),
+			emitted: true,
+		},
+		{
+			name: "event type not subject to ref filters",
+			payload: func() interface{} {
+				p := bitbucket.RepoForkPayload{}
+				p.Repository.FullName = "example-org/example"
+				return p
+			}(),
+			emitted: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var emitted bool
+			s := NewService(
+				&sdkTesting.MockEventsClient{
+					CreateFn: func(
+						context.Context,
+						sdk.Event,
+						*sdk.EventCreateOptions,
+					) (sdk.EventList, error) {
+						emitted = true
+						return sdk.EventList{}, nil
+					},
+				},
+				config,
+			)
+			_, err := s.Handle(context.Background(), testCase.payload)
+			require.NoError(t, err)
+			require.Equal(t, testCase.emitted, emitted)
+		})
+	}
+}
+
+func TestServiceHandleWithProjectMappings(t *testing.T) {
+	config := ServiceConfig{
+		ProjectMappings: []ProjectMapping{
+			{
+				Repo:    "example-org/*",
+				Project: "example",
+			},
+		},
+	}
+	testCases := []struct {
+		name      string
+		ctx       context.Context
+		repo      string
+		projectID string
+	}{
+		{
+			name:      "no mapping applies",
+			ctx:       context.Background(),
+			repo:      "another-org/example",
+			projectID: "",
+		},
+		{
+			name:      "mapping applies",
+			ctx:       context.Background(),
+			repo:      "example-org/example",
+			projectID: "example",
+		},
+		{
+			name:      "project ID in context takes precedence",
+			ctx:       ContextWithProjectID(context.Background(), "explicit"),
+			repo:      "example-org/example",
+			projectID: "explicit",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			s := NewService(
+				&sdkTesting.MockEventsClient{
+					CreateFn: func(
+						_ context.Context,
+						event sdk.Event,
+						_ *sdk.EventCreateOptions,
+					) (sdk.EventList, error) {
+						require.Equal(t, testCase.projectID, event.ProjectID)
+						return sdk.EventList{}, nil
+					},
+				},
+				config,
+			)
+			payload := bitbucket.RepoForkPayload{}
+			payload.Repository.FullName = testCase.repo
+			_, err := s.Handle(testCase.ctx, payload)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestServiceHandleWithTenants(t *testing.T) {
+	var emittedBy string
+	tenantClient := func(name string) sdk.EventsClient {
+		return &sdkTesting.MockEventsClient{
+			CreateFn: func(
+				context.Context,
+				sdk.Event,
+				*sdk.EventCreateOptions,
+			) (sdk.EventList, error) {
+				emittedBy = name
+				return sdk.EventList{}, nil
+			},
+		}
+	}
+	s := NewService(
+		nil,
+		ServiceConfig{
+			TenantEventsClients: map[string]sdk.EventsClient{
+				"example-org": tenantClient("example-org"),
+				"another-org": tenantClient("another-org"),
+			},
+		},
+	)
+	testCases := []struct {
+		name       string
+		repo       string
+		assertions func(error)
+	}{
+		{
+			name: "known workspace",
+			repo: "another-org/example",
+			assertions: func(err error) {
+				require.NoError(t, err)
+				require.Equal(t, "another-org", emittedBy)
+			},
+		},
+		{
+			name: "unknown workspace",
+			repo: "unknown-org/example",
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.IsType(t, &UnknownWorkspaceError{}, err)
+				require.Equal(
+					t,
+					"unknown-org",
+					err.(*UnknownWorkspaceError).Workspace,
+				)
+				require.Empty(t, emittedBy)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			emittedBy = ""
+			payload := bitbucket.RepoForkPayload{}
+			payload.Repository.FullName = testCase.repo
+			_, err := s.Handle(context.Background(), payload)
+			testCase.assertions(err)
+		})
+	}
+}
+
+func TestServiceHandleWithChangedPaths(t *testing.T) {
+	// A stand-in for the Bitbucket API's diffstat endpoint
+	var diffstatRequests int
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			diffstatRequests++
+			switch r.URL.Path {
+			case "/2.0/repositories/example-org/example/diffstat/1234567..7654321":
+				fmt.Fprint(
+					w,
+					`{"values":[{"old":{"path":"foo"},"new":{"path":"bar/baz"}}]}`,
+				)
+			case "/2.0/repositories/example-org/example/diffstat/abcdef0..1234567":
+				fmt.Fprint(
+					w,
+					`{"values":[{"old":{"path":"foo"},"new":{"path":"qux"}}]}`,
+				)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer server.Close()
+	var payload string
+	s := NewService(
+		&sdkTesting.MockEventsClient{
+			CreateFn: func(
+				_ context.Context,
+				event sdk.Event,
+				_ *sdk.EventCreateOptions,
+			) (sdk.EventList, error) {
+				payload = event.Payload
+				return sdk.EventList{}, nil
+			},
+		},
+		ServiceConfig{
+			ChangedPaths: NewCachingChangedPathsLister(
+				bitbucketAPI.NewClient(
+					bitbucketAPI.ClientConfig{APIAddress: server.URL},
+				),
+				10,
+			),
+		},
+	)
+	pullRequest := pullRequestCreatedPayload(
+		t,
+		"example-org/example",
+		"feature",
+		"main",
+	)
+	pullRequest.PullRequest.Destination.Commit.Hash = "7654321"
+	push := pushPayload(t, "example-org/example", "branch", "main")
+	push.Push.Changes[0].Old.Target.Hash = "7654321"
+	testCases := []struct {
+		name             string
+		payload          interface{}
+		changedPaths     []string
+		diffstatRequests int
+	}{
+		{
+			name:             "pull request",
+			payload:          pullRequest,
+			changedPaths:     []string{"bar/baz", "foo"},
+			diffstatRequests: 1,
+		},
+		{
+			name:         "push of the same commit range",
+			payload:      push,
+			changedPaths: []string{"bar/baz", "foo"},
+			// The paths changed by the pull request were cached
+			diffstatRequests: 1,
+		},
+		{
+			name: "push of an unknown commit range",
+			payload: func() bitbucket.RepoPushPayload {
+				p := pushPayload(t, "example-org/example", "branch", "main")
+				p.Push.Changes[0].Old.Target.Hash = "0000000"
+				return p
+			}(),
+			// The event is still emitted, just without changed paths
+			diffstatRequests: 2,
+		},
+		{
+			name: "push creating a branch",
+			payload: pushPayload(
+				t,
+				"example-org/example",
+				"branch",
+				"feature",
+			),
+			diffstatRequests: 2,
+		},
+		{
+			name:    "push updating several branches",
+			payload: multiChangePushPayload(t, "example-org/example"),
+			// The paths changed by every change are combined
+			changedPaths: []string{"bar/baz", "foo", "qux"},
+			// The paths changed by the first change were cached
+			diffstatRequests: 3,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			payload = ""
+			_, err := s.Handle(context.Background(), testCase.payload)
+			require.NoError(t, err)
+			require.Equal(t, testCase.diffstatRequests, diffstatRequests)
+			enriched := struct {
+				ChangedPaths []string `json:"changed_paths"`
+			}{}
+			require.NoError(t, json.Unmarshal([]byte(payload), &enriched))
+			require.Equal(t, testCase.changedPaths, enriched.ChangedPaths)
+		})
+	}
+}
+
+func TestServiceHandleWithPathFilters(t *testing.T) {
+	var listErr error
+	config := ServiceConfig{
+		ChangedPaths: mockChangedPathsLister(
+			func(_ context.Context, _ string, spec string) ([]string, error) {
+				if spec == "abcdef0..1234567" {
+					return []string{"services/orders/main.go"}, listErr
+				}
+				return []string{
+					"services/billing/main.go",
+					"services/orders/README.md",
+				}, listErr
+			},
+		),
+		PathFilters: []PathFilter{
+			{
+				Repo:    "example-org/monorepo",
+				Exclude: []string{"**/*.md"},
+				Components: []Component{
+					{Name: "billing", Paths: []string{"services/billing/**"}},
+					{Name: "orders", Paths: []string{"services/orders/**"}},
+				},
+			},
+			{
+				Repo:    "example-org/*",
+				Include: []string{"docs/**"},
+			},
+		},
+	}
+	pullRequest := func(repo string) bitbucket.PullRequestCreatedPayload {
+		p := pullRequestCreatedPayload(t, repo, "feature", "main")
+		p.PullRequest.Destination.Commit.Hash = "7654321"
+		return p
+	}
+	testCases := []struct {
+		name       string
+		payload    interface{}
+		listErr    error
+		failing    []string
+		components []string
+		assertions func(error)
+	}{
+		{
+			name:       "not subject to path filters",
+			payload:    pullRequest("another-org/example"),
+			components: []string{""},
+		},
+		{
+			name: "does not pertain to changes",
+			payload: func() bitbucket.RepoForkPayload {
+				p := bitbucket.RepoForkPayload{}
+				p.Repository.FullName = "example-org/example"
+				return p
+			}(),
+			components: []string{""},
+		},
+		{
+			name:    "excluded by path filters",
+			payload: pullRequest("example-org/example"),
+		},
+		{
+			name:       "one event per affected component",
+			payload:    pullRequest("example-org/monorepo"),
+			components: []string{"billing"},
+		},
+		{
+			name:       "changed paths unknown",
+			payload:    pullRequest("example-org/monorepo"),
+			listErr:    errors.New("something went wrong"),
+			components: []string{"billing", "orders"},
+		},
+		{
+			name:    "push updating several branches",
+			payload: multiChangePushPayload(t, "example-org/monorepo"),
+			// Paths changed by every change are considered
+			components: []string{"billing", "orders"},
+		},
+		{
+			name:    "error emitting event for one component",
+			payload: multiChangePushPayload(t, "example-org/monorepo"),
+			failing: []string{"billing"},
+			// The event for the other component is still emitted
+			components: []string{"orders"},
+		},
+		{
+			name:    "error emitting events for every component",
+			payload: multiChangePushPayload(t, "example-org/monorepo"),
+			failing: []string{"billing", "orders"},
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "component(s) billing, orders")
+				require.Contains(t, err.Error(), "something went wrong")
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			listErr = testCase.listErr
+			var components []string
+			s := NewService(
+				&sdkTesting.MockEventsClient{
+					CreateFn: func(
+						_ context.Context,
+						event sdk.Event,
+						_ *sdk.EventCreateOptions,
+					) (sdk.EventList, error) {
+						component := event.Qualifiers["component"]
+						for _, failing := range testCase.failing {
+							if component == failing {
+								return sdk.EventList{}, errors.New("something went wrong")
+							}
+						}
+						components = append(components, component)
+						return sdk.EventList{Items: []sdk.Event{event}}, nil
+					},
+				},
+				config,
+			)
+			events, err := s.Handle(context.Background(), testCase.payload)
+			if testCase.assertions != nil {
+				testCase.assertions(err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, testCase.components, components)
+			require.Len(t, events.Items, len(testCase.components))
+		})
+	}
+}
+
+// pushPayload returns a bitbucket.RepoPushPayload for a push to the specified
+// ref of the specified repository.
+func pushPayload(
+	t *testing.T,
+	repo string,
+	refType string,
+	refName string,
+) bitbucket.RepoPushPayload {
+	payload := bitbucket.RepoPushPayload{}
+	unmarshalPayload(
+		t,
+		map[string]interface{}{
+			"repository": map[string]interface{}{"full_name": repo},
+			"push": map[string]interface{}{
+				"changes": []interface{}{
+					map[string]interface{}{
+						"new": map[string]interface{}{
+							"type":   refType,
+							"name":   refName,
+							"target": map[string]interface{}{"hash": "1234567"},
+						},
+					},
+				},
+			},
+		},
+		&payload,
+	)
+	return payload
+}
+
+// multiChangePushPayload returns a bitbucket.RepoPushPayload for a push to the
+// specified repository that updated two branches, from 7654321 to 1234567 and
+// from 1234567 to abcdef0, respectively.
+func multiChangePushPayload(
+	t *testing.T,
+	repo string,
+) bitbucket.RepoPushPayload {
+	payload := pushPayload(t, repo, "branch", "main")
+	payload.Push.Changes[0].Old.Target.Hash = "7654321"
+	change := payload.Push.Changes[0]
+	change.New.Name = "feature"
+	change.New.Target.Hash = "abcdef0"
+	change.Old.Target.Hash = "1234567"
+	payload.Push.Changes = append(payload.Push.Changes, change)
+	return payload
+}
+
+// pullRequestCreatedPayload returns a bitbucket.PullRequestCreatedPayload for
+// a pull request from the specified source branch into the specified
+// destination branch of the specified repository.
+func pullRequestCreatedPayload(
+	t *testing.T,
+	repo string,
+	sourceBranch string,
+	destinationBranch string,
+) bitbucket.PullRequestCreatedPayload {
+	payload := bitbucket.PullRequestCreatedPayload{}
+	unmarshalPayload(
+		t,
+		map[string]interface{}{
+			"repository": map[string]interface{}{"full_name": repo},
+			"pullrequest": map[string]interface{}{
+				"source": map[string]interface{}{
+					"branch": map[string]interface{}{"name": sourceBranch},
+					"commit": map[string]interface{}{"hash": "1234567"},
+				},
+				"destination": map[string]interface{}{
+					"branch": map[string]interface{}{"name": destinationBranch},
+				},
+			},
+		},
+		&payload,
+	)
+	return payload
+}
+
+// unmarshalPayload populates the provided payload from the JSON representation
+// of the provided object.
+func unmarshalPayload(t *testing.T, obj interface{}, payload interface{}) {
+	payloadJSON, err := json.Marshal(obj)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(payloadJSON, payload))
 }
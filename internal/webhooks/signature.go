@@ -0,0 +1,40 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// signatureHeader is the header in which Bitbucket conveys the signature of a
+// webhook whose secret has been configured.
+const signatureHeader = "X-Hub-Signature"
+
+// verifySignature verifies that the provided signature, in the form
+// sha256=<hex-encoded HMAC>, is that of the provided webhook body using the
+// provided secret.
+func verifySignature(secret string, signature string, body []byte) error {
+	if signature == "" {
+		return errors.Errorf("webhook has no %s header", signatureHeader)
+	}
+	hexSum := strings.TrimPrefix(signature, "sha256=")
+	if hexSum == signature {
+		return errors.Errorf(
+			"%s header does not contain a SHA-256 signature",
+			signatureHeader,
+		)
+	}
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return errors.Wrapf(err, "error decoding %s header", signatureHeader)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body) // nolint: errcheck
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return errors.New("webhook signature is invalid")
+	}
+	return nil
+}
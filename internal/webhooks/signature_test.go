@@ -0,0 +1,73 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sign returns the value of the X-Hub-Signature header Bitbucket would send
+// with the provided body when the webhook's secret is the provided secret.
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body)) // nolint: errcheck
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	const body = `{"repository":{"full_name":"example-org/example"}}`
+	testCases := []struct {
+		name       string
+		signature  string
+		assertions func(error)
+	}{
+		{
+			name: "no signature",
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "no X-Hub-Signature header")
+			},
+		},
+		{
+			name:      "not a SHA-256 signature",
+			signature: "sha1=abc",
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "does not contain a SHA-256")
+			},
+		},
+		{
+			name:      "signature not hex-encoded",
+			signature: "sha256=xyz",
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "error decoding")
+			},
+		},
+		{
+			name:      "wrong secret",
+			signature: sign("wrong", body),
+			assertions: func(err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "signature is invalid")
+			},
+		},
+		{
+			name:      "success",
+			signature: sign("secret", body),
+			assertions: func(err error) {
+				require.NoError(t, err)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.assertions(
+				verifySignature("secret", testCase.signature, []byte(body)),
+			)
+		})
+	}
+}
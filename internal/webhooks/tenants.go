@@ -0,0 +1,24 @@
+package webhooks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnknownWorkspaceError is returned by a Service that routes events to
+// different Brigade API servers by Bitbucket workspace when it receives a
+// webhook pertaining to a workspace it has no API server for.
+type UnknownWorkspaceError struct {
+	// Workspace is the Bitbucket workspace that the webhook pertained to.
+	Workspace string
+}
+
+func (u *UnknownWorkspaceError) Error() string {
+	return fmt.Sprintf("no tenant is configured for workspace %q", u.Workspace)
+}
+
+// workspaceOf returns the Bitbucket workspace (e.g. example-org) portion of the
+// provided repository full name (e.g. example-org/example).
+func workspaceOf(repo string) string {
+	return strings.SplitN(repo, "/", 2)[0]
+}
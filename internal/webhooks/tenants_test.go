@@ -0,0 +1,22 @@
+package webhooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownWorkspaceError(t *testing.T) {
+	err := &UnknownWorkspaceError{Workspace: "example-org"}
+	require.Equal(
+		t,
+		`no tenant is configured for workspace "example-org"`,
+		err.Error(),
+	)
+}
+
+func TestWorkspaceOf(t *testing.T) {
+	require.Equal(t, "example-org", workspaceOf("example-org/example"))
+	require.Equal(t, "example-org", workspaceOf("example-org"))
+	require.Equal(t, "", workspaceOf(""))
+}
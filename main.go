@@ -1,51 +1,288 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/admin"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/bitbucket"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/brigade"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/connect"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/ipfilter"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/polling"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/readiness"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/relay"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/server"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/subscriptions"
 	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
 	libHTTP "github.com/brigadecore/brigade-foundations/http"
 	"github.com/brigadecore/brigade-foundations/signals"
 	"github.com/brigadecore/brigade-foundations/version"
 	"github.com/brigadecore/brigade/sdk/v3"
+	"github.com/brigadecore/brigade/sdk/v3/restmachinery"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 )
 
 func main() {
 
+	if err := applyConfigFile(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(signals.Context(), os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "relay" {
+		if err := runRelay(signals.Context(), os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		if err := doctor(signals.Context(), os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.Printf(
 		"Starting Brigade Bitbucket Gateway -- version %s -- commit %s",
 		version.Version(),
 		version.Commit(),
 	)
 
-	var webhooksService webhooks.Service
+	if err := validateConfig(); err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := signals.Context()
+
+	webhooksService, eventsClients, err := newService(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var readinessChecker readiness.Checker
 	{
-		address, token, opts, err := apiClientConfig()
+		config, err := readinessCheckerConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
-		webhooksService = webhooks.NewService(
-			sdk.NewEventsClient(address, token, &opts),
-		)
+		// A tenant's Brigade API server being unavailable should not prevent the
+		// gateway from emitting events on behalf of other tenants, so tenants'
+		// checks are non-critical.
+		checks := map[string]readiness.Check{}
+		tenantChecks := map[string]readiness.Check{}
+		for workspace, eventsClient := range eventsClients {
+			if checker, ok := eventsClient.(brigade.APIChecker); ok {
+				if workspace == "" {
+					checks["brigadeAPI"] = checker.CheckAPI
+				} else {
+					tenantChecks["brigadeAPI/"+workspace] = checker.CheckAPI
+				}
+			}
+		}
+		readinessChecker = readiness.NewChecker(config, checks, tenantChecks)
+		go readinessChecker.Run(ctx)
 	}
 
-	var ipFilter libHTTP.Filter
+	var ipFilter ipfilter.Filter
 	{
 		config, err := ipFilterConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
-		ipFilter = libHTTP.NewIPFilter(config)
+		if len(config.TrustedProxies) == 0 {
+			log.Println(
+				"No trusted proxies are configured; the X-Forwarded-For header " +
+					"will be trusted unconditionally when determining client IPs",
+			)
+		}
+		ipFilter = ipfilter.New(config)
+		refreshEnabled, refresherConfig, err := ipRangesRefresherConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if refreshEnabled {
+			// Statically configured ranges remain permitted after every refresh.
+			refresherConfig.AdditionalRanges = config.AllowedRanges
+			go ipfilter.NewRefresher(refresherConfig, ipFilter).Run(ctx)
+		}
 	}
 
-	webhooksHandler, err := webhooks.NewHandler(webhooksService)
+	adminEnabled, adminToken, adminMaxDeliveries, err := adminConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var server libHTTP.Server
+	var recentDeliveries webhooks.RecentDeliveries
+	var webhooksHandler http.Handler
+	var connectApp http.Handler
+	{
+		archives := []webhooks.DeliveryArchive{}
+		archiveEnabled, archiveConfig, err := deliveryArchiveConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if archiveEnabled {
+			var archive webhooks.DeliveryArchive
+			archive, err = webhooks.NewDirectoryArchive(archiveConfig)
+			if err != nil {
+				log.Fatal(err)
+			}
+			archives = append(archives, archive)
+		}
+		if adminEnabled {
+			recentDeliveries = webhooks.NewRecentDeliveries(adminMaxDeliveries)
+			archives = append(archives, recentDeliveries)
+		}
+		handlerConfig := webhooks.HandlerConfig{Secret: webhookSecretConfig()}
+		if len(archives) > 0 {
+			handlerConfig.Archive = webhooks.NewMultiArchive(archives...)
+		}
+		rateLimitEnabled, rateLimiterConfig, err := rateLimiterConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rateLimitEnabled {
+			handlerConfig.RateLimiter = webhooks.NewRateLimiter(rateLimiterConfig)
+		}
+		if webhooksHandler, err =
+			webhooks.NewHandler(webhooksService, handlerConfig); err != nil {
+			log.Fatal(err)
+		}
+		connectEnabled, appConfig, err := connectConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if connectEnabled {
+			// Webhooks sent to the app are authenticated using JWTs instead of
+			// signatures.
+			handlerConfig.Secret = ""
+			var appWebhooksHandler http.Handler
+			if appWebhooksHandler, err =
+				webhooks.NewHandler(webhooksService, handlerConfig); err != nil {
+				log.Fatal(err)
+			}
+			if connectApp, err =
+				connect.NewApp(appConfig, appWebhooksHandler); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	{
+		registrationEnabled, reconcilerConfig, err := webhookRegistrationConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if registrationEnabled {
+			var clientConfig bitbucket.ClientConfig
+			if clientConfig, err = bitbucketClientConfig(); err != nil {
+				log.Fatal(err)
+			}
+			if reconcilerConfig.Secret == "" {
+				log.Println(
+					"No webhook secret is configured; registered webhooks will not " +
+						"be signed",
+				)
+			}
+			go bitbucket.NewReconciler(
+				reconcilerConfig,
+				bitbucket.NewClient(clientConfig),
+			).Run(ctx)
+		}
+	}
+
+	var auditor subscriptions.Auditor
+	{
+		auditEnabled, auditorConfig, reconcilerConfig, err :=
+			subscriptionAuditConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if auditEnabled {
+			var clientConfig bitbucket.ClientConfig
+			if clientConfig, err = bitbucketClientConfig(); err != nil {
+				log.Fatal(err)
+			}
+			listers := map[string]brigade.ProjectLister{}
+			for workspace, eventsClient := range eventsClients {
+				lister, ok := eventsClient.(brigade.ProjectLister)
+				if !ok {
+					log.Fatal(
+						"subscription auditing is not supported by the configured " +
+							"Brigade API client",
+					)
+				}
+				listers[workspace] = lister
+			}
+			client := bitbucket.NewClient(clientConfig)
+			auditor = subscriptions.NewAuditor(
+				auditorConfig,
+				listers,
+				client,
+				bitbucket.NewReconciler(reconcilerConfig, client),
+			)
+			go auditor.Run(ctx)
+		}
+	}
+
+	{
+		pollingEnabled, pollerConfig, err := pollingConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pollingEnabled {
+			var clientConfig bitbucket.ClientConfig
+			if clientConfig, err = bitbucketClientConfig(); err != nil {
+				log.Fatal(err)
+			}
+			var replayer webhooks.Replayer
+			if replayer, err = webhooks.NewReplayer(webhooksService); err != nil {
+				log.Fatal(err)
+			}
+			var poller polling.Poller
+			if poller, err = polling.NewPoller(
+				pollerConfig,
+				bitbucket.NewClient(clientConfig),
+				replayer,
+			); err != nil {
+				log.Fatal(err)
+			}
+			go poller.Run(ctx)
+		}
+	}
+
+	{
+		relayEnabled, clientConfig, err := relayConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if relayEnabled {
+			// Relayed webhooks have already been subject to the relay server's IP
+			// filter.
+			router := mux.NewRouter()
+			router.StrictSlash(true)
+			router.Handle("/events", webhooksHandler).Methods(http.MethodPost)
+			router.Handle(
+				"/events/projects/{projectID}",
+				webhooksHandler,
+			).Methods(http.MethodPost)
+			go relay.NewClient(clientConfig, router).Run(ctx)
+		}
+	}
+
+	var httpServer server.Server
 	{
 		router := mux.NewRouter()
 		router.StrictSlash(true)
@@ -53,15 +290,194 @@ func main() {
 			"/events",
 			ipFilter.Decorate(webhooksHandler.ServeHTTP),
 		).Methods(http.MethodPost)
+		router.Handle(
+			"/events/projects/{projectID}",
+			ipFilter.Decorate(webhooksHandler.ServeHTTP),
+		).Methods(http.MethodPost)
+		if connectApp != nil {
+			router.PathPrefix("/connect/").Handler(
+				ipFilter.Decorate(connectApp.ServeHTTP),
+			)
+		}
+		if adminEnabled {
+			replayer, err := webhooks.NewReplayer(webhooksService)
+			if err != nil {
+				log.Fatal(err)
+			}
+			adminAPI := admin.NewAPI(recentDeliveries, replayer)
+			tokenFilter := admin.NewTokenFilter(adminToken)
+			router.HandleFunc(
+				"/admin/deliveries",
+				tokenFilter.Decorate(adminAPI.ListDeliveries),
+			).Methods(http.MethodGet)
+			router.HandleFunc(
+				"/admin/deliveries/{uuid}/redeliver",
+				tokenFilter.Decorate(adminAPI.Redeliver),
+			).Methods(http.MethodPost)
+			router.HandleFunc(
+				"/admin/readiness",
+				tokenFilter.Decorate(readinessChecker.ServeReport),
+			).Methods(http.MethodGet)
+			router.HandleFunc(
+				"/admin/metrics",
+				tokenFilter.Decorate(expvar.Handler().ServeHTTP),
+			).Methods(http.MethodGet)
+			if auditor != nil {
+				router.HandleFunc(
+					"/admin/subscriptions",
+					tokenFilter.Decorate(auditor.ServeHTTP),
+				).Methods(http.MethodGet)
+			}
+		}
 		router.HandleFunc("/healthz", libHTTP.Healthz).Methods(http.MethodGet)
+		router.Handle("/readyz", readinessChecker).Methods(http.MethodGet)
 		serverConfig, err := serverConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
-		server = libHTTP.NewServer(router, &serverConfig)
+		httpServer = server.New(router, &serverConfig)
 	}
 
 	log.Println(
-		server.ListenAndServe(signals.Context()),
+		httpServer.ListenAndServe(ctx),
 	)
 }
+
+// newService returns the webhooks.Service that should be used for handling
+// webhooks (events) from Bitbucket, along with the sdk.EventsClients the
+// service emits events with. These are keyed by the Bitbucket workspace whose
+// events each emits or, if no tenants are configured, by the empty string. Any
+// background work the service's dependencies perform continues until the
+// provided context is canceled.
+func newService(
+	ctx context.Context,
+) (webhooks.Service, map[string]sdk.EventsClient, error) {
+	config, err := serviceConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	changedPathsEnabled, cacheSize, err := changedPathsConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	if changedPathsEnabled {
+		var clientConfig bitbucket.ClientConfig
+		if clientConfig, err = bitbucketClientConfig(); err != nil {
+			return nil, nil, err
+		}
+		log.Println(
+			"Paths changed by pull requests and pushes will be added to event " +
+				"payloads",
+		)
+		config.ChangedPaths = webhooks.NewCachingChangedPathsLister(
+			bitbucket.NewClient(clientConfig),
+			cacheSize,
+		)
+	}
+	if config.TenantEventsClients, err = newTenantEventsClients(); err != nil {
+		return nil, nil, err
+	}
+	if len(config.TenantEventsClients) > 0 {
+		// Every event is emitted using one of the tenants' clients, so no default
+		// client is required.
+		return webhooks.NewService(nil, config), config.TenantEventsClients, nil
+	}
+	eventsClient, err := newEventsClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return webhooks.NewService(eventsClient, config),
+		map[string]sdk.EventsClient{"": eventsClient},
+		nil
+}
+
+// newEventsClient returns the sdk.EventsClient that should be used for emitting
+// events into Brigade's event bus.
+func newEventsClient(ctx context.Context) (sdk.EventsClient, error) {
+	dryRun, err := dryRunConfig()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		log.Println(
+			"Dry run mode is enabled; events will be logged instead of " +
+				"being emitted into Brigade",
+		)
+		return brigade.NewDryRunEventsClient(), nil
+	}
+	address, token, opts, err := apiClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	newClient, err :=
+		brigade.NewEventsClientFactory(address, opts, apiClientTLSConfig())
+	if err != nil {
+		return nil, err
+	}
+	tokenFileEnabled, tokenFileConfig, err := apiTokenFileConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tokenFileEnabled {
+		log.Printf("API token will be read from %s", tokenFileConfig.Path)
+		return brigade.NewTokenFileEventsClient(ctx, tokenFileConfig, newClient)
+	}
+	return newClient(token), nil
+}
+
+// newTenantEventsClients returns a map of Bitbucket workspaces to the
+// sdk.EventsClients that should be used for emitting events for repositories in
+// each into distinct Brigade installations. If no tenants are configured, an
+// empty map is returned.
+func newTenantEventsClients() (map[string]sdk.EventsClient, error) {
+	tenants, err := tenantsConfig()
+	if err != nil {
+		return nil, err
+	}
+	eventsClients := map[string]sdk.EventsClient{}
+	if len(tenants) == 0 {
+		return eventsClients, nil
+	}
+	dryRun, err := dryRunConfig()
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		log.Println(
+			"Dry run mode is enabled; events for all tenants will be logged " +
+				"instead of being emitted into Brigade",
+		)
+	}
+	for _, tenant := range tenants {
+		log.Printf(
+			"Events for workspace %s will be emitted into Brigade at %s",
+			tenant.Workspace,
+			tenant.APIAddress,
+		)
+		if dryRun {
+			eventsClients[tenant.Workspace] = brigade.NewDryRunEventsClient()
+			continue
+		}
+		var newClient func(apiToken string) sdk.EventsClient
+		newClient, err = brigade.NewEventsClientFactory(
+			tenant.APIAddress,
+			restmachinery.APIClientOptions{
+				AllowInsecureConnections: tenant.APIIgnoreCertWarnings,
+			},
+			brigade.TLSConfig{
+				CACertPath:     tenant.APICACertPath,
+				ClientCertPath: tenant.APIClientCertPath,
+				ClientKeyPath:  tenant.APIClientKeyPath,
+			},
+		)
+		if err != nil {
+			return nil, errors.Wrapf(
+				err,
+				"error configuring client for workspace %s",
+				tenant.Workspace,
+			)
+		}
+		eventsClients[tenant.Workspace] = newClient(tenant.APIToken)
+	}
+	return eventsClients, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/ipfilter"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/relay"
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/server"
+	libHTTP "github.com/brigadecore/brigade-foundations/http"
+	"github.com/brigadecore/brigade-foundations/version"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// runRelay implements the relay subcommand, which runs a minimal relay server
+// that accepts webhooks from Bitbucket on behalf of a gateway that cannot
+// receive them directly and relays each to the gateway over a connection the
+// gateway initiates.
+func runRelay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("relay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(
+			flags.Output(),
+			"Usage: bitbucket-gateway relay\n\n"+
+				"Runs a relay server that accepts webhooks from Bitbucket and "+
+				"relays them to a gateway\nconfigured to receive them from it.\n",
+		)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("the relay subcommand does not accept arguments")
+	}
+
+	log.Printf(
+		"Starting Brigade Bitbucket Gateway relay server -- version %s -- "+
+			"commit %s",
+		version.Version(),
+		version.Commit(),
+	)
+
+	handler, err := newRelayHandler()
+	if err != nil {
+		return err
+	}
+	serverConfig, err := serverConfig()
+	if err != nil {
+		return err
+	}
+	return server.New(handler, &serverConfig).ListenAndServe(ctx)
+}
+
+// newRelayHandler returns the http.Handler that serves the relay subcommand's
+// relay server. Webhooks from Bitbucket are subject to the same IP filter as
+// webhooks sent directly to the gateway.
+func newRelayHandler() (http.Handler, error) {
+	relayConfig, err := relayServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	ipConfig, err := ipFilterConfig()
+	if err != nil {
+		return nil, err
+	}
+	ipFilter := ipfilter.New(ipConfig)
+	relayServer := relay.NewServer(relayConfig)
+	router := mux.NewRouter()
+	router.StrictSlash(true)
+	router.Handle(
+		"/events",
+		ipFilter.Decorate(relayServer.ServeHTTP),
+	).Methods(http.MethodPost)
+	router.Handle(
+		"/events/projects/{projectID}",
+		ipFilter.Decorate(relayServer.ServeHTTP),
+	).Methods(http.MethodPost)
+	router.PathPrefix("/tunnel/").Handler(relayServer)
+	router.HandleFunc("/healthz", libHTTP.Healthz).Methods(http.MethodGet)
+	return router, nil
+}
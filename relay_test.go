@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunRelay(t *testing.T) {
+	err := runRelay(context.Background(), []string{"foo"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not accept arguments")
+}
+
+func TestNewRelayHandler(t *testing.T) {
+	testCases := []struct {
+		name       string
+		setup      func()
+		assertions func(http.Handler, error)
+	}{
+		{
+			name: "RELAY_SERVER_TOKEN not defined",
+			assertions: func(_ http.Handler, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "RELAY_SERVER_TOKEN")
+			},
+		},
+		{
+			name: "ALLOWED_CLIENT_IPS invalid",
+			setup: func() {
+				t.Setenv("RELAY_SERVER_TOKEN", "foo")
+				t.Setenv("ALLOWED_CLIENT_IPS", "bogus")
+			},
+			assertions: func(_ http.Handler, err error) {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), "ALLOWED_CLIENT_IPS")
+			},
+		},
+		{
+			name: "success",
+			setup: func() {
+				t.Setenv("ALLOWED_CLIENT_IPS", "10.0.0.0/8")
+			},
+			assertions: func(handler http.Handler, err error) {
+				require.NoError(t, err)
+				// Webhooks are subject to the IP filter
+				req := httptest.NewRequest(http.MethodPost, "/events", nil)
+				req.RemoteAddr = "192.168.0.1:12345"
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				require.Equal(t, http.StatusForbidden, rr.Code)
+				// The tunnel is not subject to the IP filter
+				req = httptest.NewRequest(
+					http.MethodGet,
+					"/tunnel/deliveries?wait=0s",
+					nil,
+				)
+				req.RemoteAddr = "192.168.0.1:12345"
+				req.Header.Set("Authorization", "Bearer foo")
+				rr = httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				require.Equal(t, http.StatusNoContent, rr.Code)
+				rr = httptest.NewRecorder()
+				handler.ServeHTTP(
+					rr,
+					httptest.NewRequest(http.MethodGet, "/healthz", nil),
+				)
+				require.Equal(t, http.StatusOK, rr.Code)
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if testCase.setup != nil {
+				testCase.setup()
+			}
+			testCase.assertions(newRelayHandler())
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/pkg/errors"
+)
+
+// replayFilter encapsulates criteria used for selecting which captured
+// deliveries should be replayed.
+type replayFilter struct {
+	// eventKeys are patterns (e.g. pullrequest:*) matched against a delivery's
+	// event key. If empty, deliveries with any event key are selected.
+	eventKeys []string
+	// repos are patterns (e.g. example-org/*) matched against the full name of
+	// the repository a delivery pertains to. If empty, deliveries pertaining to
+	// any repository are selected.
+	repos []string
+	// since, if non-zero, excludes deliveries received before this time.
+	since time.Time
+	// until, if non-zero, excludes deliveries received after this time.
+	until time.Time
+}
+
+// matches returns a bool indicating whether the provided delivery satisfies
+// all the filter's criteria.
+func (r replayFilter) matches(delivery webhooks.Delivery) bool {
+	if !r.since.IsZero() && delivery.ReceivedAt.Before(r.since) {
+		return false
+	}
+	if !r.until.IsZero() && delivery.ReceivedAt.After(r.until) {
+		return false
+	}
+	return matchesAny(r.eventKeys, delivery.EventKey()) &&
+		matchesAny(r.repos, delivery.Repo())
+}
+
+// matchesAny returns true if patterns is empty or if the provided value matches
+// at least one of the patterns.
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// replay implements the replay subcommand, which pushes previously captured
+// deliveries through the same code path as webhooks received live from
+// Bitbucket.
+func replay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(
+			flags.Output(),
+			"Usage: bitbucket-gateway replay [options] <file or directory>...\n\n"+
+				"Replays captured webhook deliveries against the configured "+
+				"Brigade API server.\n\nOptions:\n",
+		)
+		flags.PrintDefaults()
+	}
+	eventKeys := flags.String(
+		"event-key",
+		"",
+		"comma-separated list of event key patterns, e.g. pullrequest:*",
+	)
+	repos := flags.String(
+		"repo",
+		"",
+		"comma-separated list of repository patterns, e.g. example-org/*",
+	)
+	since := flags.String(
+		"since",
+		"",
+		"only replay deliveries received at or after this RFC 3339 timestamp",
+	)
+	until := flags.String(
+		"until",
+		"",
+		"only replay deliveries received at or before this RFC 3339 timestamp",
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no files or directories were specified")
+	}
+
+	filter := replayFilter{
+		eventKeys: splitList(*eventKeys),
+		repos:     splitList(*repos),
+	}
+	var err error
+	if filter.since, err = parseOptionalTime("since", *since); err != nil {
+		return err
+	}
+	if filter.until, err = parseOptionalTime("until", *until); err != nil {
+		return err
+	}
+
+	deliveries, err := loadDeliveries(flags.Args())
+	if err != nil {
+		return err
+	}
+
+	service, _, err := newService(ctx)
+	if err != nil {
+		return err
+	}
+	replayer, err := webhooks.NewReplayer(service)
+	if err != nil {
+		return err
+	}
+
+	var replayed, failed int
+	for _, delivery := range deliveries {
+		if !filter.matches(delivery.Delivery) {
+			continue
+		}
+		events, replayErr := replayer.Replay(ctx, delivery.Delivery)
+		if replayErr != nil {
+			log.Printf("error replaying %s: %s", delivery.file, replayErr)
+			failed++
+			continue
+		}
+		eventIDs := make([]string, len(events.Items))
+		for i, event := range events.Items {
+			eventIDs[i] = event.ID
+		}
+		log.Printf(
+			"replayed %s (%s %s): event IDs %v",
+			delivery.file,
+			delivery.EventKey(),
+			delivery.Repo(),
+			eventIDs,
+		)
+		replayed++
+	}
+	log.Printf("replayed %d deliveries; %d failed", replayed, failed)
+	if failed > 0 {
+		return errors.Errorf("%d deliveries could not be replayed", failed)
+	}
+	return nil
+}
+
+// capturedDelivery is a webhooks.Delivery along with the path of the file it
+// was loaded from.
+type capturedDelivery struct {
+	webhooks.Delivery
+	file string
+}
+
+// loadDeliveries loads captured deliveries from the specified files and/or,
+// recursively, from all JSON files in the specified directories. Deliveries are
+// returned in the order in which they were originally received.
+func loadDeliveries(paths []string) ([]capturedDelivery, error) {
+	deliveries := []capturedDelivery{}
+	for _, p := range paths {
+		err := filepath.WalkDir(
+			p,
+			func(file string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if entry.IsDir() ||
+					(file != p && filepath.Ext(file) != ".json") {
+					return nil
+				}
+				delivery, err := loadDelivery(file)
+				if err != nil {
+					return err
+				}
+				deliveries = append(deliveries, delivery)
+				return nil
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].ReceivedAt.Before(deliveries[j].ReceivedAt)
+	})
+	return deliveries, nil
+}
+
+// loadDelivery loads a single captured delivery from the specified file.
+func loadDelivery(file string) (capturedDelivery, error) {
+	delivery := capturedDelivery{file: file}
+	deliveryJSON, err := os.ReadFile(file)
+	if err != nil {
+		return delivery, errors.Wrapf(err, "error reading %s", file)
+	}
+	if err = json.Unmarshal(deliveryJSON, &delivery.Delivery); err != nil {
+		return delivery, errors.Wrapf(err, "error parsing %s", file)
+	}
+	return delivery, nil
+}
+
+// splitList splits a comma-separated list into its non-empty, whitespace
+// trimmed elements.
+func splitList(list string) []string {
+	elements := []string{}
+	for _, element := range strings.Split(list, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// parseOptionalTime parses an RFC 3339 timestamp. An empty string results in a
+// zero time.
+func parseOptionalTime(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, errors.Wrapf(
+		err,
+		"value %q for %s is not a valid RFC 3339 timestamp",
+		value,
+		name,
+	)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brigadecore/brigade-bitbucket-gateway/internal/webhooks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFilter(t *testing.T) {
+	now := time.Now()
+	delivery := webhooks.Delivery{
+		ReceivedAt: now,
+		Headers:    http.Header{"X-Event-Key": []string{"pullrequest:created"}},
+		Body:       `{"repository":{"full_name":"example-org/example"}}`,
+	}
+	testCases := []struct {
+		name    string
+		filter  replayFilter
+		matches bool
+	}{
+		{
+			name:    "empty filter",
+			filter:  replayFilter{},
+			matches: true,
+		},
+		{
+			name: "event key matches",
+			filter: replayFilter{
+				eventKeys: []string{"repo:push", "pullrequest:*"},
+			},
+			matches: true,
+		},
+		{
+			name: "event key does not match",
+			filter: replayFilter{
+				eventKeys: []string{"repo:*"},
+			},
+			matches: false,
+		},
+		{
+			name: "repo matches",
+			filter: replayFilter{
+				repos: []string{"example-org/*"},
+			},
+			matches: true,
+		},
+		{
+			name: "repo does not match",
+			filter: replayFilter{
+				repos: []string{"another-org/*"},
+			},
+			matches: false,
+		},
+		{
+			name: "received too early",
+			filter: replayFilter{
+				since: now.Add(time.Minute),
+			},
+			matches: false,
+		},
+		{
+			name: "received too late",
+			filter: replayFilter{
+				until: now.Add(-time.Minute),
+			},
+			matches: false,
+		},
+		{
+			name: "received in range",
+			filter: replayFilter{
+				since: now.Add(-time.Minute),
+				until: now.Add(time.Minute),
+			},
+			matches: true,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			require.Equal(t, testCase.matches, testCase.filter.matches(delivery))
+		})
+	}
+}
+
+func TestLoadDeliveries(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "nested"), 0755))
+	require.NoError(
+		t,
+		os.WriteFile(
+			filepath.Join(dir, "nested", "b.json"),
+			[]byte(`{"receivedAt":"2022-01-02T00:00:00Z","body":"b"}`),
+			0600,
+		),
+	)
+	require.NoError(
+		t,
+		os.WriteFile(
+			filepath.Join(dir, "a.json"),
+			[]byte(`{"receivedAt":"2022-01-01T00:00:00Z","body":"a"}`),
+			0600,
+		),
+	)
+	require.NoError(
+		t,
+		os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0600),
+	)
+	deliveries, err := loadDeliveries([]string{dir})
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	require.Equal(t, "a", deliveries[0].Body)
+	require.Equal(t, filepath.Join(dir, "a.json"), deliveries[0].file)
+	require.Equal(t, "b", deliveries[1].Body)
+
+	_, err = loadDeliveries([]string{filepath.Join(dir, "README")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "error parsing")
+}
+
+func TestSplitList(t *testing.T) {
+	require.Equal(t, []string{}, splitList(""))
+	require.Equal(t, []string{"a", "b"}, splitList(" a, ,b "))
+}
+
+func TestParseOptionalTime(t *testing.T) {
+	tm, err := parseOptionalTime("since", "")
+	require.NoError(t, err)
+	require.True(t, tm.IsZero())
+	tm, err = parseOptionalTime("since", "2022-01-01T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, 2022, tm.Year())
+	_, err = parseOptionalTime("since", "yesterday")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not a valid RFC 3339 timestamp")
+}